@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"m3u8-download/internal/config"
+	"m3u8-download/pkg/m3u8"
+	"m3u8-download/pkg/m3u8/client"
+)
+
+// batchStdin is read when -input is "-".
+var batchStdin io.Reader = os.Stdin
+
+// batchResult is the outcome of one job of a batch.
+type batchResult struct {
+	job      config.BatchJob
+	output   string
+	code     int
+	duration time.Duration
+}
+
+// runBatch runs the jobs listed in cfg.Input, at most cfg.Jobs at a time,
+// all sharing c, and prints a summary of their results.
+func runBatch(ctx context.Context, cfg *m3u8.DownloadConfig, c *client.Client, stdout, stderr io.Writer, logger *slog.Logger) int {
+	jobs, err := loadBatch(cfg.Input)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "Error: -input 參數無效：%v\n", err)
+		return 1
+	}
+
+	logger.Info("Starting batch", "jobs", len(jobs), "concurrency", cfg.Jobs)
+
+	results := make([]batchResult, len(jobs))
+	sem := make(chan struct{}, cfg.Jobs)
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		results[i] = batchResult{job: job, code: exitInterrupted}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return
+			}
+
+			jobCfg := *cfg
+			jobCfg.Input = ""
+			jobCfg.URL = job.URL
+			jobCfg.Output = job.Output
+			opts := []client.Option{client.WithOutput(job.Output), client.WithHeaders(job.Headers)}
+
+			start := time.Now()
+			code, output := runJob(ctx, c, &jobCfg, opts, cfg.Jobs == 1, stdout, stderr, logger.With("job", i+1))
+			results[i] = batchResult{job: job, output: output, code: code, duration: time.Since(start)}
+		}()
+	}
+	wg.Wait()
+
+	printBatchSummary(stdout, results)
+	return batchExitCode(ctx, results)
+}
+
+func loadBatch(path string) ([]config.BatchJob, error) {
+	if path == "-" {
+		return config.ParseBatch(batchStdin)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return config.ParseBatch(f)
+}
+
+func printBatchSummary(w io.Writer, results []batchResult) {
+	counts := make(map[string]int)
+	for _, r := range results {
+		counts[statusName(r.code)]++
+	}
+	_, _ = fmt.Fprintf(w, "\nBatch summary: %d ok, %d incomplete, %d failed, %d interrupted\n",
+		counts["ok"], counts["incomplete"], counts["failed"], counts["interrupted"])
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "#\tSTATUS\tDURATION\tOUTPUT\tURL")
+	for i, r := range results {
+		output := r.output
+		if output == "" {
+			output = "-"
+		}
+		_, _ = fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", i+1, statusName(r.code), r.duration.Round(100*time.Millisecond), output, r.job.URL)
+	}
+	_ = tw.Flush()
+}
+
+func statusName(code int) string {
+	switch code {
+	case 0:
+		return "ok"
+	case exitIncomplete:
+		return "incomplete"
+	case exitInterrupted:
+		return "interrupted"
+	}
+	return "failed"
+}
+
+// batchExitCode is exitInterrupted when the batch was stopped, else 1 if
+// any job failed, else exitIncomplete if any job is missing segments.
+func batchExitCode(ctx context.Context, results []batchResult) int {
+	if ctx.Err() != nil {
+		return exitInterrupted
+	}
+
+	code := 0
+	for _, r := range results {
+		switch {
+		case r.code == 1:
+			return 1
+		case r.code == exitIncomplete:
+			code = exitIncomplete
+		}
+	}
+	return code
+}
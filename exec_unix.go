@@ -0,0 +1,10 @@
+//go:build unix
+
+package main
+
+import "os/exec"
+
+// shellCommand returns a command running line with the shell.
+func shellCommand(line string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", line)
+}
@@ -2,16 +2,11 @@ module m3u8-download
 
 go 1.22
 
-require (
-	github.com/schollz/progressbar/v3 v3.17.1
-	github.com/twinj/uuid v1.0.0
-)
+require github.com/schollz/progressbar/v3 v3.17.1
 
 require (
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
-	github.com/myesui/uuid v1.0.0 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	golang.org/x/sys v0.28.0 // indirect
 	golang.org/x/term v0.27.0 // indirect
-	gopkg.in/stretchr/testify.v1 v1.2.2 // indirect
 )
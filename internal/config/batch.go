@@ -0,0 +1,115 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// BatchJob is one download listed in an -input file.
+type BatchJob struct {
+	Line    int
+	URL     string
+	Output  string
+	Headers map[string]string
+}
+
+// headerField matches a "Key: Value" field of an -input line: a header name
+// made of RFC 7230 token characters, a colon and a space. Output names such
+// as "out:1.ts" have no space after the colon.
+var headerField = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+: ")
+
+// ParseBatch reads an -input list with one job per line:
+//
+//	URL [output] ["Key: Value" ...]
+//
+// Fields are separated by whitespace and may be quoted with " or '. A field
+// that starts with a header name, a colon and a space is a header; the
+// other field after the URL is the output name. Blank lines and lines starting with #
+// are skipped.
+func ParseBatch(r io.Reader) ([]BatchJob, error) {
+	var jobs []BatchJob
+	lines := make(map[string]int)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields, err := splitFields(line)
+		if err != nil {
+			return nil, fmt.Errorf("第 %d 行：%w", n, err)
+		}
+
+		job := BatchJob{Line: n, URL: fields[0]}
+		for _, field := range fields[1:] {
+			if headerField.MatchString(field) {
+				if err := (*headerFlag)(&job.Headers).Set(field); err != nil {
+					return nil, fmt.Errorf("第 %d 行：%w", n, err)
+				}
+				continue
+			}
+			if job.Output != "" {
+				return nil, fmt.Errorf("第 %d 行：輸出檔名 %q 與 %q 重複", n, job.Output, field)
+			}
+			if field == "-" {
+				return nil, fmt.Errorf("第 %d 行：批次模式無法輸出到標準輸出", n)
+			}
+			job.Output = field
+		}
+
+		if prev, ok := lines[job.URL]; ok {
+			return nil, fmt.Errorf("第 %d 行：URL 與第 %d 行重複", n, prev)
+		}
+		lines[job.URL] = n
+		jobs = append(jobs, job)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("清單中沒有任何 URL")
+	}
+	return jobs, nil
+}
+
+// splitFields splits line at whitespace outside quotes.
+func splitFields(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	var quote rune
+	inField := false
+
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			field.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inField = true
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("引號未結束")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
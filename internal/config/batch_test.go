@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseBatch(t *testing.T) {
+	input := `# lectures
+https://example.com/a.m3u8
+
+https://example.com/b.m3u8 b.mp4
+  https://example.com/c.m3u8 "Referer: https://example.com/" 'my video.mkv' "Authorization: Bearer x y"
+https://example.com/d.m3u8 out:1.ts "X_Custom-Token: t"
+`
+
+	jobs, err := ParseBatch(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []BatchJob{
+		{Line: 2, URL: "https://example.com/a.m3u8"},
+		{Line: 4, URL: "https://example.com/b.m3u8", Output: "b.mp4"},
+		{Line: 5, URL: "https://example.com/c.m3u8", Output: "my video.mkv", Headers: map[string]string{
+			"Referer":       "https://example.com/",
+			"Authorization": "Bearer x y",
+		}},
+		{Line: 6, URL: "https://example.com/d.m3u8", Output: "out:1.ts", Headers: map[string]string{
+			"X_Custom-Token": "t",
+		}},
+	}
+	if fmt.Sprint(jobs) != fmt.Sprint(want) {
+		t.Errorf("got %+v, want %+v", jobs, want)
+	}
+}
+
+func TestParseBatchErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{name: "empty", input: "# nothing\n\n", wantErr: "沒有任何 URL"},
+		{name: "unterminated quote", input: "https://example.com/a.m3u8 \"a.ts\n", wantErr: "第 1 行"},
+		{name: "two outputs", input: "https://example.com/a.m3u8 a.ts b.ts\n", wantErr: "第 1 行"},
+		{name: "stdout output", input: "https://example.com/a.m3u8 -\n", wantErr: "標準輸出"},
+		{name: "bad header", input: "https://example.com/a.m3u8 \"X-Bad: a\r\"\n", wantErr: "第 1 行"},
+		{name: "duplicate URL", input: "https://example.com/a.m3u8\nhttps://example.com/a.m3u8 a.ts\n", wantErr: "第 1 行重複"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseBatch(strings.NewReader(tt.input))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
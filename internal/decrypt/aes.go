@@ -3,6 +3,7 @@ package decrypt
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"encoding/binary"
 	"m3u8-download/pkg/m3u8"
 	"sync"
 )
@@ -13,6 +14,9 @@ type Decryptor struct {
 	mu    sync.Mutex
 }
 
+// NewDecryptor returns an AES-128-CBC decryptor. A short iv is zero-padded
+// and an empty iv means an all-zero IV; callers without an explicit IV
+// should pass SequenceIV of the segment's media sequence number.
 func NewDecryptor(key []byte, iv []byte) (*Decryptor, error) {
 	if len(key) == 0 {
 		return nil, m3u8.ErrInvalidKey
@@ -25,10 +29,7 @@ func NewDecryptor(key []byte, iv []byte) (*Decryptor, error) {
 
 	blockSize := block.BlockSize()
 
-	if len(iv) == 0 {
-		iv = make([]byte, blockSize)
-		copy(iv, key)
-	} else if len(iv) < blockSize {
+	if len(iv) < blockSize {
 		temp := make([]byte, blockSize)
 		copy(temp, iv)
 		iv = temp
@@ -41,6 +42,10 @@ func NewDecryptor(key []byte, iv []byte) (*Decryptor, error) {
 }
 
 func (d *Decryptor) Decrypt(data []byte) ([]byte, error) {
+	if len(data)%d.block.BlockSize() != 0 {
+		return nil, m3u8.ErrDecryptFailed
+	}
+
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
@@ -52,6 +57,14 @@ func (d *Decryptor) Decrypt(data []byte) ([]byte, error) {
 	return origData, nil
 }
 
+// SequenceIV returns the IV implied by a media sequence number when
+// #EXT-X-KEY has no IV attribute: the number as a big-endian 128-bit value.
+func SequenceIV(sequence uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], sequence)
+	return iv
+}
+
 func Decrypt(data, key []byte, iv []byte) ([]byte, error) {
 	decryptor, err := NewDecryptor(key, iv)
 	if err != nil {
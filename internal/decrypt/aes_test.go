@@ -59,6 +59,50 @@ func TestDecryptInvalidIV(t *testing.T) {
 	}
 }
 
+func TestSequenceIV(t *testing.T) {
+	iv := SequenceIV(0x0102)
+
+	want := make([]byte, aes.BlockSize)
+	want[14] = 0x01
+	want[15] = 0x02
+	if !bytes.Equal(iv, want) {
+		t.Errorf("got %x, want %x", iv, want)
+	}
+}
+
+func TestDecryptEmptyIVIsZero(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	plaintext := []byte("zero iv payload")
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+
+	padded := pkcs7Pad(plaintext, aes.BlockSize)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(ciphertext, padded)
+
+	decrypted, err := Decrypt(ciphertext, key, nil)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("got %q, want %q", decrypted, plaintext)
+	}
+}
+
+func TestDecryptPartialBlock(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+
+	_, err := Decrypt([]byte{0x47, 0x00, 0x00, 0x00}, key, nil)
+	if err == nil {
+		t.Error("expected error for data that is not a multiple of the block size")
+	}
+}
+
 func TestPKCS7UnPadding(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -0,0 +1,553 @@
+package decrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"sort"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+const tsPacketSize = 188
+
+// MPEG-TS stream types for the clear and SAMPLE-AES variants of the codecs
+// we can decrypt.
+const (
+	streamTypeH264          = 0x1B
+	streamTypeAAC           = 0x0F
+	streamTypeSampleAESH264 = 0xDB
+	streamTypeSampleAESAAC  = 0xCF
+)
+
+// SegmentDecryptor decrypts one media segment.
+type SegmentDecryptor interface {
+	Decrypt(data []byte) ([]byte, error)
+}
+
+// NewMethodDecryptor returns the decryptor for an #EXT-X-KEY METHOD.
+func NewMethodDecryptor(method string, key, iv []byte) (SegmentDecryptor, error) {
+	switch method {
+	case m3u8.MethodAES128:
+		return NewDecryptor(key, iv)
+	case m3u8.MethodSampleAES:
+		return NewSampleAESDecryptor(key, iv)
+	default:
+		return nil, m3u8.NewUnsupportedMethodError(method)
+	}
+}
+
+// SampleAESDecryptor decrypts SAMPLE-AES protected MPEG-TS segments as
+// described in Apple's "MPEG-2 Stream Encryption Format for HTTP Live
+// Streaming". Only H.264 video and AAC (ADTS) audio are encrypted; all other
+// packets pass through unchanged. The PMT is rewritten to the clear stream
+// types so the result plays as a regular transport stream.
+type SampleAESDecryptor struct {
+	block cipher.Block
+	iv    []byte
+}
+
+func NewSampleAESDecryptor(key, iv []byte) (*SampleAESDecryptor, error) {
+	if len(key) == 0 {
+		return nil, m3u8.ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, m3u8.ErrDecryptFailed
+	}
+
+	padded := make([]byte, aes.BlockSize)
+	copy(padded, iv)
+
+	return &SampleAESDecryptor{
+		block: block,
+		iv:    padded,
+	}, nil
+}
+
+// pesBuffer collects the packets of one PES packet on an elementary stream.
+type pesBuffer struct {
+	streamType byte
+	slots      []int
+	packets    [][]byte
+	data       []byte
+}
+
+func (d *SampleAESDecryptor) Decrypt(data []byte) ([]byte, error) {
+	data = RemoveSyncBytePrefix(data)
+	count := len(data) / tsPacketSize
+	if count == 0 {
+		return data, nil
+	}
+
+	slots := make([][][]byte, count)
+	streams := make(map[uint16]byte)
+	pending := make(map[uint16]*pesBuffer)
+	pmtPID := -1
+
+	for i := 0; i < count; i++ {
+		pkt := append([]byte{}, data[i*tsPacketSize:(i+1)*tsPacketSize]...)
+		if pkt[0] != 0x47 {
+			return nil, m3u8.ErrDecryptFailed
+		}
+
+		pid := packetPID(pkt)
+		pusi := pkt[1]&0x40 != 0
+		payload := packetPayload(pkt)
+
+		switch {
+		case pid == 0 && pusi:
+			if p := parsePAT(payload); p >= 0 {
+				pmtPID = p
+			}
+			slots[i] = [][]byte{pkt}
+		case int(pid) == pmtPID && pusi:
+			for esPID, st := range rewritePMT(payload) {
+				streams[esPID] = st
+			}
+			slots[i] = [][]byte{pkt}
+		case streams[pid] != 0:
+			if pusi {
+				if buf := pending[pid]; buf != nil {
+					d.flushPES(buf, slots)
+				}
+				pending[pid] = &pesBuffer{streamType: streams[pid]}
+			}
+
+			buf := pending[pid]
+			if buf == nil {
+				slots[i] = [][]byte{pkt}
+				continue
+			}
+			buf.slots = append(buf.slots, i)
+			buf.packets = append(buf.packets, pkt)
+			buf.data = append(buf.data, payload...)
+		default:
+			slots[i] = [][]byte{pkt}
+		}
+	}
+
+	pids := make([]int, 0, len(pending))
+	for pid := range pending {
+		pids = append(pids, int(pid))
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		d.flushPES(pending[uint16(pid)], slots)
+	}
+
+	continuity := make(map[uint16]byte)
+	out := make([]byte, 0, len(data))
+	for _, slot := range slots {
+		for _, pkt := range slot {
+			pid := packetPID(pkt)
+			if streams[pid] != 0 && pkt[3]&0x10 != 0 {
+				pkt[3] = pkt[3]&0xF0 | continuity[pid]&0x0F
+				continuity[pid]++
+			}
+			out = append(out, pkt...)
+		}
+	}
+
+	return append(out, data[count*tsPacketSize:]...), nil
+}
+
+// flushPES decrypts a completed PES packet and stores the resulting TS
+// packets in the slots its input packets occupied.
+func (d *SampleAESDecryptor) flushPES(buf *pesBuffer, slots [][][]byte) {
+	pes := buf.data
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || len(pes) < 9+int(pes[8]) {
+		for k, idx := range buf.slots {
+			slots[idx] = [][]byte{buf.packets[k]}
+		}
+		return
+	}
+
+	headerLen := 9 + int(pes[8])
+	es := pes[headerLen:]
+
+	var clear []byte
+	switch buf.streamType {
+	case streamTypeH264, streamTypeSampleAESH264:
+		clear = d.decryptH264(es)
+	default:
+		clear = d.decryptAAC(es)
+	}
+
+	if len(clear) == len(es) {
+		copy(es, clear)
+		writePayloads(buf.packets, pes)
+		for k, idx := range buf.slots {
+			slots[idx] = [][]byte{buf.packets[k]}
+		}
+		return
+	}
+
+	newPES := append(append([]byte{}, pes[:headerLen]...), clear...)
+	if binary.BigEndian.Uint16(newPES[4:6]) != 0 {
+		length := len(newPES) - 6
+		if length > 0xFFFF {
+			length = 0
+		}
+		binary.BigEndian.PutUint16(newPES[4:6], uint16(length))
+	}
+
+	packets := packetize(buf.packets[0], newPES)
+	for k, idx := range buf.slots {
+		slots[idx] = nil
+		if k < len(packets) {
+			slots[idx] = [][]byte{packets[k]}
+		}
+	}
+	if extra := len(packets) - len(buf.slots); extra > 0 {
+		last := buf.slots[len(buf.slots)-1]
+		slots[last] = append(slots[last], packets[len(buf.slots):]...)
+	}
+}
+
+// decryptH264 decrypts the protected NAL units of an Annex B byte stream.
+// Slices (types 1 and 5) longer than 48 bytes keep a 32 byte clear leader,
+// then every tenth 16 byte block is encrypted, CBC-chained within the NAL
+// unit. Encryption happens before emulation prevention, so each NAL unit is
+// unescaped, decrypted and escaped again, which may change its length.
+func (d *SampleAESDecryptor) decryptH264(es []byte) []byte {
+	out := make([]byte, 0, len(es))
+	pos := 0
+
+	for _, nal := range nalUnits(es) {
+		out = append(out, es[pos:nal[0]]...)
+		out = append(out, d.decryptNAL(es[nal[0]:nal[1]])...)
+		pos = nal[1]
+	}
+
+	return append(out, es[pos:]...)
+}
+
+func (d *SampleAESDecryptor) decryptNAL(nal []byte) []byte {
+	if len(nal) <= 48 {
+		return nal
+	}
+	if nalType := nal[0] & 0x1F; nalType != 1 && nalType != 5 {
+		return nal
+	}
+
+	raw := unescapeRBSP(nal)
+	mode := cipher.NewCBCDecrypter(d.block, d.iv)
+	for pos := 32; len(raw)-pos > aes.BlockSize; pos += 10 * aes.BlockSize {
+		mode.CryptBlocks(raw[pos:pos+aes.BlockSize], raw[pos:pos+aes.BlockSize])
+	}
+
+	return escapeRBSP(raw)
+}
+
+// decryptAAC decrypts ADTS frames: after the header and a 16 byte clear
+// leader, every whole 16 byte block is CBC encrypted; the tail is clear.
+func (d *SampleAESDecryptor) decryptAAC(es []byte) []byte {
+	out := append([]byte{}, es...)
+
+	for i := 0; i+7 <= len(out); {
+		if out[i] != 0xFF || out[i+1]&0xF0 != 0xF0 {
+			i++
+			continue
+		}
+
+		headerLen := 7
+		if out[i+1]&0x01 == 0 {
+			headerLen = 9
+		}
+		frameLen := int(out[i+3]&0x03)<<11 | int(out[i+4])<<3 | int(out[i+5])>>5
+		if frameLen < headerLen || i+frameLen > len(out) {
+			break
+		}
+
+		payload := out[i+headerLen : i+frameLen]
+		if len(payload) > aes.BlockSize {
+			enc := payload[aes.BlockSize:]
+			enc = enc[:len(enc)/aes.BlockSize*aes.BlockSize]
+			if len(enc) > 0 {
+				cipher.NewCBCDecrypter(d.block, d.iv).CryptBlocks(enc, enc)
+			}
+		}
+
+		i += frameLen
+	}
+
+	return out
+}
+
+// nalUnits returns the [start, end) offsets of each NAL unit in an Annex B
+// byte stream, excluding start codes and trailing zero bytes.
+func nalUnits(es []byte) [][2]int {
+	var units [][2]int
+	start := -1
+
+	for i := 0; i+2 < len(es); i++ {
+		if es[i] != 0 || es[i+1] != 0 || es[i+2] != 1 {
+			continue
+		}
+
+		if start >= 0 {
+			end := i
+			for end > start && es[end-1] == 0 {
+				end--
+			}
+			units = append(units, [2]int{start, end})
+		}
+
+		start = i + 3
+		i += 2
+	}
+
+	if start >= 0 && start < len(es) {
+		units = append(units, [2]int{start, len(es)})
+	}
+
+	return units
+}
+
+func unescapeRBSP(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+
+	return out
+}
+
+func escapeRBSP(raw []byte) []byte {
+	out := make([]byte, 0, len(raw)+len(raw)/64)
+	zeros := 0
+
+	for _, b := range raw {
+		if zeros >= 2 && b <= 0x03 {
+			out = append(out, 0x03)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+
+	return out
+}
+
+func packetPID(pkt []byte) uint16 {
+	return uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+}
+
+// payloadOffset returns where the payload of a TS packet starts, or -1 if it
+// has none.
+func payloadOffset(pkt []byte) int {
+	afc := pkt[3] >> 4 & 0x03
+	if afc&0x01 == 0 {
+		return -1
+	}
+
+	offset := 4
+	if afc&0x02 != 0 {
+		offset += 1 + int(pkt[4])
+	}
+	if offset >= tsPacketSize {
+		return -1
+	}
+
+	return offset
+}
+
+func packetPayload(pkt []byte) []byte {
+	offset := payloadOffset(pkt)
+	if offset < 0 {
+		return nil
+	}
+	return pkt[offset:]
+}
+
+// writePayloads copies data back into the payload areas of packets, which
+// together must be exactly len(data) bytes long.
+func writePayloads(packets [][]byte, data []byte) {
+	for _, pkt := range packets {
+		if offset := payloadOffset(pkt); offset >= 0 {
+			data = data[copy(pkt[offset:], data):]
+		}
+	}
+}
+
+// packetize splits a PES packet into TS packets on the PID of first. The
+// adaptation field of first (PCR, random access flag) is kept on the first
+// packet, and the last packet is padded with adaptation field stuffing.
+// Continuity counters are left for the caller to assign.
+func packetize(first []byte, pes []byte) [][]byte {
+	pid := packetPID(first)
+
+	var firstAF []byte
+	if first[3]&0x20 != 0 {
+		firstAF = append([]byte{}, first[4:5+int(first[4])]...)
+	}
+
+	var packets [][]byte
+	for i := 0; len(pes) > 0; i++ {
+		var af []byte
+		if i == 0 {
+			af = firstAF
+		}
+
+		if room := tsPacketSize - 4 - len(af); len(pes) < room {
+			af = stuffAdaptationField(af, room-len(pes))
+		}
+
+		pkt := make([]byte, 4, tsPacketSize)
+		pkt[0] = 0x47
+		pkt[1] = byte(pid >> 8 & 0x1F)
+		if i == 0 {
+			pkt[1] |= 0x40
+		}
+		pkt[2] = byte(pid)
+		pkt[3] = 0x10
+		if af != nil {
+			pkt[3] |= 0x20
+			pkt = append(pkt, af...)
+		}
+
+		n := tsPacketSize - len(pkt)
+		pkt = append(pkt, pes[:n]...)
+		pes = pes[n:]
+		packets = append(packets, pkt)
+	}
+
+	return packets
+}
+
+// stuffAdaptationField grows af (a complete adaptation field including its
+// length byte, or nil) by n bytes.
+func stuffAdaptationField(af []byte, n int) []byte {
+	if n == 0 {
+		return af
+	}
+
+	var out []byte
+	switch {
+	case len(af) == 0 && n == 1:
+		return []byte{0x00}
+	case len(af) == 0:
+		out = []byte{byte(n - 1), 0x00}
+		n -= 2
+	case af[0] == 0:
+		out = []byte{byte(n), 0x00}
+		n--
+	default:
+		out = append([]byte{}, af...)
+		out[0] += byte(n)
+	}
+
+	for ; n > 0; n-- {
+		out = append(out, 0xFF)
+	}
+
+	return out
+}
+
+// parsePAT returns the PMT PID of the first program, or -1.
+func parsePAT(payload []byte) int {
+	section := psiSection(payload)
+	if section == nil || section[0] != 0x00 {
+		return -1
+	}
+
+	end := 3 + int(binary.BigEndian.Uint16(section[1:3])&0x0FFF) - 4
+	for i := 8; i+4 <= end && i+4 <= len(section); i += 4 {
+		program := binary.BigEndian.Uint16(section[i : i+2])
+		if program != 0 {
+			return int(binary.BigEndian.Uint16(section[i+2:i+4]) & 0x1FFF)
+		}
+	}
+
+	return -1
+}
+
+// rewritePMT maps SAMPLE-AES stream types back to their clear equivalents in
+// place, fixes the CRC, and returns the H.264 and AAC elementary PIDs.
+func rewritePMT(payload []byte) map[uint16]byte {
+	streams := make(map[uint16]byte)
+
+	section := psiSection(payload)
+	if section == nil || section[0] != 0x02 {
+		return streams
+	}
+
+	sectionEnd := 3 + int(binary.BigEndian.Uint16(section[1:3])&0x0FFF)
+	if sectionEnd > len(section) || sectionEnd < 16 {
+		return streams
+	}
+
+	programInfoLen := int(binary.BigEndian.Uint16(section[10:12]) & 0x0FFF)
+	changed := false
+	for i := 12 + programInfoLen; i+5 <= sectionEnd-4; {
+		streamType := section[i]
+		pid := binary.BigEndian.Uint16(section[i+1:i+3]) & 0x1FFF
+		infoLen := int(binary.BigEndian.Uint16(section[i+3:i+5]) & 0x0FFF)
+
+		switch streamType {
+		case streamTypeSampleAESH264:
+			section[i] = streamTypeH264
+			changed = true
+			streams[pid] = streamTypeH264
+		case streamTypeSampleAESAAC:
+			section[i] = streamTypeAAC
+			changed = true
+			streams[pid] = streamTypeAAC
+		case streamTypeH264, streamTypeAAC:
+			streams[pid] = streamType
+		}
+
+		i += 5 + infoLen
+	}
+
+	if changed {
+		binary.BigEndian.PutUint32(section[sectionEnd-4:sectionEnd], crc32MPEG2(section[:sectionEnd-4]))
+	}
+
+	return streams
+}
+
+func psiSection(payload []byte) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+
+	start := 1 + int(payload[0])
+	if start+3 > len(payload) {
+		return nil
+	}
+
+	return payload[start:]
+}
+
+func crc32MPEG2(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
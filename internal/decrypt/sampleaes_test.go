@@ -0,0 +1,300 @@
+package decrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+const (
+	testPMTPID   = 0x100
+	testVideoPID = 0x101
+	testAudioPID = 0x102
+)
+
+func TestNewMethodDecryptor(t *testing.T) {
+	key := make([]byte, 16)
+
+	if _, err := NewMethodDecryptor(m3u8.MethodAES128, key, nil); err != nil {
+		t.Errorf("AES-128: unexpected error: %v", err)
+	}
+
+	if _, err := NewMethodDecryptor(m3u8.MethodSampleAES, key, nil); err != nil {
+		t.Errorf("SAMPLE-AES: unexpected error: %v", err)
+	}
+
+	_, err := NewMethodDecryptor("SAMPLE-AES-CTR", key, nil)
+	var methodErr *m3u8.UnsupportedMethodError
+	if !errors.As(err, &methodErr) {
+		t.Fatalf("got error %v, want *UnsupportedMethodError", err)
+	}
+	if methodErr.Method != "SAMPLE-AES-CTR" {
+		t.Errorf("got method %q", methodErr.Method)
+	}
+}
+
+func TestSampleAESDecrypt(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("fedcba9876543210")
+
+	tests := []struct {
+		name string
+		// cipherBlock, when set, forces the first encrypted block of the
+		// slice so that the ciphertext needs emulation prevention bytes.
+		cipherBlock []byte
+	}{
+		{name: "same length after decryption"},
+		{name: "emulation prevention changes length", cipherBlock: append([]byte{0, 0, 1, 0, 0, 2}, bytes.Repeat([]byte{0xAA}, 10)...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+
+			slice := append([]byte{0x65}, randomNonZero(rng, 400)...)
+			if tt.cipherBlock != nil {
+				block, _ := aes.NewCipher(key)
+				block.Decrypt(slice[32:48], tt.cipherBlock)
+				for i := range iv {
+					slice[32+i] ^= iv[i]
+				}
+			}
+
+			sps := append([]byte{0x67}, randomNonZero(rng, 60)...)
+			clearVideo := annexB([]byte{0x09, 0xF0}, sps, escapeRBSP(slice))
+			encVideo := annexB([]byte{0x09, 0xF0}, sps, encryptNAL(t, key, iv, slice))
+			if tt.cipherBlock != nil && len(encVideo) == len(clearVideo) {
+				t.Fatal("test setup: ciphertext should need extra emulation prevention bytes")
+			}
+
+			frames := [][]byte{randomNonZero(rng, 150), randomNonZero(rng, 12)}
+			clearAudio := adts(frames...)
+			encAudio := adts(encryptADTSPayload(t, key, iv, frames[0]), frames[1])
+
+			segment := buildTS(t, encVideo, encAudio)
+
+			dec, err := NewSampleAESDecryptor(key, iv)
+			if err != nil {
+				t.Fatalf("NewSampleAESDecryptor failed: %v", err)
+			}
+
+			out, err := dec.Decrypt(segment)
+			if err != nil {
+				t.Fatalf("Decrypt failed: %v", err)
+			}
+
+			if len(out)%tsPacketSize != 0 {
+				t.Fatalf("output length %d is not a multiple of %d", len(out), tsPacketSize)
+			}
+
+			es, streamTypes := demux(t, out)
+			if !bytes.Equal(es[testVideoPID], clearVideo) {
+				t.Error("decrypted video elementary stream does not match")
+			}
+			if !bytes.Equal(es[testAudioPID], clearAudio) {
+				t.Error("decrypted audio elementary stream does not match")
+			}
+
+			if streamTypes[testVideoPID] != streamTypeH264 || streamTypes[testAudioPID] != streamTypeAAC {
+				t.Errorf("got PMT stream types %x, want clear types", streamTypes)
+			}
+		})
+	}
+}
+
+func TestPacketizeRoundTrip(t *testing.T) {
+	first := make([]byte, tsPacketSize)
+	first[0], first[1], first[2], first[3] = 0x47, 0x41, 0x01, 0x30
+	first[4], first[5] = 7, 0x10
+
+	pes := append([]byte{0, 0, 1, 0xE0, 0, 0, 0x80, 0, 0}, bytes.Repeat([]byte{0xAB}, 500)...)
+	packets := packetize(first, pes)
+
+	var got []byte
+	for i, pkt := range packets {
+		if len(pkt) != tsPacketSize {
+			t.Fatalf("packet %d has length %d", i, len(pkt))
+		}
+		if packetPID(pkt) != 0x101 {
+			t.Errorf("packet %d has PID %x", i, packetPID(pkt))
+		}
+		got = append(got, packetPayload(pkt)...)
+	}
+
+	if !bytes.Equal(got, pes) {
+		t.Error("payloads do not reassemble to the PES packet")
+	}
+	if packets[0][5] != 0x10 {
+		t.Error("adaptation field of the first packet was not kept")
+	}
+}
+
+func TestEscapeRBSP(t *testing.T) {
+	raw := []byte{0x65, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x05}
+	escaped := escapeRBSP(raw)
+
+	want := []byte{0x65, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x03, 0x00, 0x05}
+	if !bytes.Equal(escaped, want) {
+		t.Errorf("got %x, want %x", escaped, want)
+	}
+
+	if !bytes.Equal(unescapeRBSP(escaped), raw) {
+		t.Error("unescape does not restore the original")
+	}
+}
+
+func randomNonZero(rng *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(rng.Intn(0xEF) + 0x10)
+	}
+	return b
+}
+
+func annexB(nals ...[]byte) []byte {
+	var out []byte
+	for _, nal := range nals {
+		out = append(out, 0, 0, 0, 1)
+		out = append(out, nal...)
+	}
+	return out
+}
+
+func encryptNAL(t *testing.T, key, iv, nal []byte) []byte {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+
+	raw := append([]byte{}, nal...)
+	mode := cipher.NewCBCEncrypter(block, iv)
+	for pos := 32; len(raw)-pos > aes.BlockSize; pos += 10 * aes.BlockSize {
+		mode.CryptBlocks(raw[pos:pos+aes.BlockSize], raw[pos:pos+aes.BlockSize])
+	}
+
+	return escapeRBSP(raw)
+}
+
+func encryptADTSPayload(t *testing.T, key, iv, payload []byte) []byte {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+
+	out := append([]byte{}, payload...)
+	enc := out[aes.BlockSize:]
+	enc = enc[:len(enc)/aes.BlockSize*aes.BlockSize]
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(enc, enc)
+	return out
+}
+
+func adts(payloads ...[]byte) []byte {
+	var out []byte
+	for _, payload := range payloads {
+		frameLen := 7 + len(payload)
+		out = append(out,
+			0xFF, 0xF1, 0x50, 0x80|byte(frameLen>>11&0x03),
+			byte(frameLen>>3), byte(frameLen<<5)|0x1F, 0xFC,
+		)
+		out = append(out, payload...)
+	}
+	return out
+}
+
+func psiPacket(pid uint16, section []byte) []byte {
+	binary.BigEndian.PutUint32(section[len(section)-4:], crc32MPEG2(section[:len(section)-4]))
+
+	pkt := bytes.Repeat([]byte{0xFF}, tsPacketSize)
+	pkt[0], pkt[1], pkt[2], pkt[3] = 0x47, 0x40|byte(pid>>8), byte(pid), 0x10
+	pkt[4] = 0
+	copy(pkt[5:], section)
+	return pkt
+}
+
+func buildTS(t *testing.T, video, audio []byte) []byte {
+	t.Helper()
+
+	pat := []byte{0x00, 0xB0, 0x0D, 0x00, 0x01, 0xC1, 0x00, 0x00, 0x00, 0x01, 0xE1, 0x00, 0, 0, 0, 0}
+	pmt := []byte{
+		0x02, 0xB0, 0x17, 0x00, 0x01, 0xC1, 0x00, 0x00, 0xE1, 0x01, 0xF0, 0x00,
+		streamTypeSampleAESH264, 0xE1, 0x01, 0xF0, 0x00,
+		streamTypeSampleAESAAC, 0xE1, 0x02, 0xF0, 0x00,
+		0, 0, 0, 0,
+	}
+
+	out := append(psiPacket(0, pat), psiPacket(testPMTPID, pmt)...)
+
+	pesHeader := []byte{0x80, 0x80, 0x05, 0x21, 0x00, 0x01, 0x00, 0x01}
+	videoPES := append([]byte{0, 0, 1, 0xE0, 0, 0}, append(pesHeader, video...)...)
+	audioPES := append([]byte{0, 0, 1, 0xC0, 0, 0}, append(pesHeader, audio...)...)
+	binary.BigEndian.PutUint16(audioPES[4:6], uint16(len(audioPES)-6))
+
+	videoPackets := packetize([]byte{0x47, 0x01, 0x01, 0x10}, videoPES)
+	audioPackets := packetize([]byte{0x47, 0x01, 0x02, 0x10}, audioPES)
+
+	for i := 0; i < len(videoPackets) || i < len(audioPackets); i++ {
+		if i < len(videoPackets) {
+			videoPackets[i][3] |= byte(i) & 0x0F
+			out = append(out, videoPackets[i]...)
+		}
+		if i < len(audioPackets) {
+			audioPackets[i][3] |= byte(i) & 0x0F
+			out = append(out, audioPackets[i]...)
+		}
+	}
+
+	return out
+}
+
+// demux returns the elementary stream of each PES PID and the stream types
+// listed in the PMT, failing on a bad CRC or continuity counter.
+func demux(t *testing.T, data []byte) (map[uint16][]byte, map[uint16]byte) {
+	t.Helper()
+
+	pes := make(map[uint16][]byte)
+	streamTypes := make(map[uint16]byte)
+	continuity := make(map[uint16]int)
+
+	for i := 0; i+tsPacketSize <= len(data); i += tsPacketSize {
+		pkt := data[i : i+tsPacketSize]
+		pid := packetPID(pkt)
+		payload := packetPayload(pkt)
+
+		switch pid {
+		case 0:
+		case testPMTPID:
+			section := psiSection(payload)
+			end := 3 + int(binary.BigEndian.Uint16(section[1:3])&0x0FFF)
+			if crc32MPEG2(section[:end]) != 0 {
+				t.Fatal("PMT CRC is invalid")
+			}
+			for j := 12; j+5 <= end-4; j += 5 {
+				streamTypes[binary.BigEndian.Uint16(section[j+1:j+3])&0x1FFF] = section[j]
+			}
+		default:
+			cc := int(pkt[3] & 0x0F)
+			if last, ok := continuity[pid]; ok && cc != (last+1)&0x0F {
+				t.Fatalf("PID %x continuity counter jumped from %d to %d", pid, last, cc)
+			}
+			continuity[pid] = cc
+			pes[pid] = append(pes[pid], payload...)
+		}
+	}
+
+	es := make(map[uint16][]byte)
+	for pid, data := range pes {
+		es[pid] = data[9+int(data[8]):]
+	}
+
+	return es, streamTypes
+}
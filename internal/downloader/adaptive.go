@@ -0,0 +1,203 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+// throughputDrop is how far throughput must fall after growing the pool
+// before the growth is undone.
+const throughputDrop = 0.9
+
+// workerPool limits how many segments download at once. A fixed pool is a
+// plain semaphore of -workers slots. An adaptive pool starts there, halves
+// when the server throttles (429, 5xx, timeouts), waits out any
+// Retry-After, and grows by one slot after each window of successful
+// downloads whose throughput did not fall.
+type workerPool struct {
+	mu       sync.Mutex
+	changed  chan struct{}
+	clock    clock
+	logger   *slog.Logger
+	adaptive bool
+	max      int
+	limit    int
+	active   int
+	resumeAt time.Time
+	// epoch counts limit changes. Throttled requests started before the
+	// last change do not shrink the pool again: the change already
+	// answered the burst they belong to.
+	epoch int
+
+	windowStart time.Time
+	windowDone  int
+	windowBytes int64
+	lastRate    float64
+	grew        bool
+}
+
+func newWorkerPool(workers int, adaptive bool, clk clock, logger *slog.Logger) *workerPool {
+	workers = max(workers, 1)
+	return &workerPool{
+		changed:     make(chan struct{}),
+		clock:       clk,
+		logger:      logger,
+		adaptive:    adaptive,
+		max:         workers,
+		limit:       workers,
+		windowStart: clk.Now(),
+	}
+}
+
+// acquire waits for a free slot and returns the epoch to hand back to
+// release.
+func (p *workerPool) acquire(ctx context.Context) (int, error) {
+	for {
+		p.mu.Lock()
+		wait := p.resumeAt.Sub(p.clock.Now())
+		if wait <= 0 && p.active < p.limit {
+			p.active++
+			epoch := p.epoch
+			p.mu.Unlock()
+			return epoch, nil
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		if wait > 0 {
+			if err := p.clock.Sleep(ctx, wait); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// release frees the slot of a download that fetched size bytes or failed
+// with err, and grows or shrinks an adaptive pool according to the
+// throughput of the last window of successful downloads.
+func (p *workerPool) release(size int64, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.active--
+	defer p.broadcast()
+
+	if !p.adaptive || err != nil {
+		return
+	}
+
+	p.windowDone++
+	p.windowBytes += size
+	if p.windowDone < p.limit {
+		return
+	}
+
+	now := p.clock.Now()
+	rate := float64(p.windowBytes) / max(now.Sub(p.windowStart).Seconds(), 1e-3)
+	switch {
+	case p.grew && rate < p.lastRate*throughputDrop:
+		p.grew = false
+		p.setLimit(p.limit-1, "throughput dropped", "rate", FormatRate(int64(rate)))
+	case rate >= p.lastRate && p.limit < p.max:
+		p.grew = true
+		p.setLimit(p.limit+1, "throughput improved", "rate", FormatRate(int64(rate)))
+	default:
+		p.grew = false
+	}
+	p.lastRate = rate
+	p.resetWindow(now)
+}
+
+// observe shrinks an adaptive pool and pauses new downloads when err, the
+// error of one request attempt made by a download started in epoch, shows
+// the server is throttling.
+func (p *workerPool) observe(epoch int, err error) {
+	if !p.adaptive {
+		return
+	}
+	retryAfter, ok := throttled(err)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	if resume := now.Add(retryAfter); resume.After(p.resumeAt) {
+		p.resumeAt = resume
+	}
+	if epoch == p.epoch {
+		p.setLimit(max(p.limit/2, 1), "throttled", "error", err, "retry_after", retryAfter)
+	}
+	// Throughput measured before the throttling says nothing about the
+	// smaller pool.
+	p.resetWindow(now)
+	p.lastRate = 0
+	p.grew = false
+}
+
+// setLimit changes the pool size. Callers must hold p.mu.
+func (p *workerPool) setLimit(limit int, reason string, args ...any) {
+	if limit == p.limit {
+		return
+	}
+	p.limit = limit
+	p.epoch++
+	p.logger.Debug("Adjusted concurrency", append([]any{"workers", limit, "reason", reason}, args...)...)
+}
+
+func (p *workerPool) resetWindow(now time.Time) {
+	p.windowStart = now
+	p.windowDone = 0
+	p.windowBytes = 0
+}
+
+// broadcast wakes every acquire waiting for a change. Callers must hold
+// p.mu.
+func (p *workerPool) broadcast() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// currentLimit returns the number of slots.
+func (p *workerPool) currentLimit() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.limit
+}
+
+// throttled reports whether err means the server is overloaded or limiting
+// us, and how long it asked us to wait.
+func throttled(err error) (time.Duration, bool) {
+	if err == nil {
+		return 0, false
+	}
+
+	var httpErr *m3u8.HTTPError
+	if errors.As(err, &httpErr) {
+		if httpErr.StatusCode == http.StatusTooManyRequests || httpErr.StatusCode >= 500 {
+			return httpErr.RetryAfter, true
+		}
+		return 0, false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return 0, true
+	}
+	return 0, errors.Is(err, context.DeadlineExceeded)
+}
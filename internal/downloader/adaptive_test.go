@@ -0,0 +1,196 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func newTestPool(workers int, adaptive bool) (*workerPool, *fakeClock) {
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	return newWorkerPool(workers, adaptive, clk, slog.New(slog.NewTextHandler(io.Discard, nil))), clk
+}
+
+func httpError(status int, retryAfter time.Duration) error {
+	err := m3u8.NewHTTPError(status, "http://example.com/seg.ts")
+	err.RetryAfter = retryAfter
+	return err
+}
+
+// finishWindow completes one window of successful downloads taking d.
+func finishWindow(t *testing.T, p *workerPool, clk *fakeClock, size int64, d time.Duration) {
+	t.Helper()
+	n := p.currentLimit()
+	for i := 0; i < n; i++ {
+		if _, err := p.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire failed: %v", err)
+		}
+	}
+	clk.Sleep(context.Background(), d)
+	for i := 0; i < n; i++ {
+		p.release(size, nil)
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		want       bool
+		retryAfter time.Duration
+	}{
+		{name: "nil", err: nil},
+		{name: "429", err: httpError(http.StatusTooManyRequests, 2*time.Second), want: true, retryAfter: 2 * time.Second},
+		{name: "503", err: httpError(http.StatusServiceUnavailable, 0), want: true},
+		{name: "404", err: httpError(http.StatusNotFound, 0)},
+		{name: "wrapped", err: fmt.Errorf("segment: %w", m3u8.NewRetryExhaustedError(3, httpError(http.StatusTooManyRequests, 0))), want: true},
+		{name: "timeout", err: timeoutError{}, want: true},
+		{name: "deadline", err: context.DeadlineExceeded, want: true},
+		{name: "other", err: errors.New("connection reset")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryAfter, got := throttled(tt.err)
+			if got != tt.want || retryAfter != tt.retryAfter {
+				t.Errorf("got (%v, %v), want (%v, %v)", retryAfter, got, tt.retryAfter, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolFixed(t *testing.T) {
+	p, clk := newTestPool(4, false)
+
+	epoch, _ := p.acquire(context.Background())
+	p.observe(epoch, httpError(http.StatusTooManyRequests, time.Minute))
+	p.release(0, errors.New("failed"))
+	for i := 0; i < 3; i++ {
+		finishWindow(t, p, clk, 1000, time.Second)
+	}
+
+	if got := p.currentLimit(); got != 4 {
+		t.Errorf("got limit %d, want 4", got)
+	}
+	start := clk.Now()
+	if _, err := p.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	if waited := clk.elapsed(start); waited != 0 {
+		t.Errorf("fixed pool waited %v for Retry-After", waited)
+	}
+}
+
+func TestWorkerPoolThrottle(t *testing.T) {
+	p, clk := newTestPool(8, true)
+	tooMany := httpError(http.StatusTooManyRequests, 0)
+
+	var epochs []int
+	for i := 0; i < 3; i++ {
+		epoch, _ := p.acquire(context.Background())
+		epochs = append(epochs, epoch)
+	}
+
+	// A burst of throttled requests started together halves the pool once.
+	for _, epoch := range epochs {
+		p.observe(epoch, tooMany)
+	}
+	if got := p.currentLimit(); got != 4 {
+		t.Errorf("after one burst got limit %d, want 4", got)
+	}
+	for range epochs {
+		p.release(0, tooMany)
+	}
+
+	// A request started after the change shrinks it again.
+	epoch, _ := p.acquire(context.Background())
+	p.observe(epoch, httpError(http.StatusServiceUnavailable, 0))
+	p.observe(epoch, timeoutError{})
+	p.release(0, timeoutError{})
+	if got := p.currentLimit(); got != 2 {
+		t.Errorf("after second burst got limit %d, want 2", got)
+	}
+
+	// The pool never drops below one worker.
+	for i := 0; i < 3; i++ {
+		epoch, _ := p.acquire(context.Background())
+		p.observe(epoch, tooMany)
+		p.release(0, tooMany)
+	}
+	if got := p.currentLimit(); got != 1 {
+		t.Errorf("got limit %d, want 1", got)
+	}
+
+	// Retry-After pauses new downloads.
+	epoch, _ = p.acquire(context.Background())
+	p.observe(epoch, httpError(http.StatusTooManyRequests, 30*time.Second))
+	p.release(0, tooMany)
+	start := clk.Now()
+	if _, err := p.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	if waited := clk.elapsed(start); waited != 30*time.Second {
+		t.Errorf("waited %v, want 30s", waited)
+	}
+}
+
+func TestWorkerPoolGrow(t *testing.T) {
+	p, clk := newTestPool(4, true)
+
+	epoch, _ := p.acquire(context.Background())
+	p.observe(epoch, httpError(http.StatusTooManyRequests, 0))
+	p.release(0, errors.New("failed"))
+	if got := p.currentLimit(); got != 2 {
+		t.Fatalf("got limit %d, want 2", got)
+	}
+
+	// Each window at least as fast as the last adds a worker, up to -workers.
+	wants := []int{3, 4, 4}
+	for i, want := range wants {
+		finishWindow(t, p, clk, 1000, time.Second)
+		if got := p.currentLimit(); got != want {
+			t.Errorf("after window %d got limit %d, want %d", i+1, got, want)
+		}
+	}
+
+	// Throughput falling after growth undoes it.
+	p, clk = newTestPool(4, true)
+	p.setLimit(2, "test")
+	finishWindow(t, p, clk, 1000, time.Second)
+	if got := p.currentLimit(); got != 3 {
+		t.Fatalf("got limit %d, want 3", got)
+	}
+	finishWindow(t, p, clk, 1000, 2*time.Second)
+	if got := p.currentLimit(); got != 2 {
+		t.Errorf("after slower window got limit %d, want 2", got)
+	}
+}
+
+func TestWorkerPoolCanceled(t *testing.T) {
+	p, _ := newTestPool(1, true)
+	if _, err := p.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := p.acquire(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+}
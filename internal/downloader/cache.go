@@ -0,0 +1,232 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+// fetchCache fetches each distinct URI once and shares the result between
+// workers. It holds small per-job resources such as keys and fMP4
+// initialization sections.
+type fetchCache struct {
+	httpClient *HTTPClient
+	mu         sync.Mutex
+	entries    map[string]*fetchEntry
+}
+
+type fetchEntry struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+func newFetchCache(httpClient *HTTPClient) *fetchCache {
+	return &fetchCache{
+		httpClient: httpClient,
+		entries:    make(map[string]*fetchEntry),
+	}
+}
+
+// get returns the resource at uri. The fetch runs under the context of the first
+// caller; later callers share its result.
+func (c *fetchCache) get(ctx context.Context, uri string) ([]byte, error) {
+	return c.load(uri, func() ([]byte, error) {
+		return c.httpClient.Get(ctx, uri)
+	})
+}
+
+// getRange is like get for the byte range br of uri, or the whole resource
+// when br is nil.
+func (c *fetchCache) getRange(ctx context.Context, uri string, br *m3u8.ByteRange) ([]byte, error) {
+	if br == nil {
+		return c.get(ctx, uri)
+	}
+	return c.load(fmt.Sprintf("%s#%d@%d", uri, br.Length, br.Offset), func() ([]byte, error) {
+		return c.httpClient.GetRange(ctx, uri, *br)
+	})
+}
+
+func (c *fetchCache) load(key string, fetch func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &fetchEntry{}
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.data, entry.err = fetch()
+	})
+
+	return entry.data, entry.err
+}
+
+// forgetFailures drops failed fetches so the next get retries them.
+func (c *fetchCache) forgetFailures() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for uri, entry := range c.entries {
+		if entry.err != nil {
+			delete(c.entries, uri)
+		}
+	}
+}
+
+// jobResources are the fetch-once resources shared by the segments of one
+// download pass.
+type jobResources struct {
+	keys   *fetchCache
+	inits  *fetchCache
+	ranges *rangeCache
+	pool   *workerPool
+	// out receives the segments in order when streaming.
+	out *orderedWriter
+	// initAt marks the segments that start an #EXT-X-MAP run; they carry
+	// the initialization section in front of their own data.
+	initAt map[int]bool
+}
+
+func newJobResources(httpClient *HTTPClient) *jobResources {
+	return &jobResources{
+		keys:   newFetchCache(httpClient),
+		inits:  newFetchCache(httpClient),
+		ranges: newRangeCache(httpClient),
+	}
+}
+
+func (r *jobResources) forgetFailures() {
+	r.keys.forgetFailures()
+	r.inits.forgetFailures()
+}
+
+// maxCoalescedRange caps the size of one coalesced Range request.
+const maxCoalescedRange = 8 << 20
+
+// rangeSpan is a run of adjacent byte ranges of one resource that is fetched
+// with a single Range request.
+type rangeSpan struct {
+	url      string
+	br       m3u8.ByteRange
+	segments int
+}
+
+// rangeCache fetches each span once and hands every segment its part of it.
+// A span's data is dropped once all of its segments have taken their part.
+type rangeCache struct {
+	httpClient *HTTPClient
+	mu         sync.Mutex
+	spans      map[int]*rangeSpan
+	entries    map[*rangeSpan]*rangeEntry
+}
+
+type rangeEntry struct {
+	once      sync.Once
+	data      []byte
+	err       error
+	remaining int
+}
+
+func newRangeCache(httpClient *HTTPClient) *rangeCache {
+	return &rangeCache{httpClient: httpClient}
+}
+
+// plan groups the byte-range segments at indices into spans, merging a
+// segment into the span before it when it continues the same resource right
+// where that span ends. It discards anything fetched for an earlier plan.
+func (c *rangeCache) plan(segs []*m3u8.TSInfo, indices []int) {
+	spans := make(map[int]*rangeSpan)
+
+	var prev *rangeSpan
+	prevIdx := -1
+	for _, i := range indices {
+		seg := segs[i]
+		if seg.ByteRange == nil {
+			prev = nil
+			continue
+		}
+
+		if prev != nil && i == prevIdx+1 && seg.Url == prev.url &&
+			seg.ByteRange.Offset == prev.br.Offset+prev.br.Length &&
+			prev.br.Length+seg.ByteRange.Length <= maxCoalescedRange {
+			prev.br.Length += seg.ByteRange.Length
+			prev.segments++
+		} else {
+			prev = &rangeSpan{url: seg.Url, br: *seg.ByteRange, segments: 1}
+		}
+		spans[i] = prev
+		prevIdx = i
+	}
+
+	c.mu.Lock()
+	c.spans = spans
+	c.entries = make(map[*rangeSpan]*rangeEntry)
+	c.mu.Unlock()
+}
+
+// get returns the bytes of seg, the byte-range segment at idx. Segments
+// outside the current plan are fetched on their own.
+func (c *rangeCache) get(ctx context.Context, idx int, seg *m3u8.TSInfo) ([]byte, error) {
+	c.mu.Lock()
+	span, ok := c.spans[idx]
+	if !ok {
+		c.mu.Unlock()
+		return c.httpClient.GetRange(ctx, seg.Url, *seg.ByteRange)
+	}
+	entry, ok := c.entries[span]
+	if !ok {
+		entry = &rangeEntry{remaining: span.segments}
+		c.entries[span] = entry
+	}
+	c.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.data, entry.err = c.httpClient.GetRange(ctx, span.url, span.br)
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry.err != nil {
+		if c.entries[span] == entry {
+			delete(c.entries, span)
+		}
+		return nil, entry.err
+	}
+
+	entry.remaining--
+	if entry.remaining == 0 {
+		delete(c.entries, span)
+	}
+
+	start := seg.ByteRange.Offset - span.br.Offset
+	return entry.data[start : start+seg.ByteRange.Length], nil
+}
+
+// initRunStarts returns the indices of segs whose initialization section
+// differs from the one before them. prev is the section in effect before
+// segs[0], or nil.
+func initRunStarts(segs []*m3u8.TSInfo, prev *m3u8.Map) map[int]bool {
+	starts := make(map[int]bool)
+	for i, seg := range segs {
+		if seg.Map != nil && !sameMap(seg.Map, prev) {
+			starts[i] = true
+		}
+		prev = seg.Map
+	}
+	return starts
+}
+
+func sameMap(a, b *m3u8.Map) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.URI != b.URI || (a.ByteRange == nil) != (b.ByteRange == nil) {
+		return false
+	}
+	return a.ByteRange == nil || *a.ByteRange == *b.ByteRange
+}
@@ -0,0 +1,102 @@
+package downloader
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpOnlyPrefix marks HttpOnly cookies in files exported by curl and most
+// browser extensions; such lines are cookies, not comments.
+const httpOnlyPrefix = "#HttpOnly_"
+
+// LoadCookieFile reads a Netscape/Mozilla cookies.txt file into a cookie jar.
+// Each cookie keeps the domain, path and secure flag of its line, so it is
+// only sent to the hosts it was issued for. Expired cookies are dropped.
+func LoadCookieFile(path string) (http.CookieJar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cookie file: %w", err)
+	}
+	defer f.Close()
+
+	jar, _ := cookiejar.New(nil)
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		httpOnly := false
+		if strings.HasPrefix(line, httpOnlyPrefix) {
+			line = strings.TrimPrefix(line, httpOnlyPrefix)
+			httpOnly = true
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		host, cookie, err := parseCookieLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("cookie file line %d: %w", lineNum, err)
+		}
+		cookie.HttpOnly = httpOnly
+
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: cookie.Path}, []*http.Cookie{cookie})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read cookie file: %w", err)
+	}
+
+	return jar, nil
+}
+
+// parseCookieLine parses the seven tab-separated fields of a cookies.txt
+// line: domain, include subdomains, path, secure, expiry, name and value.
+// It returns the host the cookie was issued by along with the cookie.
+func parseCookieLine(line string) (string, *http.Cookie, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 7 {
+		return "", nil, fmt.Errorf("got %d fields, want 7", len(fields))
+	}
+
+	domain := fields[0]
+	if domain == "" || fields[5] == "" {
+		return "", nil, fmt.Errorf("missing domain or name")
+	}
+
+	expiry, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid expiry %q", fields[4])
+	}
+
+	cookie := &http.Cookie{
+		Name:   fields[5],
+		Value:  fields[6],
+		Path:   fields[2],
+		Secure: strings.EqualFold(fields[3], "TRUE"),
+	}
+	if cookie.Path == "" {
+		cookie.Path = "/"
+	}
+	// Host-only cookies are stored without a domain attribute.
+	if strings.EqualFold(fields[1], "TRUE") {
+		cookie.Domain = domain
+	}
+	if expiry > 0 {
+		cookie.Expires = time.Unix(expiry, 0)
+	}
+
+	return strings.TrimPrefix(domain, "."), cookie, nil
+}
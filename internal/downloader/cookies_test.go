@@ -0,0 +1,82 @@
+package downloader
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCookieFile(t *testing.T) {
+	content := "# Netscape HTTP Cookie File\n" +
+		"\n" +
+		".example.com\tTRUE\t/\tFALSE\t0\tshared\tall\n" +
+		"cdn.example.com\tFALSE\t/video\tTRUE\t0\tscoped\tv\n" +
+		"#HttpOnly_example.com\tFALSE\t/\tFALSE\t0\thttponly\th\n" +
+		"example.com\tFALSE\t/\tFALSE\t1\texpired\tx\n"
+
+	path := filepath.Join(t.TempDir(), "cookies.txt")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	jar, err := LoadCookieFile(path)
+	if err != nil {
+		t.Fatalf("LoadCookieFile failed: %v", err)
+	}
+
+	tests := []struct {
+		url  string
+		want []string
+	}{
+		{url: "http://example.com/a.m3u8", want: []string{"shared", "httponly"}},
+		{url: "http://cdn.example.com/a.ts", want: []string{"shared"}},
+		{url: "https://cdn.example.com/video/a.ts", want: []string{"scoped", "shared"}},
+		{url: "http://cdn.example.com/video/a.ts", want: []string{"shared"}},
+		{url: "http://other.com/a.ts", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, _ := url.Parse(tt.url)
+			got := make(map[string]bool)
+			for _, c := range jar.Cookies(u) {
+				got[c.Name] = true
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("got cookies %v, want %v", got, tt.want)
+			}
+			for _, name := range tt.want {
+				if !got[name] {
+					t.Errorf("missing cookie %q, got %v", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadCookieFileInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "too few fields", content: "example.com\tFALSE\t/\tFALSE\t0\tname\n"},
+		{name: "bad expiry", content: "example.com\tFALSE\t/\tFALSE\tsoon\tname\tvalue\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cookies.txt")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadCookieFile(path); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+
+	if _, err := LoadCookieFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
@@ -2,22 +2,34 @@ package downloader
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 
 	"m3u8-download/internal/decrypt"
+	"m3u8-download/internal/manifest"
 	"m3u8-download/pkg/m3u8"
-
-	progressbar "github.com/schollz/progressbar/v3"
 )
 
 type Downloader struct {
 	httpClient *HTTPClient
 	logger     *slog.Logger
+	manifest   *manifest.Manifest
+	policy     FailurePolicy
+	noProgress bool
+	adaptive   bool
+	pool       *WorkerPool
+	output     string
+	outWriter  io.Writer
+	onProgress func(m3u8.Progress)
 }
 
 func NewDownloader(httpClient *HTTPClient, logger *slog.Logger) *Downloader {
@@ -27,162 +39,595 @@ func NewDownloader(httpClient *HTTPClient, logger *slog.Logger) *Downloader {
 	}
 }
 
-func (d *Downloader) DownloadSegments(playlist *m3u8.Playlist, cacheDir string, workers int) (*m3u8.DownloadStats, error) {
+// SetManifest makes DownloadSegments record progress in m and skip segments
+// that m already records as completed and whose files still verify.
+func (d *Downloader) SetManifest(m *manifest.Manifest) {
+	d.manifest = m
+}
+
+// HideProgress stops DownloadSegments from drawing a progress bar, for
+// downloads running next to another one that already draws it.
+func (d *Downloader) HideProgress() {
+	d.noProgress = true
+}
+
+// SetProgressFunc makes DownloadSegments and RecordLive call fn whenever a
+// segment settles, one call at a time. It is independent of the progress
+// bar.
+func (d *Downloader) SetProgressFunc(fn func(m3u8.Progress)) {
+	d.onProgress = fn
+}
+
+// StreamTo makes DownloadSegments append segments to the file at path in
+// playlist order while it downloads, instead of leaving them in the cache
+// directory for MergeFiles. Only segments that complete ahead of a missing
+// predecessor wait in the cache. With a manifest, a resumed download keeps
+// the segments a previous run already appended to path.
+func (d *Downloader) StreamTo(path string) {
+	d.output = path
+}
+
+// StreamToWriter is like StreamTo for a writer such as a pipe, which
+// cannot be rewound: a resumed download writes every segment again.
+func (d *Downloader) StreamToWriter(w io.Writer) {
+	d.outWriter = w
+}
+
+// SetAdaptive makes the number of concurrent segment downloads adapt to the
+// server: it shrinks when the server throttles or fails and grows back, up
+// to the workers given to DownloadSegments, while throughput improves.
+func (d *Downloader) SetAdaptive(adaptive bool) {
+	d.adaptive = adaptive
+}
+
+// WorkerPool is a budget of concurrent segment downloads that several
+// downloaders share, so that a playlist and its renditions together download
+// no more segments at once than it allows.
+type WorkerPool struct {
+	pool *workerPool
+}
+
+// NewWorkerPool returns a pool of workers, adapting to the server as
+// SetAdaptive describes when adaptive is set.
+func NewWorkerPool(workers int, adaptive bool, logger *slog.Logger) *WorkerPool {
+	return &WorkerPool{pool: newWorkerPool(workers, adaptive, realClock{}, logger)}
+}
+
+// SetWorkerPool makes DownloadSegments take its workers from pool instead of
+// a pool of its own.
+func (d *Downloader) SetWorkerPool(pool *WorkerPool) {
+	d.pool = pool
+}
+
+// FailurePolicy decides what happens to segments that still fail after the
+// HTTP client's own retries.
+type FailurePolicy struct {
+	// RetryPasses is the number of extra passes over failed segments.
+	RetryPasses int
+	// MaxFailed is how many segments may be missing before the download
+	// as a whole is reported as failed.
+	MaxFailed int
+}
+
+func (d *Downloader) SetFailurePolicy(policy FailurePolicy) {
+	d.policy = policy
+}
+
+// DownloadSegments downloads every segment of playlist into cacheDir. Failed
+// segments are retried according to the failure policy; if more than
+// MaxFailed remain missing it returns an *m3u8.IncompleteDownloadError;
+// when streaming, the output then ends before the first missing segment.
+// When ctx is canceled it stops starting new segments, aborts in-flight
+// requests, records interrupted segments as pending and returns ctx.Err().
+func (d *Downloader) DownloadSegments(ctx context.Context, playlist *m3u8.Playlist, cacheDir string, workers int) (*m3u8.DownloadStats, error) {
 	stats := &m3u8.DownloadStats{
 		Total:     len(playlist.Segments),
 		StartTime: 0,
 	}
 
-	bar := progressbar.Default(int64(len(playlist.Segments)))
+	prog := d.newProgress(len(playlist.Segments), true)
+
+	res := newJobResources(d.httpClient)
+	res.initAt = initRunStarts(playlist.Segments, nil)
+	res.pool = d.newWorkerPool(workers)
+
+	written := 0
+	switch {
+	case d.outWriter != nil:
+		res.out = d.newOrderedWriter(d.outWriter, cacheDir, playlist.Segments, 0, 0, workers)
+	case d.output != "":
+		f, next, size, err := d.openOutput()
+		if err != nil {
+			return stats, err
+		}
+		defer f.Close()
+
+		written = next
+		res.out = d.newOrderedWriter(f, cacheDir, playlist.Segments, next, size, workers)
+		res.out.onWrite = func(count int, size int64) {
+			d.recordProgress(func(m *manifest.Manifest) error { return m.MarkWritten(d.output, count, size) })
+		}
+	}
+
+	var pending []int
+	for i := range playlist.Segments {
+		if i < written || (d.manifest != nil && d.manifest.Verify(cacheDir, i)) {
+			if res.out != nil && i >= written {
+				res.out.ready(i)
+			}
+			stats.Skipped++
+			prog.add(1, 0)
+			continue
+		}
+		pending = append(pending, i)
+	}
+
+	var outErr error
+	if res.out != nil {
+		outErr = res.out.flush(nil)
+	}
+	pending, completed, keyErr := d.downloadWithRetries(ctx, playlist, pending, cacheDir, res, prog)
+	if res.out != nil && outErr == nil {
+		// Missing segments are only left out of a complete download; a
+		// failed write to the output is reported either way.
+		var skip []int
+		if keyErr == nil && ctx.Err() == nil && len(pending) <= d.policy.MaxFailed {
+			skip = pending
+		}
+		outErr = res.out.flush(skip)
+	}
+
+	if d.manifest != nil {
+		if err := d.manifest.Save(); err != nil {
+			d.logger.Warn("Failed to save manifest", "error", err)
+		}
+	}
+
+	stats.Completed = completed + stats.Skipped
+	stats.Failed = len(pending)
+	stats.FailedSegments = pending
 
+	if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+
+	if outErr != nil {
+		return stats, outErr
+	}
+
+	if keyErr != nil {
+		return stats, fmt.Errorf("failed to download encryption key: %w", keyErr)
+	}
+
+	if len(pending) > d.policy.MaxFailed {
+		return stats, m3u8.NewIncompleteDownloadError(stats.Total, pending)
+	}
+
+	return stats, nil
+}
+
+// downloadWithRetries runs a download pass over indices followed by the
+// retry passes of the failure policy. It returns what the last pass
+// returned, with completed summed over all passes.
+func (d *Downloader) downloadWithRetries(ctx context.Context, playlist *m3u8.Playlist, indices []int, cacheDir string, res *jobResources, prog *progress) ([]int, int, error) {
+	pending := indices
+	var completed int
+	var keyErr error
+
+	for pass := 0; len(pending) > 0 && pass <= d.policy.RetryPasses; pass++ {
+		if pass > 0 {
+			d.logger.Info("Retrying failed segments", "pass", pass, "segments", len(pending))
+			res.forgetFailures()
+			prog = nil
+		}
+		res.ranges.plan(playlist.Segments, pending)
+
+		var done int
+		pending, done, keyErr = d.downloadPass(ctx, playlist, pending, cacheDir, res, prog)
+		completed += done
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return pending, completed, keyErr
+}
+
+// downloadPass downloads the segments at indices and returns the indices that
+// failed, how many completed, and the first key error seen. Segments that
+// were interrupted by cancellation are not reported as failed.
+func (d *Downloader) downloadPass(ctx context.Context, playlist *m3u8.Playlist, indices []int, cacheDir string, res *jobResources, prog *progress) ([]int, int, error) {
 	var wg sync.WaitGroup
-	ch := make(chan struct{}, workers)
 
 	var mu sync.Mutex
-	var keyData []byte
-	var keyDataErr error
-	var keyDataLoaded bool
-	var decryptor *decrypt.Decryptor
+	var failedSegments []int
+	var keyErr error
 
 	var completed atomic.Int64
-	var failed atomic.Int64
 
-	if playlist.IsEncrypted && playlist.Key != "" {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			keyData, keyDataErr = d.httpClient.Get(playlist.Key)
-			if keyDataErr == nil {
-				decryptor, keyDataErr = decrypt.NewDecryptor(keyData, nil)
+	for _, i := range indices {
+		if res.out != nil {
+			if err := res.out.wait(ctx, i); err != nil {
+				break
 			}
-			keyDataLoaded = true
-		}()
-	}
-
-	wg.Add(len(playlist.Segments))
-	for i, segment := range playlist.Segments {
-		ch <- struct{}{}
+		}
+		epoch, err := res.pool.acquire(ctx)
+		if err != nil {
+			break
+		}
+		wg.Add(1)
 
 		go func(idx int, seg *m3u8.TSInfo) {
+			var size int64
+			var err error
 			defer func() {
-				bar.Add(1)
-				<-ch
+				if err == nil {
+					prog.add(1, size)
+				} else {
+					prog.add(1, 0)
+				}
+				res.pool.release(size, err)
 				wg.Done()
 			}()
 
 			filePath := fmt.Sprintf("%s/%s", cacheDir, seg.Name)
 
-			err := d.downloadSegment(seg.Url, filePath, playlist.IsEncrypted, decryptor, keyDataLoaded, &mu)
+			d.recordProgress(func(m *manifest.Manifest) error { return m.MarkDownloading(idx) })
+
+			segCtx := withAttemptHook(ctx, func(err error) { res.pool.observe(epoch, err) })
+			var data []byte
+			data, err = d.downloadSegment(segCtx, idx, seg, res)
+			if err == nil && len(data) == 0 {
+				err = errEmptySegment
+			}
+			if err == nil {
+				size = int64(len(data))
+				err = d.storeSegment(idx, filePath, data, res)
+			}
+			if err != nil && ctx.Err() != nil {
+				d.recordProgress(func(m *manifest.Manifest) error { return m.MarkPending(idx) })
+				return
+			}
 			if err != nil {
 				d.logger.Error("Failed to download segment", "index", idx, "url", seg.Url, "error", err)
-				failed.Add(1)
+				d.recordProgress(func(m *manifest.Manifest) error { return m.MarkFailed(idx) })
+				if res.out != nil {
+					res.out.fail(idx)
+				}
+
+				mu.Lock()
+				failedSegments = append(failedSegments, idx)
+				var kerr *keyError
+				if keyErr == nil && errors.As(err, &kerr) {
+					keyErr = kerr.err
+				}
+				mu.Unlock()
 				return
 			}
 
+			sum := manifest.Checksum(data)
+			d.recordProgress(func(m *manifest.Manifest) error { return m.MarkCompleted(idx, size, sum) })
 			completed.Add(1)
-		}(i, segment)
+		}(i, playlist.Segments[i])
 	}
 
 	wg.Wait()
 
-	if keyDataErr != nil {
-		return stats, fmt.Errorf("failed to download encryption key: %w", keyDataErr)
+	sort.Ints(failedSegments)
+	return failedSegments, int(completed.Load()), keyErr
+}
+
+func (d *Downloader) newWorkerPool(workers int) *workerPool {
+	if d.pool != nil {
+		return d.pool.pool
 	}
+	return newWorkerPool(workers, d.adaptive, realClock{}, d.logger)
+}
 
-	stats.Completed = int(completed.Load())
-	stats.Failed = int(failed.Load())
+// errEmptySegment fails a segment whose response had no body, which would
+// otherwise leave a gap in the output.
+var errEmptySegment = errors.New("empty segment")
 
-	return stats, nil
+// keyError marks a segment failure caused by its key rather than the
+// segment itself.
+type keyError struct {
+	err error
+}
+
+func (e *keyError) Error() string {
+	return fmt.Sprintf("failed to load key: %v", e.err)
+}
+
+func (e *keyError) Unwrap() error {
+	return e.err
 }
 
-func (d *Downloader) downloadSegment(url, filePath string, isEncrypted bool, decryptor *decrypt.Decryptor, keyLoaded bool, mu *sync.Mutex) error {
-	if !isEncrypted {
-		file, err := os.Create(filePath)
+// downloadSegment fetches and decrypts seg, the segment at idx. A segment
+// starting an #EXT-X-MAP run gets its fMP4 initialization section in front
+// of it.
+func (d *Downloader) downloadSegment(ctx context.Context, idx int, seg *m3u8.TSInfo, res *jobResources) ([]byte, error) {
+	var data []byte
+
+	if seg.Key == nil && seg.ByteRange != nil {
+		var err error
+		if data, err = res.ranges.get(ctx, idx, seg); err != nil {
+			return nil, err
+		}
+	} else if seg.Key == nil {
+		buf := new(bytes.Buffer)
+		if err := d.httpClient.DownloadStream(ctx, seg.Url, buf); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	} else {
+		if seg.Map != nil && seg.Key.Method != m3u8.MethodAES128 {
+			return nil, &keyError{err: m3u8.NewUnsupportedMethodError(seg.Key.Method + " (fMP4)")}
+		}
+
+		keyData, err := res.keys.get(ctx, seg.Key.URI)
 		if err != nil {
-			return fmt.Errorf("failed to create file: %w", err)
+			return nil, &keyError{err: err}
 		}
-		defer file.Close()
 
-		buf := new(bytes.Buffer)
-		if err := d.httpClient.DownloadStream(url, buf); err != nil {
-			return err
+		iv := seg.Key.IV
+		if iv == nil {
+			iv = decrypt.SequenceIV(uint64(seg.Sequence))
 		}
 
-		data := decrypt.RemoveSyncBytePrefix(buf.Bytes())
-		_, err = file.Write(data)
-		return err
+		decryptor, err := decrypt.NewMethodDecryptor(seg.Key.Method, keyData, iv)
+		if err != nil {
+			return nil, &keyError{err: err}
+		}
+
+		var encrypted []byte
+		if seg.ByteRange != nil {
+			encrypted, err = res.ranges.get(ctx, idx, seg)
+		} else {
+			encrypted, err = d.httpClient.Get(ctx, seg.Url)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		data, err = decryptor.Decrypt(encrypted)
+		if err != nil {
+			return nil, fmt.Errorf("decryption failed: %w", err)
+		}
 	}
 
-	mu.Lock()
-	ready := keyLoaded
-	mu.Unlock()
+	if seg.Map == nil && !isRawSegment(data) {
+		data = decrypt.RemoveSyncBytePrefix(data)
+	}
 
-	if !ready {
-		return fmt.Errorf("encryption key not loaded")
+	if res.initAt[idx] {
+		initData, err := d.initSection(ctx, seg.Map, res)
+		if err != nil {
+			return nil, err
+		}
+		data = append(initData[:len(initData):len(initData)], data...)
 	}
 
-	data, err := d.httpClient.Get(url)
-	if err != nil {
-		return err
+	return data, nil
+}
+
+// storeSegment hands the data of the segment at idx to the output when
+// streaming, and writes it to filePath in the cache directory otherwise.
+func (d *Downloader) storeSegment(idx int, filePath string, data []byte, res *jobResources) error {
+	if res.out != nil {
+		return res.out.add(idx, data)
 	}
+	return writeSegmentFile(filePath, data)
+}
 
-	mu.Lock()
-	decrypted, err := decryptor.Decrypt(data)
-	mu.Unlock()
+// initSection returns the decrypted bytes of an #EXT-X-MAP initialization
+// section. Each resource is fetched once per job. An encrypted section must
+// have an explicit IV (RFC 8216 section 4.3.2.5).
+func (d *Downloader) initSection(ctx context.Context, m *m3u8.Map, res *jobResources) ([]byte, error) {
+	if m.Key != nil && m.Key.IV == nil {
+		return nil, &keyError{err: fmt.Errorf("%w: encrypted EXT-X-MAP %s has no IV", m3u8.ErrInvalidIV, m.URI)}
+	}
 
+	data, err := res.inits.getRange(ctx, m.URI, m.ByteRange)
 	if err != nil {
-		return fmt.Errorf("decryption failed: %w", err)
+		return nil, fmt.Errorf("failed to download initialization section: %w", err)
 	}
 
-	data = decrypt.RemoveSyncBytePrefix(decrypted)
+	if m.Key == nil {
+		return data, nil
+	}
 
-	file, err := os.Create(filePath)
+	keyData, err := res.keys.get(ctx, m.Key.URI)
+	if err != nil {
+		return nil, &keyError{err: err}
+	}
+	decryptor, err := decrypt.NewDecryptor(keyData, m.Key.IV)
+	if err != nil {
+		return nil, &keyError{err: err}
+	}
+	data, err = decryptor.Decrypt(data)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return nil, fmt.Errorf("initialization section decryption failed: %w", err)
 	}
-	defer file.Close()
+	return data, nil
+}
 
-	_, err = file.Write(data)
-	return err
+// recordProgress applies a manifest update, if a manifest is set, logging
+// rather than failing on write errors.
+func (d *Downloader) recordProgress(update func(*manifest.Manifest) error) {
+	if d.manifest == nil {
+		return
+	}
+	if err := update(d.manifest); err != nil {
+		d.logger.Warn("Failed to update manifest", "error", err)
+	}
 }
 
-func (d *Downloader) MergeFiles(cacheDir, output string) error {
+// MergeFiles concatenates the files of playlist's segments in cacheDir into
+// output, in playlist order. The segments at the indices in missing are
+// known to have failed and are left out. Before output is created, the cache
+// directory is checked against the playlist; missing or empty segment files
+// and files no segment names are reported as an *m3u8.MergeError. It stops
+// between files when ctx is canceled.
+func (d *Downloader) MergeFiles(ctx context.Context, playlist *m3u8.Playlist, cacheDir, output string, missing []int) error {
+	paths, err := segmentFiles(playlist, cacheDir, missing)
+	if err != nil {
+		return err
+	}
+
 	outFile, err := os.Create(output)
 	if err != nil {
 		return fmt.Errorf("failed to create output file: %w", err)
 	}
 	defer outFile.Close()
 
-	entries, err := os.ReadDir(cacheDir)
-	if err != nil {
-		return fmt.Errorf("failed to read cache directory: %w", err)
+	buf := make([]byte, 32*1024)
+	for _, filePath := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		inFile, err := os.Open(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to open segment: %w", err)
+		}
+		if _, err := d.appendAndRemove(outFile, inFile, buf); err != nil {
+			return err
+		}
 	}
 
-	buf := make([]byte, 32*1024)
+	return nil
+}
 
-	for _, entry := range entries {
-		if entry.IsDir() {
+// segmentFiles returns the paths of the files of playlist's segments in
+// cacheDir in playlist order, leaving out the segments at the indices in
+// missing. It returns an *m3u8.MergeError when a file is missing or empty
+// or cacheDir holds a file no segment names.
+func segmentFiles(playlist *m3u8.Playlist, cacheDir string, missing []int) ([]string, error) {
+	skip := make(map[int]bool, len(missing))
+	for _, i := range missing {
+		skip[i] = true
+	}
+
+	mergeErr := &m3u8.MergeError{}
+	names := make(map[string]bool, len(playlist.Segments))
+	paths := make([]string, 0, len(playlist.Segments))
+	for i, seg := range playlist.Segments {
+		names[seg.Name] = true
+		if skip[i] {
 			continue
 		}
 
-		filePath := fmt.Sprintf("%s/%s", cacheDir, entry.Name())
-		inFile, err := os.Open(filePath)
-		if err != nil {
-			d.logger.Warn("Failed to open file", "path", filePath, "error", err)
+		filePath := fmt.Sprintf("%s/%s", cacheDir, seg.Name)
+		info, err := os.Stat(filePath)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			mergeErr.Missing = append(mergeErr.Missing, seg.Name)
+		case err != nil:
+			return nil, fmt.Errorf("failed to check segment: %w", err)
+		case info.Size() == 0:
+			mergeErr.Empty = append(mergeErr.Empty, seg.Name)
+		}
+		paths = append(paths, filePath)
+	}
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || isBookkeepingFile(entry.Name()) || names[entry.Name()] {
 			continue
 		}
+		mergeErr.Extra = append(mergeErr.Extra, entry.Name())
+	}
+
+	if len(mergeErr.Missing) > 0 || len(mergeErr.Empty) > 0 || len(mergeErr.Extra) > 0 {
+		return nil, mergeErr
+	}
+	return paths, nil
+}
+
+// appendAndRemove copies f to w, then closes and removes it. It returns the
+// number of bytes copied.
+func (d *Downloader) appendAndRemove(w io.Writer, f *os.File, buf []byte) (int64, error) {
+	n, err := io.CopyBuffer(w, f, buf)
+	f.Close()
+	if err != nil {
+		return n, fmt.Errorf("failed to copy file: %w", err)
+	}
 
-		if _, err := io.CopyBuffer(outFile, inFile, buf); err != nil {
-			inFile.Close()
-			return fmt.Errorf("failed to copy file: %w", err)
+	if err := os.Remove(f.Name()); err != nil {
+		d.logger.Warn("Failed to remove file", "path", f.Name(), "error", err)
+	}
+	return n, nil
+}
+
+// partSuffix marks a segment file that is still being written.
+const partSuffix = ".part"
+
+// isRawSegment reports whether data is a segment that is not MPEG-TS, such
+// as WebVTT or packed audio starting with an ID3 tag or a frame sync word,
+// whose bytes must be kept as they are.
+func isRawSegment(data []byte) bool {
+	return SegmentExt(data) != ""
+}
+
+// SegmentExt returns the file extension of a segment that is not MPEG-TS,
+// judged from its first bytes: ".vtt" for WebVTT and ".aac", ".mp3", ".ac3"
+// or ".ec3" for packed audio. It returns "" for anything else.
+func SegmentExt(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if bytes.HasPrefix(data, []byte("WEBVTT")) {
+		return ".vtt"
+	}
+
+	id3 := bytes.HasPrefix(data, []byte("ID3"))
+	if id3 && len(data) >= 10 {
+		// Packed audio timestamps the first frame with an ID3 tag; the
+		// size is syncsafe and leaves out the header and any footer.
+		size := 10 + (int(data[6]&0x7f)<<21 | int(data[7]&0x7f)<<14 | int(data[8]&0x7f)<<7 | int(data[9]&0x7f))
+		if data[5]&0x10 != 0 {
+			size += 10
 		}
+		data = data[min(size, len(data)):]
+	}
 
-		inFile.Close()
+	switch {
+	case len(data) >= 2 && data[0] == 0xff && data[1]&0xf6 == 0xf0:
+		return ".aac" // ADTS
+	case len(data) >= 2 && data[0] == 0xff && data[1]&0xe0 == 0xe0 && data[1]&0x06 != 0:
+		return ".mp3"
+	case len(data) >= 2 && data[0] == 0x0b && data[1] == 0x77:
+		if len(data) >= 6 && data[5]>>3 > 10 {
+			return ".ec3"
+		}
+		return ".ac3"
+	case id3:
+		// A tag larger than data hides the frame; AAC is the most common.
+		return ".aac"
+	}
+	return ""
+}
 
-		if err := os.Remove(filePath); err != nil {
-			d.logger.Warn("Failed to remove file", "path", filePath, "error", err)
+// CachedSegmentExt returns SegmentExt of the first segment of playlist
+// cached in cacheDir, "" when none is.
+func CachedSegmentExt(playlist *m3u8.Playlist, cacheDir string) string {
+	head := make([]byte, 4096)
+	for _, seg := range playlist.Segments {
+		f, err := os.Open(filepath.Join(cacheDir, seg.Name))
+		if err != nil {
+			continue
+		}
+		n, _ := io.ReadFull(f, head)
+		f.Close()
+		if n > 0 {
+			return SegmentExt(head[:n])
 		}
 	}
+	return ""
+}
 
-	return nil
+func isBookkeepingFile(name string) bool {
+	return strings.HasPrefix(name, manifest.FileName) || strings.HasSuffix(name, partSuffix)
 }
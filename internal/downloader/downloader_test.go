@@ -0,0 +1,898 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"m3u8-download/internal/manifest"
+	"m3u8-download/pkg/m3u8"
+)
+
+func encryptSegment(t *testing.T, key, iv, plaintext []byte) []byte {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	out := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, padded)
+	return out
+}
+
+func newTestDownloader(t *testing.T) *Downloader {
+	t.Helper()
+
+	cfg := &m3u8.DownloadConfig{
+		Timeout:   10,
+		Retries:   1,
+		UserAgent: "test-agent",
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return NewDownloader(NewHTTPClient(cfg), logger)
+}
+
+func TestDownloadSegmentsKeyRotation(t *testing.T) {
+	key1 := []byte("0123456789abcdef")
+	key2 := []byte("fedcba9876543210")
+	iv := bytes.Repeat([]byte{0x01}, 16)
+
+	segments := map[string][]byte{
+		"/seg1.ts": encryptSegment(t, key1, iv, []byte("\x47segment-one")),
+		"/seg2.ts": encryptSegment(t, key2, iv, []byte("\x47segment-two")),
+		"/seg3.ts": encryptSegment(t, key2, iv, []byte("\x47segment-three")),
+		"/seg4.ts": []byte("\x47segment-four"),
+	}
+
+	var keyRequests atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/key1.key":
+			keyRequests.Add(1)
+			w.Write(key1)
+		case r.URL.Path == "/key2.key":
+			keyRequests.Add(1)
+			w.Write(key2)
+		case strings.HasSuffix(r.URL.Path, ".ts"):
+			w.Write(segments[r.URL.Path])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	k1 := &m3u8.Key{Method: "AES-128", URI: ts.URL + "/key1.key", IV: iv}
+	k2 := &m3u8.Key{Method: "AES-128", URI: ts.URL + "/key2.key", IV: iv}
+	playlist := &m3u8.Playlist{
+		IsEncrypted: true,
+		Segments: []*m3u8.TSInfo{
+			{Name: "000001.ts", Url: ts.URL + "/seg1.ts", Key: k1},
+			{Name: "000002.ts", Url: ts.URL + "/seg2.ts", Key: k2},
+			{Name: "000003.ts", Url: ts.URL + "/seg3.ts", Key: k2},
+			{Name: "000004.ts", Url: ts.URL + "/seg4.ts"},
+		},
+	}
+
+	cacheDir := t.TempDir()
+	dl := newTestDownloader(t)
+
+	stats, err := dl.DownloadSegments(context.Background(), playlist, cacheDir, 4)
+	if err != nil {
+		t.Fatalf("DownloadSegments failed: %v", err)
+	}
+	if stats.Completed != 4 {
+		t.Fatalf("got %d completed, want 4", stats.Completed)
+	}
+
+	if got := keyRequests.Load(); got != 2 {
+		t.Errorf("got %d key requests, want 2", got)
+	}
+
+	want := map[string]string{
+		"000001.ts": "\x47segment-one",
+		"000002.ts": "\x47segment-two",
+		"000003.ts": "\x47segment-three",
+		"000004.ts": "\x47segment-four",
+	}
+	for name, content := range want {
+		data, err := os.ReadFile(filepath.Join(cacheDir, name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", name, data, content)
+		}
+	}
+}
+
+func TestDownloadSegmentsKeyFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".key") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write(make([]byte, 16))
+	}))
+	defer ts.Close()
+
+	key := &m3u8.Key{Method: "AES-128", URI: ts.URL + "/key.key"}
+	playlist := &m3u8.Playlist{
+		IsEncrypted: true,
+		Segments: []*m3u8.TSInfo{
+			{Name: "000001.ts", Url: ts.URL + "/seg1.ts", Key: key},
+		},
+	}
+
+	dl := newTestDownloader(t)
+
+	stats, err := dl.DownloadSegments(context.Background(), playlist, t.TempDir(), 1)
+	if err == nil {
+		t.Fatal("expected key download error")
+	}
+	if stats.Failed != 1 {
+		t.Errorf("got %d failed, want 1", stats.Failed)
+	}
+}
+
+func TestDownloadSegmentsSequenceIV(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	explicitIV := bytes.Repeat([]byte{0xaa}, 16)
+	seqIV := make([]byte, 16)
+	seqIV[15] = 42
+
+	segments := map[string][]byte{
+		"/explicit.ts": encryptSegment(t, key, explicitIV, []byte("\x47explicit")),
+		"/derived.ts":  encryptSegment(t, key, seqIV, []byte("\x47derived")),
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/key.key" {
+			w.Write(key)
+			return
+		}
+		w.Write(segments[r.URL.Path])
+	}))
+	defer ts.Close()
+
+	playlist := &m3u8.Playlist{
+		IsEncrypted: true,
+		Segments: []*m3u8.TSInfo{
+			{Name: "000001.ts", Url: ts.URL + "/explicit.ts", Sequence: 41, Key: &m3u8.Key{Method: "AES-128", URI: ts.URL + "/key.key", IV: explicitIV}},
+			{Name: "000002.ts", Url: ts.URL + "/derived.ts", Sequence: 42, Key: &m3u8.Key{Method: "AES-128", URI: ts.URL + "/key.key"}},
+		},
+	}
+
+	cacheDir := t.TempDir()
+	if _, err := newTestDownloader(t).DownloadSegments(context.Background(), playlist, cacheDir, 2); err != nil {
+		t.Fatalf("DownloadSegments failed: %v", err)
+	}
+
+	for name, want := range map[string]string{"000001.ts": "\x47explicit", "000002.ts": "\x47derived"} {
+		data, err := os.ReadFile(filepath.Join(cacheDir, name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		if string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+}
+
+func TestDownloadSegmentsResume(t *testing.T) {
+	var requests atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("\x47" + r.URL.Path))
+	}))
+	defer ts.Close()
+
+	playlist := &m3u8.Playlist{
+		Segments: []*m3u8.TSInfo{
+			{Name: "000001.ts", Url: ts.URL + "/seg1.ts"},
+			{Name: "000002.ts", Url: ts.URL + "/seg2.ts"},
+			{Name: "000003.ts", Url: ts.URL + "/seg3.ts"},
+		},
+	}
+
+	cacheDir := t.TempDir()
+	mf := manifest.New(cacheDir, ts.URL+"/video.m3u8", playlist)
+
+	done := []byte("\x47/seg1.ts")
+	os.WriteFile(filepath.Join(cacheDir, "000001.ts"), done, 0644)
+	mf.MarkCompleted(0, int64(len(done)), manifest.Checksum(done))
+
+	corrupt := []byte("\x47/seg2.ts")
+	os.WriteFile(filepath.Join(cacheDir, "000002.ts"), corrupt[:3], 0644)
+	mf.MarkCompleted(1, int64(len(corrupt)), manifest.Checksum(corrupt))
+
+	dl := newTestDownloader(t)
+	dl.SetManifest(mf)
+
+	stats, err := dl.DownloadSegments(context.Background(), playlist, cacheDir, 2)
+	if err != nil {
+		t.Fatalf("DownloadSegments failed: %v", err)
+	}
+
+	if stats.Skipped != 1 || stats.Completed != 3 {
+		t.Errorf("got skipped=%d completed=%d, want 1 and 3", stats.Skipped, stats.Completed)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("got %d requests, want 2", got)
+	}
+
+	loaded, err := manifest.Load(cacheDir)
+	if err != nil {
+		t.Fatalf("failed to load manifest: %v", err)
+	}
+	for i := range playlist.Segments {
+		if !loaded.Verify(cacheDir, i) {
+			t.Errorf("segment %d does not verify after resume", i)
+		}
+	}
+}
+
+func TestDownloadSegmentsCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/seg1.ts") {
+			w.Write([]byte("\x47done"))
+			return
+		}
+		cancel()
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	playlist := &m3u8.Playlist{}
+	for i := 1; i <= 5; i++ {
+		playlist.Segments = append(playlist.Segments, &m3u8.TSInfo{
+			Name: fmt.Sprintf("%06d.ts", i),
+			Url:  fmt.Sprintf("%s/seg%d.ts", ts.URL, i),
+		})
+	}
+
+	cacheDir := t.TempDir()
+	mf := manifest.New(cacheDir, ts.URL+"/video.m3u8", playlist)
+
+	dl := newTestDownloader(t)
+	dl.SetManifest(mf)
+
+	_, err := dl.DownloadSegments(ctx, playlist, cacheDir, 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+
+	loaded, err := manifest.Load(cacheDir)
+	if err != nil {
+		t.Fatalf("failed to load manifest: %v", err)
+	}
+
+	if loaded.Segments[0].Status != manifest.StatusCompleted {
+		t.Errorf("segment 0 status = %q, want completed", loaded.Segments[0].Status)
+	}
+	for i, seg := range loaded.Segments[1:] {
+		if seg.Status != manifest.StatusPending {
+			t.Errorf("segment %d status = %q, want pending", i+1, seg.Status)
+		}
+	}
+
+	entries, _ := os.ReadDir(cacheDir)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), partSuffix) {
+			t.Errorf("partial file %s left behind", entry.Name())
+		}
+	}
+}
+
+func TestDownloadSegmentsFailurePolicy(t *testing.T) {
+	var flakyAttempts, blankAttempts atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky.ts":
+			if flakyAttempts.Add(1) == 1 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		case "/blank.ts":
+			if blankAttempts.Add(1) == 1 {
+				return
+			}
+		case "/missing.ts":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case "/empty.ts":
+			return
+		}
+		w.Write([]byte("\x47ok"))
+	}))
+	defer ts.Close()
+
+	newPlaylist := func(paths ...string) *m3u8.Playlist {
+		p := &m3u8.Playlist{}
+		for i, path := range paths {
+			p.Segments = append(p.Segments, &m3u8.TSInfo{Name: fmt.Sprintf("%06d.ts", i+1), Url: ts.URL + path})
+		}
+		return p
+	}
+
+	tests := []struct {
+		name           string
+		policy         FailurePolicy
+		paths          []string
+		wantFailed     []int
+		wantIncomplete bool
+	}{
+		{
+			name:       "retry pass recovers flaky segment",
+			policy:     FailurePolicy{RetryPasses: 1},
+			paths:      []string{"/ok.ts", "/flaky.ts"},
+			wantFailed: nil,
+		},
+		{
+			name:           "no retry pass leaves flaky segment missing",
+			policy:         FailurePolicy{RetryPasses: 0},
+			paths:          []string{"/ok.ts", "/flaky.ts"},
+			wantFailed:     []int{1},
+			wantIncomplete: true,
+		},
+		{
+			name:           "missing segments over threshold",
+			policy:         FailurePolicy{RetryPasses: 1, MaxFailed: 1},
+			paths:          []string{"/missing.ts", "/ok.ts", "/missing.ts"},
+			wantFailed:     []int{0, 2},
+			wantIncomplete: true,
+		},
+		{
+			name:       "missing segments within threshold",
+			policy:     FailurePolicy{RetryPasses: 1, MaxFailed: 2},
+			paths:      []string{"/missing.ts", "/ok.ts", "/missing.ts"},
+			wantFailed: []int{0, 2},
+		},
+		{
+			name:       "retry pass recovers empty segment",
+			policy:     FailurePolicy{RetryPasses: 1},
+			paths:      []string{"/ok.ts", "/blank.ts"},
+			wantFailed: nil,
+		},
+		{
+			name:           "empty segment counts as failed",
+			policy:         FailurePolicy{RetryPasses: 1},
+			paths:          []string{"/ok.ts", "/empty.ts", "/ok.ts"},
+			wantFailed:     []int{1},
+			wantIncomplete: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flakyAttempts.Store(0)
+			blankAttempts.Store(0)
+
+			dl := newTestDownloader(t)
+			dl.SetFailurePolicy(tt.policy)
+
+			stats, err := dl.DownloadSegments(context.Background(), newPlaylist(tt.paths...), t.TempDir(), 2)
+
+			var incomplete *m3u8.IncompleteDownloadError
+			if tt.wantIncomplete {
+				if !errors.As(err, &incomplete) {
+					t.Fatalf("got error %v, want *IncompleteDownloadError", err)
+				}
+				if fmt.Sprint(incomplete.Missing) != fmt.Sprint(tt.wantFailed) {
+					t.Errorf("got missing %v, want %v", incomplete.Missing, tt.wantFailed)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if stats.Failed != len(tt.wantFailed) {
+				t.Errorf("got %d failed, want %d", stats.Failed, len(tt.wantFailed))
+			}
+			if fmt.Sprint(stats.FailedSegments) != fmt.Sprint(tt.wantFailed) {
+				t.Errorf("got failed segments %v, want %v", stats.FailedSegments, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestDownloadSegmentsAdaptive(t *testing.T) {
+	var mu sync.Mutex
+	var arrivals []time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrivals = append(arrivals, time.Now())
+		first := len(arrivals) == 1
+		mu.Unlock()
+
+		if first {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("\x47ok"))
+	}))
+	defer ts.Close()
+
+	playlist := &m3u8.Playlist{}
+	for i := 0; i < 3; i++ {
+		playlist.Segments = append(playlist.Segments, &m3u8.TSInfo{Name: fmt.Sprintf("%06d.ts", i+1), Url: fmt.Sprintf("%s/%d.ts", ts.URL, i)})
+	}
+
+	cfg := &m3u8.DownloadConfig{Timeout: 10, Retries: 0, UserAgent: "test-agent"}
+	dl := NewDownloader(NewHTTPClient(cfg), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	dl.HideProgress()
+	dl.SetAdaptive(true)
+	dl.SetFailurePolicy(FailurePolicy{RetryPasses: 1})
+
+	stats, err := dl.DownloadSegments(context.Background(), playlist, t.TempDir(), 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Completed != 3 {
+		t.Errorf("got %d completed, want 3", stats.Completed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(arrivals) != 4 {
+		t.Fatalf("got %d requests, want 4", len(arrivals))
+	}
+	if gap := arrivals[1].Sub(arrivals[0]); gap < 900*time.Millisecond {
+		t.Errorf("next segment requested %v after the 429, want the 1s Retry-After honored", gap)
+	}
+}
+
+func TestDownloadSegmentsSharedWorkerPool(t *testing.T) {
+	var active, peak atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("\x47ok"))
+	}))
+	defer ts.Close()
+
+	const workers = 2
+	pool := NewWorkerPool(workers, false, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for d := range errs {
+		playlist := &m3u8.Playlist{}
+		for i := 0; i < 4; i++ {
+			playlist.Segments = append(playlist.Segments, &m3u8.TSInfo{Name: fmt.Sprintf("%06d.ts", i+1), Url: fmt.Sprintf("%s/%d/%d.ts", ts.URL, d, i)})
+		}
+		dl := newTestDownloader(t)
+		dl.HideProgress()
+		dl.SetWorkerPool(pool)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[d] = dl.DownloadSegments(context.Background(), playlist, t.TempDir(), workers)
+		}()
+	}
+	wg.Wait()
+
+	for d, err := range errs {
+		if err != nil {
+			t.Errorf("download %d: unexpected error: %v", d, err)
+		}
+	}
+	if got := peak.Load(); got > workers {
+		t.Errorf("got %d concurrent requests, want at most %d", got, workers)
+	}
+}
+
+func TestDownloadSegmentsFragmentedMP4(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := bytes.Repeat([]byte{0x02}, 16)
+
+	// The fragments deliberately contain 0x47 bytes after the box header, which
+	// TS sync byte trimming would cut at.
+	init1 := []byte("\x00\x00\x00\x08ftyp-init-one")
+	init2 := []byte("\x00\x00\x00\x08ftyp-init-two")
+	segments := map[string][]byte{
+		"/seg1.m4s": []byte("\x00\x00\x00\x10moof\x47one"),
+		"/seg2.m4s": []byte("\x00\x00\x00\x10moof\x47two"),
+		"/seg3.m4s": []byte("\x00\x00\x00\x10moof\x47three"),
+	}
+
+	var initRequests atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/init1.mp4":
+			initRequests.Add(1)
+			http.ServeContent(w, r, "init1.mp4", time.Time{}, bytes.NewReader(append([]byte("padding-"), init1...)))
+		case r.URL.Path == "/init2.mp4":
+			initRequests.Add(1)
+			w.Write(encryptSegment(t, key, iv, init2))
+		case r.URL.Path == "/key.key":
+			w.Write(key)
+		case strings.HasSuffix(r.URL.Path, ".m4s"):
+			w.Write(segments[r.URL.Path])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	map1 := &m3u8.Map{URI: ts.URL + "/init1.mp4", ByteRange: &m3u8.ByteRange{Length: int64(len(init1)), Offset: 8}}
+	map2 := &m3u8.Map{URI: ts.URL + "/init2.mp4", Key: &m3u8.Key{Method: "AES-128", URI: ts.URL + "/key.key", IV: iv}}
+	playlist := &m3u8.Playlist{
+		Segments: []*m3u8.TSInfo{
+			{Name: "000001.m4s", Url: ts.URL + "/seg1.m4s", Map: map1},
+			{Name: "000002.m4s", Url: ts.URL + "/seg2.m4s", Map: map1},
+			{Name: "000003.m4s", Url: ts.URL + "/seg3.m4s", Map: map2},
+		},
+	}
+
+	cacheDir := t.TempDir()
+	dl := newTestDownloader(t)
+
+	if _, err := dl.DownloadSegments(context.Background(), playlist, cacheDir, 3); err != nil {
+		t.Fatalf("DownloadSegments failed: %v", err)
+	}
+
+	if got := initRequests.Load(); got != 2 {
+		t.Errorf("got %d initialization section requests, want 2", got)
+	}
+
+	want := map[string][]byte{
+		"000001.m4s": append(append([]byte{}, init1...), segments["/seg1.m4s"]...),
+		"000002.m4s": segments["/seg2.m4s"],
+		"000003.m4s": append(append([]byte{}, init2...), segments["/seg3.m4s"]...),
+	}
+	for name, content := range want {
+		data, err := os.ReadFile(filepath.Join(cacheDir, name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Errorf("%s = %q, want %q", name, data, content)
+		}
+	}
+}
+
+func TestDownloadSegmentsFragmentedMP4SampleAES(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer ts.Close()
+
+	playlist := &m3u8.Playlist{
+		IsEncrypted: true,
+		Segments: []*m3u8.TSInfo{{
+			Name: "000001.m4s",
+			Url:  ts.URL + "/seg1.m4s",
+			Map:  &m3u8.Map{URI: ts.URL + "/init.mp4"},
+			Key:  &m3u8.Key{Method: "SAMPLE-AES", URI: ts.URL + "/key.key"},
+		}},
+	}
+
+	_, err := newTestDownloader(t).DownloadSegments(context.Background(), playlist, t.TempDir(), 1)
+	var unsupported *m3u8.UnsupportedMethodError
+	if !errors.As(err, &unsupported) {
+		t.Fatalf("got error %v, want UnsupportedMethodError", err)
+	}
+}
+
+func TestDownloadSegmentsEncryptedMapWithoutIV(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789abcdef"))
+	}))
+	defer ts.Close()
+
+	playlist := &m3u8.Playlist{
+		Segments: []*m3u8.TSInfo{{
+			Name: "000001.m4s",
+			Url:  ts.URL + "/seg1.m4s",
+			Map:  &m3u8.Map{URI: ts.URL + "/init.mp4", Key: &m3u8.Key{Method: "AES-128", URI: ts.URL + "/key.key"}},
+		}},
+	}
+
+	_, err := newTestDownloader(t).DownloadSegments(context.Background(), playlist, t.TempDir(), 1)
+	if !errors.Is(err, m3u8.ErrInvalidIV) {
+		t.Fatalf("got error %v, want %v", err, m3u8.ErrInvalidIV)
+	}
+}
+
+func TestInitRunStarts(t *testing.T) {
+	a := &m3u8.Map{URI: "init.mp4", ByteRange: &m3u8.ByteRange{Length: 10}}
+	aCopy := &m3u8.Map{URI: "init.mp4", ByteRange: &m3u8.ByteRange{Length: 10}}
+	b := &m3u8.Map{URI: "init.mp4", ByteRange: &m3u8.ByteRange{Length: 10, Offset: 10}}
+
+	tests := []struct {
+		name string
+		maps []*m3u8.Map
+		prev *m3u8.Map
+		want []int
+	}{
+		{"no maps", []*m3u8.Map{nil, nil}, nil, nil},
+		{"single run", []*m3u8.Map{a, aCopy, a}, nil, []int{0}},
+		{"byte range change", []*m3u8.Map{a, b, b, a}, nil, []int{0, 1, 3}},
+		{"continues previous batch", []*m3u8.Map{aCopy, b}, a, []int{1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segs := make([]*m3u8.TSInfo, len(tt.maps))
+			for i, m := range tt.maps {
+				segs[i] = &m3u8.TSInfo{Map: m}
+			}
+
+			starts := initRunStarts(segs, tt.prev)
+			var got []int
+			for i := range segs {
+				if starts[i] {
+					got = append(got, i)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsRawSegment(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want bool
+	}{
+		{"webvtt", "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nGood\n", true},
+		{"webvtt with bom", "\xef\xbb\xbfWEBVTT\n", true},
+		{"id3 tagged audio", "ID3\x04\x00\x00\x00\x00\x00\x3fG", true},
+		{"adts", "\xff\xf1\x50\x80G", true},
+		{"ac-3", "\x0b\x77G", true},
+		{"ts", "\x47\x40\x00\x10", false},
+		{"ts behind a fake header", "\x89PNG\r\n\x1a\n\x47\x40", false},
+		{"empty", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRawSegment([]byte(tt.data)); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSegmentExt(t *testing.T) {
+	id3 := "ID3\x04\x00\x00\x00\x00\x00\x3f" + strings.Repeat("\x00", 0x3f)
+
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"webvtt", "WEBVTT\n", ".vtt"},
+		{"adts", "\xff\xf1\x50\x80", ".aac"},
+		{"id3 and adts", id3 + "\xff\xf1\x50\x80", ".aac"},
+		{"id3 and mp3", id3 + "\xff\xfb\x90\x00", ".mp3"},
+		{"id3 and ac-3", id3 + "\x0b\x77\x00\x00\x00\x40", ".ac3"},
+		{"id3 and e-ac-3", id3 + "\x0b\x77\x00\x00\x00\x80", ".ec3"},
+		{"truncated id3", "ID3\x04\x00\x00\x00\x00\x7f\x7f", ".aac"},
+		{"ts", "\x47\x40\x00\x10", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SegmentExt([]byte(tt.data)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadSegmentsByteRange(t *testing.T) {
+	file := []byte("\x47one\x47two\x47three\x47four")
+
+	var mu sync.Mutex
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "main.ts", time.Time{}, bytes.NewReader(file))
+	}))
+	defer ts.Close()
+
+	segment := func(name string, length, offset int64) *m3u8.TSInfo {
+		return &m3u8.TSInfo{Name: name, Url: ts.URL + "/main.ts", ByteRange: &m3u8.ByteRange{Length: length, Offset: offset}}
+	}
+	playlist := &m3u8.Playlist{
+		Segments: []*m3u8.TSInfo{
+			segment("000001.ts", 4, 0),
+			segment("000002.ts", 4, 4),
+			segment("000003.ts", 6, 8),
+			// Starts over at offset 0, so it cannot join the span before it.
+			segment("000004.ts", 4, 0),
+		},
+	}
+
+	cacheDir := t.TempDir()
+	if _, err := newTestDownloader(t).DownloadSegments(context.Background(), playlist, cacheDir, 4); err != nil {
+		t.Fatalf("DownloadSegments failed: %v", err)
+	}
+
+	sort.Strings(ranges)
+	if want := []string{"bytes=0-13", "bytes=0-3"}; fmt.Sprint(ranges) != fmt.Sprint(want) {
+		t.Errorf("got ranges %q, want %q", ranges, want)
+	}
+
+	want := map[string]string{
+		"000001.ts": "\x47one",
+		"000002.ts": "\x47two",
+		"000003.ts": "\x47three",
+		"000004.ts": "\x47one",
+	}
+	for name, content := range want {
+		data, err := os.ReadFile(filepath.Join(cacheDir, name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", name, data, content)
+		}
+	}
+}
+
+func TestRangeCachePlan(t *testing.T) {
+	seg := func(url string, length, offset int64) *m3u8.TSInfo {
+		return &m3u8.TSInfo{Url: url, ByteRange: &m3u8.ByteRange{Length: length, Offset: offset}}
+	}
+
+	tests := []struct {
+		name    string
+		segs    []*m3u8.TSInfo
+		indices []int
+		want    []string
+	}{
+		{
+			name:    "adjacent ranges coalesce",
+			segs:    []*m3u8.TSInfo{seg("a", 10, 0), seg("a", 10, 10), seg("a", 5, 20)},
+			indices: []int{0, 1, 2},
+			want:    []string{"a 25@0", "a 25@0", "a 25@0"},
+		},
+		{
+			name:    "gap, other resource and whole segment split spans",
+			segs:    []*m3u8.TSInfo{seg("a", 10, 0), seg("a", 10, 20), seg("b", 10, 30), {Url: "c"}, seg("b", 10, 40)},
+			indices: []int{0, 1, 2, 3, 4},
+			want:    []string{"a 10@0", "a 10@20", "b 10@30", "", "b 10@40"},
+		},
+		{
+			name:    "skipped index splits spans",
+			segs:    []*m3u8.TSInfo{seg("a", 10, 0), seg("a", 10, 10), seg("a", 10, 20)},
+			indices: []int{0, 2},
+			want:    []string{"a 10@0", "", "a 10@20"},
+		},
+		{
+			name:    "spans are capped",
+			segs:    []*m3u8.TSInfo{seg("a", maxCoalescedRange-1, 0), seg("a", 2, maxCoalescedRange-1)},
+			indices: []int{0, 1},
+			want:    []string{fmt.Sprintf("a %d@0", maxCoalescedRange-1), fmt.Sprintf("a 2@%d", maxCoalescedRange-1)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newRangeCache(nil)
+			c.plan(tt.segs, tt.indices)
+
+			got := make([]string, len(tt.segs))
+			for i := range tt.segs {
+				if span := c.spans[i]; span != nil {
+					got[i] = fmt.Sprintf("%s %d@%d", span.url, span.br.Length, span.br.Offset)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeFiles(t *testing.T) {
+	// Seven-digit names sort before six-digit ones; the playlist decides.
+	playlist := &m3u8.Playlist{
+		Segments: []*m3u8.TSInfo{
+			{Name: "999999.ts"},
+			{Name: "1000000.ts"},
+			{Name: "1000001.ts"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		missing []int
+		want    string
+		wantErr *m3u8.MergeError
+	}{
+		{
+			name:  "playlist order",
+			files: map[string]string{"999999.ts": "a", "1000000.ts": "b", "1000001.ts": "c", manifest.FileName: "{}"},
+			want:  "abc",
+		},
+		{
+			name:    "known missing segment left out",
+			files:   map[string]string{"999999.ts": "a", "1000001.ts": "c"},
+			missing: []int{1},
+			want:    "ac",
+		},
+		{
+			name:    "missing, empty and extra files",
+			files:   map[string]string{"999999.ts": "", "1000001.ts": "c", "stray.ts": "x"},
+			wantErr: &m3u8.MergeError{Missing: []string{"1000000.ts"}, Empty: []string{"999999.ts"}, Extra: []string{"stray.ts"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir := t.TempDir()
+			for name, data := range tt.files {
+				os.WriteFile(filepath.Join(cacheDir, name), []byte(data), 0644)
+			}
+			output := filepath.Join(t.TempDir(), "out.ts")
+
+			err := newTestDownloader(t).MergeFiles(context.Background(), playlist, cacheDir, output, tt.missing)
+			if tt.wantErr != nil {
+				var mergeErr *m3u8.MergeError
+				if !errors.As(err, &mergeErr) {
+					t.Fatalf("got error %v, want *MergeError", err)
+				}
+				if fmt.Sprint(*mergeErr) != fmt.Sprint(*tt.wantErr) {
+					t.Errorf("got %+v, want %+v", *mergeErr, *tt.wantErr)
+				}
+				if !errors.Is(err, m3u8.ErrMergeFailed) {
+					t.Error("MergeError does not wrap ErrMergeFailed")
+				}
+				if _, err := os.Stat(output); !os.IsNotExist(err) {
+					t.Error("output written despite the mismatch")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles failed: %v", err)
+			}
+
+			data, _ := os.ReadFile(output)
+			if string(data) != tt.want {
+				t.Errorf("got output %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
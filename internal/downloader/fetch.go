@@ -0,0 +1,146 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"m3u8-download/internal/manifest"
+	"m3u8-download/pkg/m3u8"
+)
+
+// SegmentFetcher fetches single segments of a playlist on demand, for a
+// player rather than a download pass. Each segment, initialization section
+// and key is kept in the cache directory, and segments are recorded in the
+// manifest, so that later requests and later runs are served from disk.
+type SegmentFetcher struct {
+	d        *Downloader
+	playlist *m3u8.Playlist
+	cacheDir string
+	raw      bool
+	res      *jobResources
+	// locks keeps concurrent requests for the same file from fetching it
+	// twice.
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// NewSegmentFetcher returns a fetcher for the segments of playlist. With
+// raw, segments, initialization sections and keys are returned as the
+// server sends them; otherwise segments and initialization sections are
+// decrypted like DownloadSegments does and keys are not needed.
+func (d *Downloader) NewSegmentFetcher(playlist *m3u8.Playlist, cacheDir string, raw bool) *SegmentFetcher {
+	return &SegmentFetcher{
+		d:        d,
+		playlist: playlist,
+		cacheDir: cacheDir,
+		raw:      raw,
+		res:      newJobResources(d.httpClient),
+		locks:    make(map[string]*sync.Mutex),
+	}
+}
+
+// Segment returns the data of the segment at idx.
+func (f *SegmentFetcher) Segment(ctx context.Context, idx int) ([]byte, error) {
+	seg := f.playlist.Segments[idx]
+	unlock := f.lock(seg.Name)
+	defer unlock()
+
+	filePath := fmt.Sprintf("%s/%s", f.cacheDir, seg.Name)
+	if f.d.manifest != nil && f.d.manifest.Verify(f.cacheDir, idx) {
+		return os.ReadFile(filePath)
+	}
+
+	f.d.recordProgress(func(m *manifest.Manifest) error { return m.MarkDownloading(idx) })
+	data, err := f.fetchSegment(ctx, idx, seg)
+	if err == nil {
+		err = writeSegmentFile(filePath, data)
+	}
+	if err != nil {
+		f.res.forgetFailures()
+		if ctx.Err() != nil {
+			f.d.recordProgress(func(m *manifest.Manifest) error { return m.MarkPending(idx) })
+		} else {
+			f.d.recordProgress(func(m *manifest.Manifest) error { return m.MarkFailed(idx) })
+		}
+		return nil, err
+	}
+
+	sum := manifest.Checksum(data)
+	f.d.recordProgress(func(m *manifest.Manifest) error { return m.MarkCompleted(idx, int64(len(data)), sum) })
+	return data, nil
+}
+
+func (f *SegmentFetcher) fetchSegment(ctx context.Context, idx int, seg *m3u8.TSInfo) ([]byte, error) {
+	if !f.raw {
+		return f.d.downloadSegment(ctx, idx, seg, f.res)
+	}
+	if seg.ByteRange != nil {
+		return f.d.httpClient.GetRange(ctx, seg.Url, *seg.ByteRange)
+	}
+	return f.d.httpClient.Get(ctx, seg.Url)
+}
+
+// Init returns the initialization section m of one of the segments.
+func (f *SegmentFetcher) Init(ctx context.Context, m *m3u8.Map) ([]byte, error) {
+	id := m.URI
+	if m.ByteRange != nil {
+		id = fmt.Sprintf("%s#%d@%d", m.URI, m.ByteRange.Length, m.ByteRange.Offset)
+	}
+	return f.cached(resourceFile("init-", id), func() ([]byte, error) {
+		if f.raw {
+			return f.res.inits.getRange(ctx, m.URI, m.ByteRange)
+		}
+		return f.d.initSection(ctx, m, f.res)
+	})
+}
+
+// Key returns the key at uri, as the server sends it.
+func (f *SegmentFetcher) Key(ctx context.Context, uri string) ([]byte, error) {
+	return f.cached(resourceFile("key-", uri), func() ([]byte, error) {
+		return f.res.keys.get(ctx, uri)
+	})
+}
+
+// cached returns the file name in the cache directory, fetching and writing
+// it first if it does not exist yet.
+func (f *SegmentFetcher) cached(name string, fetch func() ([]byte, error)) ([]byte, error) {
+	unlock := f.lock(name)
+	defer unlock()
+
+	filePath := fmt.Sprintf("%s/%s", f.cacheDir, name)
+	data, err := os.ReadFile(filePath)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return data, err
+	}
+
+	data, err = fetch()
+	if err != nil {
+		f.res.forgetFailures()
+		return nil, err
+	}
+	if err := writeSegmentFile(filePath, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// resourceFile names the cache file of the resource identified by id.
+func resourceFile(prefix, id string) string {
+	return prefix + manifest.Checksum([]byte(id))[:16]
+}
+
+func (f *SegmentFetcher) lock(name string) func() {
+	f.mu.Lock()
+	l, ok := f.locks[name]
+	if !ok {
+		l = &sync.Mutex{}
+		f.locks[name] = l
+	}
+	f.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
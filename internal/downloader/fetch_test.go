@@ -0,0 +1,95 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"m3u8-download/internal/manifest"
+	"m3u8-download/pkg/m3u8"
+)
+
+func TestSegmentFetcher(t *testing.T) {
+	key := bytes.Repeat([]byte{0x11}, 16)
+	iv := bytes.Repeat([]byte{0x22}, 16)
+	plain := []byte{0x47, 0x40, 0x00, 0x10}
+	encrypted := encryptSegment(t, key, iv, plain)
+
+	var requests atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/key.bin"):
+			w.Write(key)
+		case strings.HasSuffix(r.URL.Path, "/seg1.ts"):
+			w.Write(encrypted)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	segKey := &m3u8.Key{Method: m3u8.MethodAES128, URI: ts.URL + "/key.bin", IV: iv}
+	playlist := &m3u8.Playlist{Segments: []*m3u8.TSInfo{
+		{Name: "000001.ts", Url: ts.URL + "/seg1.ts", Key: segKey},
+		{Name: "000002.ts", Url: ts.URL + "/missing.ts"},
+	}}
+
+	tests := []struct {
+		name string
+		raw  bool
+		want []byte
+	}{
+		{name: "decrypted", want: plain},
+		{name: "raw", raw: true, want: encrypted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir := t.TempDir()
+			mf := manifest.New(cacheDir, ts.URL+"/video.m3u8", playlist)
+			dl := newTestDownloader(t)
+			dl.SetManifest(mf)
+			f := dl.NewSegmentFetcher(playlist, cacheDir, tt.raw)
+
+			for i := 0; i < 2; i++ {
+				data, err := f.Segment(context.Background(), 0)
+				if err != nil {
+					t.Fatalf("Segment failed: %v", err)
+				}
+				if !bytes.Equal(data, tt.want) {
+					t.Errorf("got segment %x, want %x", data, tt.want)
+				}
+			}
+			if tt.raw {
+				got, err := f.Key(context.Background(), segKey.URI)
+				if err != nil || !bytes.Equal(got, key) {
+					t.Errorf("got key %x, %v, want %x", got, err, key)
+				}
+			}
+			if _, err := f.Segment(context.Background(), 1); err == nil {
+				t.Error("expected error for a missing segment but got none")
+			}
+
+			// Everything fetched so far is served from the cache, even
+			// without the origin.
+			requests.Store(0)
+			f = dl.NewSegmentFetcher(playlist, cacheDir, tt.raw)
+			if data, err := f.Segment(context.Background(), 0); err != nil || !bytes.Equal(data, tt.want) {
+				t.Errorf("got cached segment %x, %v, want %x", data, err, tt.want)
+			}
+			if tt.raw {
+				if got, err := f.Key(context.Background(), segKey.URI); err != nil || !bytes.Equal(got, key) {
+					t.Errorf("got cached key %x, %v, want %x", got, err, key)
+				}
+			}
+			if got := requests.Load(); got != 0 {
+				t.Errorf("got %d requests for cached data, want 0", got)
+			}
+		})
+	}
+}
@@ -1,8 +1,14 @@
 package downloader
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"m3u8-download/pkg/m3u8"
@@ -11,84 +17,298 @@ import (
 type HTTPClient struct {
 	client    *http.Client
 	timeout   time.Duration
-	retries   int
-	retryWait time.Duration
+	policy    RetryPolicy
+	budget    *RetryBudget
 	userAgent string
 	origin    string
 	referer   string
+	headers   map[string]string
+	cookie    string
+	limiter   *RateLimiter
 }
 
 func NewHTTPClient(cfg *m3u8.DownloadConfig) *HTTPClient {
 	client := &HTTPClient{
 		timeout:   time.Duration(cfg.Timeout) * time.Second,
-		retries:   cfg.Retries,
-		retryWait: 3 * time.Second,
+		policy:    DefaultRetryPolicy(cfg.Retries),
+		budget:    NewRetryBudget(cfg.RetryBudget),
 		userAgent: cfg.UserAgent,
 		origin:    cfg.Origin,
 		referer:   cfg.Referer,
+		headers:   cfg.CustomHeader,
+		cookie:    cfg.Cookie,
 	}
 
+	// -limit-rate is validated by config; an unset limit still gets a
+	// limiter so it can be set while downloading.
+	rate, _ := ParseRate(cfg.LimitRate)
+	client.limiter = NewRateLimiter(rate)
+
+	// The timeout covers connecting and waiting for the response headers;
+	// the body only has to keep arriving, see idleTimeoutReader, so that a
+	// large segment read slowly under -limit-rate does not time out.
 	client.client = &http.Client{
-		Timeout: client.timeout,
 		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 100,
-			IdleConnTimeout:     90 * time.Second,
+			Proxy:                 proxyFunc(cfg.ProxyURL),
+			DialContext:           (&net.Dialer{Timeout: client.timeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   client.timeout,
+			ResponseHeaderTimeout: client.timeout,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   100,
+			IdleConnTimeout:       90 * time.Second,
 		},
 	}
 
 	return client
 }
 
-func (c *HTTPClient) Get(url string) ([]byte, error) {
-	var body []byte
-	var err error
+// RateLimiter returns the limiter shared by every request of c and of the
+// clients derived from it with WithHeaders.
+func (c *HTTPClient) RateLimiter() *RateLimiter {
+	return c.limiter
+}
 
-	for attempt := 0; attempt <= c.retries; attempt++ {
-		if attempt > 0 {
-			waitTime := time.Duration(1<<uint(attempt-1)) * c.retryWait
-			if waitTime > 30*time.Second {
-				waitTime = 30 * time.Second
+// SetCookieJar makes every request send the jar's cookies for its URL, in
+// addition to any -cookie value, and store cookies set by responses.
+func (c *HTTPClient) SetCookieJar(jar http.CookieJar) {
+	c.client.Jar = jar
+}
+
+// WithHeaders returns a client that sends headers on top of c's own custom
+// headers. It shares c's connection pool and cookie jar.
+func (c *HTTPClient) WithHeaders(headers map[string]string) *HTTPClient {
+	merged := make(map[string]string, len(c.headers)+len(headers))
+	for key, value := range c.headers {
+		merged[key] = value
+	}
+	for key, value := range headers {
+		for existing := range merged {
+			if strings.EqualFold(existing, key) {
+				delete(merged, existing)
 			}
-			time.Sleep(waitTime)
 		}
+		merged[key] = value
+	}
 
-		body, err = c.doGet(url)
-		if err == nil {
-			return body, nil
-		}
+	clone := *c
+	clone.headers = merged
+	return &clone
+}
 
-		if httpErr, ok := err.(*m3u8.HTTPError); ok {
-			if httpErr.StatusCode >= 400 && httpErr.StatusCode < 500 {
-				return nil, err
-			}
-		}
+// WithRetryBudget returns a client sharing c's connection pool whose
+// requests share a new budget of n retries; n <= 0 means unlimited.
+func (c *HTTPClient) WithRetryBudget(n int) *HTTPClient {
+	clone := *c
+	clone.budget = NewRetryBudget(n)
+	return &clone
+}
+
+func (c *HTTPClient) Get(ctx context.Context, url string) ([]byte, error) {
+	return c.get(ctx, url, nil)
+}
+
+// GetRange fetches the byte range br of url with a Range request. The server
+// must answer 206 Partial Content with a matching Content-Range; anything
+// else is reported as an *m3u8.RangeError and not retried.
+func (c *HTTPClient) GetRange(ctx context.Context, url string, br m3u8.ByteRange) ([]byte, error) {
+	return c.get(ctx, url, &br)
+}
+
+func (c *HTTPClient) get(ctx context.Context, url string, br *m3u8.ByteRange) ([]byte, error) {
+	var body []byte
+	err := c.retry(ctx, func() error {
+		var err error
+		body, err = c.doGet(ctx, url, br)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return body, nil
+}
+
+type attemptHookKey struct{}
 
-	return nil, m3u8.NewRetryExhaustedError(c.retries, err)
+// withAttemptHook returns a context that makes the client call hook with the
+// error of every failed attempt of the requests made with it, retried or not.
+func withAttemptHook(ctx context.Context, hook func(error)) context.Context {
+	return context.WithValue(ctx, attemptHookKey{}, hook)
 }
 
-func (c *HTTPClient) doGet(url string) ([]byte, error) {
-	req, err := http.NewRequest("GET", url, nil)
+func reportAttempt(ctx context.Context, err error) {
+	if hook, ok := ctx.Value(attemptHookKey{}).(func(error)); ok {
+		hook(err)
+	}
+}
+
+// sleepContext waits for d or until ctx is done, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *HTTPClient) doGet(ctx context.Context, url string, br *m3u8.ByteRange) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	c.setHeaders(req)
+	if br != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", br.Offset, br.Offset+br.Length-1))
+	}
 
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	body := newIdleTimeoutReader(resp.Body, c.timeout)
+	defer body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, m3u8.NewHTTPError(resp.StatusCode, url)
+	if br == nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, statusError(resp, url)
+		}
+		return io.ReadAll(c.limiter.Reader(ctx, body))
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return nil, m3u8.NewRangeError(url, *br, "server ignored the Range header")
+	default:
+		return nil, statusError(resp, url)
+	}
+
+	contentRange := resp.Header.Get("Content-Range")
+	start, end, err := parseContentRange(contentRange)
+	if err != nil {
+		return nil, m3u8.NewRangeError(url, *br, err.Error())
+	}
+	if start != br.Offset || end != br.Offset+br.Length-1 {
+		return nil, m3u8.NewRangeError(url, *br, fmt.Sprintf("got Content-Range %q", contentRange))
 	}
 
-	return io.ReadAll(resp.Body)
+	data, err := io.ReadAll(c.limiter.Reader(ctx, io.LimitReader(body, br.Length)))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != br.Length {
+		return nil, fmt.Errorf("short range response: got %d of %d bytes", len(data), br.Length)
+	}
+	return data, nil
+}
+
+// idleTimeoutReader fails a response body read that gets no data for
+// timeout. Unlike http.Client.Timeout it does not count the time spent
+// between reads, such as waiting for the rate limiter.
+type idleTimeoutReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
 }
 
+func newIdleTimeoutReader(body io.ReadCloser, timeout time.Duration) *idleTimeoutReader {
+	r := &idleTimeoutReader{body: body, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.expired.Store(true)
+		body.Close()
+	})
+	r.timer.Stop()
+	return r
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.body.Read(p)
+	r.timer.Stop()
+	if err != nil && r.expired.Load() {
+		err = errBodyTimeout{timeout: r.timeout}
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReader) Close() error {
+	r.timer.Stop()
+	return r.body.Close()
+}
+
+// errBodyTimeout is returned for a response body that stalled. It is a
+// net.Error timeout, so it is retried and slows the adaptive worker pool
+// down like any other timeout.
+type errBodyTimeout struct {
+	timeout time.Duration
+}
+
+func (e errBodyTimeout) Error() string {
+	return fmt.Sprintf("response body stalled for %v", e.timeout)
+}
+
+func (errBodyTimeout) Timeout() bool   { return true }
+func (errBodyTimeout) Temporary() bool { return true }
+
+// maxRetryAfter caps how long a Retry-After header can make us wait.
+const maxRetryAfter = 5 * time.Minute
+
+// statusError returns the *m3u8.HTTPError for an unexpected response,
+// including the delay asked for by its Retry-After header.
+func statusError(resp *http.Response, url string) *m3u8.HTTPError {
+	err := m3u8.NewHTTPError(resp.StatusCode, url)
+	err.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	return err
+}
+
+// parseRetryAfter parses a Retry-After value, either delay seconds or an
+// HTTP date, into a delay from now.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	var d time.Duration
+	if secs, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = t.Sub(now)
+	}
+	return min(max(d, 0), maxRetryAfter)
+}
+
+// parseContentRange returns the first and last byte position of a
+// Content-Range header such as "bytes 0-99/1000".
+func parseContentRange(s string) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	spec, _, _ = strings.Cut(spec, "/")
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	return start, end, nil
+}
+
+// setHeaders applies the configured headers to req. Custom headers override
+// User-Agent, Origin and Referer; the -cookie value is appended to any Cookie
+// custom header.
 func (c *HTTPClient) setHeaders(req *http.Request) {
 	req.Header.Set("User-Agent", c.userAgent)
 	if c.origin != "" {
@@ -97,10 +317,56 @@ func (c *HTTPClient) setHeaders(req *http.Request) {
 	if c.referer != "" {
 		req.Header.Set("Referer", c.referer)
 	}
+
+	for key, value := range c.headers {
+		if strings.EqualFold(key, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(key, value)
+	}
+
+	if c.cookie != "" {
+		if existing := req.Header.Get("Cookie"); existing != "" {
+			req.Header.Set("Cookie", existing+"; "+c.cookie)
+		} else {
+			req.Header.Set("Cookie", c.cookie)
+		}
+	}
+}
+
+// DownloadStream copies the body of url to writer, retrying like Get. An
+// attempt that fails after writing part of the body is retried only when
+// writer can discard it with a Reset method, as *bytes.Buffer can.
+func (c *HTTPClient) DownloadStream(ctx context.Context, url string, writer io.Writer) error {
+	resetter, canReset := writer.(interface{ Reset() })
+	cw := &countingWriter{w: writer}
+	return c.retry(ctx, func() error {
+		if cw.n > 0 {
+			resetter.Reset()
+			cw.n = 0
+		}
+		err := c.downloadStream(ctx, url, cw)
+		if err != nil && cw.n > 0 && !canReset {
+			return &permanentError{err: err}
+		}
+		return err
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
 }
 
-func (c *HTTPClient) DownloadStream(url string, writer io.Writer) error {
-	req, err := http.NewRequest("GET", url, nil)
+func (c *HTTPClient) downloadStream(ctx context.Context, url string, writer io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
@@ -111,12 +377,13 @@ func (c *HTTPClient) DownloadStream(url string, writer io.Writer) error {
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	body := newIdleTimeoutReader(resp.Body, c.timeout)
+	defer body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return m3u8.NewHTTPError(resp.StatusCode, url)
+		return statusError(resp, url)
 	}
 
-	_, err = io.Copy(writer, resp.Body)
+	_, err = io.Copy(writer, c.limiter.Reader(ctx, body))
 	return err
 }
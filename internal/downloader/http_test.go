@@ -1,9 +1,14 @@
 package downloader
 
 import (
+	"context"
+	"errors"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -27,8 +32,8 @@ func TestNewHTTPClient(t *testing.T) {
 		t.Errorf("got timeout %v, want 30s", client.timeout)
 	}
 
-	if client.retries != 3 {
-		t.Errorf("got retries %d, want 3", client.retries)
+	if client.policy.Retries != 3 {
+		t.Errorf("got retries %d, want 3", client.policy.Retries)
 	}
 
 	if client.userAgent != "test-agent" {
@@ -51,7 +56,7 @@ func TestHTTPClient_Get(t *testing.T) {
 
 	client := NewHTTPClient(cfg)
 
-	body, err := client.Get(ts.URL)
+	body, err := client.Get(context.Background(), ts.URL)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -61,6 +66,196 @@ func TestHTTPClient_Get(t *testing.T) {
 	}
 }
 
+func TestHTTPClient_GetRange(t *testing.T) {
+	content := []byte("0123456789")
+
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		want      string
+		wantRange bool
+	}{
+		{
+			name: "partial content",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(string(content)))
+			},
+			want: "3456",
+		},
+		{
+			name: "range ignored",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(content)
+			},
+			wantRange: true,
+		},
+		{
+			name: "mismatched Content-Range",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", "bytes 0-3/10")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(content[:4])
+			},
+			wantRange: true,
+		},
+		{
+			name: "missing Content-Range",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(content[3:7])
+			},
+			wantRange: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				tt.handler(w, r)
+			}))
+			defer ts.Close()
+
+			client := NewHTTPClient(&m3u8.DownloadConfig{Timeout: 10, Retries: 2})
+			client.policy.BaseWait = time.Millisecond
+
+			body, err := client.GetRange(context.Background(), ts.URL, m3u8.ByteRange{Length: 4, Offset: 3})
+
+			var rangeErr *m3u8.RangeError
+			if tt.wantRange {
+				if !errors.As(err, &rangeErr) {
+					t.Fatalf("got error %v, want RangeError", err)
+				}
+				if got := requests.Load(); got != 1 {
+					t.Errorf("got %d requests, want 1", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(body) != tt.want {
+				t.Errorf("got %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPClient_GetTimeout(t *testing.T) {
+	body := make([]byte, 48<<10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/stall") {
+			w.Write(body[:1<<10])
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(3 * time.Second):
+			}
+			return
+		}
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	// Reading 48K at 16K/s takes about two seconds, longer than the timeout,
+	// but the body never stops arriving for a whole second.
+	client := NewHTTPClient(&m3u8.DownloadConfig{Timeout: 1, LimitRate: "16K"})
+	got, err := client.Get(context.Background(), ts.URL+"/slow")
+	if err != nil {
+		t.Fatalf("rate limited Get failed: %v", err)
+	}
+	if len(got) != len(body) {
+		t.Errorf("got %d bytes, want %d", len(got), len(body))
+	}
+
+	start := time.Now()
+	_, err = client.Get(context.Background(), ts.URL+"/stall")
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2500*time.Millisecond {
+		t.Errorf("stalled body failed after %v, want about 1s", elapsed)
+	}
+}
+
+func TestHTTPClient_Headers(t *testing.T) {
+	var got http.Header
+	var host string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		host = r.Host
+	}))
+	defer ts.Close()
+
+	cfg := &m3u8.DownloadConfig{
+		Timeout:   10,
+		Retries:   0,
+		UserAgent: "default-agent",
+		Referer:   "https://example.com/",
+		CustomHeader: map[string]string{
+			"Authorization": "Bearer token",
+			"User-Agent":    "custom-agent",
+			"Cookie":        "a=1",
+			"Host":          "cdn.example.com",
+		},
+		Cookie: "b=2",
+	}
+
+	var buf strings.Builder
+	if err := NewHTTPClient(cfg).DownloadStream(context.Background(), ts.URL, &buf); err != nil {
+		t.Fatalf("DownloadStream failed: %v", err)
+	}
+
+	want := map[string]string{
+		"Authorization": "Bearer token",
+		"User-Agent":    "custom-agent",
+		"Referer":       "https://example.com/",
+		"Cookie":        "a=1; b=2",
+	}
+	for key, value := range want {
+		if got.Get(key) != value {
+			t.Errorf("got %s %q, want %q", key, got.Get(key), value)
+		}
+	}
+	if host != "cdn.example.com" {
+		t.Errorf("got host %q, want cdn.example.com", host)
+	}
+}
+
+func TestHTTPClient_WithHeaders(t *testing.T) {
+	var got []http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Clone())
+	}))
+	defer ts.Close()
+
+	cfg := &m3u8.DownloadConfig{
+		Timeout:      10,
+		UserAgent:    "default-agent",
+		CustomHeader: map[string]string{"Authorization": "Bearer base", "X-Base": "1"},
+	}
+	base := NewHTTPClient(cfg)
+	job := base.WithHeaders(map[string]string{"authorization": "Bearer job", "Referer": "https://job.example.com/"})
+
+	if job.client != base.client {
+		t.Error("WithHeaders does not share the connection pool")
+	}
+	for _, c := range []*HTTPClient{job, base} {
+		if _, err := c.Get(context.Background(), ts.URL); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+	}
+
+	if got[0].Get("Authorization") != "Bearer job" || got[0].Get("X-Base") != "1" || got[0].Get("Referer") != "https://job.example.com/" {
+		t.Errorf("got job headers %v", got[0])
+	}
+	if got[1].Get("Authorization") != "Bearer base" || got[1].Get("Referer") != "" {
+		t.Errorf("got base headers %v after WithHeaders", got[1])
+	}
+}
+
 func TestHTTPClient_GetRetry(t *testing.T) {
 	attempts := 0
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -82,7 +277,7 @@ func TestHTTPClient_GetRetry(t *testing.T) {
 
 	client := NewHTTPClient(cfg)
 
-	body, err := client.Get(ts.URL)
+	body, err := client.Get(context.Background(), ts.URL)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -110,7 +305,7 @@ func TestHTTPClient_GetExhaustedRetries(t *testing.T) {
 
 	client := NewHTTPClient(cfg)
 
-	_, err := client.Get(ts.URL)
+	_, err := client.Get(context.Background(), ts.URL)
 	if err == nil {
 		t.Error("expected error but got none")
 	}
@@ -129,6 +324,98 @@ func TestHTTPClient_GetExhaustedRetries(t *testing.T) {
 	}
 }
 
+func TestHTTPClient_GetCanceledDuringBackoff(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	cfg := &m3u8.DownloadConfig{
+		Timeout:   10,
+		Retries:   3,
+		UserAgent: "test-agent",
+	}
+
+	client := NewHTTPClient(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.Get(ctx, ts.URL)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want context.DeadlineExceeded", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Get returned after %v, want prompt return on cancellation", elapsed)
+	}
+}
+
+func TestHTTPClient_GetRetryAfter(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("test data"))
+	}))
+	defer ts.Close()
+
+	client := NewHTTPClient(&m3u8.DownloadConfig{Timeout: 10, Retries: 3, UserAgent: "test-agent"})
+	client.policy.BaseWait = time.Millisecond
+
+	var seen []error
+	ctx := withAttemptHook(context.Background(), func(err error) { seen = append(seen, err) })
+
+	start := time.Now()
+	body, err := client.Get(ctx, ts.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(body) != "test data" {
+		t.Errorf("got %q, want %q", string(body), "test data")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, want at least the 1s Retry-After", elapsed)
+	}
+
+	if len(seen) != 1 {
+		t.Fatalf("got %d failed attempts reported, want 1", len(seen))
+	}
+	var httpErr *m3u8.HTTPError
+	if !errors.As(seen[0], &httpErr) || httpErr.StatusCode != http.StatusTooManyRequests || httpErr.RetryAfter != time.Second {
+		t.Errorf("got attempt error %v, want 429 with a 1s Retry-After", seen[0])
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 0},
+		{value: "120", want: 2 * time.Minute},
+		{value: " 5 ", want: 5 * time.Second},
+		{value: "-3", want: 0},
+		{value: "86400", want: maxRetryAfter},
+		{value: "Wed, 01 May 2024 12:00:30 GMT", want: 30 * time.Second},
+		{value: "Wed, 01 May 2024 11:59:00 GMT", want: 0},
+		{value: "soon", want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
 func TestNewDownloader(t *testing.T) {
 	cfg := &m3u8.DownloadConfig{
 		Timeout:   10,
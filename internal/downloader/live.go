@@ -0,0 +1,264 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+// defaultLivePoll is the reload interval for playlists without a usable
+// #EXT-X-TARGETDURATION.
+const defaultLivePoll = 10 * time.Second
+
+// maxRefreshFailures is how many playlist reloads in a row may fail before a
+// live recording gives up.
+const maxRefreshFailures = 3
+
+// LiveOptions controls a live recording.
+type LiveOptions struct {
+	// MaxDuration stops the recording once this much media has been
+	// recorded. Zero records until the playlist ends or ctx is canceled.
+	MaxDuration time.Duration
+	// PollInterval overrides the target duration as the reload interval.
+	PollInterval time.Duration
+}
+
+// PlaylistFetcher returns the current version of a media playlist.
+type PlaylistFetcher func(ctx context.Context) (*m3u8.Playlist, error)
+
+// RecordLive records a live playlist into out. Starting from playlist, it
+// reloads the playlist with refresh every target duration, downloads
+// segments whose media sequence has not been seen yet and appends them to
+// out in order. It stops when the playlist gets #EXT-X-ENDLIST, when
+// MaxDuration of media has been recorded or when ctx is canceled; in the
+// last case it returns ctx.Err() after flushing what was already downloaded.
+//
+// Segments that fail or drop out of the window before they could be fetched
+// are left out of the output; their media sequence numbers are reported in
+// FailedSegments. Once more than MaxFailed are missing the recording stops
+// with an *m3u8.IncompleteDownloadError.
+func (d *Downloader) RecordLive(ctx context.Context, playlist *m3u8.Playlist, refresh PlaylistFetcher, cacheDir string, workers int, out io.Writer, opts LiveOptions) (*m3u8.DownloadStats, error) {
+	stats := &m3u8.DownloadStats{}
+	res := newJobResources(d.httpClient)
+	res.pool = d.newWorkerPool(workers)
+	prog := d.newProgress(0, false)
+	var lastMap *m3u8.Map
+	buf := make([]byte, 32*1024)
+
+	var recorded time.Duration
+	lastSeq := int64(-1)
+	lastDiscSeq := playlist.DiscontinuitySequence
+	refreshFailures := 0
+	lastReload := time.Now()
+
+	for {
+		if len(playlist.Segments) > 0 {
+			if lastSeq >= 0 && sequenceRestarted(playlist, lastSeq, lastDiscSeq) {
+				d.logger.Warn("Live playlist media sequence restarted, recording the new sequence",
+					"last_sequence", lastSeq,
+					"media_sequence", playlist.MediaSequence,
+				)
+				lastSeq = playlist.MediaSequence - 1
+			}
+			lastDiscSeq = playlist.DiscontinuitySequence
+		}
+
+		missed := stats.Failed
+		batch := d.newLiveSegments(playlist, lastSeq, stats)
+		if missed = stats.Failed - missed; missed > 0 {
+			prog.grow(missed)
+			prog.add(missed, 0)
+		}
+		if stats.Failed > d.policy.MaxFailed {
+			return stats, m3u8.NewIncompleteDownloadError(stats.Total, stats.FailedSegments)
+		}
+		if opts.MaxDuration > 0 {
+			batch = trimToDuration(batch, opts.MaxDuration-recorded)
+		}
+
+		if len(batch) > 0 {
+			lastSeq = batch[len(batch)-1].Sequence
+			stats.Total += len(batch)
+			prog.grow(len(batch))
+
+			res.initAt = initRunStarts(batch, lastMap)
+			lastMap = batch[len(batch)-1].Map
+
+			done, err := d.recordBatch(ctx, batch, cacheDir, res, out, buf, stats, prog)
+			recorded += done
+			if ctx.Err() != nil {
+				return stats, ctx.Err()
+			}
+			if err != nil {
+				return stats, err
+			}
+
+			d.logger.Info("Recorded live segments",
+				"segments", len(batch),
+				"last_sequence", lastSeq,
+				"recorded", recorded.Round(time.Second),
+			)
+		}
+
+		if stats.Failed > d.policy.MaxFailed {
+			return stats, m3u8.NewIncompleteDownloadError(stats.Total, stats.FailedSegments)
+		}
+		if playlist.EndList {
+			d.logger.Info("Live playlist ended")
+			return stats, nil
+		}
+		if opts.MaxDuration > 0 && recorded >= opts.MaxDuration {
+			d.logger.Info("Live duration limit reached", "recorded", recorded.Round(time.Second))
+			return stats, nil
+		}
+
+		wait := pollInterval(playlist, opts)
+		if len(batch) == 0 {
+			// The playlist did not change; RFC 8216 asks clients to retry
+			// after half the target duration.
+			wait /= 2
+		}
+		// The interval runs from the previous reload, so that downloading
+		// the batch does not push reloads further behind the live edge.
+		if err := sleepContext(ctx, max(wait-time.Since(lastReload), 0)); err != nil {
+			return stats, err
+		}
+
+		lastReload = time.Now()
+		next, err := refresh(ctx)
+		switch {
+		case err == nil:
+			playlist = next
+			refreshFailures = 0
+		case ctx.Err() != nil:
+			return stats, ctx.Err()
+		case errors.Is(err, m3u8.ErrNoTSFiles):
+			playlist = &m3u8.Playlist{TargetDuration: playlist.TargetDuration}
+		default:
+			refreshFailures++
+			d.logger.Warn("Failed to reload live playlist", "attempt", refreshFailures, "error", err)
+			if refreshFailures >= maxRefreshFailures {
+				return stats, fmt.Errorf("failed to reload live playlist: %w", err)
+			}
+			playlist = &m3u8.Playlist{TargetDuration: playlist.TargetDuration}
+		}
+	}
+}
+
+// sequenceRestarted reports whether playlist starts a new media sequence,
+// as encoders do when they restart: its window ends before lastSeq, the last
+// sequence recorded, or its discontinuity sequence went back.
+func sequenceRestarted(playlist *m3u8.Playlist, lastSeq, lastDiscSeq int64) bool {
+	return playlist.MediaSequence+int64(len(playlist.Segments)) <= lastSeq ||
+		playlist.DiscontinuitySequence < lastDiscSeq
+}
+
+// newLiveSegments returns the segments of playlist after lastSeq, named by
+// media sequence so they never collide across reloads. Segments that left
+// the window before they were seen are recorded as failed.
+func (d *Downloader) newLiveSegments(playlist *m3u8.Playlist, lastSeq int64, stats *m3u8.DownloadStats) []*m3u8.TSInfo {
+	var batch []*m3u8.TSInfo
+
+	for _, seg := range playlist.Segments {
+		if seg.Sequence <= lastSeq {
+			continue
+		}
+
+		if len(batch) == 0 && lastSeq >= 0 && seg.Sequence > lastSeq+1 {
+			d.logger.Warn("Live window moved past segments before they were downloaded",
+				"from", lastSeq+1,
+				"to", seg.Sequence-1,
+			)
+			for missed := lastSeq + 1; missed < seg.Sequence; missed++ {
+				stats.Total++
+				stats.Failed++
+				stats.FailedSegments = append(stats.FailedSegments, int(missed))
+			}
+		}
+
+		live := *seg
+		live.Name = fmt.Sprintf("live-%d%s", seg.Sequence, path.Ext(seg.Name))
+		batch = append(batch, &live)
+	}
+
+	return batch
+}
+
+// recordBatch downloads batch and appends the segments that succeeded to
+// out in playlist order, returning the media duration appended. When ctx is
+// canceled it appends the segments downloaded before the first interrupted
+// one.
+func (d *Downloader) recordBatch(ctx context.Context, batch []*m3u8.TSInfo, cacheDir string, res *jobResources, out io.Writer, buf []byte, stats *m3u8.DownloadStats, prog *progress) (time.Duration, error) {
+	indices := make([]int, len(batch))
+	for i := range batch {
+		indices[i] = i
+	}
+
+	failed, _, keyErr := d.downloadWithRetries(ctx, &m3u8.Playlist{Segments: batch}, indices, cacheDir, res, nil)
+	if keyErr != nil && ctx.Err() == nil {
+		return 0, fmt.Errorf("failed to download encryption key: %w", keyErr)
+	}
+
+	isFailed := make(map[int]bool, len(failed))
+	for _, i := range failed {
+		isFailed[i] = true
+	}
+
+	var recorded time.Duration
+	for i, seg := range batch {
+		if isFailed[i] {
+			stats.Failed++
+			stats.FailedSegments = append(stats.FailedSegments, int(seg.Sequence))
+			prog.add(1, 0)
+			continue
+		}
+
+		f, err := os.Open(fmt.Sprintf("%s/%s", cacheDir, seg.Name))
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return recorded, fmt.Errorf("failed to open segment: %w", err)
+		}
+
+		n, err := d.appendAndRemove(out, f, buf)
+		if err != nil {
+			return recorded, err
+		}
+
+		stats.Completed++
+		prog.add(1, n)
+		recorded += time.Duration(seg.Duration * float64(time.Second))
+	}
+
+	return recorded, nil
+}
+
+// trimToDuration returns the leading segments of batch needed to record
+// remaining more media.
+func trimToDuration(batch []*m3u8.TSInfo, remaining time.Duration) []*m3u8.TSInfo {
+	var total time.Duration
+	for i, seg := range batch {
+		if total >= remaining {
+			return batch[:i]
+		}
+		total += time.Duration(seg.Duration * float64(time.Second))
+	}
+	return batch
+}
+
+func pollInterval(playlist *m3u8.Playlist, opts LiveOptions) time.Duration {
+	if opts.PollInterval > 0 {
+		return opts.PollInterval
+	}
+	if playlist.TargetDuration > 0 {
+		return time.Duration(playlist.TargetDuration) * time.Second
+	}
+	return defaultLivePoll
+}
@@ -0,0 +1,282 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"m3u8-download/internal/parser"
+	"m3u8-download/pkg/m3u8"
+)
+
+// liveServer serves a sliding-window playlist of three segments that moves
+// forward by step segments on every reload and ends after endAfter reloads.
+type liveServer struct {
+	*httptest.Server
+	reloads atomic.Int64
+	// segmentDelay slows every segment response down by this many
+	// nanoseconds.
+	segmentDelay atomic.Int64
+}
+
+func newLiveServer(t *testing.T, step, endAfter int, onReload func(n int)) *liveServer {
+	t.Helper()
+
+	ls := &liveServer{}
+	ls.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".ts") {
+			var seq int
+			fmt.Sscanf(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:], "seg%d.ts", &seq)
+			time.Sleep(time.Duration(ls.segmentDelay.Load()))
+			w.Write(liveSegment(seq))
+			return
+		}
+
+		n := int(ls.reloads.Add(1)) - 1
+		if onReload != nil {
+			onReload(n)
+		}
+
+		first := n * step
+		var b strings.Builder
+		fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+		for seq := first; seq < first+3; seq++ {
+			fmt.Fprintf(&b, "#EXTINF:2.0,\nseg%d.ts\n", seq)
+		}
+		if n >= endAfter {
+			b.WriteString("#EXT-X-ENDLIST\n")
+		}
+		w.Write([]byte(b.String()))
+	}))
+	t.Cleanup(ls.Close)
+
+	return ls
+}
+
+func liveSegment(seq int) []byte {
+	return []byte{0x47, byte(seq)}
+}
+
+func (ls *liveServer) fetch(d *Downloader) PlaylistFetcher {
+	return func(ctx context.Context) (*m3u8.Playlist, error) {
+		url := ls.URL + "/live.m3u8"
+		body, err := d.httpClient.Get(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		return parser.ParsePlaylist(string(body), url)
+	}
+}
+
+func TestRecordLive(t *testing.T) {
+	tests := []struct {
+		name        string
+		step        int
+		endAfter    int
+		maxDuration time.Duration
+		maxFailed   int
+		wantSeqs    []int
+		wantMissing []int
+		wantErr     bool
+	}{
+		{
+			name:     "records until ENDLIST without duplicates",
+			step:     1,
+			endAfter: 3,
+			wantSeqs: []int{0, 1, 2, 3, 4, 5},
+		},
+		{
+			name:        "stops at duration limit",
+			step:        1,
+			endAfter:    100,
+			maxDuration: 5 * time.Second,
+			wantSeqs:    []int{0, 1, 2},
+		},
+		{
+			name:        "window moving past segments leaves holes",
+			step:        5,
+			endAfter:    1,
+			maxFailed:   10,
+			wantSeqs:    []int{0, 1, 2, 5, 6, 7},
+			wantMissing: []int{3, 4},
+		},
+		{
+			name:        "holes beyond max failed stop the recording",
+			step:        5,
+			endAfter:    1,
+			maxFailed:   1,
+			wantSeqs:    []int{0, 1, 2},
+			wantMissing: []int{3, 4},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := newLiveServer(t, tt.step, tt.endAfter, nil)
+			d := newTestDownloader(t)
+			d.SetFailurePolicy(FailurePolicy{MaxFailed: tt.maxFailed})
+
+			fetch := ls.fetch(d)
+			playlist, err := fetch(context.Background())
+			if err != nil {
+				t.Fatalf("initial fetch failed: %v", err)
+			}
+
+			var out bytes.Buffer
+			stats, err := d.RecordLive(context.Background(), playlist, fetch, t.TempDir(), 2, &out, LiveOptions{
+				MaxDuration:  tt.maxDuration,
+				PollInterval: 10 * time.Millisecond,
+			})
+
+			var incomplete *m3u8.IncompleteDownloadError
+			if tt.wantErr != errors.As(err, &incomplete) {
+				t.Fatalf("got error %v, want incomplete error: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("RecordLive failed: %v", err)
+			}
+
+			var want []byte
+			for _, seq := range tt.wantSeqs {
+				want = append(want, liveSegment(seq)...)
+			}
+			if !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("got output %v, want %v", out.Bytes(), want)
+			}
+
+			if stats.Completed != len(tt.wantSeqs) {
+				t.Errorf("got %d completed, want %d", stats.Completed, len(tt.wantSeqs))
+			}
+			if fmt.Sprint(stats.FailedSegments) != fmt.Sprint(tt.wantMissing) {
+				t.Errorf("got missing %v, want %v", stats.FailedSegments, tt.wantMissing)
+			}
+		})
+	}
+}
+
+func TestRecordLiveReloadInterval(t *testing.T) {
+	var mu sync.Mutex
+	var reloads []time.Time
+	ls := newLiveServer(t, 1, 4, func(int) {
+		mu.Lock()
+		reloads = append(reloads, time.Now())
+		mu.Unlock()
+	})
+	ls.segmentDelay.Store(int64(150 * time.Millisecond))
+	d := newTestDownloader(t)
+
+	fetch := ls.fetch(d)
+	playlist, err := fetch(context.Background())
+	if err != nil {
+		t.Fatalf("initial fetch failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	if _, err := d.RecordLive(context.Background(), playlist, fetch, t.TempDir(), 2, &out, LiveOptions{PollInterval: 300 * time.Millisecond}); err != nil {
+		t.Fatalf("RecordLive failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Each reload after the first brings one 150ms segment; with the
+	// interval measured from the previous reload they stay 300ms apart
+	// instead of 450ms.
+	for i := 2; i < len(reloads); i++ {
+		if gap := reloads[i].Sub(reloads[i-1]); gap > 400*time.Millisecond {
+			t.Errorf("reload %d came %v after the previous one, want about 300ms", i, gap)
+		}
+	}
+}
+
+func TestRecordLiveSequenceRestart(t *testing.T) {
+	// The encoder restarts after the second reload and numbers its
+	// segments from 0 again.
+	windows := []struct {
+		prefix string
+		first  int
+	}{{"a", 10}, {"a", 11}, {"b", 0}, {"b", 1}}
+
+	var reloads atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".ts") {
+			w.Write([]byte("\x47" + strings.TrimSuffix(path.Base(r.URL.Path), ".ts")))
+			return
+		}
+
+		n := min(int(reloads.Add(1))-1, len(windows)-1)
+		win := windows[n]
+		var b strings.Builder
+		fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:%d\n", win.first)
+		for seq := win.first; seq < win.first+3; seq++ {
+			fmt.Fprintf(&b, "#EXTINF:2.0,\n%s%d.ts\n", win.prefix, seq)
+		}
+		if n == len(windows)-1 {
+			b.WriteString("#EXT-X-ENDLIST\n")
+		}
+		w.Write([]byte(b.String()))
+	}))
+	defer ts.Close()
+
+	d := newTestDownloader(t)
+	fetch := (&liveServer{Server: ts}).fetch(d)
+	playlist, err := fetch(context.Background())
+	if err != nil {
+		t.Fatalf("initial fetch failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	stats, err := d.RecordLive(context.Background(), playlist, fetch, t.TempDir(), 2, &out, LiveOptions{PollInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("RecordLive failed: %v", err)
+	}
+
+	want := "\x47a10\x47a11\x47a12\x47a13\x47b0\x47b1\x47b2\x47b3"
+	if out.String() != want {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+	if stats.Failed != 0 {
+		t.Errorf("got %d failed, want 0", stats.Failed)
+	}
+}
+
+func TestRecordLiveCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ls := newLiveServer(t, 1, 1000, func(n int) {
+		if n == 2 {
+			cancel()
+		}
+	})
+	d := newTestDownloader(t)
+
+	fetch := ls.fetch(d)
+	playlist, err := fetch(context.Background())
+	if err != nil {
+		t.Fatalf("initial fetch failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	stats, err := d.RecordLive(ctx, playlist, fetch, t.TempDir(), 2, &out, LiveOptions{PollInterval: 10 * time.Millisecond})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+
+	want := append(liveSegment(0), append(liveSegment(1), append(liveSegment(2), liveSegment(3)...)...)...)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("got output %v, want %v", out.Bytes(), want)
+	}
+	if stats.Failed != 0 {
+		t.Errorf("got %d failed, want 0", stats.Failed)
+	}
+}
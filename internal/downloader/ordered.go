@@ -0,0 +1,270 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"m3u8-download/internal/manifest"
+	"m3u8-download/pkg/m3u8"
+)
+
+// reorderMemory caps the bytes of out-of-order segments kept in memory;
+// segments beyond it wait in the cache directory instead.
+const reorderMemory = 64 << 20
+
+// reorderAhead is how many segments per worker dispatch may run ahead of
+// the first segment not yet written.
+const reorderAhead = 4
+
+// orderedWriter appends segments to the output in playlist order as soon as
+// each one and all its predecessors have been downloaded. Segments that
+// complete early wait in memory, or in the cache directory once reorderMemory
+// is used up, until their turn.
+type orderedWriter struct {
+	mu       sync.Mutex
+	changed  chan struct{}
+	out      io.Writer
+	cacheDir string
+	segments []*m3u8.TSInfo
+	d        *Downloader
+	// onWrite is called after every write with the number of segments and
+	// bytes written so far.
+	onWrite func(count int, size int64)
+
+	next   int
+	size   int64
+	window int
+	memory int64
+	err    error
+
+	buffered int64
+	inMemory map[int][]byte
+	onDisk   map[int]bool
+	failed   map[int]bool
+	skipped  map[int]bool
+	buf      []byte
+}
+
+// newOrderedWriter returns a writer appending segments to out, which already
+// holds the first next segments, size bytes.
+func (d *Downloader) newOrderedWriter(out io.Writer, cacheDir string, segments []*m3u8.TSInfo, next int, size int64, workers int) *orderedWriter {
+	return &orderedWriter{
+		changed:  make(chan struct{}),
+		out:      out,
+		cacheDir: cacheDir,
+		segments: segments,
+		d:        d,
+		onWrite:  func(int, int64) {},
+		next:     next,
+		size:     size,
+		window:   max(workers, 1) * reorderAhead,
+		memory:   reorderMemory,
+		inMemory: make(map[int][]byte),
+		onDisk:   make(map[int]bool),
+		failed:   make(map[int]bool),
+		skipped:  make(map[int]bool),
+		buf:      make([]byte, 32*1024),
+	}
+}
+
+// wait blocks until segment idx is within the window of segments that may
+// download ahead of the output. The window does not apply while the first
+// missing segment has failed: its retry comes in a later pass.
+func (w *orderedWriter) wait(ctx context.Context, idx int) error {
+	for {
+		w.mu.Lock()
+		if w.err != nil {
+			w.mu.Unlock()
+			return w.err
+		}
+		if idx < w.next+w.window || w.failed[w.next] {
+			w.mu.Unlock()
+			return nil
+		}
+		changed := w.changed
+		w.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// add hands over the data of segment idx, writing it, and any segments
+// waiting behind it, if its turn has come.
+func (w *orderedWriter) add(idx int, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer w.broadcast()
+
+	if w.err != nil {
+		return w.err
+	}
+	delete(w.failed, idx)
+
+	switch {
+	case idx == w.next:
+		if _, err := w.out.Write(data); err != nil {
+			w.err = fmt.Errorf("failed to write output: %w", err)
+			return w.err
+		}
+		w.advance(int64(len(data)))
+	case w.buffered+int64(len(data)) <= w.memory:
+		w.inMemory[idx] = data
+		w.buffered += int64(len(data))
+		return nil
+	default:
+		if err := writeSegmentFile(w.path(idx), data); err != nil {
+			return err
+		}
+		w.onDisk[idx] = true
+		return nil
+	}
+	return w.drain()
+}
+
+// ready marks segment idx as already downloaded into the cache directory.
+func (w *orderedWriter) ready(idx int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onDisk[idx] = true
+}
+
+// fail records that segment idx failed in the current pass.
+func (w *orderedWriter) fail(idx int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer w.broadcast()
+	w.failed[idx] = true
+}
+
+// flush writes the segments whose turn has come, leaving out the segments
+// in skip, which are given up on.
+func (w *orderedWriter) flush(skip []int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer w.broadcast()
+
+	if w.err != nil {
+		return w.err
+	}
+	for _, idx := range skip {
+		w.skipped[idx] = true
+	}
+	return w.drain()
+}
+
+// drain writes waiting segments from w.next on. Callers must hold w.mu.
+func (w *orderedWriter) drain() error {
+	for w.next < len(w.segments) {
+		idx := w.next
+		switch {
+		case w.inMemory[idx] != nil:
+			data := w.inMemory[idx]
+			delete(w.inMemory, idx)
+			w.buffered -= int64(len(data))
+			if _, err := w.out.Write(data); err != nil {
+				w.err = fmt.Errorf("failed to write output: %w", err)
+				return w.err
+			}
+			w.advance(int64(len(data)))
+		case w.onDisk[idx]:
+			delete(w.onDisk, idx)
+			if err := w.appendFile(idx); err != nil {
+				w.err = err
+				return err
+			}
+		case w.skipped[idx]:
+			w.d.logger.Warn("Segment left out of the output", "index", idx)
+			w.next++
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (w *orderedWriter) appendFile(idx int) error {
+	f, err := os.Open(w.path(idx))
+	if err != nil {
+		return fmt.Errorf("failed to open segment: %w", err)
+	}
+	n, err := w.d.appendAndRemove(w.out, f, w.buf)
+	if err != nil {
+		return err
+	}
+	w.advance(n)
+	return nil
+}
+
+// advance moves past the segment just written. Callers must hold w.mu.
+func (w *orderedWriter) advance(n int64) {
+	w.next++
+	w.size += n
+	w.onWrite(w.next, w.size)
+}
+
+func (w *orderedWriter) path(idx int) string {
+	return fmt.Sprintf("%s/%s", w.cacheDir, w.segments[idx].Name)
+}
+
+// broadcast wakes every wait. Callers must hold w.mu.
+func (w *orderedWriter) broadcast() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// openOutput opens the file segments are streamed to. When the manifest
+// records a previous run writing to the same file, it is truncated back to
+// what that run recorded and its written segments are kept; otherwise it
+// starts out empty. It returns the file and how many segments and bytes it
+// already holds.
+func (d *Downloader) openOutput() (*os.File, int, int64, error) {
+	var next int
+	var size int64
+	if d.manifest != nil && d.manifest.Output == d.output {
+		next, size = d.manifest.Written, d.manifest.WrittenSize
+	}
+
+	f, err := os.OpenFile(d.output, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to create output file: %w", err)
+	}
+	if info, err := f.Stat(); err != nil || info.Size() < size {
+		next, size = 0, 0
+	}
+	if next > 0 {
+		d.logger.Info("Continuing partial output", "file", d.output, "segments", next, "size", size)
+	}
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, 0, 0, fmt.Errorf("failed to truncate output file: %w", err)
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, 0, fmt.Errorf("failed to seek output file: %w", err)
+	}
+	d.recordProgress(func(m *manifest.Manifest) error { return m.MarkWritten(d.output, next, size) })
+	return f, next, size, nil
+}
+
+// writeSegmentFile writes data to path under a temporary name first, so an
+// interrupted write never looks complete.
+func writeSegmentFile(path string, data []byte) error {
+	tmpPath := path + partSuffix
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
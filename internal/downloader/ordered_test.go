@@ -0,0 +1,225 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"m3u8-download/internal/manifest"
+	"m3u8-download/pkg/m3u8"
+)
+
+func newTestOrderedWriter(t *testing.T, n int) (*orderedWriter, *bytes.Buffer, string) {
+	t.Helper()
+
+	var segments []*m3u8.TSInfo
+	for i := 0; i < n; i++ {
+		segments = append(segments, &m3u8.TSInfo{Name: fmt.Sprintf("%06d.ts", i+1)})
+	}
+	cacheDir := t.TempDir()
+	out := new(bytes.Buffer)
+	return newTestDownloader(t).newOrderedWriter(out, cacheDir, segments, 0, 0, 1), out, cacheDir
+}
+
+func TestOrderedWriter(t *testing.T) {
+	w, out, cacheDir := newTestOrderedWriter(t, 5)
+	w.memory = 4
+
+	var count int
+	var size int64
+	w.onWrite = func(c int, s int64) { count, size = c, s }
+
+	// Segments 2 and 4 fit in memory, 3 spills to the cache directory.
+	for _, idx := range []int{2, 4, 3} {
+		if err := w.add(idx, []byte(fmt.Sprintf("s%d", idx))); err != nil {
+			t.Fatalf("add(%d) failed: %v", idx, err)
+		}
+	}
+	if out.Len() != 0 {
+		t.Errorf("got output %q before the first segment", out.String())
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "000004.ts")); err != nil {
+		t.Errorf("segment 3 not spilled to the cache: %v", err)
+	}
+
+	w.add(0, []byte("s0"))
+	if got := out.String(); got != "s0" {
+		t.Errorf("got output %q, want %q", got, "s0")
+	}
+
+	w.add(1, []byte("s1"))
+	if got := out.String(); got != "s0s1s2s3s4" {
+		t.Errorf("got output %q, want %q", got, "s0s1s2s3s4")
+	}
+	if count != 5 || size != 10 {
+		t.Errorf("got onWrite(%d, %d), want (5, 10)", count, size)
+	}
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 0 {
+		t.Errorf("cache directory still holds %d files", len(entries))
+	}
+}
+
+func TestOrderedWriterSkip(t *testing.T) {
+	w, out, _ := newTestOrderedWriter(t, 4)
+
+	w.add(0, []byte("s0"))
+	w.fail(1)
+	w.add(2, []byte("s2"))
+	w.fail(3)
+
+	if err := w.flush([]int{1, 3}); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if got := out.String(); got != "s0s2" {
+		t.Errorf("got output %q, want %q", got, "s0s2")
+	}
+}
+
+func TestOrderedWriterWait(t *testing.T) {
+	w, _, _ := newTestOrderedWriter(t, 10)
+	w.window = 2
+
+	waited := make(chan error, 1)
+	go func() { waited <- w.wait(context.Background(), 2) }()
+
+	select {
+	case err := <-waited:
+		t.Fatalf("wait returned %v before segment 0 was written", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	w.add(0, []byte("s0"))
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatalf("wait failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait still blocked after segment 0 was written")
+	}
+
+	// A failed first segment does not hold back the rest of the pass.
+	w.fail(1)
+	if err := w.wait(context.Background(), 9); err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w.add(1, []byte("s1"))
+	cancel()
+	if err := w.wait(ctx, 9); err != context.Canceled {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+}
+
+func TestDownloadSegmentsStreamTo(t *testing.T) {
+	var requests atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if strings.HasSuffix(r.URL.Path, "/seg1.ts") {
+			// Let the later segments finish first.
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Write([]byte("\x47" + r.URL.Path))
+	}))
+	defer ts.Close()
+
+	playlist := &m3u8.Playlist{}
+	for i := 1; i <= 4; i++ {
+		playlist.Segments = append(playlist.Segments, &m3u8.TSInfo{Name: fmt.Sprintf("%06d.ts", i), Url: fmt.Sprintf("%s/seg%d.ts", ts.URL, i)})
+	}
+	want := "\x47/seg1.ts\x47/seg2.ts\x47/seg3.ts\x47/seg4.ts"
+
+	cacheDir := t.TempDir()
+	output := filepath.Join(t.TempDir(), "out.ts")
+	mf := manifest.New(cacheDir, ts.URL+"/video.m3u8", playlist)
+
+	dl := newTestDownloader(t)
+	dl.SetManifest(mf)
+	dl.StreamTo(output)
+	if _, err := dl.DownloadSegments(context.Background(), playlist, cacheDir, 4); err != nil {
+		t.Fatalf("DownloadSegments failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(output)
+	if string(data) != want {
+		t.Errorf("got output %q, want %q", data, want)
+	}
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 1 {
+		t.Errorf("got %d files in the cache, want only the manifest", len(entries))
+	}
+	if mf.Written != 4 || mf.WrittenSize != int64(len(want)) {
+		t.Errorf("manifest records %d segments, %d bytes written, want 4 and %d", mf.Written, mf.WrittenSize, len(want))
+	}
+
+	// A resumed run truncates what was written after the last recorded
+	// segment and downloads only the rest.
+	mf = manifest.New(cacheDir, ts.URL+"/video.m3u8", playlist)
+	mf.MarkWritten(output, 2, int64(len("\x47/seg1.ts\x47/seg2.ts")))
+	os.WriteFile(output, []byte("\x47/seg1.ts\x47/seg2.ts\x47/se"), 0644)
+	requests.Store(0)
+
+	dl = newTestDownloader(t)
+	dl.SetManifest(mf)
+	dl.StreamTo(output)
+	stats, err := dl.DownloadSegments(context.Background(), playlist, cacheDir, 4)
+	if err != nil {
+		t.Fatalf("resumed DownloadSegments failed: %v", err)
+	}
+
+	data, _ = os.ReadFile(output)
+	if string(data) != want {
+		t.Errorf("got resumed output %q, want %q", data, want)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("got %d requests, want 2", got)
+	}
+	if stats.Skipped != 2 || stats.Completed != 4 {
+		t.Errorf("got skipped=%d completed=%d, want 2 and 4", stats.Skipped, stats.Completed)
+	}
+}
+
+func TestDownloadSegmentsStreamToWriter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("\x47" + r.URL.Path))
+	}))
+	defer ts.Close()
+
+	playlist := &m3u8.Playlist{}
+	for i := 1; i <= 3; i++ {
+		playlist.Segments = append(playlist.Segments, &m3u8.TSInfo{Name: fmt.Sprintf("%06d.ts", i), Url: fmt.Sprintf("%s/seg%d.ts", ts.URL, i)})
+	}
+
+	var out bytes.Buffer
+	dl := newTestDownloader(t)
+	dl.StreamToWriter(&out)
+	if _, err := dl.DownloadSegments(context.Background(), playlist, t.TempDir(), 2); err != nil {
+		t.Fatalf("DownloadSegments failed: %v", err)
+	}
+	if want := "\x47/seg1.ts\x47/seg2.ts\x47/seg3.ts"; out.String() != want {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+
+	// A closed pipe fails the download with the write error.
+	dl = newTestDownloader(t)
+	dl.StreamToWriter(brokenWriter{})
+	_, err := dl.DownloadSegments(context.Background(), playlist, t.TempDir(), 2)
+	if !errors.Is(err, os.ErrClosed) {
+		t.Errorf("got error %v, want os.ErrClosed", err)
+	}
+}
+
+type brokenWriter struct{}
+
+func (brokenWriter) Write([]byte) (int, error) {
+	return 0, os.ErrClosed
+}
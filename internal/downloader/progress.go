@@ -0,0 +1,64 @@
+package downloader
+
+import (
+	"sync"
+
+	"m3u8-download/pkg/m3u8"
+
+	progressbar "github.com/schollz/progressbar/v3"
+)
+
+// progress counts the segments of a download as they settle, drawing the
+// progress bar and calling the Downloader's progress function. A nil
+// progress reports nothing.
+type progress struct {
+	bar *progressbar.ProgressBar
+	fn  func(m3u8.Progress)
+
+	mu sync.Mutex
+	p  m3u8.Progress
+}
+
+// newProgress returns the progress of a download of total segments, nil
+// when there is neither a bar to draw nor a function to call. Live
+// recordings, whose total is not known, never draw a bar.
+func (d *Downloader) newProgress(total int, bar bool) *progress {
+	bar = bar && !d.noProgress
+	if !bar && d.onProgress == nil {
+		return nil
+	}
+
+	p := &progress{fn: d.onProgress, p: m3u8.Progress{Total: total}}
+	if bar {
+		p.bar = progressbar.Default(int64(total))
+	}
+	return p
+}
+
+// add records n more settled segments and size more downloaded bytes.
+func (p *progress) add(n int, size int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.p.Done += n
+	p.p.Bytes += size
+	if p.bar != nil {
+		p.bar.Add(n)
+	}
+	if p.fn != nil {
+		p.fn(p.p)
+	}
+}
+
+// grow adds n segments to the total, for live playlists.
+func (p *progress) grow(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.p.Total += n
+}
@@ -0,0 +1,173 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateChunk caps how much is read before waiting for tokens, so that many
+// workers sharing a limiter take turns instead of bursting.
+const rateChunk = 16 << 10
+
+// ParseRate parses a -limit-rate value: bytes per second with an optional
+// K, M or G suffix (powers of 1024), such as "500K" or "1.5M".
+func ParseRate(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(s), "/s"), "B")
+
+	mult := 1.0
+	if n := len(num); n > 0 {
+		switch num[n-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		}
+		if mult != 1 {
+			num = num[:n-1]
+		}
+	}
+
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(v * mult), nil
+}
+
+// clock is the time source of a RateLimiter, replaced in tests.
+type clock interface {
+	Now() time.Time
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	return sleepContext(ctx, d)
+}
+
+// RateLimiter is a token bucket limiting the aggregate download rate of
+// every request made through the HTTP clients that share it. The bucket
+// holds up to one second of tokens; readers that overdraw it wait until
+// the debt is paid back, so concurrent readers queue behind each other.
+type RateLimiter struct {
+	mu     sync.Mutex
+	clock  clock
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing bytesPerSec bytes per second;
+// zero means unlimited.
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	return newRateLimiter(bytesPerSec, realClock{})
+}
+
+func newRateLimiter(bytesPerSec int64, clk clock) *RateLimiter {
+	return &RateLimiter{
+		clock:  clk,
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   clk.Now(),
+	}
+}
+
+// SetRate changes the limit while downloads are running. Zero removes it.
+func (l *RateLimiter) SetRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	l.rate = float64(bytesPerSec)
+	l.tokens = min(l.tokens, l.rate)
+}
+
+// Rate returns the current limit in bytes per second, zero when unlimited.
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// refill adds the tokens earned since the last call. Callers must hold
+// l.mu.
+func (l *RateLimiter) refill() {
+	now := l.clock.Now()
+	if l.rate > 0 {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	}
+	l.last = now
+}
+
+// wait takes n tokens and blocks until the bucket has paid them back.
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.refill()
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	return l.clock.Sleep(ctx, delay)
+}
+
+// Reader returns r limited by l.
+func (l *RateLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *RateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateChunk {
+		p = p[:rateChunk]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if werr := lr.limiter.wait(lr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// FormatRate formats bytesPerSec for logs, such as "5.0MiB/s".
+func FormatRate(bytesPerSec int64) string {
+	switch {
+	case bytesPerSec <= 0:
+		return "unlimited"
+	case bytesPerSec >= 1<<30:
+		return fmt.Sprintf("%.1fGiB/s", float64(bytesPerSec)/(1<<30))
+	case bytesPerSec >= 1<<20:
+		return fmt.Sprintf("%.1fMiB/s", float64(bytesPerSec)/(1<<20))
+	case bytesPerSec >= 1<<10:
+		return fmt.Sprintf("%.1fKiB/s", float64(bytesPerSec)/(1<<10))
+	}
+	return fmt.Sprintf("%dB/s", bytesPerSec)
+}
@@ -0,0 +1,187 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+// fakeClock advances only when slept on.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return nil
+}
+
+func (c *fakeClock) elapsed(start time.Time) time.Duration {
+	return c.Now().Sub(start)
+}
+
+func readThrough(t *testing.T, l *RateLimiter, n int) {
+	t.Helper()
+	if _, err := io.Copy(io.Discard, l.Reader(context.Background(), bytes.NewReader(make([]byte, n)))); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "1000", want: 1000},
+		{in: "500K", want: 500 << 10},
+		{in: "5M", want: 5 << 20},
+		{in: "1.5m", want: 3 << 19},
+		{in: "2G", want: 2 << 30},
+		{in: "5MB/s", want: 5 << 20},
+		{in: "0", wantErr: true},
+		{in: "-1M", wantErr: true},
+		{in: "fast", wantErr: true},
+		{in: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRate(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	tests := map[int64]string{
+		0:         "unlimited",
+		512:       "512B/s",
+		500 << 10: "500.0KiB/s",
+		5 << 20:   "5.0MiB/s",
+		3 << 29:   "1.5GiB/s",
+	}
+	for rate, want := range tests {
+		if got := FormatRate(rate); got != want {
+			t.Errorf("FormatRate(%d) = %q, want %q", rate, got, want)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  int64
+		reads []int
+		want  time.Duration
+	}{
+		{name: "burst is free", rate: 64 << 10, reads: []int{64 << 10}, want: 0},
+		{name: "limited after the burst", rate: 64 << 10, reads: []int{256 << 10}, want: 3 * time.Second},
+		{name: "readers share the bucket", rate: 64 << 10, reads: []int{64 << 10, 64 << 10, 128 << 10}, want: 3 * time.Second},
+		{name: "unlimited", rate: 0, reads: []int{1 << 20}, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clk := &fakeClock{now: time.Unix(0, 0)}
+			start := clk.Now()
+			l := newRateLimiter(tt.rate, clk)
+
+			for _, n := range tt.reads {
+				readThrough(t, l, n)
+			}
+			if got := clk.elapsed(start); got != tt.want {
+				t.Errorf("took %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	l := newRateLimiter(64<<10, clk)
+	readThrough(t, l, 64<<10)
+
+	l.SetRate(128 << 10)
+	start := clk.Now()
+	readThrough(t, l, 256<<10)
+	if got := clk.elapsed(start); got != 2*time.Second {
+		t.Errorf("took %v after raising the rate, want 2s", got)
+	}
+
+	l.SetRate(0)
+	start = clk.Now()
+	readThrough(t, l, 1<<20)
+	if got := clk.elapsed(start); got != 0 {
+		t.Errorf("took %v after removing the limit, want 0", got)
+	}
+	if l.Rate() != 0 {
+		t.Errorf("got rate %d, want 0", l.Rate())
+	}
+}
+
+func TestRateLimiterCanceled(t *testing.T) {
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	l := newRateLimiter(1<<10, clk)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := io.Copy(io.Discard, l.Reader(ctx, bytes.NewReader(make([]byte, 64<<10))))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+}
+
+func TestHTTPClientRateLimit(t *testing.T) {
+	body := make([]byte, 96<<10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	c := NewHTTPClient(&m3u8.DownloadConfig{Timeout: 10, LimitRate: "32K"})
+	if c.RateLimiter().Rate() != 32<<10 {
+		t.Fatalf("got rate %d, want %d", c.RateLimiter().Rate(), 32<<10)
+	}
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	c.limiter = newRateLimiter(32<<10, clk)
+	job := c.WithHeaders(nil)
+
+	start := clk.Now()
+	if _, err := c.Get(context.Background(), ts.URL); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := job.DownloadStream(context.Background(), ts.URL, &buf); err != nil {
+		t.Fatalf("DownloadStream failed: %v", err)
+	}
+
+	// 192K at 32K/s with a 32K burst, shared by both clients.
+	if got := clk.elapsed(start); got != 5*time.Second {
+		t.Errorf("took %v, want 5s", got)
+	}
+}
@@ -0,0 +1,192 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+// RetryPolicy decides which failed requests are retried and how long to wait
+// before each retry.
+type RetryPolicy struct {
+	// Retries is the number of retries after the first attempt.
+	Retries int
+	// BaseWait is the wait before the first retry. It doubles with every
+	// further retry, up to MaxWait.
+	BaseWait time.Duration
+	MaxWait  time.Duration
+	// Jitter moves each wait randomly by up to this fraction of it, so that
+	// workers failing together do not retry together.
+	Jitter float64
+}
+
+// DefaultRetryPolicy returns the policy used for -retries.
+func DefaultRetryPolicy(retries int) RetryPolicy {
+	return RetryPolicy{
+		Retries:  retries,
+		BaseWait: 3 * time.Second,
+		MaxWait:  30 * time.Second,
+		Jitter:   0.2,
+	}
+}
+
+// Retryable reports whether a request that failed with err may succeed if
+// tried again.
+func (p RetryPolicy) Retryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var httpErr *m3u8.HTTPError
+	if errors.As(err, &httpErr) {
+		return retryableStatus(httpErr.StatusCode)
+	}
+	return temporaryError(err)
+}
+
+// temporaryError reports whether err is a failure known to pass, such as a
+// timeout, a stalled body or a connection the server reset or closed. Any
+// other error, such as a certificate that does not verify, an unsupported
+// URL or a failed write to a local file, fails again however often it is
+// tried.
+func temporaryError(err error) bool {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return true
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return true
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED):
+		return true
+	case errors.Is(err, errEmptySegment):
+		return true
+	}
+	return false
+}
+
+// retryableStatus reports whether a response with status code is worth
+// retrying. Client errors are final except for timeouts and rate limiting;
+// server errors are temporary except for those about what the server
+// supports.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported, http.StatusNetworkAuthenticationRequired:
+		return false
+	}
+	return code >= 500
+}
+
+// Backoff returns how long to wait before retry number retry (from 1) of a
+// request whose last attempt failed with err. A Retry-After delay asked for
+// by the server is honored even when it is longer than MaxWait.
+func (p RetryPolicy) Backoff(retry int, err error) time.Duration {
+	wait := p.BaseWait
+	for i := 1; i < retry && wait < p.MaxWait; i++ {
+		wait *= 2
+	}
+	wait = min(wait, p.MaxWait)
+	if p.Jitter > 0 {
+		wait += time.Duration(float64(wait) * p.Jitter * (2*rand.Float64() - 1))
+	}
+
+	var httpErr *m3u8.HTTPError
+	if errors.As(err, &httpErr) && httpErr.RetryAfter > wait {
+		wait = httpErr.RetryAfter
+	}
+	return wait
+}
+
+// RetryBudget caps the retries of every request of one job, so that a job
+// against a failing server gives up instead of retrying each segment in
+// turn. A nil budget is unlimited.
+type RetryBudget struct {
+	left atomic.Int64
+}
+
+// NewRetryBudget returns a budget of n retries, or nil (unlimited) when n is
+// not positive.
+func NewRetryBudget(n int) *RetryBudget {
+	if n <= 0 {
+		return nil
+	}
+	b := &RetryBudget{}
+	b.left.Store(int64(n))
+	return b
+}
+
+// take uses up one retry, reporting false when none is left.
+func (b *RetryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	return b.left.Add(-1) >= 0
+}
+
+// Remaining returns the number of retries left, -1 for an unlimited budget.
+func (b *RetryBudget) Remaining() int {
+	if b == nil {
+		return -1
+	}
+	return int(max(b.left.Load(), 0))
+}
+
+// retry calls attempt until it succeeds, fails with an error the policy does
+// not retry, or runs out of retries or budget. Every failed attempt is
+// reported to the attempt hook of ctx.
+func (c *HTTPClient) retry(ctx context.Context, attempt func() error) error {
+	var err error
+	for n := 0; ; n++ {
+		if n > 0 {
+			if !c.budget.take() {
+				return fmt.Errorf("%w after %d attempts: %w", m3u8.ErrRetryBudget, n, err)
+			}
+			if err := sleepContext(ctx, c.policy.Backoff(n, err)); err != nil {
+				return err
+			}
+		}
+
+		err = attempt()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		reportAttempt(ctx, err)
+
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if !c.policy.Retryable(err) {
+			return err
+		}
+		if n >= c.policy.Retries {
+			return m3u8.NewRetryExhaustedError(c.policy.Retries, err)
+		}
+	}
+}
+
+// permanentError makes retry give up on err whatever the policy says.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,244 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "408", err: m3u8.NewHTTPError(http.StatusRequestTimeout, ""), want: true},
+		{name: "425", err: m3u8.NewHTTPError(http.StatusTooEarly, ""), want: true},
+		{name: "429", err: m3u8.NewHTTPError(http.StatusTooManyRequests, ""), want: true},
+		{name: "403", err: m3u8.NewHTTPError(http.StatusForbidden, "")},
+		{name: "404", err: m3u8.NewHTTPError(http.StatusNotFound, "")},
+		{name: "500", err: m3u8.NewHTTPError(http.StatusInternalServerError, ""), want: true},
+		{name: "503", err: m3u8.NewHTTPError(http.StatusServiceUnavailable, ""), want: true},
+		{name: "501", err: m3u8.NewHTTPError(http.StatusNotImplemented, "")},
+		{name: "505", err: m3u8.NewHTTPError(http.StatusHTTPVersionNotSupported, "")},
+		{name: "range", err: m3u8.NewRangeError("", m3u8.ByteRange{Length: 1}, "ignored")},
+		{name: "canceled", err: context.Canceled},
+		{name: "timeout", err: timeoutError{}, want: true},
+		{name: "stalled body", err: errBodyTimeout{timeout: time.Second}, want: true},
+		{name: "unexpected eof", err: fmt.Errorf("read body: %w", io.ErrUnexpectedEOF), want: true},
+		{name: "connection closed", err: urlError(io.EOF), want: true},
+		{name: "connection reset", err: urlError(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), want: true},
+		{name: "connection refused", err: urlError(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), want: true},
+		{name: "empty segment", err: errEmptySegment, want: true},
+		{name: "certificate verification", err: urlError(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}})},
+		{name: "unknown authority", err: urlError(x509.UnknownAuthorityError{})},
+		{name: "hostname mismatch", err: urlError(x509.HostnameError{Certificate: &x509.Certificate{}, Host: "example.com"})},
+		{name: "unsupported scheme", err: urlError(errors.New(`unsupported protocol scheme "ftp"`))},
+		{name: "malformed url", err: func() error { _, err := url.Parse("http://[::1"); return err }()},
+		{name: "local write", err: &fs.PathError{Op: "write", Path: "000001.ts", Err: syscall.ENOSPC}},
+		{name: "unknown", err: errors.New("something else")},
+	}
+
+	policy := DefaultRetryPolicy(3)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Retryable(tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func urlError(err error) error {
+	return &url.Error{Op: "Get", URL: "http://example.com/seg.ts", Err: err}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseWait: time.Second, MaxWait: 5 * time.Second}
+
+	tests := []struct {
+		retry int
+		err   error
+		want  time.Duration
+	}{
+		{retry: 1, want: time.Second},
+		{retry: 2, want: 2 * time.Second},
+		{retry: 3, want: 4 * time.Second},
+		{retry: 4, want: 5 * time.Second},
+		{retry: 40, want: 5 * time.Second},
+		{retry: 1, err: httpError(http.StatusTooManyRequests, 20*time.Second), want: 20 * time.Second},
+		{retry: 3, err: httpError(http.StatusTooManyRequests, 2*time.Second), want: 4 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := policy.Backoff(tt.retry, tt.err); got != tt.want {
+			t.Errorf("Backoff(%d, %v) = %v, want %v", tt.retry, tt.err, got, tt.want)
+		}
+	}
+
+	policy.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if got := policy.Backoff(2, nil); got < 1600*time.Millisecond || got > 2400*time.Millisecond {
+			t.Fatalf("got %v, want within 20%% of 2s", got)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	if b := NewRetryBudget(0); b != nil || !b.take() || b.Remaining() != -1 {
+		t.Errorf("zero budget is not unlimited")
+	}
+
+	b := NewRetryBudget(2)
+	for i, want := range []bool{true, true, false, false} {
+		if got := b.take(); got != want {
+			t.Errorf("take %d: got %v, want %v", i+1, got, want)
+		}
+	}
+	if got := b.Remaining(); got != 0 {
+		t.Errorf("got %d remaining, want 0", got)
+	}
+}
+
+func TestHTTPClient_RetryBudget(t *testing.T) {
+	var requests atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	client := NewHTTPClient(&m3u8.DownloadConfig{Timeout: 10, Retries: 3, RetryBudget: 2})
+	client.policy.BaseWait = time.Millisecond
+
+	// The first request spends the whole budget...
+	if _, err := client.Get(context.Background(), ts.URL); !errors.Is(err, m3u8.ErrRetryBudget) {
+		t.Errorf("got error %v, want ErrRetryBudget", err)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+
+	// ...so the next one, even streamed, is tried once.
+	requests.Store(0)
+	var buf bytes.Buffer
+	err := client.DownloadStream(context.Background(), ts.URL, &buf)
+	var httpErr *m3u8.HTTPError
+	if !errors.Is(err, m3u8.ErrRetryBudget) || !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got error %v, want ErrRetryBudget wrapping a 503", err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+
+	// A job's own budget starts full.
+	requests.Store(0)
+	client.WithRetryBudget(1).Get(context.Background(), ts.URL)
+	if got := requests.Load(); got != 2 {
+		t.Errorf("got %d requests with a new budget, want 2", got)
+	}
+}
+
+func TestHTTPClient_DownloadStreamRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		wantErr  bool
+		requests int64
+	}{
+		{name: "408 is retried", status: http.StatusRequestTimeout, requests: 2},
+		{name: "502 is retried", status: http.StatusBadGateway, requests: 2},
+		{name: "404 is final", status: http.StatusNotFound, wantErr: true, requests: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if requests.Add(1) == 1 {
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.Write([]byte("segment"))
+			}))
+			defer ts.Close()
+
+			client := NewHTTPClient(&m3u8.DownloadConfig{Timeout: 10, Retries: 2})
+			client.policy.BaseWait = time.Millisecond
+
+			var buf bytes.Buffer
+			err := client.DownloadStream(context.Background(), ts.URL, &buf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && buf.String() != "segment" {
+				t.Errorf("got body %q, want %q", buf.String(), "segment")
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("got %d requests, want %d", got, tt.requests)
+			}
+		})
+	}
+}
+
+func TestHTTPClient_DownloadStreamPartial(t *testing.T) {
+	var requests atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		w.Header().Set("Content-Length", "14")
+		w.Write([]byte("segment"))
+		if n == 1 {
+			// Cut the body short.
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte(" data!!"))
+	}))
+	defer ts.Close()
+
+	client := NewHTTPClient(&m3u8.DownloadConfig{Timeout: 10, Retries: 2})
+	client.policy.BaseWait = time.Millisecond
+
+	var buf bytes.Buffer
+	if err := client.DownloadStream(context.Background(), ts.URL, &buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if buf.String() != "segment data!!" {
+		t.Errorf("got body %q, want the partial attempt discarded", buf.String())
+	}
+
+	// A writer that cannot discard the partial body is not retried.
+	requests.Store(0)
+	var partial bytes.Buffer
+	if err := client.DownloadStream(context.Background(), ts.URL, writerOnly{&partial}); err == nil {
+		t.Error("expected error but got none")
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
+
+// writerOnly hides every method of w but Write.
+type writerOnly struct {
+	w *bytes.Buffer
+}
+
+func (w writerOnly) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
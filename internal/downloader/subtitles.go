@@ -0,0 +1,60 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"m3u8-download/internal/subtitle"
+	"m3u8-download/pkg/m3u8"
+)
+
+// MergeSubtitles merges the WebVTT segments of playlist downloaded into
+// cacheDir into a single subtitle file in format (subtitle.FormatVTT or
+// subtitle.FormatSRT), leaving out the segments at the indices in missing.
+// Unlike MergeFiles it does not concatenate the segments: their cues are
+// moved onto one timeline with each segment's X-TIMESTAMP-MAP, and cues
+// repeated across segment boundaries are written once. The cache directory
+// is checked against the playlist as by MergeFiles.
+func (d *Downloader) MergeSubtitles(ctx context.Context, playlist *m3u8.Playlist, cacheDir, output, format string, missing []int) error {
+	paths, err := segmentFiles(playlist, cacheDir, missing)
+	if err != nil {
+		return err
+	}
+
+	var merger subtitle.Merger
+	for _, filePath := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to read segment: %w", err)
+		}
+
+		seg, err := subtitle.Parse(data)
+		if err != nil {
+			return fmt.Errorf("subtitle segment %s: %w", filepath.Base(filePath), err)
+		}
+		merger.Add(seg)
+	}
+
+	outFile, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer outFile.Close()
+
+	if err := subtitle.Write(outFile, format, merger.Cues()); err != nil {
+		return fmt.Errorf("failed to write subtitles: %w", err)
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			d.logger.Warn("Failed to remove file", "path", path, "error", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"m3u8-download/internal/subtitle"
+	"m3u8-download/pkg/m3u8"
+)
+
+func TestMergeSubtitles(t *testing.T) {
+	// "Good" contains a 0x47 byte, which TS sync byte trimming would cut at;
+	// the second segment has no extension to tell it is WebVTT.
+	segments := map[string]string{
+		"/sub1.vtt":    "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00:01.000 --> 00:00:02.000\nGood morning\n\n00:00:09.000 --> 00:00:10.000\nSee you\n",
+		"/subtitles/2": "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:1800000,LOCAL:00:00:00.000\n\n00:00:00.000 --> 00:00:01.500\nSee you\n\n00:00:03.000 --> 00:00:04.000\n<i>Bye</i>\n",
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for path, body := range segments {
+			if strings.HasSuffix(r.URL.Path, path) {
+				w.Write([]byte(body))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	playlist := &m3u8.Playlist{
+		Segments: []*m3u8.TSInfo{
+			{Name: "000001.ts", Url: ts.URL + "/sub1.vtt"},
+			{Name: "000002.ts", Url: ts.URL + "/subtitles/2?token=x"},
+		},
+	}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: subtitle.FormatVTT,
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nGood morning\n\n" +
+				"00:00:09.000 --> 00:00:11.500\nSee you\n\n00:00:13.000 --> 00:00:14.000\n<i>Bye</i>\n",
+		},
+		{
+			format: subtitle.FormatSRT,
+			want: "1\n00:00:01,000 --> 00:00:02,000\nGood morning\n\n" +
+				"2\n00:00:09,000 --> 00:00:11,500\nSee you\n\n3\n00:00:13,000 --> 00:00:14,000\n<i>Bye</i>\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			cacheDir := t.TempDir()
+			dl := newTestDownloader(t)
+			if _, err := dl.DownloadSegments(context.Background(), playlist, cacheDir, 2); err != nil {
+				t.Fatalf("DownloadSegments failed: %v", err)
+			}
+
+			output := filepath.Join(t.TempDir(), "subs."+tt.format)
+			if err := dl.MergeSubtitles(context.Background(), playlist, cacheDir, output, tt.format, nil); err != nil {
+				t.Fatalf("MergeSubtitles failed: %v", err)
+			}
+
+			data, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", data, tt.want)
+			}
+
+			if entries, _ := os.ReadDir(cacheDir); len(entries) != 0 {
+				t.Errorf("got %d files left in the cache, want 0", len(entries))
+			}
+		})
+	}
+}
+
+func TestMergeSubtitlesInvalidSegment(t *testing.T) {
+	cacheDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(cacheDir, "000001.ts"), []byte("not a subtitle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	playlist := &m3u8.Playlist{Segments: []*m3u8.TSInfo{{Name: "000001.ts"}}}
+	err := newTestDownloader(t).MergeSubtitles(context.Background(), playlist, cacheDir, filepath.Join(t.TempDir(), "subs.vtt"), subtitle.FormatVTT, nil)
+	if err == nil || !strings.Contains(err.Error(), "000001.ts") {
+		t.Errorf("got error %v, want it to name the segment", err)
+	}
+}
@@ -0,0 +1,242 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+// FileName is the name of the manifest inside a job's cache directory.
+const FileName = "manifest.json"
+
+// saveInterval limits how often progress updates are flushed to disk.
+const saveInterval = time.Second
+
+type Status string
+
+const (
+	StatusPending     Status = "pending"
+	StatusDownloading Status = "downloading"
+	StatusCompleted   Status = "completed"
+	StatusFailed      Status = "failed"
+)
+
+// Segment records the download state of one playlist segment.
+type Segment struct {
+	Name   string `json:"name"`
+	Status Status `json:"status"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Manifest is the persistent record of a download job. It keeps the parsed
+// playlist so a resumed job downloads exactly the same segment list.
+type Manifest struct {
+	URL      string         `json:"url"`
+	Playlist *m3u8.Playlist `json:"playlist"`
+	Segments []*Segment     `json:"segments"`
+	// Renditions are the alternate audio and subtitle renditions downloaded
+	// with the playlist, each into its own subdirectory with its own
+	// manifest.
+	Renditions []*m3u8.Rendition `json:"renditions,omitempty"`
+	// Output is the file segments are appended to while they download.
+	// Its first Written segments, WrittenSize bytes, are in place.
+	Output      string    `json:"output,omitempty"`
+	Written     int       `json:"written,omitempty"`
+	WrittenSize int64     `json:"written_size,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	mu        sync.Mutex
+	path      string
+	lastSaved time.Time
+}
+
+func New(cacheDir, url string, playlist *m3u8.Playlist) *Manifest {
+	m := &Manifest{
+		URL:      url,
+		Playlist: playlist,
+		Segments: make([]*Segment, len(playlist.Segments)),
+		path:     filepath.Join(cacheDir, FileName),
+	}
+
+	for i, seg := range playlist.Segments {
+		m.Segments[i] = &Segment{Name: seg.Name, Status: StatusPending}
+	}
+
+	return m
+}
+
+// Load reads the manifest of cacheDir. The error wraps os.ErrNotExist when
+// no manifest has been written yet.
+func Load(cacheDir string) (*Manifest, error) {
+	path := filepath.Join(cacheDir, FileName)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+
+	if m.Playlist == nil || len(m.Segments) != len(m.Playlist.Segments) {
+		return nil, fmt.Errorf("manifest is inconsistent with its playlist")
+	}
+
+	m.path = path
+	return &m, nil
+}
+
+// Save writes the manifest atomically.
+func (m *Manifest) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.save()
+}
+
+func (m *Manifest) save() error {
+	m.UpdatedAt = time.Now()
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	m.lastSaved = m.UpdatedAt
+	return nil
+}
+
+// saveThrottled flushes the manifest unless it was saved very recently.
+// Callers must hold m.mu.
+func (m *Manifest) saveThrottled() error {
+	if time.Since(m.lastSaved) < saveInterval {
+		return nil
+	}
+	return m.save()
+}
+
+// MarkPending records that a segment still has to be downloaded, e.g. after
+// an interrupted attempt.
+func (m *Manifest) MarkPending(index int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Segments[index].Status = StatusPending
+	m.Segments[index].Size = 0
+	m.Segments[index].SHA256 = ""
+	return m.saveThrottled()
+}
+
+func (m *Manifest) MarkDownloading(index int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Segments[index].Status = StatusDownloading
+	m.Segments[index].Size = 0
+	m.Segments[index].SHA256 = ""
+	return m.saveThrottled()
+}
+
+func (m *Manifest) MarkCompleted(index int, size int64, sum string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Segments[index].Status = StatusCompleted
+	m.Segments[index].Size = size
+	m.Segments[index].SHA256 = sum
+	return m.saveThrottled()
+}
+
+func (m *Manifest) MarkFailed(index int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Segments[index].Status = StatusFailed
+	return m.saveThrottled()
+}
+
+// MarkWritten records that the first count segments, size bytes, have been
+// appended to output.
+func (m *Manifest) MarkWritten(output string, count int, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Output = output
+	m.Written = count
+	m.WrittenSize = size
+	return m.saveThrottled()
+}
+
+// CompletedCount returns how many segments are recorded as completed.
+func (m *Manifest) CompletedCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for _, seg := range m.Segments {
+		if seg.Status == StatusCompleted {
+			count++
+		}
+	}
+	return count
+}
+
+// Verify reports whether segment index is recorded as completed and its file
+// in cacheDir still has the recorded size and checksum.
+func (m *Manifest) Verify(cacheDir string, index int) bool {
+	m.mu.Lock()
+	seg := *m.Segments[index]
+	m.mu.Unlock()
+
+	if seg.Status != StatusCompleted {
+		return false
+	}
+
+	path := filepath.Join(cacheDir, seg.Name)
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != seg.Size {
+		return false
+	}
+
+	sum, err := FileChecksum(path)
+	return err == nil && sum == seg.SHA256
+}
+
+// Checksum returns the hex SHA-256 of data as stored in the manifest.
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func FileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
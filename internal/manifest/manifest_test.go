@@ -0,0 +1,103 @@
+package manifest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+func testPlaylist() *m3u8.Playlist {
+	return &m3u8.Playlist{
+		BaseURL: "http://example.com",
+		Segments: []*m3u8.TSInfo{
+			{Name: "000001.ts", Url: "http://example.com/seg1.ts", Sequence: 3},
+			{Name: "000002.ts", Url: "http://example.com/seg2.ts", Sequence: 4,
+				Key: &m3u8.Key{Method: m3u8.MethodAES128, URI: "http://example.com/key", IV: []byte{1, 2, 3}}},
+		},
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	m := New(dir, "http://example.com/video.m3u8", testPlaylist())
+	if err := m.MarkCompleted(0, 3, Checksum([]byte("abc"))); err != nil {
+		t.Fatalf("MarkCompleted failed: %v", err)
+	}
+	if err := m.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if loaded.URL != m.URL {
+		t.Errorf("got URL %q, want %q", loaded.URL, m.URL)
+	}
+	if len(loaded.Playlist.Segments) != 2 {
+		t.Fatalf("got %d playlist segments, want 2", len(loaded.Playlist.Segments))
+	}
+	if key := loaded.Playlist.Segments[1].Key; key == nil || key.URI != "http://example.com/key" || len(key.IV) != 3 {
+		t.Errorf("key not preserved: %+v", key)
+	}
+	if loaded.Playlist.Segments[1].Sequence != 4 {
+		t.Errorf("sequence not preserved")
+	}
+	if loaded.Segments[0].Status != StatusCompleted || loaded.Segments[1].Status != StatusPending {
+		t.Errorf("got statuses %q/%q", loaded.Segments[0].Status, loaded.Segments[1].Status)
+	}
+	if loaded.CompletedCount() != 1 {
+		t.Errorf("got %d completed, want 1", loaded.CompletedCount())
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	_, err := Load(t.TempDir())
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	m := New(dir, "http://example.com/video.m3u8", testPlaylist())
+
+	data := []byte("segment data")
+	path := filepath.Join(dir, "000001.ts")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Verify(dir, 0) {
+		t.Error("pending segment verified")
+	}
+
+	m.MarkCompleted(0, int64(len(data)), Checksum(data))
+	if !m.Verify(dir, 0) {
+		t.Error("completed segment with matching file did not verify")
+	}
+
+	if err := os.WriteFile(path, []byte("segment dat?"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if m.Verify(dir, 0) {
+		t.Error("corrupted segment verified")
+	}
+
+	if err := os.WriteFile(path, data[:4], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if m.Verify(dir, 0) {
+		t.Error("truncated segment verified")
+	}
+
+	m.MarkDownloading(0)
+	if m.Verify(dir, 0) {
+		t.Error("segment marked downloading verified")
+	}
+}
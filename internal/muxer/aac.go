@@ -0,0 +1,65 @@
+package muxer
+
+import "fmt"
+
+// aacSamplesPerFrame is the number of PCM samples in one AAC frame.
+const aacSamplesPerFrame = 1024
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// adtsConfig is the stream configuration carried in every ADTS header.
+type adtsConfig struct {
+	objectType int
+	rateIndex  int
+	channels   int
+}
+
+func (c adtsConfig) sampleRate() int {
+	return aacSampleRates[c.rateIndex]
+}
+
+// audioSpecificConfig builds the MPEG-4 AudioSpecificConfig for c.
+func (c adtsConfig) audioSpecificConfig() []byte {
+	return []byte{
+		byte(c.objectType<<3 | c.rateIndex>>1),
+		byte(c.rateIndex&1<<7 | c.channels<<3),
+	}
+}
+
+// splitADTS returns the raw AAC frames of an ADTS stream and the
+// configuration of its first frame.
+func splitADTS(es []byte) ([][]byte, adtsConfig, error) {
+	var frames [][]byte
+	var cfg adtsConfig
+
+	for len(es) > 0 {
+		if len(es) < 7 || es[0] != 0xFF || es[1]&0xF6 != 0xF0 {
+			return nil, cfg, fmt.Errorf("invalid ADTS header")
+		}
+
+		headerLen := 7
+		if es[1]&1 == 0 {
+			headerLen = 9 // CRC present
+		}
+		frameLen := int(es[3]&0x03)<<11 | int(es[4])<<3 | int(es[5])>>5
+		if frameLen < headerLen || frameLen > len(es) {
+			return nil, cfg, fmt.Errorf("invalid ADTS frame length %d", frameLen)
+		}
+
+		if len(frames) == 0 {
+			cfg = adtsConfig{
+				objectType: int(es[2]>>6) + 1,
+				rateIndex:  int(es[2] >> 2 & 0x0F),
+				channels:   int(es[2]&1)<<2 | int(es[3]>>6),
+			}
+			if cfg.rateIndex >= len(aacSampleRates) {
+				return nil, cfg, fmt.Errorf("invalid ADTS sample rate index %d", cfg.rateIndex)
+			}
+		}
+
+		frames = append(frames, es[headerLen:frameLen])
+		es = es[frameLen:]
+	}
+
+	return frames, cfg, nil
+}
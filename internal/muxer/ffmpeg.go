@@ -0,0 +1,104 @@
+package muxer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// FFmpeg remuxes with an ffmpeg binary, copying the streams as they are.
+type FFmpeg struct {
+	Path   string
+	Format string
+}
+
+// FindFFmpeg looks up ffmpeg on PATH and returns a muxer writing format.
+func FindFFmpeg(format string) (*FFmpeg, error) {
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, ErrFFmpegNotFound
+	}
+	return &FFmpeg{Path: path, Format: format}, nil
+}
+
+func (f *FFmpeg) Name() string {
+	return "ffmpeg"
+}
+
+func (f *FFmpeg) Remux(ctx context.Context, src, dst string) error {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", src, "-c", "copy"}
+	return f.run(ctx, append(append(args, f.formatArgs()...), dst))
+}
+
+// RemuxTracks muxes src with tracks into dst. When audio tracks are given
+// they replace any audio in src. MP4 cannot carry WebVTT, so subtitles are
+// converted to mov_text there.
+func (f *FFmpeg) RemuxTracks(ctx context.Context, src string, tracks []Track, dst string) error {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", src}
+	for _, t := range tracks {
+		args = append(args, "-i", t.Path)
+	}
+
+	hasAudio := false
+	for _, t := range tracks {
+		hasAudio = hasAudio || t.Type == TrackAudio
+	}
+	args = append(args, "-map", "0:v?")
+	if !hasAudio {
+		args = append(args, "-map", "0:a?")
+	}
+
+	var audio, subtitles int
+	for i, t := range tracks {
+		args = append(args, "-map", strconv.Itoa(i+1))
+
+		spec := fmt.Sprintf("s:a:%d", audio)
+		if t.Type == TrackSubtitles {
+			spec = fmt.Sprintf("s:s:%d", subtitles)
+			subtitles++
+		} else {
+			audio++
+		}
+		if t.Language != "" {
+			args = append(args, "-metadata:"+spec, "language="+t.Language)
+		}
+		if t.Name != "" {
+			args = append(args, "-metadata:"+spec, "title="+t.Name)
+		}
+	}
+
+	args = append(args, "-c", "copy")
+	if subtitles > 0 && f.Format == FormatMP4 {
+		args = append(args, "-c:s", "mov_text")
+	}
+	return f.run(ctx, append(append(args, f.formatArgs()...), dst))
+}
+
+func (f *FFmpeg) formatArgs() []string {
+	switch f.Format {
+	case FormatMP4:
+		return []string{"-f", "mp4"}
+	case FormatMKV:
+		return []string{"-f", "matroska"}
+	case FormatTS:
+		return []string{"-f", "mpegts"}
+	}
+	return nil
+}
+
+func (f *FFmpeg) run(ctx context.Context, args []string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, f.Path, args...)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("ffmpeg failed: %w: %s", err, msg)
+		}
+		return fmt.Errorf("ffmpeg failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package muxer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFFmpegRemux(t *testing.T) {
+	// The fake records its arguments and copies the input (after -i) to the
+	// output (the last argument).
+	dir := fakeFFmpeg(t, `echo "$@" > "$(dirname "$0")/args"
+in=""; prev=""
+for a in "$@"; do [ "$prev" = "-i" ] && in="$a"; prev="$a"; done
+cp "$in" "$prev"
+`)
+
+	src := filepath.Join(t.TempDir(), "merged.ts")
+	dst := filepath.Join(t.TempDir(), "video.mkv")
+	if err := os.WriteFile(src, []byte("media"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mux, err := FindFFmpeg(FormatMKV)
+	if err != nil {
+		t.Fatalf("FindFFmpeg failed: %v", err)
+	}
+	if err := mux.Remux(context.Background(), src, dst); err != nil {
+		t.Fatalf("Remux failed: %v", err)
+	}
+
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatalf("failed to read args: %v", err)
+	}
+	want := "-hide_banner -loglevel error -y -i " + src + " -c copy -f matroska " + dst
+	if got := strings.TrimSpace(string(args)); got != want {
+		t.Errorf("got args %q, want %q", got, want)
+	}
+
+	if data, _ := os.ReadFile(dst); string(data) != "media" {
+		t.Errorf("got output %q, want %q", data, "media")
+	}
+}
+
+func TestFFmpegRemuxFailure(t *testing.T) {
+	fakeFFmpeg(t, "echo 'Invalid data found when processing input' >&2\nexit 1\n")
+
+	mux, err := FindFFmpeg(FormatMP4)
+	if err != nil {
+		t.Fatalf("FindFFmpeg failed: %v", err)
+	}
+
+	err = mux.Remux(context.Background(), "in.ts", filepath.Join(t.TempDir(), "out.mp4"))
+	if err == nil || !strings.Contains(err.Error(), "Invalid data found") {
+		t.Errorf("got error %v, want ffmpeg's message", err)
+	}
+}
+
+func TestFFmpegRemuxTracks(t *testing.T) {
+	dir := fakeFFmpeg(t, `echo "$@" > "$(dirname "$0")/args"`+"\n")
+
+	tests := []struct {
+		name   string
+		format string
+		tracks []Track
+		want   string
+	}{
+		{
+			name:   "audio and subtitles into mp4",
+			format: FormatMP4,
+			tracks: []Track{
+				{Path: "en.aac", Type: TrackAudio, Language: "en", Name: "English"},
+				{Path: "de.vtt", Type: TrackSubtitles, Language: "de"},
+			},
+			want: "-hide_banner -loglevel error -y -i main.ts -i en.aac -i de.vtt -map 0:v? " +
+				"-map 1 -metadata:s:a:0 language=en -metadata:s:a:0 title=English " +
+				"-map 2 -metadata:s:s:0 language=de -c copy -c:s mov_text -f mp4 out.mp4",
+		},
+		{
+			name:   "subtitles keep the main audio",
+			format: FormatMKV,
+			tracks: []Track{{Path: "fr.vtt", Type: TrackSubtitles, Language: "fr"}},
+			want:   "-hide_banner -loglevel error -y -i main.ts -i fr.vtt -map 0:v? -map 0:a? -map 1 -metadata:s:s:0 language=fr -c copy -f matroska out.mp4",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, err := FindFFmpeg(tt.format)
+			if err != nil {
+				t.Fatalf("FindFFmpeg failed: %v", err)
+			}
+			if err := mux.RemuxTracks(context.Background(), "main.ts", tt.tracks, "out.mp4"); err != nil {
+				t.Fatalf("RemuxTracks failed: %v", err)
+			}
+
+			args, err := os.ReadFile(filepath.Join(dir, "args"))
+			if err != nil {
+				t.Fatalf("failed to read args: %v", err)
+			}
+			if got := strings.TrimSpace(string(args)); got != tt.want {
+				t.Errorf("got args %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package muxer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// H.264 NAL unit types the remuxer cares about.
+const (
+	nalIDR = 5
+	nalSPS = 7
+	nalPPS = 8
+	nalAUD = 9
+)
+
+// splitNALUnits returns the NAL units of an Annex B byte stream, without
+// start codes and trailing zero bytes.
+func splitNALUnits(es []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+
+	for i := 0; i+2 < len(es); i++ {
+		if es[i] != 0 || es[i+1] != 0 || es[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nals = appendNAL(nals, es[start:i])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 {
+		nals = appendNAL(nals, es[start:])
+	}
+
+	return nals
+}
+
+func appendNAL(nals [][]byte, nal []byte) [][]byte {
+	for len(nal) > 0 && nal[len(nal)-1] == 0 {
+		nal = nal[:len(nal)-1]
+	}
+	if len(nal) == 0 {
+		return nals
+	}
+	return append(nals, nal)
+}
+
+// unescapeRBSP removes emulation prevention bytes (00 00 03).
+func unescapeRBSP(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+var errShortSPS = errors.New("truncated SPS")
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) bit() (uint, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errShortSPS
+	}
+	b := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint(b), nil
+}
+
+func (r *bitReader) bits(n int) (uint, error) {
+	var v uint
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() (uint, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, fmt.Errorf("invalid Exp-Golomb code")
+		}
+	}
+	rest, err := r.bits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return 1<<zeros - 1 + rest, nil
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() (int, error) {
+	v, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	if v%2 == 1 {
+		return int(v+1) / 2, nil
+	}
+	return -int(v / 2), nil
+}
+
+// spsDimensions returns the cropped picture size coded in an SPS NAL unit.
+func spsDimensions(sps []byte) (width, height int, err error) {
+	if len(sps) < 4 {
+		return 0, 0, errShortSPS
+	}
+	r := &bitReader{data: unescapeRBSP(sps[1:])}
+
+	profile, _ := r.bits(8)
+	r.bits(16) // constraint flags and level
+	if _, err := r.ue(); err != nil {
+		return 0, 0, err
+	}
+
+	chromaFormat := uint(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat, err = r.ue(); err != nil {
+			return 0, 0, err
+		}
+		if chromaFormat == 3 {
+			r.bit() // separate_colour_plane_flag
+		}
+		r.ue()  // bit_depth_luma_minus8
+		r.ue()  // bit_depth_chroma_minus8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		present, err := r.bit()
+		if err != nil {
+			return 0, 0, err
+		}
+		if present == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if err := skipScalingList(r, i); err != nil {
+					return 0, 0, err
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	pocType, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch pocType {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		n, err := r.ue()
+		if err != nil {
+			return 0, 0, err
+		}
+		for i := uint(0); i < n; i++ {
+			if _, err := r.se(); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+	widthMBs, _ := r.ue()
+	heightMapUnits, _ := r.ue()
+	frameMBsOnly, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameMBsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint
+	cropping, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if cropping == 1 {
+		cropLeft, _ = r.ue()
+		cropRight, _ = r.ue()
+		cropTop, _ = r.ue()
+		if cropBottom, err = r.ue(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	cropX, cropY := uint(1), 2-frameMBsOnly
+	switch chromaFormat {
+	case 1:
+		cropX, cropY = 2, 2*(2-frameMBsOnly)
+	case 2:
+		cropX = 2
+	}
+
+	width = int((widthMBs+1)*16 - cropX*(cropLeft+cropRight))
+	height = int((2-frameMBsOnly)*(heightMapUnits+1)*16 - cropY*(cropTop+cropBottom))
+	if width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid SPS picture size %dx%d", width, height)
+	}
+	return width, height, nil
+}
+
+func skipScalingList(r *bitReader, i int) error {
+	present, err := r.bit()
+	if err != nil || present == 0 {
+		return err
+	}
+
+	size := 16
+	if i >= 6 {
+		size = 64
+	}
+	last, next := 8, 8
+	for j := 0; j < size; j++ {
+		if next != 0 {
+			delta, err := r.se()
+			if err != nil {
+				return err
+			}
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+	return nil
+}
+
+// avcDecoderConfig builds the avcC record for sps and pps.
+func avcDecoderConfig(sps, pps []byte) []byte {
+	b := []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+	b = appendU16(b, uint16(len(sps)))
+	b = append(b, sps...)
+	b = append(b, 1)
+	b = appendU16(b, uint16(len(pps)))
+	return append(b, pps...)
+}
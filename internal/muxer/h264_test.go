@@ -0,0 +1,125 @@
+package muxer
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// bitWriter builds test bitstreams.
+type bitWriter struct {
+	bits []byte
+}
+
+func (w *bitWriter) u(n int, v uint) {
+	for i := n - 1; i >= 0; i-- {
+		w.bits = append(w.bits, byte(v>>i&1))
+	}
+}
+
+func (w *bitWriter) ue(v uint) {
+	n := 0
+	for x := v + 1; x > 1; x >>= 1 {
+		n++
+	}
+	w.u(n, 0)
+	w.u(n+1, v+1)
+}
+
+func (w *bitWriter) bytes() []byte {
+	w.u(1, 1) // rbsp_stop_one_bit
+	for len(w.bits)%8 != 0 {
+		w.bits = append(w.bits, 0)
+	}
+	out := make([]byte, len(w.bits)/8)
+	for i, b := range w.bits {
+		out[i/8] |= b << (7 - i%8)
+	}
+	return out
+}
+
+// testSPS builds an SPS NAL unit for a progressive 4:2:0 picture of
+// widthMBs x heightMBs macroblocks with cropBottom rows of crop units.
+func testSPS(profile uint, widthMBs, heightMBs, cropBottom uint) []byte {
+	w := &bitWriter{}
+	w.u(8, profile)
+	w.u(8, 0)  // constraint flags
+	w.u(8, 31) // level
+	w.ue(0)    // seq_parameter_set_id
+	if profile == 100 {
+		w.ue(1)   // chroma_format_idc
+		w.ue(0)   // bit_depth_luma_minus8
+		w.ue(0)   // bit_depth_chroma_minus8
+		w.u(1, 0) // qpprime_y_zero_transform_bypass_flag
+		w.u(1, 1) // seq_scaling_matrix_present_flag
+		w.u(1, 1) // first list present, the rest absent
+		for i := 0; i < 16; i++ {
+			w.ue(0) // delta_scale 0 (se)
+		}
+		w.u(7, 0)
+	}
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(0) // pic_order_cnt_type
+	w.ue(0) // log2_max_pic_order_cnt_lsb_minus4
+	w.ue(1) // max_num_ref_frames
+	w.u(1, 0)
+	w.ue(widthMBs - 1)
+	w.ue(heightMBs - 1)
+	w.u(1, 1) // frame_mbs_only_flag
+	w.u(1, 1) // direct_8x8_inference_flag
+	if cropBottom > 0 {
+		w.u(1, 1)
+		w.ue(0)
+		w.ue(0)
+		w.ue(0)
+		w.ue(cropBottom)
+	} else {
+		w.u(1, 0)
+	}
+	w.u(1, 0) // vui_parameters_present_flag
+
+	return append([]byte{0x67}, w.bytes()...)
+}
+
+func TestSPSDimensions(t *testing.T) {
+	tests := []struct {
+		name       string
+		sps        []byte
+		wantWidth  int
+		wantHeight int
+	}{
+		{name: "baseline", sps: testSPS(66, 40, 30, 0), wantWidth: 640, wantHeight: 480},
+		{name: "cropped 1080p", sps: testSPS(66, 120, 68, 4), wantWidth: 1920, wantHeight: 1080},
+		{name: "high profile with scaling list", sps: testSPS(100, 80, 45, 0), wantWidth: 1280, wantHeight: 720},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height, err := spsDimensions(tt.sps)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if width != tt.wantWidth || height != tt.wantHeight {
+				t.Errorf("got %dx%d, want %dx%d", width, height, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+
+	if _, _, err := spsDimensions([]byte{0x67, 66, 0}); err == nil {
+		t.Error("expected error for truncated SPS")
+	}
+}
+
+func TestSplitNALUnits(t *testing.T) {
+	es := []byte{0, 0, 0, 1, 0x09, 0xF0, 0, 0, 1, 0x67, 1, 2, 0, 0, 0, 1, 0x65, 0, 0, 3, 1}
+
+	got := splitNALUnits(es)
+	want := [][]byte{{0x09, 0xF0}, {0x67, 1, 2}, {0x65, 0, 0, 3, 1}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := unescapeRBSP([]byte{0x65, 0, 0, 3, 1}); !bytes.Equal(got, []byte{0x65, 0, 0, 1}) {
+		t.Errorf("got unescaped %v", got)
+	}
+}
@@ -0,0 +1,359 @@
+package muxer
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// movieTimescale is the timescale of the movie header and edit lists.
+const movieTimescale = 1000
+
+// track collects the samples of one elementary stream while the remuxer
+// writes their data, and builds its trak box afterwards.
+type track struct {
+	id        uint32
+	video     bool
+	timescale uint32
+
+	// Video codec configuration.
+	sps, pps      []byte
+	width, height int
+	// Audio codec configuration.
+	aac adtsConfig
+
+	sizes   []uint32
+	offsets []uint64
+	syncs   []uint32
+	// dts and pts are in the track timescale, unwrapped.
+	dts, pts []int64
+}
+
+func (t *track) addSample(offset uint64, size int, dts, pts int64, sync bool) {
+	t.sizes = append(t.sizes, uint32(size))
+	t.offsets = append(t.offsets, offset)
+	t.dts = append(t.dts, dts)
+	t.pts = append(t.pts, pts)
+	if sync {
+		t.syncs = append(t.syncs, uint32(len(t.sizes)))
+	}
+}
+
+// durations returns the duration of each sample. Timestamps that go
+// backwards or jump by more than ten seconds, as they do across a
+// discontinuity, are replaced by the previous sample's duration.
+func (t *track) durations() []uint32 {
+	durs := make([]uint32, len(t.dts))
+	if !t.video {
+		for i := range durs {
+			durs[i] = aacSamplesPerFrame
+		}
+		return durs
+	}
+
+	last := int64(t.timescale / 25)
+	for i := 0; i+1 < len(t.dts); i++ {
+		d := t.dts[i+1] - t.dts[i]
+		if d <= 0 || d > 10*int64(t.timescale) {
+			d = last
+		}
+		durs[i] = uint32(d)
+		last = d
+	}
+	if len(durs) > 0 {
+		durs[len(durs)-1] = uint32(last)
+	}
+	return durs
+}
+
+// mediaStart returns the earliest presentation time at the start of the
+// track in 90 kHz units. Only the first samples are looked at, enough to
+// cover reordered frames, since timestamps may restart after a
+// discontinuity.
+func (t *track) mediaStart() int64 {
+	start := int64(math.MaxInt64)
+	for _, pts := range t.pts[:min(len(t.pts), 32)] {
+		start = min(start, pts)
+	}
+	return start * 90000 / int64(t.timescale)
+}
+
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = appendU32(b, uint32(size))
+	b = append(b, typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func fullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := appendU32(nil, uint32(version)<<24|flags)
+	return box(typ, append([][]byte{header}, payload...)...)
+}
+
+func appendU16(b []byte, v uint16) []byte { return binary.BigEndian.AppendUint16(b, v) }
+func appendU32(b []byte, v uint32) []byte { return binary.BigEndian.AppendUint32(b, v) }
+func appendU64(b []byte, v uint64) []byte { return binary.BigEndian.AppendUint64(b, v) }
+
+var unityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+func appendMatrix(b []byte) []byte {
+	for _, v := range unityMatrix {
+		b = appendU32(b, v)
+	}
+	return b
+}
+
+func ftypBox() []byte {
+	var b []byte
+	b = append(b, "isom"...)
+	b = appendU32(b, 0x200)
+	b = append(b, "isomiso2avc1mp41"...)
+	return box("ftyp", b)
+}
+
+// moovBox builds the movie box for tracks. Tracks that start later than the
+// earliest one get an empty edit so audio and video stay in sync.
+func moovBox(tracks []*track) []byte {
+	start := int64(math.MaxInt64)
+	for _, t := range tracks {
+		start = min(start, t.mediaStart())
+	}
+
+	var traks [][]byte
+	var movieDuration uint64
+	for _, t := range tracks {
+		trak, duration := t.trakBox(start)
+		traks = append(traks, trak)
+		movieDuration = max(movieDuration, duration)
+	}
+
+	var mvhd []byte
+	mvhd = appendU32(mvhd, 0) // creation time
+	mvhd = appendU32(mvhd, 0) // modification time
+	mvhd = appendU32(mvhd, movieTimescale)
+	mvhd = appendU32(mvhd, uint32(movieDuration))
+	mvhd = appendU32(mvhd, 0x00010000) // rate
+	mvhd = appendU16(mvhd, 0x0100)     // volume
+	mvhd = append(mvhd, make([]byte, 10)...)
+	mvhd = appendMatrix(mvhd)
+	mvhd = append(mvhd, make([]byte, 24)...)
+	mvhd = appendU32(mvhd, uint32(len(tracks)+1))
+
+	return box("moov", append([][]byte{fullBox("mvhd", 0, 0, mvhd)}, traks...)...)
+}
+
+// trakBox returns the trak box of t and its duration in the movie
+// timescale, including any leading empty edit. movieStart is the earliest
+// presentation time of all tracks in 90 kHz units.
+func (t *track) trakBox(movieStart int64) ([]byte, uint64) {
+	durs := t.durations()
+	var mediaDuration uint64
+	for _, d := range durs {
+		mediaDuration += uint64(d)
+	}
+
+	delay := uint64(t.mediaStart()-movieStart) * movieTimescale / 90000
+	editDuration := mediaDuration * movieTimescale / uint64(t.timescale)
+	// The first presented sample is not necessarily the first decoded one.
+	var mediaTime int64
+	if len(t.dts) > 0 {
+		mediaTime = t.mediaStart()*int64(t.timescale)/90000 - t.dts[0]
+	}
+
+	var elst []byte
+	entries := uint32(1)
+	if delay > 0 {
+		entries = 2
+	}
+	elst = appendU32(elst, entries)
+	if delay > 0 {
+		elst = appendU32(elst, uint32(delay))
+		elst = appendU32(elst, 0xFFFFFFFF) // media time -1: empty edit
+		elst = appendU32(elst, 0x00010000)
+	}
+	elst = appendU32(elst, uint32(editDuration))
+	elst = appendU32(elst, uint32(max(mediaTime, 0)))
+	elst = appendU32(elst, 0x00010000)
+
+	var tkhd []byte
+	tkhd = appendU32(tkhd, 0) // creation time
+	tkhd = appendU32(tkhd, 0) // modification time
+	tkhd = appendU32(tkhd, t.id)
+	tkhd = appendU32(tkhd, 0)
+	tkhd = appendU32(tkhd, uint32(delay+editDuration))
+	tkhd = append(tkhd, make([]byte, 8)...)
+	tkhd = appendU16(tkhd, 0) // layer
+	tkhd = appendU16(tkhd, 0) // alternate group
+	if t.video {
+		tkhd = appendU16(tkhd, 0)
+	} else {
+		tkhd = appendU16(tkhd, 0x0100)
+	}
+	tkhd = appendU16(tkhd, 0)
+	tkhd = appendMatrix(tkhd)
+	tkhd = appendU32(tkhd, uint32(t.width)<<16)
+	tkhd = appendU32(tkhd, uint32(t.height)<<16)
+
+	var mdhd []byte
+	mdhd = appendU32(mdhd, 0) // creation time
+	mdhd = appendU32(mdhd, 0) // modification time
+	mdhd = appendU32(mdhd, t.timescale)
+	mdhd = appendU32(mdhd, uint32(mediaDuration))
+	mdhd = appendU16(mdhd, 0x55C4) // "und"
+	mdhd = appendU16(mdhd, 0)
+
+	handler, name, header := "vide", "VideoHandler", fullBox("vmhd", 0, 1, make([]byte, 8))
+	if !t.video {
+		handler, name, header = "soun", "SoundHandler", fullBox("smhd", 0, 0, make([]byte, 4))
+	}
+	var hdlr []byte
+	hdlr = appendU32(hdlr, 0)
+	hdlr = append(hdlr, handler...)
+	hdlr = append(hdlr, make([]byte, 12)...)
+	hdlr = append(hdlr, name...)
+	hdlr = append(hdlr, 0)
+
+	dref := fullBox("dref", 0, 0, appendU32(nil, 1), fullBox("url ", 0, 1))
+
+	trak := box("trak",
+		fullBox("tkhd", 0, 3, tkhd),
+		box("edts", fullBox("elst", 0, 0, elst)),
+		box("mdia",
+			fullBox("mdhd", 0, 0, mdhd),
+			fullBox("hdlr", 0, 0, hdlr),
+			box("minf", header, box("dinf", dref), t.stblBox(durs)),
+		),
+	)
+	return trak, delay + editDuration
+}
+
+func (t *track) stblBox(durs []uint32) []byte {
+	boxes := [][]byte{
+		fullBox("stsd", 0, 0, appendU32(nil, 1), t.sampleEntry()),
+		fullBox("stts", 0, 0, runLengths(durs)),
+	}
+
+	if t.video {
+		cts := make([]uint32, len(t.pts))
+		nonzero := false
+		for i := range t.pts {
+			cts[i] = uint32(max(t.pts[i]-t.dts[i], 0))
+			nonzero = nonzero || cts[i] != 0
+		}
+		if nonzero {
+			boxes = append(boxes, fullBox("ctts", 0, 0, runLengths(cts)))
+		}
+
+		stss := appendU32(nil, uint32(len(t.syncs)))
+		for _, s := range t.syncs {
+			stss = appendU32(stss, s)
+		}
+		boxes = append(boxes, fullBox("stss", 0, 0, stss))
+	}
+
+	// Every sample is its own chunk.
+	stsc := appendU32(nil, 1)
+	stsc = appendU32(stsc, 1)
+	stsc = appendU32(stsc, 1)
+	stsc = appendU32(stsc, 1)
+	boxes = append(boxes, fullBox("stsc", 0, 0, stsc))
+
+	stsz := appendU32(nil, 0)
+	stsz = appendU32(stsz, uint32(len(t.sizes)))
+	for _, s := range t.sizes {
+		stsz = appendU32(stsz, s)
+	}
+	boxes = append(boxes, fullBox("stsz", 0, 0, stsz))
+
+	large := len(t.offsets) > 0 && t.offsets[len(t.offsets)-1] > math.MaxUint32
+	chunks := appendU32(nil, uint32(len(t.offsets)))
+	for _, off := range t.offsets {
+		if large {
+			chunks = appendU64(chunks, off)
+		} else {
+			chunks = appendU32(chunks, uint32(off))
+		}
+	}
+	if large {
+		boxes = append(boxes, fullBox("co64", 0, 0, chunks))
+	} else {
+		boxes = append(boxes, fullBox("stco", 0, 0, chunks))
+	}
+
+	return box("stbl", boxes...)
+}
+
+// runLengths encodes values as the (count, value) pairs of stts and ctts.
+func runLengths(values []uint32) []byte {
+	var runs []byte
+	entries, count := uint32(0), uint32(0)
+	for i, v := range values {
+		count++
+		if i+1 == len(values) || values[i+1] != v {
+			runs = appendU32(runs, count)
+			runs = appendU32(runs, v)
+			entries++
+			count = 0
+		}
+	}
+	return append(appendU32(nil, entries), runs...)
+}
+
+func (t *track) sampleEntry() []byte {
+	if t.video {
+		var avc1 []byte
+		avc1 = append(avc1, make([]byte, 6)...)
+		avc1 = appendU16(avc1, 1) // data reference index
+		avc1 = append(avc1, make([]byte, 16)...)
+		avc1 = appendU16(avc1, uint16(t.width))
+		avc1 = appendU16(avc1, uint16(t.height))
+		avc1 = appendU32(avc1, 0x00480000) // 72 dpi
+		avc1 = appendU32(avc1, 0x00480000)
+		avc1 = appendU32(avc1, 0)
+		avc1 = appendU16(avc1, 1) // frame count
+		avc1 = append(avc1, make([]byte, 32)...)
+		avc1 = appendU16(avc1, 0x0018)
+		avc1 = appendU16(avc1, 0xFFFF)
+		return box("avc1", avc1, box("avcC", avcDecoderConfig(t.sps, t.pps)))
+	}
+
+	rate := min(t.aac.sampleRate(), math.MaxUint16)
+	var mp4a []byte
+	mp4a = append(mp4a, make([]byte, 6)...)
+	mp4a = appendU16(mp4a, 1) // data reference index
+	mp4a = append(mp4a, make([]byte, 8)...)
+	mp4a = appendU16(mp4a, uint16(t.aac.channels))
+	mp4a = appendU16(mp4a, 16) // sample size
+	mp4a = appendU32(mp4a, 0)
+	mp4a = appendU32(mp4a, uint32(rate)<<16)
+	return box("mp4a", mp4a, fullBox("esds", 0, 0, esDescriptor(t.id, t.aac.audioSpecificConfig())))
+}
+
+// esDescriptor builds the ES_Descriptor of an AAC esds box.
+func esDescriptor(id uint32, asc []byte) []byte {
+	var dsi []byte
+	dsi = append(dsi, 0x05, byte(len(asc)))
+	dsi = append(dsi, asc...)
+
+	var dcd []byte
+	dcd = append(dcd, 0x40)                   // MPEG-4 audio
+	dcd = append(dcd, 0x15)                   // audio stream
+	dcd = append(dcd, 0, 0, 0)                // buffer size
+	dcd = append(dcd, 0, 0, 0, 0, 0, 0, 0, 0) // max and average bitrate
+	dcd = append(dcd, dsi...)
+
+	var es []byte
+	es = appendU16(es, uint16(id))
+	es = append(es, 0)
+	es = append(es, 0x04, byte(len(dcd)))
+	es = append(es, dcd...)
+	es = append(es, 0x06, 1, 0x02) // SL config: predefined MP4
+
+	return append([]byte{0x03, byte(len(es))}, es...)
+}
@@ -0,0 +1,108 @@
+// Package muxer converts a merged download into the container the user asked
+// for.
+package muxer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Output container formats.
+const (
+	FormatTS  = "ts"
+	FormatMP4 = "mp4"
+	FormatMKV = "mkv"
+)
+
+var (
+	ErrFFmpegNotFound    = errors.New("ffmpeg not found in PATH")
+	ErrUnsupportedStream = errors.New("unsupported elementary stream")
+)
+
+// Track types.
+const (
+	TrackAudio     = "audio"
+	TrackSubtitles = "subtitles"
+)
+
+// Track is a separately downloaded audio or subtitle stream muxed into the
+// output next to the main media file.
+type Track struct {
+	Path     string
+	Type     string
+	Language string
+	Name     string
+}
+
+// Muxer rewrites the media file src into dst without re-encoding.
+type Muxer interface {
+	Name() string
+	Remux(ctx context.Context, src, dst string) error
+}
+
+// TrackMuxer combines a media file with extra tracks into one output.
+type TrackMuxer interface {
+	Name() string
+	RemuxTracks(ctx context.Context, src string, tracks []Track, dst string) error
+}
+
+// ValidateFormat reports whether format is an output container we can write.
+// An empty format means "decide from the output name".
+func ValidateFormat(format string) error {
+	switch format {
+	case "", FormatTS, FormatMP4, FormatMKV:
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// FormatFromPath returns the container format named by the extension of
+// path, or "" when the extension is not one we write.
+func FormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ts":
+		return FormatTS
+	case ".mp4", ".m4v":
+		return FormatMP4
+	case ".mkv":
+		return FormatMKV
+	}
+	return ""
+}
+
+// Select returns the muxer that turns a merged download in container src
+// into format, or nil when the merged file already is in that format.
+// ffmpeg is preferred when it is on PATH; without it only MPEG-TS to MP4 is
+// possible, with the built-in remuxer.
+func Select(src, format string) (Muxer, error) {
+	if src == format {
+		return nil, nil
+	}
+
+	ffmpeg, err := FindFFmpeg(format)
+	if err == nil {
+		return ffmpeg, nil
+	}
+
+	if src == FormatTS && format == FormatMP4 {
+		return TSToMP4{}, nil
+	}
+	return nil, fmt.Errorf("converting %s to %s: %w", src, format, err)
+}
+
+// SelectTracks returns the muxer that combines the main download with extra
+// tracks into format. Only ffmpeg can do this, and only for MP4 and
+// Matroska; for MPEG-TS it returns nil and the tracks stay separate files.
+func SelectTracks(format string) (TrackMuxer, error) {
+	if format == FormatTS {
+		return nil, nil
+	}
+	ffmpeg, err := FindFFmpeg(format)
+	if err != nil {
+		return nil, fmt.Errorf("adding tracks to %s: %w", format, err)
+	}
+	return ffmpeg, nil
+}
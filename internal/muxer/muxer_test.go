@@ -0,0 +1,108 @@
+package muxer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeFFmpeg puts an ffmpeg script running body first on PATH.
+func fakeFFmpeg(t *testing.T, body string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatalf("failed to write fake ffmpeg: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return dir
+}
+
+func TestFormatFromPath(t *testing.T) {
+	tests := map[string]string{
+		"video.ts":      FormatTS,
+		"video.MP4":     FormatMP4,
+		"video.m4v":     FormatMP4,
+		"dir/video.mkv": FormatMKV,
+		"video.avi":     "",
+		"video":         "",
+	}
+
+	for path, want := range tests {
+		if got := FormatFromPath(path); got != want {
+			t.Errorf("FormatFromPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	for _, format := range []string{"", "ts", "mp4", "mkv"} {
+		if err := ValidateFormat(format); err != nil {
+			t.Errorf("ValidateFormat(%q) = %v, want nil", format, err)
+		}
+	}
+	for _, format := range []string{"avi", "MP4", ".mp4"} {
+		if err := ValidateFormat(format); err == nil {
+			t.Errorf("ValidateFormat(%q) = nil, want error", format)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		name      string
+		ffmpeg    bool
+		src       string
+		format    string
+		wantMuxer string
+		wantErr   error
+	}{
+		{name: "same container", src: "ts", format: "ts"},
+		{name: "fMP4 to mp4", src: "mp4", format: "mp4"},
+		{name: "built-in TS to MP4", src: "ts", format: "mp4", wantMuxer: "built-in"},
+		{name: "mkv needs ffmpeg", src: "ts", format: "mkv", wantErr: ErrFFmpegNotFound},
+		{name: "fMP4 to ts needs ffmpeg", src: "mp4", format: "ts", wantErr: ErrFFmpegNotFound},
+		{name: "ffmpeg preferred", ffmpeg: true, src: "ts", format: "mp4", wantMuxer: "ffmpeg"},
+		{name: "ffmpeg for mkv", ffmpeg: true, src: "mp4", format: "mkv", wantMuxer: "ffmpeg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.ffmpeg {
+				fakeFFmpeg(t, "exit 0\n")
+			} else {
+				t.Setenv("PATH", t.TempDir())
+			}
+
+			mux, err := Select(tt.src, tt.format)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			var got string
+			if mux != nil {
+				got = mux.Name()
+			}
+			if got != tt.wantMuxer {
+				t.Errorf("got muxer %q, want %q", got, tt.wantMuxer)
+			}
+		})
+	}
+}
+
+func TestSelectTracks(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	if mux, err := SelectTracks(FormatTS); mux != nil || err != nil {
+		t.Errorf("got %v, %v for ts, want no muxer", mux, err)
+	}
+	if _, err := SelectTracks(FormatMKV); !errors.Is(err, ErrFFmpegNotFound) {
+		t.Errorf("got error %v, want ErrFFmpegNotFound", err)
+	}
+
+	fakeFFmpeg(t, "exit 0\n")
+	if mux, err := SelectTracks(FormatMP4); err != nil || mux == nil || mux.Name() != "ffmpeg" {
+		t.Errorf("got %v, %v, want ffmpeg", mux, err)
+	}
+}
@@ -0,0 +1,451 @@
+package muxer
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const tsPacketSize = 188
+
+// MPEG-TS stream types.
+const (
+	streamTypeH264 = 0x1B
+	streamTypeAAC  = 0x0F
+)
+
+// unsupportedStreamTypes are audio and video stream types the built-in
+// remuxer cannot carry over; dropping them silently would lose a track.
+var unsupportedStreamTypes = map[byte]string{
+	0x01: "MPEG-1 video",
+	0x02: "MPEG-2 video",
+	0x03: "MPEG-1 audio",
+	0x04: "MPEG-2 audio",
+	0x10: "MPEG-4 video",
+	0x11: "AAC LATM",
+	0x24: "HEVC",
+	0x81: "AC-3",
+	0x87: "E-AC-3",
+	0xCF: "SAMPLE-AES AAC",
+	0xDB: "SAMPLE-AES H.264",
+}
+
+// TSToMP4 remuxes MPEG-TS with H.264 video and ADTS AAC audio into MP4
+// without external tools.
+type TSToMP4 struct{}
+
+func (TSToMP4) Name() string {
+	return "built-in"
+}
+
+func (TSToMP4) Remux(ctx context.Context, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	err = remuxTS(ctx, bufio.NewReaderSize(in, 1<<20), out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// remuxTS writes the H.264 and AAC streams of the transport stream r to out
+// as an MP4 file: ftyp, then the samples in one mdat as they are demuxed,
+// then the moov describing them.
+func remuxTS(ctx context.Context, r *bufio.Reader, out *os.File) error {
+	w := bufio.NewWriterSize(out, 1<<20)
+
+	ftyp := ftypBox()
+	w.Write(ftyp)
+	mdatStart := int64(len(ftyp))
+	// A 64-bit size, patched once all samples are written.
+	w.Write(appendU64(append(appendU32(nil, 1), "mdat"...), 0))
+
+	m := &tsRemuxer{
+		w:        w,
+		offset:   uint64(mdatStart) + 16,
+		pmtPID:   -1,
+		videoPID: -1,
+		audioPID: -1,
+		pes:      make(map[int][]byte),
+	}
+	if err := m.run(ctx, r); err != nil {
+		return err
+	}
+
+	var tracks []*track
+	for _, t := range []*track{m.video, m.audio} {
+		if t != nil && len(t.sizes) > 0 {
+			t.id = uint32(len(tracks) + 1)
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		return fmt.Errorf("%w: no H.264 or AAC samples found", ErrUnsupportedStream)
+	}
+	if m.audioPID >= 0 && (m.audio == nil || len(m.audio.sizes) == 0) {
+		return fmt.Errorf("%w: audio is not ADTS AAC", ErrUnsupportedStream)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := out.WriteAt(appendU64(nil, m.offset-uint64(mdatStart)), mdatStart+8); err != nil {
+		return err
+	}
+	if _, err := w.Write(moovBox(tracks)); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+type tsRemuxer struct {
+	w      *bufio.Writer
+	offset uint64
+
+	pmtPID, videoPID, audioPID int
+	pes                        map[int][]byte
+
+	video, audio           *track
+	videoClock, audioClock clock
+}
+
+func (m *tsRemuxer) run(ctx context.Context, r *bufio.Reader) error {
+	pkt := make([]byte, tsPacketSize)
+
+	for n := 0; ; n++ {
+		if n%4096 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err := readPacket(r, pkt); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+
+		pid := int(binary.BigEndian.Uint16(pkt[1:3]) & 0x1FFF)
+		start := pkt[1]&0x40 != 0
+		payload := packetPayload(pkt)
+		if payload == nil {
+			continue
+		}
+
+		switch pid {
+		case 0:
+			if m.pmtPID < 0 && start {
+				m.pmtPID = parsePAT(payload)
+			}
+		case m.pmtPID:
+			if start && m.videoPID < 0 && m.audioPID < 0 {
+				if err := m.parsePMT(payload); err != nil {
+					return err
+				}
+			}
+		case m.videoPID, m.audioPID:
+			if start {
+				if err := m.flushPES(pid); err != nil {
+					return err
+				}
+				m.pes[pid] = append(m.pes[pid][:0], payload...)
+			} else if len(m.pes[pid]) > 0 {
+				m.pes[pid] = append(m.pes[pid], payload...)
+			}
+		}
+	}
+
+	if m.pmtPID < 0 || (m.videoPID < 0 && m.audioPID < 0) {
+		return fmt.Errorf("%w: no PAT/PMT with H.264 or AAC streams", ErrUnsupportedStream)
+	}
+	for _, pid := range []int{m.videoPID, m.audioPID} {
+		if err := m.flushPES(pid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPacket reads the next TS packet, skipping bytes until a sync byte.
+// A truncated last packet counts as the end of the stream.
+func readPacket(r *bufio.Reader, pkt []byte) error {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == 0x47 {
+			break
+		}
+	}
+	pkt[0] = 0x47
+	if _, err := io.ReadFull(r, pkt[1:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return io.EOF
+		}
+		return err
+	}
+	return nil
+}
+
+func packetPayload(pkt []byte) []byte {
+	if pkt[3]&0x10 == 0 {
+		return nil
+	}
+	off := 4
+	if pkt[3]&0x20 != 0 {
+		off += 1 + int(pkt[4])
+	}
+	if off >= tsPacketSize {
+		return nil
+	}
+	return pkt[off:]
+}
+
+// psiSection returns the section after the pointer field of a PSI payload.
+func psiSection(payload []byte) []byte {
+	if len(payload) < 1 || 1+int(payload[0]) > len(payload) {
+		return nil
+	}
+	section := payload[1+int(payload[0]):]
+	if len(section) < 3 {
+		return nil
+	}
+	end := 3 + int(binary.BigEndian.Uint16(section[1:3])&0x0FFF)
+	if end > len(section) {
+		return nil
+	}
+	return section[:end]
+}
+
+// parsePAT returns the PMT PID of the first program, or -1.
+func parsePAT(payload []byte) int {
+	section := psiSection(payload)
+	if len(section) < 12 {
+		return -1
+	}
+	for p := section[8 : len(section)-4]; len(p) >= 4; p = p[4:] {
+		if binary.BigEndian.Uint16(p[0:2]) != 0 {
+			return int(binary.BigEndian.Uint16(p[2:4]) & 0x1FFF)
+		}
+	}
+	return -1
+}
+
+func (m *tsRemuxer) parsePMT(payload []byte) error {
+	section := psiSection(payload)
+	if len(section) < 16 {
+		return nil
+	}
+	infoLen := int(binary.BigEndian.Uint16(section[10:12]) & 0x0FFF)
+	if 12+infoLen > len(section)-4 {
+		return nil
+	}
+
+	for p := section[12+infoLen : len(section)-4]; len(p) >= 5; {
+		streamType := p[0]
+		pid := int(binary.BigEndian.Uint16(p[1:3]) & 0x1FFF)
+		esInfoLen := int(binary.BigEndian.Uint16(p[3:5]) & 0x0FFF)
+
+		switch {
+		case streamType == streamTypeH264 && m.videoPID < 0:
+			m.videoPID = pid
+		case streamType == streamTypeAAC && m.audioPID < 0:
+			m.audioPID = pid
+		case unsupportedStreamTypes[streamType] != "":
+			return fmt.Errorf("%w: %s (stream type 0x%02X)", ErrUnsupportedStream, unsupportedStreamTypes[streamType], streamType)
+		}
+
+		if 5+esInfoLen > len(p) {
+			break
+		}
+		p = p[5+esInfoLen:]
+	}
+	return nil
+}
+
+// flushPES turns the buffered PES packet of pid into samples.
+func (m *tsRemuxer) flushPES(pid int) error {
+	data := m.pes[pid]
+	if pid < 0 || len(data) == 0 {
+		return nil
+	}
+	m.pes[pid] = data[:0]
+
+	es, pts, dts, ok := parsePES(data)
+	if !ok {
+		return nil
+	}
+
+	if pid == m.videoPID {
+		return m.addVideo(es, pts, dts)
+	}
+	return m.addAudio(es, pts)
+}
+
+// parsePES returns the payload and timestamps of a PES packet. dts equals
+// pts when the packet has no DTS; both are -1 without a PTS.
+func parsePES(data []byte) (es []byte, pts, dts int64, ok bool) {
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return nil, 0, 0, false
+	}
+	headerEnd := 9 + int(data[8])
+	if headerEnd > len(data) {
+		return nil, 0, 0, false
+	}
+
+	pts, dts = -1, -1
+	flags := data[7]
+	if flags&0x80 != 0 && len(data) >= 14 {
+		pts = readTimestamp(data[9:14])
+		dts = pts
+	}
+	if flags&0x40 != 0 && len(data) >= 19 {
+		dts = readTimestamp(data[14:19])
+	}
+
+	es = data[headerEnd:]
+	if n := int(binary.BigEndian.Uint16(data[4:6])); n > 0 && 6+n < len(data) {
+		es = data[headerEnd : 6+n]
+	}
+	return es, pts, dts, true
+}
+
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// clock unwraps 33-bit MPEG-TS timestamps into a monotonic timeline.
+type clock struct {
+	last, base int64
+	set        bool
+}
+
+func (c *clock) unwrap(ts int64) int64 {
+	if c.set {
+		switch diff := ts - c.last; {
+		case diff < -(1 << 32):
+			c.base += 1 << 33
+		case diff > 1<<32:
+			c.base -= 1 << 33
+		}
+	}
+	c.last, c.set = ts, true
+	return ts + c.base
+}
+
+func (m *tsRemuxer) addVideo(es []byte, pts, dts int64) error {
+	if m.video == nil {
+		m.video = &track{video: true, timescale: 90000}
+	}
+	t := m.video
+
+	var sample []byte
+	key := false
+	for _, nal := range splitNALUnits(es) {
+		switch nal[0] & 0x1F {
+		case nalSPS:
+			if t.sps == nil {
+				width, height, err := spsDimensions(nal)
+				if err != nil {
+					return fmt.Errorf("invalid H.264 SPS: %w", err)
+				}
+				t.sps, t.width, t.height = append([]byte(nil), nal...), width, height
+			}
+			continue
+		case nalPPS:
+			if t.pps == nil {
+				t.pps = append([]byte(nil), nal...)
+			}
+			continue
+		case nalAUD:
+			continue
+		case nalIDR:
+			key = true
+		}
+		sample = appendU32(sample, uint32(len(nal)))
+		sample = append(sample, nal...)
+	}
+
+	// Start at the first key frame that can be decoded.
+	if len(sample) == 0 || t.sps == nil || t.pps == nil || (len(t.sizes) == 0 && !key) {
+		return nil
+	}
+
+	switch {
+	case dts >= 0:
+		dts = m.videoClock.unwrap(dts)
+		pts = dts + signedDiff(pts, m.videoClock.last)
+	case len(t.dts) > 0:
+		dts = t.dts[len(t.dts)-1] + int64(t.timescale/25)
+		pts = dts
+	default:
+		dts, pts = 0, 0
+	}
+
+	t.addSample(m.offset, len(sample), dts, pts, key)
+	return m.write(sample)
+}
+
+func (m *tsRemuxer) addAudio(es []byte, pts int64) error {
+	frames, cfg, err := splitADTS(es)
+	if err != nil || len(frames) == 0 {
+		// A damaged audio packet is dropped rather than failing the file.
+		return nil
+	}
+
+	if m.audio == nil {
+		m.audio = &track{timescale: uint32(cfg.sampleRate()), aac: cfg}
+	}
+	t := m.audio
+
+	var start int64
+	switch {
+	case pts >= 0:
+		start = m.audioClock.unwrap(pts) * int64(t.timescale) / 90000
+	case len(t.pts) > 0:
+		start = t.pts[len(t.pts)-1] + aacSamplesPerFrame
+	}
+
+	for i, frame := range frames {
+		ts := start + int64(i)*aacSamplesPerFrame
+		t.addSample(m.offset, len(frame), ts, ts, false)
+		if err := m.write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signedDiff returns a-b for two 33-bit timestamps, allowing for a wrap
+// between them.
+func signedDiff(a, b int64) int64 {
+	d := (a - b) & (1<<33 - 1)
+	if d >= 1<<32 {
+		d -= 1 << 33
+	}
+	return d
+}
+
+func (m *tsRemuxer) write(p []byte) error {
+	if _, err := m.w.Write(p); err != nil {
+		return err
+	}
+	m.offset += uint64(len(p))
+	return nil
+}
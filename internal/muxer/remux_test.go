@@ -0,0 +1,263 @@
+package muxer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testVideoPID = 0x100
+	testAudioPID = 0x101
+)
+
+// tsWriter builds a transport stream for the remuxer tests.
+type tsWriter struct {
+	buf bytes.Buffer
+	cc  map[int]byte
+}
+
+func (w *tsWriter) packets(pid int, payload []byte) {
+	if w.cc == nil {
+		w.cc = make(map[int]byte)
+	}
+
+	for first := true; first || len(payload) > 0; first = false {
+		pkt := make([]byte, 4, tsPacketSize)
+		pkt[0] = 0x47
+		binary.BigEndian.PutUint16(pkt[1:3], uint16(pid))
+		if first {
+			pkt[1] |= 0x40
+		}
+		pkt[3] = 0x10 | w.cc[pid]&0x0F
+		w.cc[pid]++
+
+		n := min(len(payload), tsPacketSize-4)
+		if stuffing := tsPacketSize - 4 - n; stuffing > 0 {
+			pkt[3] |= 0x20
+			af := make([]byte, stuffing)
+			af[0] = byte(stuffing - 1)
+			for i := 2; i < stuffing; i++ {
+				af[i] = 0xFF
+			}
+			pkt = append(pkt, af...)
+		}
+		pkt = append(pkt, payload[:n]...)
+		payload = payload[n:]
+		w.buf.Write(pkt)
+	}
+}
+
+func (w *tsWriter) psi(pid int, tableID byte, body []byte) {
+	section := []byte{tableID, 0xB0, 0}
+	section = append(section, 0, 1, 0xC1, 0, 0)
+	section = append(section, body...)
+	section = append(section, 0, 0, 0, 0) // CRC, not checked
+	binary.BigEndian.PutUint16(section[1:3], 0xB000|uint16(len(section)-3))
+	w.packets(pid, append([]byte{0}, section...))
+}
+
+func (w *tsWriter) tables(streams ...[2]int) {
+	w.psi(0, 0, []byte{0, 1, 0xF0, 0x00}) // program 1 on PID 0x1000
+	pmt := []byte{0xE1, 0x00, 0xF0, 0x00}
+	for _, s := range streams {
+		pmt = append(pmt, byte(s[0]), 0xE0|byte(s[1]>>8), byte(s[1]), 0xF0, 0)
+	}
+	w.psi(0x1000, 2, pmt)
+}
+
+func (w *tsWriter) pes(pid int, streamID byte, pts, dts int64, es []byte) {
+	header := []byte{0x80, 0x80, 5}
+	timestamps := encodeTimestamp(0x20, pts)
+	if dts != pts {
+		header = []byte{0x80, 0xC0, 10}
+		timestamps = append(encodeTimestamp(0x30, pts), encodeTimestamp(0x10, dts)...)
+	}
+
+	pes := []byte{0, 0, 1, streamID, 0, 0}
+	pes = append(pes, header...)
+	pes = append(pes, timestamps...)
+	pes = append(pes, es...)
+	if streamID != 0xE0 {
+		binary.BigEndian.PutUint16(pes[4:6], uint16(len(pes)-6))
+	}
+	w.packets(pid, pes)
+}
+
+func encodeTimestamp(prefix byte, ts int64) []byte {
+	return []byte{
+		prefix | byte(ts>>29&0x0E) | 1,
+		byte(ts >> 22),
+		byte(ts>>14) | 1,
+		byte(ts >> 7),
+		byte(ts<<1) | 1,
+	}
+}
+
+func adtsFrame(payload []byte) []byte {
+	n := 7 + len(payload)
+	// AAC LC, 48 kHz, stereo, no CRC.
+	header := []byte{0xFF, 0xF1, 0x4C, 0x80 | byte(n>>11), byte(n >> 3), byte(n<<5) | 0x1F, 0xFC}
+	return append(header, payload...)
+}
+
+func annexB(nals ...[]byte) []byte {
+	var es []byte
+	for _, nal := range nals {
+		es = append(es, 0, 0, 0, 1)
+		es = append(es, nal...)
+	}
+	return es
+}
+
+// mp4Boxes returns the payloads of the boxes named name among the boxes in
+// data.
+func mp4Boxes(t *testing.T, data []byte, name string) [][]byte {
+	t.Helper()
+
+	var found [][]byte
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		header := 8
+		if size == 1 {
+			size = int(binary.BigEndian.Uint64(data[8:]))
+			header = 16
+		}
+		if size < header || size > len(data) {
+			t.Fatalf("invalid size %d for box %q", size, data[4:8])
+		}
+		if string(data[4:8]) == name {
+			found = append(found, data[header:size])
+		}
+		data = data[size:]
+	}
+	return found
+}
+
+// mp4Box returns the payload of the first box at path.
+func mp4Box(t *testing.T, data []byte, path ...string) []byte {
+	t.Helper()
+
+	for _, name := range path {
+		boxes := mp4Boxes(t, data, name)
+		if len(boxes) == 0 {
+			t.Fatalf("box %v not found", path)
+		}
+		data = boxes[0]
+	}
+	return data
+}
+
+func TestTSToMP4(t *testing.T) {
+	sps := testSPS(66, 40, 30, 0)
+	pps := []byte{0x68, 0xCE, 0x38, 0x80}
+	idr := []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+	slice := []byte{0x41, 0x9A, 0x02}
+
+	var w tsWriter
+	w.tables([2]int{streamTypeH264, testVideoPID}, [2]int{streamTypeAAC, testAudioPID}, [2]int{0x15, 0x102})
+	// A frame before the first key frame cannot be decoded and is dropped.
+	w.pes(testVideoPID, 0xE0, 87000, 87000, annexB([]byte{0x09, 0xF0}, slice))
+	w.pes(testVideoPID, 0xE0, 96000, 90000, annexB([]byte{0x09, 0xF0}, sps, pps, idr))
+	w.pes(testAudioPID, 0xC0, 99000, 99000, append(adtsFrame([]byte("aa")), adtsFrame([]byte("bb"))...))
+	w.pes(testVideoPID, 0xE0, 102000, 93000, annexB(slice))
+	w.pes(testVideoPID, 0xE0, 99000, 96000, annexB(slice))
+	w.pes(testAudioPID, 0xC0, 102840, 102840, adtsFrame([]byte("cc")))
+
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "in.ts"), filepath.Join(dir, "out.mp4")
+	if err := os.WriteFile(src, w.buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (TSToMP4{}).Remux(context.Background(), src, dst); err != nil {
+		t.Fatalf("Remux failed: %v", err)
+	}
+
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data[4:8]) != "ftyp" {
+		t.Fatalf("file starts with %q, want ftyp", data[4:8])
+	}
+	mdat := mp4Box(t, data, "mdat")
+
+	moov := mp4Box(t, data, "moov")
+	traks := mp4Boxes(t, moov, "trak")
+	if len(traks) != 2 {
+		t.Fatalf("got %d tracks, want 2", len(traks))
+	}
+	video, audio := traks[0], traks[1]
+
+	tkhd := mp4Box(t, video, "tkhd")
+	if w, h := binary.BigEndian.Uint32(tkhd[76:])>>16, binary.BigEndian.Uint32(tkhd[80:])>>16; w != 640 || h != 480 {
+		t.Errorf("got video size %dx%d, want 640x480", w, h)
+	}
+
+	avcC := mp4Box(t, video, "mdia", "minf", "stbl", "stsd")[8+78+8:]
+	if !bytes.Contains(avcC, sps) || !bytes.Contains(avcC, pps) {
+		t.Error("avcC does not carry the SPS and PPS")
+	}
+
+	vstbl := mp4Box(t, video, "mdia", "minf", "stbl")
+	if n := binary.BigEndian.Uint32(mp4Box(t, vstbl, "stsz")[8:]); n != 3 {
+		t.Errorf("got %d video samples, want 3", n)
+	}
+	if stss := mp4Box(t, vstbl, "stss"); binary.BigEndian.Uint32(stss[4:]) != 1 || binary.BigEndian.Uint32(stss[8:]) != 1 {
+		t.Errorf("got stss %v, want only sample 1", stss)
+	}
+	mp4Box(t, vstbl, "ctts")
+
+	// The key frame sample is length-prefixed, without AUD, SPS and PPS.
+	stco := mp4Box(t, vstbl, "stco")
+	first := binary.BigEndian.Uint32(stco[8:])
+	want := append([]byte{0, 0, 0, byte(len(idr))}, idr...)
+	if got := data[first : int(first)+len(want)]; !bytes.Equal(got, want) {
+		t.Errorf("got first video sample %v, want %v", got, want)
+	}
+	if !bytes.Contains(mdat, want) {
+		t.Error("mdat does not contain the first video sample")
+	}
+
+	astbl := mp4Box(t, audio, "mdia", "minf", "stbl")
+	if n := binary.BigEndian.Uint32(mp4Box(t, astbl, "stsz")[8:]); n != 3 {
+		t.Errorf("got %d audio samples, want 3", n)
+	}
+	esds := mp4Box(t, astbl, "stsd")[8+8+28:]
+	if !bytes.Contains(esds, []byte{0x05, 2, 0x11, 0x90}) {
+		t.Errorf("esds %v lacks the AudioSpecificConfig for AAC LC 48 kHz stereo", esds)
+	}
+
+	// Audio starts 33 ms after the first video frame is presented, so its
+	// edit list begins with an empty edit.
+	elst := mp4Box(t, audio, "edts", "elst")
+	if entries := binary.BigEndian.Uint32(elst[4:]); entries != 2 {
+		t.Errorf("got %d audio edits, want an empty edit first", entries)
+	}
+}
+
+func TestTSToMP4Unsupported(t *testing.T) {
+	var w tsWriter
+	w.tables([2]int{0x24, testVideoPID})
+	w.pes(testVideoPID, 0xE0, 90000, 90000, []byte{0, 0, 1, 0x40})
+
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "in.ts"), filepath.Join(dir, "out.mp4")
+	if err := os.WriteFile(src, w.buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := (TSToMP4{}).Remux(context.Background(), src, dst)
+	if !errors.Is(err, ErrUnsupportedStream) {
+		t.Fatalf("got error %v, want ErrUnsupportedStream", err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Error("output left behind after a failed remux")
+	}
+}
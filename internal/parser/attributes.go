@@ -0,0 +1,183 @@
+package parser
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// attributeList is a parsed attribute list (RFC 8216 section 4.2), keyed by
+// attribute name.
+type attributeList map[string]attribute
+
+type attribute struct {
+	value  string
+	quoted bool
+}
+
+// parseAttributeList tokenizes an attribute list such as
+// `BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2"`. Quoted values are
+// stored without their quotes and may contain commas. Malformed lists, such
+// as an attribute without a value or an unterminated quoted string, are
+// reported as errors.
+func parseAttributeList(s string) (attributeList, error) {
+	attrs := make(attributeList)
+
+	for s = strings.TrimSpace(s); s != ""; {
+		eq := strings.IndexByte(s, '=')
+		if eq == -1 {
+			return nil, fmt.Errorf("attribute %q has no value", s)
+		}
+
+		name := strings.TrimSpace(s[:eq])
+		if !validAttributeName(name) {
+			return nil, fmt.Errorf("invalid attribute name %q", name)
+		}
+		s = strings.TrimSpace(s[eq+1:])
+
+		var attr attribute
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quoted string in %s", name)
+			}
+			attr = attribute{value: s[1 : end+1], quoted: true}
+			s = strings.TrimSpace(s[end+2:])
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end == -1 {
+				end = len(s)
+			}
+			attr = attribute{value: strings.TrimSpace(s[:end])}
+			s = s[end:]
+			if attr.value == "" {
+				return nil, fmt.Errorf("attribute %s has an empty value", name)
+			}
+		}
+
+		if _, dup := attrs[name]; dup {
+			return nil, fmt.Errorf("duplicate attribute %s", name)
+		}
+		attrs[name] = attr
+
+		if s == "" {
+			break
+		}
+		if s[0] != ',' {
+			return nil, fmt.Errorf("expected ',' after %s", name)
+		}
+		s = strings.TrimSpace(s[1:])
+	}
+
+	return attrs, nil
+}
+
+func validAttributeName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (a attributeList) has(name string) bool {
+	_, ok := a[name]
+	return ok
+}
+
+// String returns a quoted-string attribute. Unquoted values are accepted as
+// well, since many servers leave URIs unquoted.
+func (a attributeList) String(name string) string {
+	return a[name].value
+}
+
+// Enum returns an enumerated-string attribute.
+func (a attributeList) Enum(name string) (string, error) {
+	attr, ok := a[name]
+	if !ok {
+		return "", nil
+	}
+	if attr.quoted {
+		return "", fmt.Errorf("%s must not be quoted", name)
+	}
+	return attr.value, nil
+}
+
+// Bool returns a YES/NO enumerated-string attribute; absent means NO.
+func (a attributeList) Bool(name string) (bool, error) {
+	value, err := a.Enum(name)
+	if err != nil {
+		return false, err
+	}
+	switch value {
+	case "", "NO":
+		return false, nil
+	case "YES":
+		return true, nil
+	}
+	return false, fmt.Errorf("%s must be YES or NO, got %q", name, value)
+}
+
+// Int returns a decimal-integer attribute, or 0 when it is absent.
+func (a attributeList) Int(name string) (int64, error) {
+	attr, ok := a[name]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(attr.value, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a decimal integer: %q", name, attr.value)
+	}
+	return int64(n), nil
+}
+
+// Float returns a signed or unsigned decimal-floating-point attribute, or 0
+// when it is absent.
+func (a attributeList) Float(name string) (float64, error) {
+	attr, ok := a[name]
+	if !ok {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(attr.value, 64)
+	if err != nil || strings.ContainsAny(attr.value, "eEnN") {
+		return 0, fmt.Errorf("%s is not a decimal number: %q", name, attr.value)
+	}
+	return f, nil
+}
+
+// Hex returns a hexadecimal-sequence attribute such as 0x1A2B, or nil when
+// it is absent.
+func (a attributeList) Hex(name string) ([]byte, error) {
+	attr, ok := a[name]
+	if !ok {
+		return nil, nil
+	}
+	s := attr.value
+	if !strings.HasPrefix(s, "0x") && !strings.HasPrefix(s, "0X") {
+		return nil, fmt.Errorf("%s is not a hexadecimal sequence: %q", name, s)
+	}
+	s = s[2:]
+	if len(s)%2 == 1 {
+		s = "0" + s
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("%s is not a hexadecimal sequence: %q", name, attr.value)
+	}
+	return b, nil
+}
+
+// Resolution returns a decimal-resolution attribute such as 1280x720, or
+// zeros when it is absent.
+func (a attributeList) Resolution(name string) (int, int, error) {
+	attr, ok := a[name]
+	if !ok {
+		return 0, 0, nil
+	}
+	return parseResolution(attr.value)
+}
@@ -0,0 +1,86 @@
+package parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseAttributeList(t *testing.T) {
+	attrs, err := parseAttributeList(`BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2",RESOLUTION=640x360, IV=0x1A2B`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string]string{
+		"BANDWIDTH":  "1280000",
+		"CODECS":     "avc1.4d401f,mp4a.40.2",
+		"RESOLUTION": "640x360",
+		"IV":         "0x1A2B",
+	}
+	for k, v := range want {
+		if attrs.String(k) != v {
+			t.Errorf("attrs[%q] = %q, want %q", k, attrs.String(k), v)
+		}
+	}
+
+	if !attrs["CODECS"].quoted || attrs["BANDWIDTH"].quoted {
+		t.Error("quoting was not recorded")
+	}
+}
+
+func TestParseAttributeListErrors(t *testing.T) {
+	tests := []string{
+		`BANDWIDTH`,
+		`CODECS="avc1`,
+		`BANDWIDTH=`,
+		`BANDWIDTH=1,BANDWIDTH=2`,
+		`bandwidth=1`,
+		`URI="a"b`,
+	}
+
+	for _, in := range tests {
+		t.Run(in, func(t *testing.T) {
+			if _, err := parseAttributeList(in); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+}
+
+func TestAttributeListTypes(t *testing.T) {
+	attrs, err := parseAttributeList(`N=42,F=-1.5,H=0x0ABC,R=1920x1080,E=YES,Q="YES",BAD=4x`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n, err := attrs.Int("N"); err != nil || n != 42 {
+		t.Errorf("Int = %d, %v", n, err)
+	}
+	if _, err := attrs.Int("F"); err == nil {
+		t.Error("Int accepted a signed float")
+	}
+	if f, err := attrs.Float("F"); err != nil || f != -1.5 {
+		t.Errorf("Float = %v, %v", f, err)
+	}
+	if h, err := attrs.Hex("H"); err != nil || !bytes.Equal(h, []byte{0x0A, 0xBC}) {
+		t.Errorf("Hex = %x, %v", h, err)
+	}
+	if _, err := attrs.Hex("N"); err == nil {
+		t.Error("Hex accepted a value without 0x")
+	}
+	if w, h, err := attrs.Resolution("R"); err != nil || w != 1920 || h != 1080 {
+		t.Errorf("Resolution = %dx%d, %v", w, h, err)
+	}
+	if _, _, err := attrs.Resolution("BAD"); err == nil {
+		t.Error("Resolution accepted 4x")
+	}
+	if b, err := attrs.Bool("E"); err != nil || !b {
+		t.Errorf("Bool = %v, %v", b, err)
+	}
+	if _, err := attrs.Enum("Q"); err == nil {
+		t.Error("Enum accepted a quoted string")
+	}
+	if b, err := attrs.Bool("MISSING"); err != nil || b {
+		t.Errorf("Bool of missing attribute = %v, %v", b, err)
+	}
+}
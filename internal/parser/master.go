@@ -0,0 +1,404 @@
+package parser
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+// Variant selection rules accepted by SelectVariant. Besides these, a rule
+// may be an exact resolution ("1280x720") or an exact bandwidth ("2560000").
+const (
+	VariantHighest       = "highest"
+	VariantLowest        = "lowest"
+	VariantMaxResolution = "max-resolution"
+)
+
+// IsMasterPlaylist reports whether content lists variant streams rather than
+// media segments.
+func IsMasterPlaylist(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#EXT-X-STREAM-INF") {
+			return true
+		}
+	}
+	return false
+}
+
+func ParseMasterPlaylist(content, m3u8URL string) (*m3u8.MasterPlaylist, error) {
+	baseURL, err := getBaseURL(m3u8URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get base URL: %w", err)
+	}
+
+	master := &m3u8.MasterPlaylist{
+		BaseURL: baseURL,
+	}
+
+	var pending *m3u8.Variant
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "#") {
+			if pending == nil {
+				continue
+			}
+			pending.URL, err = resolveURL(m3u8URL, line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid variant URI %q: %w", line, err)
+			}
+			master.Variants = append(master.Variants, pending)
+			pending = nil
+			continue
+		}
+
+		tag, value, _ := strings.Cut(line, ":")
+
+		switch tag {
+		case "#EXT-X-VERSION":
+			master.Version, err = parseDecimal(value)
+		case "#EXT-X-INDEPENDENT-SEGMENTS":
+			master.IndependentSegments = true
+		case "#EXT-X-START":
+			master.Start, err = parseStart(value)
+		case "#EXT-X-STREAM-INF":
+			pending, err = parseVariant(value)
+		case "#EXT-X-I-FRAME-STREAM-INF":
+			var v *m3u8.Variant
+			if v, err = parseIFrameVariant(m3u8URL, value); err == nil {
+				master.IFrameVariants = append(master.IFrameVariants, v)
+			}
+		case "#EXT-X-MEDIA":
+			var r *m3u8.Rendition
+			if r, err = parseRendition(m3u8URL, value); err == nil {
+				master.Renditions = append(master.Renditions, r)
+			}
+		case "#EXT-X-SESSION-DATA":
+			var sd *m3u8.SessionData
+			if sd, err = parseSessionData(m3u8URL, value); err == nil {
+				master.SessionData = append(master.SessionData, sd)
+			}
+		case "#EXT-X-SESSION-KEY":
+			var key *m3u8.Key
+			if key, err = parseKeyAttributes(m3u8URL, value); err == nil && key != nil {
+				master.SessionKeys = append(master.SessionKeys, key)
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", strings.TrimPrefix(tag, "#"), err)
+		}
+	}
+
+	if len(master.Variants) == 0 {
+		return nil, m3u8.ErrNoVariants
+	}
+
+	return master, nil
+}
+
+func parseVariant(attrList string) (*m3u8.Variant, error) {
+	attrs, err := parseAttributeList(attrList)
+	if err != nil {
+		return nil, err
+	}
+	if !attrs.has("BANDWIDTH") {
+		return nil, fmt.Errorf("missing BANDWIDTH")
+	}
+
+	v := &m3u8.Variant{
+		Codecs:         attrs.String("CODECS"),
+		Audio:          attrs.String("AUDIO"),
+		Video:          attrs.String("VIDEO"),
+		Subtitles:      attrs.String("SUBTITLES"),
+		ClosedCaptions: attrs.String("CLOSED-CAPTIONS"),
+	}
+
+	bandwidth, err := attrs.Int("BANDWIDTH")
+	if err != nil {
+		return nil, err
+	}
+	averageBandwidth, err := attrs.Int("AVERAGE-BANDWIDTH")
+	if err != nil {
+		return nil, err
+	}
+	v.Bandwidth, v.AverageBandwidth = int(bandwidth), int(averageBandwidth)
+
+	if v.FrameRate, err = attrs.Float("FRAME-RATE"); err != nil {
+		return nil, err
+	}
+	if v.Width, v.Height, err = attrs.Resolution("RESOLUTION"); err != nil {
+		return nil, err
+	}
+	if v.HDCPLevel, err = attrs.Enum("HDCP-LEVEL"); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func parseIFrameVariant(m3u8URL, attrList string) (*m3u8.Variant, error) {
+	v, err := parseVariant(attrList)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, _ := parseAttributeList(attrList)
+	if attrs.String("URI") == "" {
+		return nil, fmt.Errorf("missing URI")
+	}
+	if v.URL, err = resolveURL(m3u8URL, attrs.String("URI")); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func parseRendition(m3u8URL, attrList string) (*m3u8.Rendition, error) {
+	attrs, err := parseAttributeList(attrList)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &m3u8.Rendition{
+		GroupID:         attrs.String("GROUP-ID"),
+		Language:        attrs.String("LANGUAGE"),
+		AssocLanguage:   attrs.String("ASSOC-LANGUAGE"),
+		Name:            attrs.String("NAME"),
+		InstreamID:      attrs.String("INSTREAM-ID"),
+		Characteristics: attrs.String("CHARACTERISTICS"),
+		Channels:        attrs.String("CHANNELS"),
+	}
+
+	if r.Type, err = attrs.Enum("TYPE"); err != nil {
+		return nil, err
+	}
+	switch r.Type {
+	case m3u8.MediaTypeAudio, m3u8.MediaTypeVideo, m3u8.MediaTypeSubtitles, m3u8.MediaTypeClosedCaptions:
+	default:
+		return nil, fmt.Errorf("unknown TYPE %q", r.Type)
+	}
+	if r.GroupID == "" || r.Name == "" {
+		return nil, fmt.Errorf("missing GROUP-ID or NAME")
+	}
+
+	if uri := attrs.String("URI"); uri != "" {
+		if r.URI, err = resolveURL(m3u8URL, uri); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.Default, err = attrs.Bool("DEFAULT"); err != nil {
+		return nil, err
+	}
+	if r.AutoSelect, err = attrs.Bool("AUTOSELECT"); err != nil {
+		return nil, err
+	}
+	if r.Forced, err = attrs.Bool("FORCED"); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func parseSessionData(m3u8URL, attrList string) (*m3u8.SessionData, error) {
+	attrs, err := parseAttributeList(attrList)
+	if err != nil {
+		return nil, err
+	}
+
+	sd := &m3u8.SessionData{
+		DataID:   attrs.String("DATA-ID"),
+		Value:    attrs.String("VALUE"),
+		Language: attrs.String("LANGUAGE"),
+	}
+	if sd.DataID == "" {
+		return nil, fmt.Errorf("missing DATA-ID")
+	}
+
+	if uri := attrs.String("URI"); uri != "" {
+		if sd.URI, err = resolveURL(m3u8URL, uri); err != nil {
+			return nil, err
+		}
+	}
+
+	return sd, nil
+}
+
+func parseResolution(s string) (int, int, error) {
+	w, h, ok := strings.Cut(strings.ToLower(s), "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid resolution %q", s)
+	}
+
+	width, err := strconv.Atoi(w)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid resolution %q", s)
+	}
+	height, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid resolution %q", s)
+	}
+
+	return width, height, nil
+}
+
+func resolveURL(base, ref string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return baseURL.ResolveReference(refURL).String(), nil
+}
+
+// ValidateVariantRule reports whether rule is understood by SelectVariant.
+func ValidateVariantRule(rule string) error {
+	switch rule {
+	case "", VariantHighest, VariantLowest, VariantMaxResolution:
+		return nil
+	}
+
+	if strings.ContainsAny(rule, "xX") {
+		_, _, err := parseResolution(rule)
+		return err
+	}
+
+	if _, err := strconv.Atoi(rule); err != nil {
+		return fmt.Errorf("invalid variant rule %q", rule)
+	}
+
+	return nil
+}
+
+// SelectVariant picks the variant matching rule. An empty rule selects the
+// highest bandwidth.
+func SelectVariant(master *m3u8.MasterPlaylist, rule string) (*m3u8.Variant, error) {
+	if err := ValidateVariantRule(rule); err != nil {
+		return nil, err
+	}
+
+	if len(master.Variants) == 0 {
+		return nil, m3u8.ErrNoVariants
+	}
+
+	var selected *m3u8.Variant
+	for _, v := range master.Variants {
+		switch rule {
+		case "", VariantHighest:
+			if selected == nil || v.Bandwidth > selected.Bandwidth {
+				selected = v
+			}
+		case VariantLowest:
+			if selected == nil || v.Bandwidth < selected.Bandwidth {
+				selected = v
+			}
+		case VariantMaxResolution:
+			if selected == nil || v.Width*v.Height > selected.Width*selected.Height ||
+				(v.Width*v.Height == selected.Width*selected.Height && v.Bandwidth > selected.Bandwidth) {
+				selected = v
+			}
+		default:
+			if !variantMatches(v, rule) {
+				continue
+			}
+			if selected == nil || v.Bandwidth > selected.Bandwidth {
+				selected = v
+			}
+		}
+	}
+
+	if selected == nil {
+		return nil, fmt.Errorf("%w: %s", m3u8.ErrNoVariantMatch, rule)
+	}
+
+	return selected, nil
+}
+
+func variantMatches(v *m3u8.Variant, rule string) bool {
+	if strings.ContainsAny(rule, "xX") {
+		width, height, _ := parseResolution(rule)
+		return v.Width == width && v.Height == height
+	}
+
+	bandwidth, _ := strconv.Atoi(rule)
+	return v.Bandwidth == bandwidth
+}
+
+// SelectRenditions returns the renditions of type typ in group that match
+// rules, a comma-separated list of languages, names or "all". A language also
+// matches its subtags, so "en" selects "en-US". Renditions without a URI are
+// carried in the variant stream itself and are never returned.
+func SelectRenditions(master *m3u8.MasterPlaylist, typ, group, rules string) []*m3u8.Rendition {
+	var selected []*m3u8.Rendition
+	for _, r := range master.Renditions {
+		if r.Type != typ || r.GroupID != group || r.URI == "" {
+			continue
+		}
+		for _, rule := range strings.Split(rules, ",") {
+			if renditionMatches(r, strings.TrimSpace(rule)) {
+				selected = append(selected, r)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+func renditionMatches(r *m3u8.Rendition, rule string) bool {
+	switch {
+	case rule == "":
+		return false
+	case strings.EqualFold(rule, "all"):
+		return true
+	case strings.EqualFold(rule, r.Name):
+		return true
+	}
+	lang := strings.ToLower(r.Language)
+	rule = strings.ToLower(rule)
+	return lang == rule || strings.HasPrefix(lang, rule+"-")
+}
+
+// DefaultRendition returns the rendition of type typ in group a player picks
+// without a user preference: the DEFAULT=YES one, else the first with
+// AUTOSELECT=YES, else the first. It returns nil when the group is empty or
+// that rendition has no URI.
+func DefaultRendition(master *m3u8.MasterPlaylist, typ, group string) *m3u8.Rendition {
+	var first, auto *m3u8.Rendition
+	for _, r := range master.Renditions {
+		if r.Type != typ || r.GroupID != group {
+			continue
+		}
+		if r.Default {
+			return uriOrNil(r)
+		}
+		if first == nil {
+			first = r
+		}
+		if auto == nil && r.AutoSelect {
+			auto = r
+		}
+	}
+	if auto != nil {
+		return uriOrNil(auto)
+	}
+	if first != nil {
+		return uriOrNil(first)
+	}
+	return nil
+}
+
+func uriOrNil(r *m3u8.Rendition) *m3u8.Rendition {
+	if r.URI == "" {
+		return nil
+	}
+	return r
+}
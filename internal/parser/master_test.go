@@ -0,0 +1,261 @@
+package parser
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+const masterContent = `#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2"
+low/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2560000,AVERAGE-BANDWIDTH=2000000,RESOLUTION=1280x720,FRAME-RATE=29.970,CODECS="avc1.4d401f,mp4a.40.2"
+mid/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1280x720
+http://cdn.example.com/high/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=4000000,RESOLUTION=1920x1080
+/hd/index.m3u8
+`
+
+func TestIsMasterPlaylist(t *testing.T) {
+	if !IsMasterPlaylist(masterContent) {
+		t.Error("expected master playlist to be detected")
+	}
+
+	media := `#EXTM3U
+#EXTINF:10.0,
+segment1.ts`
+	if IsMasterPlaylist(media) {
+		t.Error("media playlist detected as master")
+	}
+}
+
+func TestParsePlaylistRejectsMaster(t *testing.T) {
+	_, err := ParsePlaylist(masterContent, "http://example.com/video/master.m3u8")
+	if !errors.Is(err, m3u8.ErrMasterPlaylist) {
+		t.Errorf("got error %v, want %v", err, m3u8.ErrMasterPlaylist)
+	}
+}
+
+func TestParseMasterPlaylist(t *testing.T) {
+	master, err := ParseMasterPlaylist(masterContent, "http://example.com/video/master.m3u8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(master.Variants) != 4 {
+		t.Fatalf("got %d variants, want 4", len(master.Variants))
+	}
+
+	mid := master.Variants[1]
+	if mid.URL != "http://example.com/video/mid/index.m3u8" {
+		t.Errorf("got URL %q", mid.URL)
+	}
+	if mid.Bandwidth != 2560000 || mid.AverageBandwidth != 2000000 {
+		t.Errorf("got bandwidth %d/%d", mid.Bandwidth, mid.AverageBandwidth)
+	}
+	if mid.Width != 1280 || mid.Height != 720 {
+		t.Errorf("got resolution %dx%d, want 1280x720", mid.Width, mid.Height)
+	}
+	if mid.Codecs != "avc1.4d401f,mp4a.40.2" {
+		t.Errorf("got codecs %q", mid.Codecs)
+	}
+	if mid.FrameRate != 29.97 {
+		t.Errorf("got frame rate %v, want 29.97", mid.FrameRate)
+	}
+
+	if got := master.Variants[2].URL; got != "http://cdn.example.com/high/index.m3u8" {
+		t.Errorf("got absolute URL %q", got)
+	}
+	if got := master.Variants[3].URL; got != "http://example.com/hd/index.m3u8" {
+		t.Errorf("got root-relative URL %q", got)
+	}
+}
+
+func TestParseMasterPlaylistRenditions(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-START:TIME-OFFSET=-12.5,PRECISE=YES
+#EXT-X-SESSION-DATA:DATA-ID="com.example.title",VALUE="Episode 1",LANGUAGE="en"
+#EXT-X-SESSION-KEY:METHOD=AES-128,URI="key.bin",KEYFORMAT="identity"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",LANGUAGE="en",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="audio/en.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="Deutsch",LANGUAGE="de",FORCED=NO,URI="subs/de.m3u8"
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="CC1",INSTREAM-ID="CC1"
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,AUDIO="aac",SUBTITLES="subs",CLOSED-CAPTIONS="cc",HDCP-LEVEL=TYPE-0
+video/720.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=200000,RESOLUTION=1280x720,URI="video/720-iframes.m3u8"
+`
+
+	master, err := ParseMasterPlaylist(content, "http://example.com/show/master.m3u8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if master.Version != 6 || !master.IndependentSegments {
+		t.Errorf("got version %d, independent %v", master.Version, master.IndependentSegments)
+	}
+	if master.Start == nil || master.Start.TimeOffset != -12.5 || !master.Start.Precise {
+		t.Errorf("got start %+v", master.Start)
+	}
+
+	if len(master.Renditions) != 3 {
+		t.Fatalf("got %d renditions, want 3", len(master.Renditions))
+	}
+	audio := master.Renditions[0]
+	if audio.Type != m3u8.MediaTypeAudio || audio.GroupID != "aac" || !audio.Default || !audio.AutoSelect || audio.Channels != "2" {
+		t.Errorf("got audio rendition %+v", audio)
+	}
+	if audio.URI != "http://example.com/show/audio/en.m3u8" {
+		t.Errorf("got audio URI %q", audio.URI)
+	}
+	if cc := master.Renditions[2]; cc.URI != "" || cc.InstreamID != "CC1" {
+		t.Errorf("got closed-caption rendition %+v", cc)
+	}
+
+	v := master.Variants[0]
+	if v.Audio != "aac" || v.Subtitles != "subs" || v.ClosedCaptions != "cc" || v.HDCPLevel != "TYPE-0" {
+		t.Errorf("got variant groups %+v", v)
+	}
+
+	if len(master.IFrameVariants) != 1 || master.IFrameVariants[0].URL != "http://example.com/show/video/720-iframes.m3u8" {
+		t.Errorf("got I-frame variants %+v", master.IFrameVariants)
+	}
+	if len(master.SessionData) != 1 || master.SessionData[0].Value != "Episode 1" {
+		t.Errorf("got session data %+v", master.SessionData)
+	}
+	if len(master.SessionKeys) != 1 || master.SessionKeys[0].KeyFormat != "identity" {
+		t.Errorf("got session keys %+v", master.SessionKeys)
+	}
+}
+
+func TestParseMasterPlaylistInvalidTags(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{name: "missing bandwidth", line: "#EXT-X-STREAM-INF:RESOLUTION=640x360"},
+		{name: "bad resolution", line: "#EXT-X-STREAM-INF:BANDWIDTH=1,RESOLUTION=wide"},
+		{name: "unknown media type", line: `#EXT-X-MEDIA:TYPE=TEXT,GROUP-ID="g",NAME="n"`},
+		{name: "quoted enum", line: `#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="g",NAME="n",DEFAULT="YES"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := "#EXTM3U\n" + tt.line + "\n#EXT-X-STREAM-INF:BANDWIDTH=1\nlow.m3u8\n"
+			if _, err := ParseMasterPlaylist(content, "http://example.com/master.m3u8"); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+}
+
+func TestParseMasterPlaylistNoVariants(t *testing.T) {
+	_, err := ParseMasterPlaylist("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n", "http://example.com/master.m3u8")
+	if !errors.Is(err, m3u8.ErrNoVariants) {
+		t.Errorf("got error %v, want %v", err, m3u8.ErrNoVariants)
+	}
+}
+
+func TestSelectVariant(t *testing.T) {
+	master, err := ParseMasterPlaylist(masterContent, "http://example.com/video/master.m3u8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		rule          string
+		wantBandwidth int
+		wantErr       bool
+	}{
+		{name: "default is highest", rule: "", wantBandwidth: 5000000},
+		{name: "highest", rule: VariantHighest, wantBandwidth: 5000000},
+		{name: "lowest", rule: VariantLowest, wantBandwidth: 800000},
+		{name: "max resolution", rule: VariantMaxResolution, wantBandwidth: 4000000},
+		{name: "exact resolution prefers highest bandwidth", rule: "1280x720", wantBandwidth: 5000000},
+		{name: "exact bandwidth", rule: "2560000", wantBandwidth: 2560000},
+		{name: "no matching resolution", rule: "3840x2160", wantErr: true},
+		{name: "invalid rule", rule: "best", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := SelectVariant(master, tt.rule)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if v.Bandwidth != tt.wantBandwidth {
+				t.Errorf("got bandwidth %d, want %d", v.Bandwidth, tt.wantBandwidth)
+			}
+		})
+	}
+}
+
+func TestSelectRenditions(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",LANGUAGE="en-US",AUTOSELECT=YES,URI="audio/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="Deutsch",LANGUAGE="de",DEFAULT=YES,URI="audio/de.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="Commentary",LANGUAGE="en",URI="audio/commentary.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="muxed",NAME="Main",LANGUAGE="en",DEFAULT=YES
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",LANGUAGE="en",URI="subs/en.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="Français",LANGUAGE="fr",URI="subs/fr.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,AUDIO="aac",SUBTITLES="subs"
+video.m3u8
+`
+	master, err := ParseMasterPlaylist(content, "http://example.com/master.m3u8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	names := func(renditions []*m3u8.Rendition) string {
+		var names []string
+		for _, r := range renditions {
+			names = append(names, r.Name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	tests := []struct {
+		name  string
+		typ   string
+		group string
+		rules string
+		want  string
+	}{
+		{name: "language prefix", typ: m3u8.MediaTypeAudio, group: "aac", rules: "en", want: "English,Commentary"},
+		{name: "exact language", typ: m3u8.MediaTypeAudio, group: "aac", rules: "EN-us", want: "English"},
+		{name: "name", typ: m3u8.MediaTypeAudio, group: "aac", rules: "commentary", want: "Commentary"},
+		{name: "several rules", typ: m3u8.MediaTypeSubtitles, group: "subs", rules: "fr, de", want: "Français"},
+		{name: "all", typ: m3u8.MediaTypeSubtitles, group: "subs", rules: "all", want: "English,Français"},
+		{name: "no URI", typ: m3u8.MediaTypeAudio, group: "muxed", rules: "all", want: ""},
+		{name: "no match", typ: m3u8.MediaTypeAudio, group: "aac", rules: "ja", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := names(SelectRenditions(master, tt.typ, tt.group, tt.rules)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if r := DefaultRendition(master, m3u8.MediaTypeAudio, "aac"); r == nil || r.Name != "Deutsch" {
+		t.Errorf("got default audio %+v, want Deutsch", r)
+	}
+	if r := DefaultRendition(master, m3u8.MediaTypeAudio, "muxed"); r != nil {
+		t.Errorf("got default audio %+v for a group without URIs, want nil", r)
+	}
+	if r := DefaultRendition(master, m3u8.MediaTypeSubtitles, "missing"); r != nil {
+		t.Errorf("got default %+v for a missing group, want nil", r)
+	}
+}
@@ -4,28 +4,35 @@ import (
 	"fmt"
 	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"m3u8-download/pkg/m3u8"
 )
 
 func ParsePlaylist(content, m3u8URL string) (*m3u8.Playlist, error) {
+	if IsMasterPlaylist(content) {
+		return nil, m3u8.ErrMasterPlaylist
+	}
+
 	baseURL, err := getBaseURL(m3u8URL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get base URL: %w", err)
 	}
 
 	playlist := &m3u8.Playlist{
+		URL:     m3u8URL,
 		BaseURL: baseURL,
 	}
 
 	lines := strings.Split(content, "\n")
-	key, iv := extractEncryptionKey(baseURL, lines)
-	playlist.Key = key
-	playlist.IV = iv
-	playlist.IsEncrypted = key != ""
+	playlist.Key, playlist.IV = extractEncryptionKey(m3u8URL, lines)
+	if err := extractPlaylistTags(playlist, lines); err != nil {
+		return nil, err
+	}
 
-	segments, err := extractSegments(baseURL, lines)
+	segments, err := extractSegments(m3u8URL, lines)
 	if err != nil {
 		return nil, err
 	}
@@ -35,6 +42,12 @@ func ParsePlaylist(content, m3u8URL string) (*m3u8.Playlist, error) {
 	}
 
 	playlist.Segments = segments
+	for _, seg := range segments {
+		if seg.Key != nil {
+			playlist.IsEncrypted = true
+			break
+		}
+	}
 
 	return playlist, nil
 }
@@ -49,72 +62,417 @@ func getBaseURL(m3u8URL string) (string, error) {
 	return s, nil
 }
 
-func extractEncryptionKey(baseURL string, lines []string) (string, []byte) {
-	var key string
-	var iv []byte
+func extractEncryptionKey(playlistURL string, lines []string) (string, []byte) {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#EXT-X-KEY:") {
+			continue
+		}
+
+		key, err := parseKey(playlistURL, line)
+		if err == nil && key != nil && isIdentityKey(key) {
+			return key.URI, key.IV
+		}
+	}
+
+	return "", nil
+}
+
+// parseKey parses an #EXT-X-KEY line. It returns nil for METHOD=NONE and for
+// keys without a URI, and an *m3u8.UnsupportedMethodError for methods that
+// cannot be decrypted.
+func parseKey(playlistURL, line string) (*m3u8.Key, error) {
+	key, err := parseKeyAttributes(playlistURL, strings.TrimPrefix(line, "#EXT-X-KEY:"))
+	if err != nil || key == nil {
+		return nil, err
+	}
+	return usableKey(key)
+}
+
+// usableKey returns key if this tool can decrypt with it, nil for a key
+// without a URI and an *m3u8.UnsupportedMethodError otherwise.
+func usableKey(key *m3u8.Key) (*m3u8.Key, error) {
+	switch key.Method {
+	case m3u8.MethodAES128, m3u8.MethodSampleAES:
+	default:
+		return nil, m3u8.NewUnsupportedMethodError(key.Method)
+	}
+
+	if key.URI == "" {
+		return nil, nil
+	}
+
+	return key, nil
+}
+
+// isIdentityKey reports whether key is in the identity KEYFORMAT, the one
+// holding the key itself rather than a DRM system's license URI.
+func isIdentityKey(key *m3u8.Key) bool {
+	return key.KeyFormat == "" || key.KeyFormat == "identity"
+}
+
+// selectKey picks the key of a segment from the #EXT-X-KEY tags that apply
+// to it together, which offer the key in several KEYFORMATs. Only the
+// identity format can be used; without it the segments are protected by a
+// DRM system and an *m3u8.UnsupportedMethodError is returned. It returns
+// nil when the tags are METHOD=NONE.
+func selectKey(keys []*m3u8.Key) (*m3u8.Key, error) {
+	var drm *m3u8.Key
+	for _, key := range keys {
+		switch {
+		case key == nil:
+		case isIdentityKey(key):
+			return usableKey(key)
+		case drm == nil:
+			drm = key
+		}
+	}
+	if drm != nil {
+		return nil, m3u8.NewUnsupportedMethodError(fmt.Sprintf("%s with KEYFORMAT %q", drm.Method, drm.KeyFormat))
+	}
+	return nil, nil
+}
+
+// parseKeyAttributes parses the attribute list shared by #EXT-X-KEY and
+// #EXT-X-SESSION-KEY without judging whether the method is supported. It
+// returns nil for METHOD=NONE.
+func parseKeyAttributes(playlistURL, attrList string) (*m3u8.Key, error) {
+	attrs, err := parseAttributeList(attrList)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+
+	if !attrs.has("METHOD") {
+		return nil, fmt.Errorf("invalid key: METHOD is missing")
+	}
+	method, err := attrs.Enum("METHOD")
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	if method == m3u8.MethodNone {
+		return nil, nil
+	}
 
+	key := &m3u8.Key{
+		Method:            method,
+		KeyFormat:         attrs.String("KEYFORMAT"),
+		KeyFormatVersions: attrs.String("KEYFORMATVERSIONS"),
+	}
+	if uri := attrs.String("URI"); uri != "" {
+		if key.URI, err = resolveURL(playlistURL, uri); err != nil {
+			return nil, fmt.Errorf("invalid key URI: %w", err)
+		}
+	}
+	if key.IV, err = attrs.Hex("IV"); err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	if key.IV != nil && len(key.IV) != 16 {
+		return nil, fmt.Errorf("invalid key: IV is not 128 bits: %q", attrs.String("IV"))
+	}
+
+	return key, nil
+}
+
+// extractPlaylistTags fills in the playlist-wide tags of a media playlist.
+func extractPlaylistTags(playlist *m3u8.Playlist, lines []string) error {
 	for _, line := range lines {
-		if strings.Contains(line, "#EXT-X-KEY") {
-			uriPos := strings.Index(line, "URI")
-			quotationMarkPos := strings.LastIndex(line, "\"")
-			if uriPos == -1 || quotationMarkPos == -1 {
-				continue
+		line = strings.TrimSpace(line)
+		tag, value, _ := strings.Cut(line, ":")
+
+		var err error
+		switch tag {
+		case "#EXT-X-VERSION":
+			playlist.Version, err = parseDecimal(value)
+		case "#EXT-X-TARGETDURATION":
+			playlist.TargetDuration, err = parseDecimal(value)
+		case "#EXT-X-MEDIA-SEQUENCE":
+			playlist.MediaSequence, err = parseDecimal64(value)
+		case "#EXT-X-DISCONTINUITY-SEQUENCE":
+			playlist.DiscontinuitySequence, err = parseDecimal64(value)
+		case "#EXT-X-PLAYLIST-TYPE":
+			playlist.PlaylistType = value
+			if value != m3u8.PlaylistTypeEvent && value != m3u8.PlaylistTypeVOD {
+				err = fmt.Errorf("unknown playlist type %q", value)
 			}
+		case "#EXT-X-ENDLIST":
+			playlist.EndList = true
+		case "#EXT-X-I-FRAMES-ONLY":
+			playlist.IFramesOnly = true
+		case "#EXT-X-INDEPENDENT-SEGMENTS":
+			playlist.IndependentSegments = true
+		case "#EXT-X-START":
+			playlist.Start, err = parseStart(value)
+		case "#EXT-X-DATERANGE":
+			var dr *m3u8.DateRange
+			dr, err = parseDateRange(value)
+			playlist.DateRanges = append(playlist.DateRanges, dr)
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", strings.TrimPrefix(tag, "#"), err)
+		}
+	}
 
-			keyUrl := strings.Split(line[uriPos:quotationMarkPos], "\"")[1]
+	return nil
+}
 
-			if !strings.Contains(line, "http") {
-				keyUrl = fmt.Sprintf("%s/%s", baseURL, keyUrl)
-			}
+func parseDecimal(s string) (int, error) {
+	n, err := parseDecimal64(s)
+	return int(n), err
+}
 
-			key = keyUrl
+func parseDecimal64(s string) (int64, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a decimal integer", s)
+	}
+	return int64(n), nil
+}
 
-			if ivPos := strings.Index(line, "IV="); ivPos != -1 {
-				ivStart := strings.Index(line[ivPos:], "0x")
-				if ivStart != -1 {
-					ivStr := line[ivPos+ivStart+2 : ivPos+ivStart+34]
-					if len(ivStr) == 32 {
-						iv = parseIV(ivStr)
-					}
-				}
-			}
+// parseExtInf parses the <duration>,[<title>] value of an #EXTINF tag.
+func parseExtInf(value string) (float64, string, error) {
+	durationText, title, _ := strings.Cut(value, ",")
+	duration, err := strconv.ParseFloat(strings.TrimSpace(durationText), 64)
+	if err != nil || duration < 0 {
+		return 0, "", fmt.Errorf("%q is not a duration", durationText)
+	}
+	return duration, strings.TrimSpace(title), nil
+}
 
-			break
+// parseByteRange parses <length>[@<offset>]. hasOffset reports whether the
+// offset was given.
+func parseByteRange(s string) (br *m3u8.ByteRange, hasOffset bool, err error) {
+	lengthText, offsetText, hasOffset := strings.Cut(strings.TrimSpace(s), "@")
+
+	br = &m3u8.ByteRange{}
+	if br.Length, err = parseDecimal64(lengthText); err != nil {
+		return nil, false, err
+	}
+	if hasOffset {
+		if br.Offset, err = parseDecimal64(offsetText); err != nil {
+			return nil, false, err
 		}
 	}
+	return br, hasOffset, nil
+}
 
-	return key, iv
+// programDateTimeLayouts are the ISO 8601 forms seen in #EXT-X-PROGRAM-DATE-TIME
+// and #EXT-X-DATERANGE; some servers omit the colon in the zone offset.
+var programDateTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
 }
 
-func parseIV(hex string) []byte {
-	iv := make([]byte, 16)
-	for i := 0; i < 32; i += 2 {
-		b, err := fmt.Sscanf(hex[i:i+2], "%02x", &iv[i/2])
-		if err != nil || b != 1 {
-			return nil
+func parseDateTime(s string) (time.Time, error) {
+	for _, layout := range programDateTimeLayouts {
+		if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+			return t, nil
 		}
 	}
-	return iv
+	return time.Time{}, fmt.Errorf("%q is not an ISO 8601 date", s)
 }
 
-func extractSegments(baseURL string, lines []string) ([]*m3u8.TSInfo, error) {
+func parseStart(attrList string) (*m3u8.Start, error) {
+	attrs, err := parseAttributeList(attrList)
+	if err != nil {
+		return nil, err
+	}
+	if !attrs.has("TIME-OFFSET") {
+		return nil, fmt.Errorf("missing TIME-OFFSET")
+	}
+
+	start := &m3u8.Start{}
+	if start.TimeOffset, err = attrs.Float("TIME-OFFSET"); err != nil {
+		return nil, err
+	}
+	if start.Precise, err = attrs.Bool("PRECISE"); err != nil {
+		return nil, err
+	}
+	return start, nil
+}
+
+func parseDateRange(attrList string) (*m3u8.DateRange, error) {
+	attrs, err := parseAttributeList(attrList)
+	if err != nil {
+		return nil, err
+	}
+	if attrs.String("ID") == "" || !attrs.has("START-DATE") {
+		return nil, fmt.Errorf("missing ID or START-DATE")
+	}
+
+	dr := &m3u8.DateRange{
+		ID:        attrs.String("ID"),
+		Class:     attrs.String("CLASS"),
+		SCTE35Cmd: attrs.String("SCTE35-CMD"),
+		SCTE35Out: attrs.String("SCTE35-OUT"),
+		SCTE35In:  attrs.String("SCTE35-IN"),
+	}
+
+	if dr.StartDate, err = parseDateTime(attrs.String("START-DATE")); err != nil {
+		return nil, err
+	}
+	if attrs.has("END-DATE") {
+		if dr.EndDate, err = parseDateTime(attrs.String("END-DATE")); err != nil {
+			return nil, err
+		}
+	}
+	if dr.Duration, err = attrs.Float("DURATION"); err != nil {
+		return nil, err
+	}
+	if dr.PlannedDuration, err = attrs.Float("PLANNED-DURATION"); err != nil {
+		return nil, err
+	}
+	if dr.EndOnNext, err = attrs.Bool("END-ON-NEXT"); err != nil {
+		return nil, err
+	}
+
+	for name, attr := range attrs {
+		if strings.HasPrefix(name, "X-") {
+			if dr.ClientAttributes == nil {
+				dr.ClientAttributes = make(map[string]string)
+			}
+			dr.ClientAttributes[name] = attr.value
+		}
+	}
+
+	return dr, nil
+}
+
+// parseMap parses an #EXT-X-MAP. key is the key in effect at the tag; an
+// AES-128 key applies to the initialization section too.
+func parseMap(playlistURL, attrList string, key *m3u8.Key) (*m3u8.Map, error) {
+	attrs, err := parseAttributeList(attrList)
+	if err != nil {
+		return nil, err
+	}
+	if attrs.String("URI") == "" {
+		return nil, fmt.Errorf("missing URI")
+	}
+
+	uri, err := resolveURL(playlistURL, attrs.String("URI"))
+	if err != nil {
+		return nil, err
+	}
+	m := &m3u8.Map{URI: uri}
+	if key != nil && key.Method == m3u8.MethodAES128 {
+		m.Key = key
+	}
+	if attrs.has("BYTERANGE") {
+		if m.ByteRange, _, err = parseByteRange(attrs.String("BYTERANGE")); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// segmentExt is the cache file extension of segments: fMP4 fragments under
+// an #EXT-X-MAP are .m4s, everything else MPEG-TS.
+func segmentExt(initMap *m3u8.Map) string {
+	if initMap != nil {
+		return ".m4s"
+	}
+	return ".ts"
+}
+
+// extractSegments returns the media segments of a playlist together with the
+// segment tags that apply to each of them.
+func extractSegments(playlistURL string, lines []string) ([]*m3u8.TSInfo, error) {
 	var segments []*m3u8.TSInfo
-	index := 0
+	var initMap *m3u8.Map
+
+	// The #EXT-X-KEY tags since the last segment apply together, one per
+	// KEYFORMAT; a tag after a segment starts a new set.
+	var keys []*m3u8.Key
+	var key *m3u8.Key
+	var keyErr error
+	keysDone := true
+	var mediaSequence int64
+
+	// Tags that apply only to the next segment.
+	var next m3u8.TSInfo
+	var nextRange *m3u8.ByteRange
+	var nextRangeHasOffset bool
+
+	// Where an #EXT-X-BYTERANGE without offset continues from.
+	var lastRangeURL string
+	var lastRangeEnd int64
 
 	for _, line := range lines {
-		if !strings.HasPrefix(line, "#") && line != "" {
-			index++
-			ts := &m3u8.TSInfo{
-				Name: fmt.Sprintf("%06d.ts", index),
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "#") {
+			if keyErr != nil {
+				return nil, keyErr
 			}
+			keysDone = true
 
-			if strings.HasPrefix(line, "http") {
-				ts.Url = line
+			seg := next
+			seg.Name = fmt.Sprintf("%06d%s", len(segments)+1, segmentExt(initMap))
+			segURL, err := resolveURL(playlistURL, line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid segment URI %q: %w", line, err)
+			}
+			seg.Url = segURL
+			seg.Key = key
+			seg.Map = initMap
+			seg.Sequence = mediaSequence + int64(len(segments))
+
+			if nextRange != nil {
+				if !nextRangeHasOffset {
+					if lastRangeURL != seg.Url {
+						return nil, fmt.Errorf("invalid EXT-X-BYTERANGE for %s: offset is required unless the previous segment is a sub-range of the same resource", line)
+					}
+					nextRange.Offset = lastRangeEnd
+				}
+				seg.ByteRange = nextRange
+				lastRangeURL = seg.Url
+				lastRangeEnd = nextRange.Offset + nextRange.Length
 			} else {
-				ts.Url = fmt.Sprintf("%s/%s", baseURL, line)
+				lastRangeURL = ""
 			}
 
-			segments = append(segments, ts)
+			segments = append(segments, &seg)
+			next = m3u8.TSInfo{}
+			nextRange = nil
+			continue
+		}
+
+		tag, value, _ := strings.Cut(line, ":")
+
+		var err error
+		switch tag {
+		case "#EXT-X-KEY":
+			var k *m3u8.Key
+			if k, err = parseKeyAttributes(playlistURL, value); err != nil {
+				return nil, err
+			}
+			if keysDone {
+				keys, keysDone = nil, false
+			}
+			keys = append(keys, k)
+			key, keyErr = selectKey(keys)
+		case "#EXT-X-MEDIA-SEQUENCE":
+			mediaSequence, err = parseDecimal64(value)
+		case "#EXTINF":
+			next.Duration, next.Title, err = parseExtInf(value)
+		case "#EXT-X-BYTERANGE":
+			nextRange, nextRangeHasOffset, err = parseByteRange(value)
+		case "#EXT-X-DISCONTINUITY":
+			next.Discontinuity = true
+		case "#EXT-X-PROGRAM-DATE-TIME":
+			next.ProgramDateTime, err = parseDateTime(value)
+		case "#EXT-X-MAP":
+			if keyErr != nil {
+				return nil, keyErr
+			}
+			initMap, err = parseMap(playlistURL, value, key)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", strings.TrimPrefix(tag, "#"), err)
 		}
 	}
 
@@ -1,7 +1,12 @@
 package parser
 
 import (
+	"errors"
+	"strings"
 	"testing"
+	"time"
+
+	"m3u8-download/pkg/m3u8"
 )
 
 func TestParsePlaylist(t *testing.T) {
@@ -158,6 +163,417 @@ http://cdn.example.com/segment1.ts`,
 	}
 }
 
+func TestExtractSegmentsKeyRotation(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-KEY:METHOD=AES-128,URI="key1.key",IV=0x00000000000000000000000000000001
+#EXTINF:10.0,
+segment1.ts
+#EXTINF:10.0,
+segment2.ts
+#EXT-X-KEY:METHOD=AES-128,URI="http://keys.example.com/key2.key"
+#EXTINF:10.0,
+segment3.ts
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:10.0,
+segment4.ts`
+
+	segments, err := extractSegments("http://example.com", splitLines(content))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(segments) != 4 {
+		t.Fatalf("got %d segments, want 4", len(segments))
+	}
+
+	for i := 0; i < 2; i++ {
+		key := segments[i].Key
+		if key == nil || key.URI != "http://example.com/key1.key" {
+			t.Fatalf("segment %d has key %+v, want key1", i, key)
+		}
+		if key.Method != "AES-128" {
+			t.Errorf("segment %d has method %q, want AES-128", i, key.Method)
+		}
+		if len(key.IV) != 16 || key.IV[15] != 1 {
+			t.Errorf("segment %d has IV %x", i, key.IV)
+		}
+	}
+
+	if key := segments[2].Key; key == nil || key.URI != "http://keys.example.com/key2.key" || key.IV != nil {
+		t.Errorf("segment 2 has key %+v, want key2 without IV", key)
+	}
+
+	if segments[3].Key != nil {
+		t.Errorf("segment 3 has key %+v after METHOD=NONE", segments[3].Key)
+	}
+}
+
+func TestParsePlaylistKeyMethods(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="key.key",KEYFORMAT="identity"
+#EXTINF:10.0,
+segment1.ts`
+
+	playlist, err := ParsePlaylist(content, "http://example.com/video.m3u8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key := playlist.Segments[0].Key; key == nil || key.Method != m3u8.MethodSampleAES {
+		t.Errorf("got key %+v, want SAMPLE-AES", key)
+	}
+
+	unsupported := strings.Replace(content, "SAMPLE-AES", "SAMPLE-AES-CTR", 1)
+	_, err = ParsePlaylist(unsupported, "http://example.com/video.m3u8")
+	var methodErr *m3u8.UnsupportedMethodError
+	if !errors.As(err, &methodErr) || methodErr.Method != "SAMPLE-AES-CTR" {
+		t.Errorf("got error %v, want UnsupportedMethodError for SAMPLE-AES-CTR", err)
+	}
+}
+
+func TestParsePlaylistKeyFormats(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://fps-1",KEYFORMAT="com.apple.streamingkeydelivery",KEYFORMATVERSIONS="1"
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="key1.key",KEYFORMAT="identity"
+#EXTINF:10.0,
+segment1.ts
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="key2.key"
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="data:text/plain;base64,AAAA",KEYFORMAT="urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed"
+#EXTINF:10.0,
+segment2.ts`
+
+	playlist, err := ParsePlaylist(content, "http://example.com/video.m3u8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if playlist.Key != "http://example.com/key1.key" {
+		t.Errorf("got playlist key %q, want the identity key", playlist.Key)
+	}
+	for i, want := range []string{"http://example.com/key1.key", "http://example.com/key2.key"} {
+		if key := playlist.Segments[i].Key; key == nil || key.URI != want {
+			t.Errorf("segment %d has key %+v, want %s", i, key, want)
+		}
+	}
+
+	drmOnly := `#EXTM3U
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://fps-1",KEYFORMAT="com.apple.streamingkeydelivery"
+#EXTINF:10.0,
+segment1.ts`
+	_, err = ParsePlaylist(drmOnly, "http://example.com/video.m3u8")
+	var methodErr *m3u8.UnsupportedMethodError
+	if !errors.As(err, &methodErr) || !strings.Contains(methodErr.Method, "com.apple.streamingkeydelivery") {
+		t.Errorf("got error %v, want UnsupportedMethodError for the FairPlay key", err)
+	}
+}
+
+func TestParsePlaylistMediaSequence(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="key.key"
+#EXTINF:10.0,
+segment1.ts
+#EXTINF:10.0,
+segment2.ts`
+
+	playlist, err := ParsePlaylist(content, "http://example.com/video.m3u8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if playlist.MediaSequence != 7 {
+		t.Errorf("got media sequence %d, want 7", playlist.MediaSequence)
+	}
+
+	for i, seg := range playlist.Segments {
+		if seg.Sequence != int64(7+i) {
+			t.Errorf("segment %d has sequence %d, want %d", i, seg.Sequence, 7+i)
+		}
+	}
+}
+
+func TestParsePlaylistLiveInfo(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       string
+		wantTarget    int
+		wantEndList   bool
+		wantDurations []float64
+	}{
+		{
+			name: "live window",
+			content: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:100
+#EXTINF:5.5,
+a.ts
+#EXTINF:6,title
+b.ts`,
+			wantTarget:    6,
+			wantEndList:   false,
+			wantDurations: []float64{5.5, 6},
+		},
+		{
+			name: "ended event",
+			content: `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-PLAYLIST-TYPE:EVENT
+#EXTINF:9.009,
+a.ts
+#EXT-X-ENDLIST`,
+			wantTarget:    10,
+			wantEndList:   true,
+			wantDurations: []float64{9.009},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			playlist, err := ParsePlaylist(tt.content, "http://example.com/live.m3u8")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if playlist.URL != "http://example.com/live.m3u8" {
+				t.Errorf("got URL %q", playlist.URL)
+			}
+			if playlist.TargetDuration != tt.wantTarget {
+				t.Errorf("got target duration %d, want %d", playlist.TargetDuration, tt.wantTarget)
+			}
+			if playlist.EndList != tt.wantEndList {
+				t.Errorf("got end list %v, want %v", playlist.EndList, tt.wantEndList)
+			}
+			for i, seg := range playlist.Segments {
+				if seg.Duration != tt.wantDurations[i] {
+					t.Errorf("segment %d has duration %v, want %v", i, seg.Duration, tt.wantDurations[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParsePlaylistTags(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-DISCONTINUITY-SEQUENCE:2
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-START:TIME-OFFSET=3
+#EXT-X-DATERANGE:ID="ad-1",CLASS="com.example.ad",START-DATE="2024-05-01T10:00:00.000Z",DURATION=30.0,SCTE35-OUT=0xFC30,X-AD-ID="abc"
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXT-X-PROGRAM-DATE-TIME:2024-05-01T10:00:00.500+0800
+#EXTINF:6.006,Opening
+#EXT-X-BYTERANGE:1000@720
+main.mp4
+#EXTINF:6.006,
+#EXT-X-BYTERANGE:2000
+main.mp4
+#EXT-X-DISCONTINUITY
+#EXTINF:4,
+other.mp4
+#EXT-X-ENDLIST`
+
+	playlist, err := ParsePlaylist(content, "http://example.com/vod/index.m3u8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if playlist.Version != 7 || playlist.PlaylistType != m3u8.PlaylistTypeVOD || playlist.DiscontinuitySequence != 2 {
+		t.Errorf("got version %d, type %q, discontinuity sequence %d", playlist.Version, playlist.PlaylistType, playlist.DiscontinuitySequence)
+	}
+	if !playlist.IndependentSegments || playlist.Start == nil || playlist.Start.TimeOffset != 3 {
+		t.Errorf("got independent %v, start %+v", playlist.IndependentSegments, playlist.Start)
+	}
+
+	if len(playlist.DateRanges) != 1 {
+		t.Fatalf("got %d date ranges, want 1", len(playlist.DateRanges))
+	}
+	dr := playlist.DateRanges[0]
+	if dr.ID != "ad-1" || dr.Duration != 30 || dr.SCTE35Out != "0xFC30" || dr.ClientAttributes["X-AD-ID"] != "abc" {
+		t.Errorf("got date range %+v", dr)
+	}
+	if !dr.StartDate.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("got start date %v", dr.StartDate)
+	}
+
+	segs := playlist.Segments
+	if len(segs) != 3 {
+		t.Fatalf("got %d segments, want 3", len(segs))
+	}
+
+	if segs[0].Title != "Opening" || segs[0].Duration != 6.006 {
+		t.Errorf("got title %q duration %v", segs[0].Title, segs[0].Duration)
+	}
+	if want := time.Date(2024, 5, 1, 2, 0, 0, 500000000, time.UTC); !segs[0].ProgramDateTime.Equal(want) {
+		t.Errorf("got program date time %v, want %v", segs[0].ProgramDateTime, want)
+	}
+	if !segs[1].ProgramDateTime.IsZero() {
+		t.Error("program date time leaked to the next segment")
+	}
+
+	if *segs[0].ByteRange != (m3u8.ByteRange{Length: 1000, Offset: 720}) {
+		t.Errorf("got byte range %+v", segs[0].ByteRange)
+	}
+	if *segs[1].ByteRange != (m3u8.ByteRange{Length: 2000, Offset: 1720}) {
+		t.Errorf("got implicit-offset byte range %+v", segs[1].ByteRange)
+	}
+	if segs[2].ByteRange != nil {
+		t.Errorf("byte range leaked to the next segment: %+v", segs[2].ByteRange)
+	}
+
+	if segs[1].Discontinuity || !segs[2].Discontinuity {
+		t.Errorf("got discontinuity %v/%v, want false/true", segs[1].Discontinuity, segs[2].Discontinuity)
+	}
+
+	for i, seg := range segs {
+		if seg.Map == nil || seg.Map.URI != "http://example.com/vod/init.mp4" || seg.Map.ByteRange.Length != 720 {
+			t.Errorf("segment %d has map %+v", i, seg.Map)
+		}
+	}
+}
+
+func TestParsePlaylistFragmentedMP4(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4,
+plain.ts
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x00000000000000000000000000000001
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4,
+seg1.m4s
+#EXT-X-KEY:METHOD=NONE
+#EXT-X-MAP:URI="init2.mp4"
+#EXTINF:4,
+seg2.m4s
+#EXT-X-ENDLIST`
+
+	playlist, err := ParsePlaylist(content, "http://example.com/live/index.m3u8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !playlist.IsFragmentedMP4() {
+		t.Error("playlist not reported as fMP4")
+	}
+
+	segs := playlist.Segments
+	if len(segs) != 3 {
+		t.Fatalf("got %d segments, want 3", len(segs))
+	}
+
+	wantNames := []string{"000001.ts", "000002.m4s", "000003.m4s"}
+	for i, seg := range segs {
+		if seg.Name != wantNames[i] {
+			t.Errorf("segment %d: got name %q, want %q", i, seg.Name, wantNames[i])
+		}
+	}
+
+	if segs[0].Map != nil {
+		t.Errorf("got map %+v before #EXT-X-MAP", segs[0].Map)
+	}
+	if segs[1].Map.Key == nil || segs[1].Map.Key.URI != "http://example.com/live/key.bin" {
+		t.Errorf("got map key %+v, want the AES-128 key in effect", segs[1].Map.Key)
+	}
+	if segs[2].Map.URI != "http://example.com/live/init2.mp4" || segs[2].Map.Key != nil {
+		t.Errorf("got map %+v, want unencrypted init2.mp4", segs[2].Map)
+	}
+}
+
+func TestParsePlaylistInvalidTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "bad target duration", content: "#EXTM3U\n#EXT-X-TARGETDURATION:ten\n#EXTINF:10,\na.ts"},
+		{name: "bad duration", content: "#EXTM3U\n#EXTINF:abc,\na.ts"},
+		{name: "unknown playlist type", content: "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:LIVE\n#EXTINF:10,\na.ts"},
+		{name: "byte range without offset after another resource", content: "#EXTM3U\n#EXTINF:10,\n#EXT-X-BYTERANGE:100\na.ts"},
+		{name: "bad program date time", content: "#EXTM3U\n#EXT-X-PROGRAM-DATE-TIME:yesterday\n#EXTINF:10,\na.ts"},
+		{name: "map without URI", content: "#EXTM3U\n#EXT-X-MAP:BYTERANGE=\"1@0\"\n#EXTINF:10,\na.ts"},
+		{name: "malformed key attributes", content: "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\n#EXTINF:10,\na.ts"},
+		{name: "key without METHOD", content: "#EXTM3U\n#EXT-X-KEY:URI=\"key.bin\"\n#EXTINF:10,\na.ts"},
+		{name: "key IV without 0x", content: "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\",IV=0102030405060708090a0b0c0d0e0f10\n#EXTINF:10,\na.ts"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParsePlaylist(tt.content, "http://example.com/video.m3u8"); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+}
+
+func TestParseKeyIV(t *testing.T) {
+	tests := []struct {
+		name    string
+		iv      string
+		wantErr bool
+	}{
+		{name: "full length", iv: "0x0102030405060708090a0b0c0d0e0f10"},
+		{name: "upper case prefix", iv: "0X0102030405060708090A0B0C0D0E0F10"},
+		{name: "missing 0x prefix", iv: "0102030405060708090a0b0c0d0e0f10", wantErr: true},
+		{name: "short value", iv: "0x2a", wantErr: true},
+		{name: "invalid hex", iv: "0xzz", wantErr: true},
+		{name: "too long", iv: "0x" + "00000000000000000000000000000000ff", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := parseKeyAttributes("http://example.com/video.m3u8", `METHOD=AES-128,URI="key.bin",IV=`+tt.iv)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got IV %x, want error", key.IV)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(key.IV) != 16 || key.IV[15] != 0x10 {
+				t.Errorf("got IV %x, want 0102...0f10", key.IV)
+			}
+		})
+	}
+}
+
+func TestParsePlaylistResolvesURIs(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-KEY:METHOD=AES-128,URI="/keys/key.bin"
+#EXT-X-MAP:URI="../init.mp4"
+#EXTINF:10,
+seg1.m4s
+#EXTINF:10,
+//cdn.example.com/seg2.m4s
+#EXTINF:10,
+https://other.example.com/seg3.m4s
+#EXTINF:10,
+../media/seg4.m4s?token=abc
+#EXT-X-ENDLIST`
+
+	playlist, err := ParsePlaylist(content, "https://example.com/hls/720p/index.m3u8?sig=1")
+	if err != nil {
+		t.Fatalf("ParsePlaylist failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{name: "relative segment", got: playlist.Segments[0].Url, want: "https://example.com/hls/720p/seg1.m4s"},
+		{name: "protocol-relative segment", got: playlist.Segments[1].Url, want: "https://cdn.example.com/seg2.m4s"},
+		{name: "absolute segment", got: playlist.Segments[2].Url, want: "https://other.example.com/seg3.m4s"},
+		{name: "parent segment with query", got: playlist.Segments[3].Url, want: "https://example.com/hls/media/seg4.m4s?token=abc"},
+		{name: "root-relative key", got: playlist.Segments[0].Key.URI, want: "https://example.com/keys/key.bin"},
+		{name: "parent map", got: playlist.Segments[0].Map.URI, want: "https://example.com/hls/init.mp4"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
 func splitLines(content string) []string {
 	lines := make([]string, 0)
 	start := 0
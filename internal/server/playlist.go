@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+// PlaylistPath is where the server serves the rewritten playlist.
+const PlaylistPath = "/playlist.m3u8"
+
+// Paths the rewritten playlist points players at, relative to the
+// playlist itself.
+const (
+	segmentDir = "segments/"
+	initDir    = "init/"
+	keyDir     = "keys/"
+)
+
+// resources names what a rewritten playlist refers to and maps the names
+// back to the playlist.
+type resources struct {
+	segments map[string]int
+	inits    map[string]*m3u8.Map
+	keys     map[string]*m3u8.Key
+	// initNames and keyNames name each distinct initialization section, by
+	// mapID, and key, by URI.
+	initNames map[string]string
+	keyNames  map[string]string
+}
+
+func newResources(playlist *m3u8.Playlist) *resources {
+	r := &resources{
+		segments:  make(map[string]int),
+		inits:     make(map[string]*m3u8.Map),
+		keys:      make(map[string]*m3u8.Key),
+		initNames: make(map[string]string),
+		keyNames:  make(map[string]string),
+	}
+
+	addKey := func(k *m3u8.Key) {
+		if k == nil || r.keyNames[k.URI] != "" {
+			return
+		}
+		name := fmt.Sprintf("%d.key", len(r.keys)+1)
+		r.keys[name] = k
+		r.keyNames[k.URI] = name
+	}
+	for i, seg := range playlist.Segments {
+		r.segments[seg.Name] = i
+		if m := seg.Map; m != nil && r.initNames[mapID(m)] == "" {
+			name := fmt.Sprintf("%d.mp4", len(r.inits)+1)
+			r.inits[name] = m
+			r.initNames[mapID(m)] = name
+			addKey(m.Key)
+		}
+		addKey(seg.Key)
+	}
+	return r
+}
+
+func mapID(m *m3u8.Map) string {
+	if m.ByteRange == nil {
+		return m.URI
+	}
+	return fmt.Sprintf("%s#%d@%d", m.URI, m.ByteRange.Length, m.ByteRange.Offset)
+}
+
+// writePlaylist renders playlist with its segments, initialization
+// sections and, when raw, keys pointing at the local server. Segments are
+// served whole, so byte ranges are left out. Without raw the server hands
+// out decrypted data and the playlist has no keys.
+func writePlaylist(playlist *m3u8.Playlist, res *resources, raw bool) []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	if playlist.Version > 0 {
+		fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", playlist.Version)
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", playlist.TargetDuration)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", playlist.MediaSequence)
+	if playlist.DiscontinuitySequence > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", playlist.DiscontinuitySequence)
+	}
+	if playlist.PlaylistType != "" {
+		fmt.Fprintf(&b, "#EXT-X-PLAYLIST-TYPE:%s\n", playlist.PlaylistType)
+	}
+	if playlist.IndependentSegments {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	if s := playlist.Start; s != nil {
+		fmt.Fprintf(&b, "#EXT-X-START:TIME-OFFSET=%s", formatFloat(s.TimeOffset))
+		if s.Precise {
+			b.WriteString(",PRECISE=YES")
+		}
+		b.WriteString("\n")
+	}
+
+	var key *m3u8.Key
+	var initMap *m3u8.Map
+	setKey := func(k *m3u8.Key) {
+		if !raw || sameKey(k, key) {
+			return
+		}
+		key = k
+		if k == nil {
+			b.WriteString("#EXT-X-KEY:METHOD=NONE\n")
+			return
+		}
+		fmt.Fprintf(&b, "#EXT-X-KEY:METHOD=%s,URI=%q", k.Method, keyDir+res.keyNames[k.URI])
+		if k.IV != nil {
+			fmt.Fprintf(&b, ",IV=0x%s", strings.ToUpper(hex.EncodeToString(k.IV)))
+		}
+		if k.KeyFormat != "" {
+			fmt.Fprintf(&b, ",KEYFORMAT=%q", k.KeyFormat)
+		}
+		if k.KeyFormatVersions != "" {
+			fmt.Fprintf(&b, ",KEYFORMATVERSIONS=%q", k.KeyFormatVersions)
+		}
+		b.WriteString("\n")
+	}
+
+	for _, seg := range playlist.Segments {
+		if seg.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.Map != nil && (initMap == nil || mapID(seg.Map) != mapID(initMap)) {
+			// An encrypted initialization section is decrypted with the
+			// key in effect at its tag.
+			setKey(seg.Map.Key)
+			initMap = seg.Map
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=%q\n", initDir+res.initNames[mapID(seg.Map)])
+		}
+		setKey(seg.Key)
+		if !seg.ProgramDateTime.IsZero() {
+			fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.ProgramDateTime.Format(time.RFC3339Nano))
+		}
+		fmt.Fprintf(&b, "#EXTINF:%s,%s\n", formatFloat(seg.Duration), seg.Title)
+		b.WriteString(segmentDir + seg.Name + "\n")
+	}
+
+	if playlist.EndList {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.Bytes()
+}
+
+func sameKey(a, b *m3u8.Key) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Method == b.Method && a.URI == b.URI && bytes.Equal(a.IV, b.IV) &&
+		a.KeyFormat == b.KeyFormat && a.KeyFormatVersions == b.KeyFormatVersions
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,133 @@
+// Package server re-serves a remote HLS playlist to local players. The
+// playlist is rewritten to point at the server, which fetches segments,
+// initialization sections and keys through a downloader.SegmentFetcher and
+// so through the configured HTTP client, keeping them in the cache
+// directory for later offline playback.
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"m3u8-download/internal/downloader"
+	"m3u8-download/pkg/m3u8"
+)
+
+// Server is an http.Handler serving one playlist.
+type Server struct {
+	playlist []byte
+	res      *resources
+	segments []*m3u8.TSInfo
+	fetcher  *downloader.SegmentFetcher
+	logger   *slog.Logger
+	mux      *http.ServeMux
+}
+
+// New returns a server for playlist. raw must match the fetcher: with raw,
+// encrypted segments are served as they are and players fetch the keys from
+// the server; otherwise segments are served decrypted.
+func New(playlist *m3u8.Playlist, fetcher *downloader.SegmentFetcher, raw bool, logger *slog.Logger) *Server {
+	res := newResources(playlist)
+	s := &Server{
+		playlist: writePlaylist(playlist, res, raw),
+		res:      res,
+		segments: playlist.Segments,
+		fetcher:  fetcher,
+		logger:   logger,
+		mux:      http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("GET "+PlaylistPath, s.servePlaylist)
+	s.mux.HandleFunc("GET /"+segmentDir+"{name}", s.serveSegment)
+	s.mux.HandleFunc("GET /"+initDir+"{name}", s.serveInit)
+	if raw {
+		s.mux.HandleFunc("GET /"+keyDir+"{name}", s.serveKey)
+	}
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.playlist))
+}
+
+func (s *Server) serveSegment(w http.ResponseWriter, r *http.Request) {
+	idx, ok := s.res.segments[r.PathValue("name")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	seg := s.segments[idx]
+	data, err := s.fetcher.Segment(r.Context(), idx)
+	if err != nil {
+		s.fail(w, r, "segment", seg.Url, err)
+		return
+	}
+	s.logger.Debug("Served segment", "index", idx, "size", len(data))
+
+	contentType := "video/mp2t"
+	if seg.Map != nil {
+		contentType = "video/mp4"
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func (s *Server) serveInit(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.res.inits[r.PathValue("name")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := s.fetcher.Init(r.Context(), m)
+	if err != nil {
+		s.fail(w, r, "initialization section", m.URI, err)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func (s *Server) serveKey(w http.ResponseWriter, r *http.Request) {
+	k, ok := s.res.keys[r.PathValue("name")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := s.fetcher.Key(r.Context(), k.URI)
+	if err != nil {
+		s.fail(w, r, "key", k.URI, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// fail answers a request whose upstream fetch failed: 404 when the origin
+// does not have the resource, 502 Bad Gateway otherwise. Requests the player
+// gave up on are not answered.
+func (s *Server) fail(w http.ResponseWriter, r *http.Request, what, url string, err error) {
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		return
+	}
+	s.logger.Warn("Failed to fetch "+what, "url", url, "error", err)
+
+	var httpErr *m3u8.HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
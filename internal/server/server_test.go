@@ -0,0 +1,154 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"m3u8-download/internal/downloader"
+	"m3u8-download/internal/manifest"
+	"m3u8-download/internal/parser"
+	"m3u8-download/pkg/m3u8"
+)
+
+func TestWritePlaylist(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="https://keys.example.com/k1",IV=0x000102030405060708090A0B0C0D0E0F
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="100@0"
+#EXTINF:4.0,first
+#EXT-X-BYTERANGE:1000@100
+media.mp4
+#EXTINF:3.5,
+#EXT-X-BYTERANGE:1000
+media.mp4
+#EXT-X-DISCONTINUITY
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:4,
+clear.m4s
+#EXT-X-ENDLIST
+`
+	playlist, err := parser.ParsePlaylist(content, "https://example.com/video/index.m3u8")
+	if err != nil {
+		t.Fatalf("ParsePlaylist failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		raw  bool
+		want string
+	}{
+		{
+			name: "decrypted",
+			want: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-MAP:URI="init/1.mp4"
+#EXTINF:4,first
+segments/000001.m4s
+#EXTINF:3.5,
+segments/000002.m4s
+#EXT-X-DISCONTINUITY
+#EXTINF:4,
+segments/000003.m4s
+#EXT-X-ENDLIST
+`,
+		},
+		{
+			name: "raw",
+			raw:  true,
+			want: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="keys/1.key",IV=0x000102030405060708090A0B0C0D0E0F
+#EXT-X-MAP:URI="init/1.mp4"
+#EXTINF:4,first
+segments/000001.m4s
+#EXTINF:3.5,
+segments/000002.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:4,
+segments/000003.m4s
+#EXT-X-ENDLIST
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(writePlaylist(playlist, newResources(playlist), tt.raw))
+			if got != tt.want {
+				t.Errorf("got playlist\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/seg1.ts"):
+			w.Write([]byte{0x47, 0x01})
+		case strings.HasSuffix(r.URL.Path, "/seg2.ts"):
+			w.Write([]byte{0x47, 0x02})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer origin.Close()
+
+	playlist, err := parser.ParsePlaylist("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\nseg1.ts\n#EXTINF:10,\nseg2.ts\n#EXTINF:10,\ngone.ts\n#EXT-X-ENDLIST\n", origin.URL+"/video.m3u8")
+	if err != nil {
+		t.Fatalf("ParsePlaylist failed: %v", err)
+	}
+
+	cacheDir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dl := downloader.NewDownloader(downloader.NewHTTPClient(&m3u8.DownloadConfig{Timeout: 10, Retries: 1}), logger)
+	dl.SetManifest(manifest.New(cacheDir, playlist.URL, playlist))
+	local := httptest.NewServer(New(playlist, dl.NewSegmentFetcher(playlist, cacheDir, false), false, logger))
+	defer local.Close()
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{path: PlaylistPath, status: http.StatusOK, contentType: "application/vnd.apple.mpegurl", body: "segments/000001.ts\n"},
+		{path: "/segments/000001.ts", status: http.StatusOK, contentType: "video/mp2t", body: "\x47\x01"},
+		{path: "/segments/000002.ts", status: http.StatusOK, contentType: "video/mp2t", body: "\x47\x02"},
+		{path: "/segments/000003.ts", status: http.StatusNotFound},
+		{path: "/segments/000009.ts", status: http.StatusNotFound},
+		{path: "/keys/1.key", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(local.URL + tt.path)
+			if err != nil {
+				t.Fatalf("GET failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.contentType != "" && resp.Header.Get("Content-Type") != tt.contentType {
+				t.Errorf("got Content-Type %q, want %q", resp.Header.Get("Content-Type"), tt.contentType)
+			}
+			if !strings.Contains(string(body), tt.body) {
+				t.Errorf("got body %q, want it to contain %q", body, tt.body)
+			}
+		})
+	}
+}
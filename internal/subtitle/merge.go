@@ -0,0 +1,80 @@
+package subtitle
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	mpegtsClock = 90000
+	mpegtsWrap  = 1 << 33
+)
+
+// Merger places the cues of consecutive segments on one timeline starting
+// at the first segment's X-TIMESTAMP-MAP, which is where the media the
+// subtitles belong to starts.
+type Merger struct {
+	cues    []Cue
+	started bool
+	base    int64
+	last    int64
+}
+
+// Add adds the cues of the next segment.
+func (m *Merger) Add(seg *Segment) {
+	var shift time.Duration
+	if seg.HasMap {
+		ts := m.unwrap(seg.MPEGTS)
+		shift = time.Duration(ts-m.base)*time.Second/mpegtsClock - seg.Local
+	}
+
+	for _, cue := range seg.Cues {
+		cue.Start += shift
+		cue.End += shift
+		if cue.End <= 0 || cue.End < cue.Start {
+			continue
+		}
+		cue.Start = max(cue.Start, 0)
+		m.cues = append(m.cues, cue)
+	}
+}
+
+// unwrap returns ts, a 33-bit MPEG-TS timestamp, continued past the
+// wraparounds since the previous one. The first timestamp becomes the base.
+func (m *Merger) unwrap(ts int64) int64 {
+	if !m.started {
+		m.started = true
+		m.base, m.last = ts, ts
+		return ts
+	}
+
+	for ts-m.last > mpegtsWrap/2 {
+		ts -= mpegtsWrap
+	}
+	for m.last-ts > mpegtsWrap/2 {
+		ts += mpegtsWrap
+	}
+	m.last = ts
+	return ts
+}
+
+// Cues returns the merged cues in start order. Segments often repeat a cue
+// that spans their boundary, either whole or split in two; such repeats are
+// folded into a single cue.
+func (m *Merger) Cues() []Cue {
+	cues := append([]Cue(nil), m.cues...)
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].Start < cues[j].Start })
+
+	var merged []Cue
+	open := make(map[string]int)
+	for _, cue := range cues {
+		key := cue.Settings + "\x00" + cue.Text
+		if i, ok := open[key]; ok && cue.Start <= merged[i].End {
+			merged[i].End = max(merged[i].End, cue.End)
+			continue
+		}
+		open[key] = len(merged)
+		merged = append(merged, cue)
+	}
+	return merged
+}
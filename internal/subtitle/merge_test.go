@@ -0,0 +1,88 @@
+package subtitle
+
+import (
+	"testing"
+	"time"
+)
+
+func sec(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func TestMerger(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []*Segment
+		want     []Cue
+	}{
+		{
+			name: "local times already on the media timeline",
+			segments: []*Segment{
+				{HasMap: true, MPEGTS: 900000, Cues: []Cue{{Start: sec(1), End: sec(2), Text: "a"}}},
+				{HasMap: true, MPEGTS: 900000, Cues: []Cue{{Start: sec(11), End: sec(12), Text: "b"}}},
+			},
+			want: []Cue{{Start: sec(1), End: sec(2), Text: "a"}, {Start: sec(11), End: sec(12), Text: "b"}},
+		},
+		{
+			name: "each segment restarts its local time",
+			segments: []*Segment{
+				{HasMap: true, MPEGTS: 900000, Cues: []Cue{{Start: sec(1), End: sec(2), Text: "a"}}},
+				{HasMap: true, MPEGTS: 1800000, Cues: []Cue{{Start: sec(1), End: sec(2), Text: "b"}}},
+				{HasMap: true, MPEGTS: 2700000, Local: sec(5), Cues: []Cue{{Start: sec(6), End: sec(7), Text: "c"}}},
+			},
+			want: []Cue{
+				{Start: sec(1), End: sec(2), Text: "a"},
+				{Start: sec(11), End: sec(12), Text: "b"},
+				{Start: sec(21), End: sec(22), Text: "c"},
+			},
+		},
+		{
+			name: "33-bit wraparound",
+			segments: []*Segment{
+				{HasMap: true, MPEGTS: mpegtsWrap - 450000, Cues: []Cue{{Start: sec(1), End: sec(2), Text: "a"}}},
+				{HasMap: true, MPEGTS: 450000, Cues: []Cue{{Start: sec(1), End: sec(2), Text: "b"}}},
+			},
+			want: []Cue{{Start: sec(1), End: sec(2), Text: "a"}, {Start: sec(11), End: sec(12), Text: "b"}},
+		},
+		{
+			name: "cues repeated across a boundary",
+			segments: []*Segment{
+				{Cues: []Cue{{Start: sec(8), End: sec(12), Text: "long"}, {Start: sec(9), End: sec(10), Text: "short"}}},
+				{Cues: []Cue{{Start: sec(8), End: sec(12), Text: "long"}, {Start: sec(12), End: sec(14), Text: "split"}}},
+				{Cues: []Cue{{Start: sec(14), End: sec(15), Text: "split"}, {Start: sec(20), End: sec(21), Text: "short"}}},
+			},
+			want: []Cue{
+				{Start: sec(8), End: sec(12), Text: "long"},
+				{Start: sec(9), End: sec(10), Text: "short"},
+				{Start: sec(12), End: sec(15), Text: "split"},
+				{Start: sec(20), End: sec(21), Text: "short"},
+			},
+		},
+		{
+			name: "cues before the media start",
+			segments: []*Segment{
+				{HasMap: true, MPEGTS: 900000, Local: sec(2), Cues: []Cue{{Start: sec(0), End: sec(1), Text: "gone"}, {Start: sec(1), End: sec(3), Text: "clipped"}}},
+			},
+			want: []Cue{{Start: 0, End: sec(1), Text: "clipped"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Merger
+			for _, seg := range tt.segments {
+				m.Add(seg)
+			}
+
+			got := m.Cues()
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("cue %d: got %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
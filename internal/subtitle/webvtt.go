@@ -0,0 +1,177 @@
+// Package subtitle merges segmented WebVTT subtitles into a single WebVTT or
+// SubRip file.
+package subtitle
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cue is one timed subtitle.
+type Cue struct {
+	Start    time.Duration
+	End      time.Duration
+	Settings string
+	Text     string
+}
+
+// Segment is a parsed WebVTT segment of a subtitle playlist.
+type Segment struct {
+	Cues []Cue
+	// HasMap reports whether the segment carries an X-TIMESTAMP-MAP, which
+	// maps its LOCAL cue time to the MPEGTS timestamp of the media.
+	HasMap bool
+	MPEGTS int64
+	Local  time.Duration
+}
+
+// Parse parses a WebVTT segment. NOTE, STYLE and REGION blocks are skipped.
+func Parse(data []byte) (*Segment, error) {
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	blocks := splitBlocks(text)
+	if len(blocks) == 0 || !isHeader(blocks[0][0]) {
+		return nil, fmt.Errorf("missing WEBVTT header")
+	}
+
+	seg := &Segment{}
+	for _, line := range blocks[0][1:] {
+		value, ok := strings.CutPrefix(line, "X-TIMESTAMP-MAP=")
+		if !ok {
+			continue
+		}
+		if err := seg.parseTimestampMap(value); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, block := range blocks[1:] {
+		switch {
+		case hasKeyword(block[0], "NOTE"), hasKeyword(block[0], "STYLE"), hasKeyword(block[0], "REGION"):
+			continue
+		}
+
+		lines := block
+		if !strings.Contains(lines[0], "-->") {
+			// The first line is a cue identifier.
+			lines = lines[1:]
+		}
+		if len(lines) == 0 || !strings.Contains(lines[0], "-->") {
+			return nil, fmt.Errorf("invalid cue block %q", block[0])
+		}
+
+		cue, err := parseTiming(lines[0])
+		if err != nil {
+			return nil, err
+		}
+		cue.Text = strings.Join(lines[1:], "\n")
+		seg.Cues = append(seg.Cues, cue)
+	}
+	return seg, nil
+}
+
+func isHeader(line string) bool {
+	return line == "WEBVTT" || strings.HasPrefix(line, "WEBVTT ") || strings.HasPrefix(line, "WEBVTT\t")
+}
+
+func hasKeyword(line, keyword string) bool {
+	rest, ok := strings.CutPrefix(line, keyword)
+	return ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t')
+}
+
+// splitBlocks splits text into blocks of non-empty lines.
+func splitBlocks(text string) [][]string {
+	var blocks [][]string
+	var block []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			if block != nil {
+				blocks = append(blocks, block)
+				block = nil
+			}
+			continue
+		}
+		block = append(block, line)
+	}
+	if block != nil {
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// parseTimestampMap parses "MPEGTS:900000,LOCAL:00:00:00.000".
+func (s *Segment) parseTimestampMap(value string) error {
+	var hasMPEGTS, hasLocal bool
+	for _, field := range strings.Split(value, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(field), ":")
+		switch key {
+		case "MPEGTS":
+			ts, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || ts < 0 {
+				return fmt.Errorf("invalid X-TIMESTAMP-MAP MPEGTS %q", val)
+			}
+			s.MPEGTS, hasMPEGTS = ts, true
+		case "LOCAL":
+			local, err := parseTimestamp(val)
+			if err != nil {
+				return fmt.Errorf("invalid X-TIMESTAMP-MAP LOCAL: %w", err)
+			}
+			s.Local, hasLocal = local, true
+		}
+	}
+	if !hasMPEGTS || !hasLocal {
+		return fmt.Errorf("invalid X-TIMESTAMP-MAP %q", value)
+	}
+	s.HasMap = true
+	return nil
+}
+
+// parseTiming parses a cue timing line such as
+// "00:01.000 --> 00:02.500 align:start".
+func parseTiming(line string) (Cue, error) {
+	startText, rest, _ := strings.Cut(line, "-->")
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return Cue{}, fmt.Errorf("invalid cue timing %q", line)
+	}
+
+	start, err := parseTimestamp(strings.TrimSpace(startText))
+	if err != nil {
+		return Cue{}, fmt.Errorf("invalid cue timing %q: %w", line, err)
+	}
+	end, err := parseTimestamp(fields[0])
+	if err != nil {
+		return Cue{}, fmt.Errorf("invalid cue timing %q: %w", line, err)
+	}
+	return Cue{Start: start, End: end, Settings: strings.Join(fields[1:], " ")}, nil
+}
+
+// parseTimestamp parses "hh:mm:ss.ttt" or "mm:ss.ttt".
+func parseTimestamp(s string) (time.Duration, error) {
+	clock, frac, ok := strings.Cut(s, ".")
+	parts := strings.Split(clock, ":")
+	if !ok || len(frac) != 3 || len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	if len(parts) == 2 {
+		parts = append([]string{"00"}, parts...)
+	}
+
+	hours, err1 := strconv.Atoi(parts[0])
+	minutes, err2 := strconv.Atoi(parts[1])
+	seconds, err3 := strconv.Atoi(parts[2])
+	millis, err4 := strconv.Atoi(frac)
+	if err := errors.Join(err1, err2, err3, err4); err != nil ||
+		hours < 0 || len(parts[1]) != 2 || len(parts[2]) != 2 || minutes > 59 || seconds > 59 || millis < 0 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+		time.Duration(seconds)*time.Second + time.Duration(millis)*time.Millisecond, nil
+}
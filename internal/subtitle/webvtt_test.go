@@ -0,0 +1,88 @@
+package subtitle
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	data := "\ufeffWEBVTT\r\nX-TIMESTAMP-MAP=LOCAL:00:00:00.000,MPEGTS:900000\r\n\r\n" +
+		"NOTE written by hand\r\nacross two lines\r\n\r\n" +
+		"STYLE\r\n::cue { color: yellow }\r\n\r\n" +
+		"intro\r\n00:01.000 --> 00:02.500 align:start line:90%\r\n<i>Hello</i>\r\nworld\r\n\r\n" +
+		"01:00:03.250 --> 01:00:04.000\r\nGood night\r\n"
+
+	seg, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !seg.HasMap || seg.MPEGTS != 900000 || seg.Local != 0 {
+		t.Errorf("got timestamp map %v %d %v", seg.HasMap, seg.MPEGTS, seg.Local)
+	}
+
+	want := []Cue{
+		{Start: time.Second, End: 2500 * time.Millisecond, Settings: "align:start line:90%", Text: "<i>Hello</i>\nworld"},
+		{Start: time.Hour + 3250*time.Millisecond, End: time.Hour + 4*time.Second, Text: "Good night"},
+	}
+	if len(seg.Cues) != len(want) {
+		t.Fatalf("got %d cues, want %d", len(seg.Cues), len(want))
+	}
+	for i := range want {
+		if seg.Cues[i] != want[i] {
+			t.Errorf("cue %d: got %+v, want %+v", i, seg.Cues[i], want[i])
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "missing header", data: "00:01.000 --> 00:02.000\nHi\n", wantErr: "WEBVTT"},
+		{name: "bad timestamp map", data: "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:abc,LOCAL:00:00:00.000\n", wantErr: "MPEGTS"},
+		{name: "incomplete timestamp map", data: "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000\n", wantErr: "X-TIMESTAMP-MAP"},
+		{name: "bad timing", data: "WEBVTT\n\n00:01 --> 00:02.000\nHi\n", wantErr: "cue timing"},
+		{name: "block without timing", data: "WEBVTT\n\nsome text\nmore text\n", wantErr: "cue block"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "00:01.000", want: time.Second},
+		{in: "12:34.567", want: 12*time.Minute + 34567*time.Millisecond},
+		{in: "01:02:03.004", want: time.Hour + 2*time.Minute + 3004*time.Millisecond},
+		{in: "100:00:00.000", want: 100 * time.Hour},
+		{in: "00:60.000", wantErr: true},
+		{in: "0:01.000", wantErr: true},
+		{in: "00:01.5", wantErr: true},
+		{in: "00:01", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTimestamp(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTimestamp(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseTimestamp(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package subtitle
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Output subtitle formats.
+const (
+	FormatVTT = "vtt"
+	FormatSRT = "srt"
+)
+
+// Write writes cues to w in format.
+func Write(w io.Writer, format string, cues []Cue) error {
+	switch format {
+	case FormatVTT:
+		return WriteVTT(w, cues)
+	case FormatSRT:
+		return WriteSRT(w, cues)
+	}
+	return fmt.Errorf("unknown subtitle format %q", format)
+}
+
+// WriteVTT writes cues as a WebVTT file.
+func WriteVTT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("WEBVTT\n")
+	for _, cue := range cues {
+		fmt.Fprintf(bw, "\n%s --> %s", timestamp(cue.Start, '.'), timestamp(cue.End, '.'))
+		if cue.Settings != "" {
+			bw.WriteString(" " + cue.Settings)
+		}
+		fmt.Fprintf(bw, "\n%s\n", cue.Text)
+	}
+	return bw.Flush()
+}
+
+// WriteSRT writes cues as a SubRip file. Cue settings are dropped, and of the
+// WebVTT markup only <b>, <i> and <u>, which SubRip players understand, are
+// kept.
+func WriteSRT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	for i, cue := range cues {
+		if i > 0 {
+			bw.WriteString("\n")
+		}
+		fmt.Fprintf(bw, "%d\n%s --> %s\n%s\n", i+1, timestamp(cue.Start, ','), timestamp(cue.End, ','), srtText(cue.Text))
+	}
+	return bw.Flush()
+}
+
+func timestamp(d time.Duration, sep byte) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%c%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
+
+var (
+	vttTag      = regexp.MustCompile(`<[^>]*>`)
+	srtTag      = regexp.MustCompile(`^</?[biu]>$`)
+	vttEntities = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&nbsp;", "\u00a0", "&lrm;", "\u200e", "&rlm;", "\u200f")
+)
+
+func srtText(text string) string {
+	text = vttTag.ReplaceAllStringFunc(text, func(tag string) string {
+		if srtTag.MatchString(tag) {
+			return tag
+		}
+		return ""
+	})
+	return vttEntities.Replace(text)
+}
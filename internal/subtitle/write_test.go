@@ -0,0 +1,47 @@
+package subtitle
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	cues := []Cue{
+		{Start: 1500 * time.Millisecond, End: 3 * time.Second, Settings: "align:start", Text: "<v Roger><i>Hi</i> &amp; bye</v>"},
+		{Start: time.Hour + 61*time.Second, End: time.Hour + 62*time.Second, Text: "line one\nline <c.yellow>two</c>"},
+	}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: FormatVTT,
+			want: "WEBVTT\n\n" +
+				"00:00:01.500 --> 00:00:03.000 align:start\n<v Roger><i>Hi</i> &amp; bye</v>\n\n" +
+				"01:01:01.000 --> 01:01:02.000\nline one\nline <c.yellow>two</c>\n",
+		},
+		{
+			format: FormatSRT,
+			want: "1\n00:00:01,500 --> 00:00:03,000\n<i>Hi</i> & bye\n\n" +
+				"2\n01:01:01,000 --> 01:01:02,000\nline one\nline two\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Write(&buf, tt.format, cues); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+
+	if err := Write(&bytes.Buffer{}, "ass", cues); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
@@ -1,17 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
 	"m3u8-download/internal/config"
 	"m3u8-download/internal/downloader"
-	"m3u8-download/internal/parser"
-
-	"github.com/twinj/uuid"
+	"m3u8-download/pkg/m3u8"
+	"m3u8-download/pkg/m3u8/client"
 )
 
 var (
@@ -39,81 +40,104 @@ func run(args []string, stdout, stderr io.Writer) int {
 		return 0
 	}
 
-	logger := setupLogger(cfg.Verbose)
+	logger := setupLogger(cfg.Verbose, stderr)
 
-	id := uuid.NewV4().String()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	cacheDir, err := config.EnsureCacheDir(id)
+	cacheRoot, err := config.CacheRoot()
 	if err != nil {
-		logger.Error("Failed to create cache directory", "error", err)
+		logger.Error("Failed to locate cache directory", "error", err)
 		return 1
 	}
-
-	httpClient := downloader.NewHTTPClient(cfg)
-	dl := downloader.NewDownloader(httpClient, logger)
-
-	logger.Info("Fetching M3U8 playlist", "url", cfg.URL)
-	body, err := httpClient.Get(cfg.URL)
+	c, err := client.New(client.WithConfig(cfg), client.WithCacheDir(cacheRoot), client.WithLogger(logger))
 	if err != nil {
-		logger.Error("Failed to fetch M3U8", "error", err)
+		logger.Error("Failed to set up client", "error", err)
 		return 1
 	}
 
-	logger.Info("Parsing playlist")
-	playlist, err := parser.ParsePlaylist(string(body), cfg.URL)
-	if err != nil {
-		logger.Error("Failed to parse playlist", "error", err)
-		return 1
+	if rate := c.RateLimit(); rate > 0 {
+		logger.Info("Rate limit enabled", "rate", downloader.FormatRate(rate))
+		watchRateSignals(ctx, c, logger)
 	}
 
-	logger.Info("Playlist parsed", "segments", len(playlist.Segments), "encrypted", playlist.IsEncrypted)
-
-	if cfg.Output == "" {
-		cfg.Output = fmt.Sprintf("%s.ts", id)
+	if mode == config.ParseModeServe {
+		return runServe(ctx, c, cfg, logger)
 	}
+	if cfg.Input != "" {
+		return runBatch(ctx, cfg, c, stdout, stderr, logger)
+	}
+	code, _ := runJob(ctx, c, cfg, nil, true, stdout, stderr, logger)
+	return code
+}
 
-	logger.Info("Starting download", "output", cfg.Output, "workers", cfg.Workers)
-	startTime := time.Now()
-
-	stats, err := dl.DownloadSegments(playlist, cacheDir, cfg.Workers)
-	if err != nil {
-		logger.Error("Download failed", "error", err)
-		return 1
+// runJob downloads cfg.URL with c and returns the exit status and the file
+// written. opts override c's options for this job. progress draws a
+// progress bar, which only one job at a time can do. stdout and stderr are
+// given to -output - and -exec.
+func runJob(ctx context.Context, c *client.Client, cfg *m3u8.DownloadConfig, opts []client.Option, progress bool, stdout, stderr io.Writer, logger *slog.Logger) (int, string) {
+	opts = append(opts, client.WithProgressBar(progress), client.WithLogger(logger))
+
+	var pipe *pipeOutput
+	if config.IsPipe(cfg) {
+		var err error
+		pipe, err = openPipe(cfg, stdout, stderr)
+		if err != nil {
+			logger.Error("Failed to start -exec command", "command", cfg.Exec, "error", err)
+			return 1, ""
+		}
+		opts = append(opts, client.WithWriter(pipe))
 	}
 
-	logger.Info("Merging files")
-	if err := dl.MergeFiles(cacheDir, cfg.Output); err != nil {
-		logger.Error("Failed to merge files", "error", err)
-		return 1
+	res, err := c.Download(ctx, cfg.URL, opts...)
+	if pipe != nil {
+		// The command gets EOF and may finish its output even after Ctrl+C.
+		if closeErr := pipe.Close(); closeErr != nil {
+			logger.Error("Command failed", "command", cfg.Exec, "error", closeErr)
+			if err == nil {
+				return 1, res.Output
+			}
+		}
 	}
 
-	if err := config.CleanupCacheDir(cacheDir); err != nil {
-		logger.Warn("Failed to cleanup cache directory", "error", err)
+	switch {
+	case err != nil:
+		return exitCode(ctx), res.Output
+	case res.Incomplete():
+		return exitIncomplete, res.Output
 	}
+	return 0, res.Output
+}
 
-	elapsed := time.Since(startTime)
-	logger.Info("Download completed",
-		"file", cfg.Output,
-		"segments", stats.Total,
-		"completed", stats.Completed,
-		"failed", stats.Failed,
-		"duration", elapsed,
-	)
+const (
+	// exitIncomplete means the output was written but segments are missing.
+	exitIncomplete = 2
+	// exitInterrupted is the conventional exit status after SIGINT.
+	exitInterrupted = 130
+)
 
-	return 0
+// exitCode returns the exit status for a failed run: exitInterrupted when
+// the run was canceled by a signal, 1 otherwise.
+func exitCode(ctx context.Context) int {
+	if ctx.Err() != nil {
+		return exitInterrupted
+	}
+	return 1
 }
 
 func printVersion(stdout io.Writer) {
 	_, _ = fmt.Fprintf(stdout, "m3u8-download version %s (commit: %s, built: %s)\n", version, commit, date)
 }
 
-func setupLogger(verbose bool) *slog.Logger {
+// setupLogger logs to w, which is stderr so that stdout stays free for
+// -output -.
+func setupLogger(verbose bool, w io.Writer) *slog.Logger {
 	level := slog.LevelInfo
 	if verbose {
 		level = slog.LevelDebug
 	}
 
-	return slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{
 		Level: level,
 	}))
 }
@@ -2,14 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"m3u8-download/internal/config"
 	"m3u8-download/internal/downloader"
+	"m3u8-download/internal/manifest"
 	"m3u8-download/internal/parser"
 	"m3u8-download/pkg/m3u8"
 )
@@ -46,10 +57,10 @@ segment2.ts
 	}
 
 	httpClient := downloader.NewHTTPClient(cfg)
-	logger := setupLogger(false)
+	logger := setupLogger(false, io.Discard)
 	dl := downloader.NewDownloader(httpClient, logger)
 
-	body, err := httpClient.Get(cfg.URL)
+	body, err := httpClient.Get(context.Background(), cfg.URL)
 	if err != nil {
 		t.Fatalf("Failed to fetch M3U8: %v", err)
 	}
@@ -66,7 +77,7 @@ segment2.ts
 	}
 	defer config.CleanupCacheDir(cacheDir)
 
-	stats, err := dl.DownloadSegments(playlist, cacheDir, cfg.Workers)
+	stats, err := dl.DownloadSegments(context.Background(), playlist, cacheDir, cfg.Workers)
 	if err != nil {
 		t.Fatalf("Failed to download segments: %v", err)
 	}
@@ -79,7 +90,7 @@ segment2.ts
 		t.Errorf("got %d completed, want 2", stats.Completed)
 	}
 
-	err = dl.MergeFiles(cacheDir, cfg.Output)
+	err = dl.MergeFiles(context.Background(), playlist, cacheDir, cfg.Output, stats.FailedSegments)
 	if err != nil {
 		t.Fatalf("Failed to merge files: %v", err)
 	}
@@ -93,6 +104,16 @@ segment2.ts
 }
 
 func TestIntegrationEncryptedDownload(t *testing.T) {
+	key := []byte("0123456789012345")
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	// One TS sync byte plus PKCS#7 padding, encrypted with the IV implied by
+	// media sequence 0.
+	segment := append([]byte{0x47, 0x00, 0x00, 0x00}, bytes.Repeat([]byte{12}, 12)...)
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(segment, segment)
+
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(r.URL.Path, ".m3u8") {
 			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
@@ -108,7 +129,7 @@ segment1.ts
 			w.Write([]byte("0123456789012345"))
 		} else if strings.HasSuffix(r.URL.Path, ".ts") {
 			w.Header().Set("Content-Type", "video/mp2t")
-			w.Write([]byte{0x47, 0x00, 0x00, 0x00})
+			w.Write(segment)
 		}
 	}))
 	defer ts.Close()
@@ -123,10 +144,10 @@ segment1.ts
 	}
 
 	httpClient := downloader.NewHTTPClient(cfg)
-	logger := setupLogger(false)
+	logger := setupLogger(false, io.Discard)
 	dl := downloader.NewDownloader(httpClient, logger)
 
-	body, err := httpClient.Get(cfg.URL)
+	body, err := httpClient.Get(context.Background(), cfg.URL)
 	if err != nil {
 		t.Fatalf("Failed to fetch M3U8: %v", err)
 	}
@@ -143,14 +164,218 @@ segment1.ts
 	}
 	defer config.CleanupCacheDir(cacheDir)
 
-	_, err = dl.DownloadSegments(playlist, cacheDir, cfg.Workers)
+	stats, err := dl.DownloadSegments(context.Background(), playlist, cacheDir, cfg.Workers)
 	if err != nil {
 		t.Errorf("Failed to download segments: %v", err)
 	}
 
+	if stats.Completed != 1 {
+		t.Errorf("got %d completed, want 1", stats.Completed)
+	}
+
 	os.Remove(cfg.Output)
 }
 
+func TestRunResume(t *testing.T) {
+	var seg1Requests atomic.Int64
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/video.m3u8"):
+			w.Write([]byte(`#EXTM3U
+#EXTINF:10.0,
+segment1.ts
+#EXTINF:10.0,
+segment2.ts
+#EXT-X-ENDLIST`))
+		case strings.HasSuffix(r.URL.Path, "/segment1.ts"):
+			seg1Requests.Add(1)
+			w.Write([]byte{0x47, 0x01})
+		case strings.HasSuffix(r.URL.Path, "/segment2.ts"):
+			w.Write([]byte{0x47, 0x02})
+		}
+	}))
+	defer ts.Close()
+
+	playlistURL := ts.URL + "/video.m3u8"
+	cacheDir, err := config.EnsureCacheDir("test-resume")
+	if err != nil {
+		t.Fatalf("EnsureCacheDir failed: %v", err)
+	}
+	defer config.CleanupCacheDir(cacheDir)
+
+	// Simulate a run interrupted after the first segment was stored.
+	playlist, err := parser.ParsePlaylist("#EXTM3U\n#EXTINF:10.0,\nsegment1.ts\n#EXTINF:10.0,\nsegment2.ts\n", playlistURL)
+	if err != nil {
+		t.Fatalf("ParsePlaylist failed: %v", err)
+	}
+	mf := manifest.New(cacheDir, playlistURL, playlist)
+	seg1 := []byte{0x47, 0x01}
+	if err := os.WriteFile(filepath.Join(cacheDir, playlist.Segments[0].Name), seg1, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mf.MarkCompleted(0, int64(len(seg1)), manifest.Checksum(seg1))
+	if err := mf.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	output := filepath.Join(t.TempDir(), "resume.ts")
+	args := []string{"-url", playlistURL, "-output", output, "-name", "test-resume", "-resume"}
+
+	var stdout, stderr bytes.Buffer
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("run() code = %d, want 0", code)
+	}
+
+	if got := seg1Requests.Load(); got != 0 {
+		t.Errorf("segment1 requested %d times, want 0", got)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if !bytes.Equal(data, []byte{0x47, 0x01, 0x47, 0x02}) {
+		t.Errorf("got output %x, want 47014702", data)
+	}
+
+	if _, err := os.Stat(cacheDir); !os.IsNotExist(err) {
+		t.Error("cache directory not cleaned up after successful run")
+	}
+}
+
+func TestRunFailurePolicyExitCodes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/video.m3u8"):
+			w.Write([]byte(`#EXTM3U
+#EXTINF:10.0,
+segment1.ts
+#EXTINF:10.0,
+missing.ts
+#EXT-X-ENDLIST`))
+		case strings.HasSuffix(r.URL.Path, "/segment1.ts"):
+			w.Write([]byte{0x47, 0x01})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	// The output is streamed, so a failed job leaves the segments before
+	// the first missing one in place for -resume.
+	tests := []struct {
+		name       string
+		extraArgs  []string
+		wantCode   int
+		wantOutput []byte
+	}{
+		{name: "missing segment fails the job", wantCode: 1, wantOutput: []byte{0x47, 0x01}},
+		{name: "tolerated missing segment is incomplete", extraArgs: []string{"-max-failed", "1"}, wantCode: exitIncomplete, wantOutput: []byte{0x47, 0x01}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "out.ts")
+			args := append([]string{"-url", ts.URL + "/video.m3u8", "-output", output, "-name", "test-failure-policy"}, tt.extraArgs...)
+
+			cacheDir, err := config.EnsureCacheDir("test-failure-policy")
+			if err != nil {
+				t.Fatalf("EnsureCacheDir failed: %v", err)
+			}
+			defer config.CleanupCacheDir(cacheDir)
+
+			var stdout, stderr bytes.Buffer
+			if code := run(args, &stdout, &stderr); code != tt.wantCode {
+				t.Fatalf("run() code = %d, want %d", code, tt.wantCode)
+			}
+
+			data, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("failed to read output: %v", err)
+			}
+			if !bytes.Equal(data, tt.wantOutput) {
+				t.Errorf("got output %x, want %x", data, tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestRunRemux(t *testing.T) {
+	var segmentRequests atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/video.m3u8"):
+			w.Write([]byte("#EXTM3U\n#EXTINF:10.0,\nsegment1.ts\n#EXT-X-ENDLIST\n"))
+		case strings.HasSuffix(r.URL.Path, "/segment1.ts"):
+			segmentRequests.Add(1)
+			w.Write([]byte{0x47, 0x01})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name         string
+		ffmpeg       bool
+		wantCode     int
+		wantSegments int64
+	}{
+		{name: "remuxed with ffmpeg", ffmpeg: true, wantCode: 0, wantSegments: 1},
+		{name: "fails before downloading without ffmpeg", wantCode: 1, wantSegments: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segmentRequests.Store(0)
+
+			bin := t.TempDir()
+			if tt.ffmpeg {
+				// Copies the input (after -i) to the output (the last argument).
+				script := "#!/bin/sh\nin=\"\"; prev=\"\"\nfor a in \"$@\"; do [ \"$prev\" = \"-i\" ] && in=\"$a\"; prev=\"$a\"; done\ncp \"$in\" \"$prev\"\n"
+				if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte(script), 0755); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+			} else {
+				t.Setenv("PATH", bin)
+			}
+
+			output := filepath.Join(t.TempDir(), "out.mkv")
+			args := []string{"-url", ts.URL + "/video.m3u8", "-output", output, "-name", "test-remux"}
+
+			cacheDir, err := config.EnsureCacheDir("test-remux")
+			if err != nil {
+				t.Fatalf("EnsureCacheDir failed: %v", err)
+			}
+			defer config.CleanupCacheDir(cacheDir)
+
+			var stdout, stderr bytes.Buffer
+			if code := run(args, &stdout, &stderr); code != tt.wantCode {
+				t.Fatalf("run() code = %d, want %d", code, tt.wantCode)
+			}
+			if got := segmentRequests.Load(); got != tt.wantSegments {
+				t.Errorf("got %d segment requests, want %d", got, tt.wantSegments)
+			}
+
+			if tt.wantCode != 0 {
+				return
+			}
+			data, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("output missing: %v", err)
+			}
+			if !bytes.Equal(data, []byte{0x47, 0x01}) {
+				t.Errorf("got output %v, want the merged segments", data)
+			}
+			if _, err := os.Stat(output + ".part.ts"); !os.IsNotExist(err) {
+				t.Error("merged file left behind after remuxing")
+			}
+		})
+	}
+}
+
 func TestRunCLIPaths(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -261,3 +486,428 @@ func TestEnsureCacheDirCreatesDirectory(t *testing.T) {
 
 	config.CleanupCacheDir(cacheDir)
 }
+
+func TestRunSendsHeadersAndCookies(t *testing.T) {
+	key := []byte("0123456789012345")
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	segment := append([]byte{0x47, 0x00, 0x00, 0x00}, bytes.Repeat([]byte{12}, 12)...)
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(segment, segment)
+
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("X-Token") != "abc" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		session, err1 := r.Cookie("session")
+		cdn, err2 := r.Cookie("cdn")
+		if err1 != nil || err2 != nil || session.Value != "s1" || cdn.Value != "c1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		mu.Lock()
+		seen[filepath.Ext(r.URL.Path)] = true
+		mu.Unlock()
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, ".m3u8"):
+			w.Write([]byte(`#EXTM3U
+#EXT-X-KEY:METHOD=AES-128,URI="key.key"
+#EXTINF:10.0,
+segment1.ts
+#EXT-X-ENDLIST`))
+		case strings.HasSuffix(r.URL.Path, ".key"):
+			w.Write(key)
+		case strings.HasSuffix(r.URL.Path, ".ts"):
+			w.Write(segment)
+		}
+	}))
+	defer ts.Close()
+
+	cookieFile := filepath.Join(t.TempDir(), "cookies.txt")
+	if err := os.WriteFile(cookieFile, []byte("# Netscape HTTP Cookie File\n127.0.0.1\tFALSE\t/\tFALSE\t0\tcdn\tc1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(t.TempDir(), "out.ts")
+	args := []string{
+		"-url", ts.URL + "/video.m3u8", "-output", output, "-name", "test-headers",
+		"-header", "Authorization: Bearer secret", "-header", "X-Token: abc",
+		"-cookie", "session=s1", "-cookie-file", cookieFile,
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("run() code = %d, want 0\n%s", code, stdout.String())
+	}
+
+	for _, ext := range []string{".m3u8", ".key", ".ts"} {
+		if !seen[ext] {
+			t.Errorf("no authorized %s request", ext)
+		}
+	}
+}
+
+func TestRunLive(t *testing.T) {
+	var reloads atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/live.m3u8"):
+			if reloads.Add(1) == 1 {
+				w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1.0,\nseg0.ts\n"))
+				return
+			}
+			w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1.0,\nseg0.ts\n#EXTINF:1.0,\nseg1.ts\n#EXT-X-ENDLIST\n"))
+		case strings.HasSuffix(r.URL.Path, "/seg0.ts"):
+			w.Write([]byte{0x47, 0x00})
+		case strings.HasSuffix(r.URL.Path, "/seg1.ts"):
+			w.Write([]byte{0x47, 0x01})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	output := filepath.Join(t.TempDir(), "live.ts")
+	args := []string{"-url", ts.URL + "/live.m3u8", "-output", output, "-name", "test-live", "-live"}
+
+	var stdout, stderr bytes.Buffer
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("run() code = %d, want 0", code)
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if want := []byte{0x47, 0x00, 0x47, 0x01}; !bytes.Equal(got, want) {
+		t.Errorf("got output %x, want %x", got, want)
+	}
+}
+
+func TestRunPipe(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/video.m3u8"):
+			w.Write([]byte("#EXTM3U\n#EXTINF:10.0,\nsegment1.ts\n#EXTINF:10.0,\nsegment2.ts\n#EXT-X-ENDLIST\n"))
+		case strings.HasSuffix(r.URL.Path, "/segment1.ts"):
+			w.Write([]byte{0x47, 0x01})
+		case strings.HasSuffix(r.URL.Path, "/segment2.ts"):
+			w.Write([]byte{0x47, 0x02})
+		}
+	}))
+	defer ts.Close()
+
+	want := []byte{0x47, 0x01, 0x47, 0x02}
+	piped := filepath.Join(t.TempDir(), "piped.ts")
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout []byte
+		wantFile   []byte
+	}{
+		{name: "stdout", args: []string{"-output", "-"}, wantStdout: want},
+		{name: "exec", args: []string{"-exec", "cat > " + piped}, wantFile: want},
+		{name: "exec output", args: []string{"-exec", "cat"}, wantStdout: want},
+		{name: "failed exec", args: []string{"-exec", "cat > /dev/null; exit 3"}, wantCode: 1},
+	}
+
+	// The failed exec leaves its segments cached for -resume.
+	t.Cleanup(func() { config.CleanupCacheDir(filepath.Join("cache", "test-pipe")) })
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-url", ts.URL + "/video.m3u8", "-name", "test-pipe"}, tt.args...)
+
+			var stdout bytes.Buffer
+			var stderr syncBuffer
+			if code := run(args, &stdout, &stderr); code != tt.wantCode {
+				t.Fatalf("run() code = %d, want %d; stderr:\n%s", code, tt.wantCode, stderr.String())
+			}
+			if !bytes.Equal(stdout.Bytes(), tt.wantStdout) {
+				t.Errorf("got stdout %x, want %x", stdout.Bytes(), tt.wantStdout)
+			}
+			if !strings.Contains(stderr.String(), "Playlist parsed") {
+				t.Errorf("logs not written to stderr: %q", stderr.String())
+			}
+			if tt.wantFile != nil {
+				got, err := os.ReadFile(piped)
+				if err != nil {
+					t.Fatalf("failed to read piped output: %v", err)
+				}
+				if !bytes.Equal(got, tt.wantFile) {
+					t.Errorf("got piped output %x, want %x", got, tt.wantFile)
+				}
+			}
+		})
+	}
+}
+
+// syncBuffer is a bytes.Buffer that the logger and the stderr of an -exec
+// command can write to at once.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// adtsAudio starts like an ADTS frame, which names the audio sidecar .aac.
+const adtsAudio = "\xff\xf1\x50\x80aac"
+
+func TestRunRenditions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/master.m3u8":
+			w.Write([]byte(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",LANGUAGE="en",DEFAULT=YES,URI="audio/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="Japanese",LANGUAGE="ja",URI="audio/ja.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="sub",NAME="Deutsch",LANGUAGE="de",URI="subs/de.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,AUDIO="aud",SUBTITLES="sub"
+video/index.m3u8
+`))
+		case "/video/index.m3u8":
+			w.Write([]byte("#EXTM3U\n#EXTINF:10.0,\nv1.ts\n#EXT-X-ENDLIST\n"))
+		case "/audio/en.m3u8", "/audio/ja.m3u8":
+			w.Write([]byte("#EXTM3U\n#EXTINF:10.0,\na1.aac\n#EXT-X-ENDLIST\n"))
+		case "/subs/de.m3u8":
+			w.Write([]byte("#EXTM3U\n#EXTINF:10.0,\ns1.vtt\n#EXT-X-ENDLIST\n"))
+		case "/video/v1.ts":
+			w.Write([]byte{0x47, 0x01})
+		case "/audio/a1.aac":
+			w.Write([]byte(adtsAudio))
+		case "/subs/s1.vtt":
+			w.Write([]byte("WEBVTT\n\n00:01.000 --> 00:02.000\nHallo\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		ffmpeg    bool
+		output    string
+		args      []string
+		wantFiles []string
+		wantArgs  string
+	}{
+		{
+			name:      "default audio as a sidecar",
+			output:    "out.ts",
+			wantFiles: []string{"out.ts", "out.en.aac"},
+		},
+		{
+			name:      "selected audio and subtitles as sidecars without ffmpeg",
+			output:    "out.ts",
+			args:      []string{"-audio-lang", "ja", "-subs", "de"},
+			wantFiles: []string{"out.ts", "out.ja.aac", "out.de.vtt"},
+		},
+		{
+			name:      "subtitles converted to SubRip",
+			output:    "out.ts",
+			args:      []string{"-subs", "de", "-subs-format", "srt"},
+			wantFiles: []string{"out.ts", "out.en.aac", "out.de.srt"},
+		},
+		{
+			name:      "muxed with ffmpeg",
+			ffmpeg:    true,
+			output:    "out.mkv",
+			args:      []string{"-audio-lang", "all", "-subs", "all"},
+			wantFiles: []string{"out.mkv"},
+			wantArgs:  "-map 1 -metadata:s:a:0 language=en -metadata:s:a:0 title=English -map 2 -metadata:s:a:1 language=ja",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bin := t.TempDir()
+			if tt.ffmpeg {
+				script := "#!/bin/sh\necho \"$@\" > \"$(dirname \"$0\")/args\"\nfor a in \"$@\"; do out=\"$a\"; done\necho muxed > \"$out\"\n"
+				if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte(script), 0755); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+			} else {
+				t.Setenv("PATH", bin)
+			}
+
+			dir := t.TempDir()
+			args := append([]string{"-url", ts.URL + "/master.m3u8", "-output", filepath.Join(dir, tt.output), "-name", "test-renditions"}, tt.args...)
+
+			cacheDir, err := config.EnsureCacheDir("test-renditions")
+			if err != nil {
+				t.Fatalf("EnsureCacheDir failed: %v", err)
+			}
+			defer config.CleanupCacheDir(cacheDir)
+
+			var stdout, stderr bytes.Buffer
+			if code := run(args, &stdout, &stderr); code != 0 {
+				t.Fatalf("run() code = %d, want 0", code)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			want := append([]string(nil), tt.wantFiles...)
+			sort.Strings(want)
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("got files %v, want %v", got, want)
+			}
+
+			if !tt.ffmpeg {
+				if data, _ := os.ReadFile(filepath.Join(dir, tt.wantFiles[1])); string(data) != adtsAudio {
+					t.Errorf("got audio sidecar %q, want %q", data, adtsAudio)
+				}
+				return
+			}
+			data, err := os.ReadFile(filepath.Join(bin, "args"))
+			if err != nil {
+				t.Fatalf("ffmpeg not run: %v", err)
+			}
+			if !strings.Contains(string(data), tt.wantArgs) {
+				t.Errorf("got ffmpeg args %q, want them to contain %q", data, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int64
+	var mu sync.Mutex
+	referers := make(map[string]string)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, ".m3u8") && !strings.Contains(r.URL.Path, "missing"):
+			mu.Lock()
+			referers[r.URL.Path] = r.Header.Get("Referer")
+			mu.Unlock()
+			w.Write([]byte("#EXTM3U\n#EXTINF:10.0,\nsegment1.ts\n#EXT-X-ENDLIST\n"))
+		case strings.HasSuffix(r.URL.Path, "/segment1.ts"):
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				m := maxInFlight.Load()
+				if n <= m || maxInFlight.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte{0x47, 0x01})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	list := fmt.Sprintf(`# batch
+%[1]s/a/video.m3u8 %[2]s/a.ts
+%[1]s/b/video.m3u8 %[2]s/b.ts "Referer: https://b.example.com/"
+%[1]s/missing.m3u8 %[2]s/c.ts
+`, ts.URL, dir)
+
+	tests := []struct {
+		name    string
+		jobs    string
+		stdin   bool
+		maxJobs int64
+	}{
+		{name: "sequential from a file", jobs: "1", maxJobs: 1},
+		{name: "concurrent from stdin", jobs: "3", stdin: true, maxJobs: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxInFlight.Store(0)
+
+			input := filepath.Join(t.TempDir(), "list.txt")
+			if err := os.WriteFile(input, []byte(list), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.stdin {
+				batchStdin = strings.NewReader(list)
+				defer func() { batchStdin = os.Stdin }()
+				input = "-"
+			}
+
+			for _, path := range []string{ts.URL + "/a/video.m3u8", ts.URL + "/b/video.m3u8", ts.URL + "/missing.m3u8"} {
+				defer config.CleanupCacheDir(filepath.Join("cache", config.JobID(path, "")))
+			}
+
+			var stdout, stderr bytes.Buffer
+			code := run([]string{"-input", input, "-jobs", tt.jobs, "-workers", "1", "-retries", "1"}, &stdout, &stderr)
+			if code != 1 {
+				t.Fatalf("run() code = %d, want 1 for a failed job; stderr %s", code, stderr.String())
+			}
+
+			for _, name := range []string{"a.ts", "b.ts"} {
+				if data, err := os.ReadFile(filepath.Join(dir, name)); err != nil || !bytes.Equal(data, []byte{0x47, 0x01}) {
+					t.Errorf("%s: got %v, %v", name, data, err)
+				}
+			}
+
+			out := stdout.String()
+			if !strings.Contains(out, "Batch summary: 2 ok, 0 incomplete, 1 failed, 0 interrupted") {
+				t.Errorf("summary missing from output:\n%s", out)
+			}
+			if !strings.Contains(out, "failed") || !strings.Contains(out, ts.URL+"/missing.m3u8") {
+				t.Errorf("summary lacks the failed job:\n%s", out)
+			}
+
+			mu.Lock()
+			if referers["/b/video.m3u8"] != "https://b.example.com/" || referers["/a/video.m3u8"] != "" {
+				t.Errorf("got referers %v, want the header only on job b", referers)
+			}
+			mu.Unlock()
+
+			if got := maxInFlight.Load(); got > tt.maxJobs {
+				t.Errorf("got %d concurrent segment downloads, want at most %d", got, tt.maxJobs)
+			}
+		})
+	}
+}
+
+func TestBatchExitCode(t *testing.T) {
+	tests := []struct {
+		codes []int
+		want  int
+	}{
+		{codes: []int{0, 0}, want: 0},
+		{codes: []int{0, exitIncomplete}, want: exitIncomplete},
+		{codes: []int{exitIncomplete, 1, 0}, want: 1},
+	}
+
+	for _, tt := range tests {
+		results := make([]batchResult, len(tt.codes))
+		for i, code := range tt.codes {
+			results[i].code = code
+		}
+		if got := batchExitCode(context.Background(), results); got != tt.want {
+			t.Errorf("batchExitCode(%v) = %d, want %d", tt.codes, got, tt.want)
+		}
+	}
+}
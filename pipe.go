@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+// pipeOutput is where a job writes with -output - or -exec: stdout, or the
+// stdin of the -exec command.
+type pipeOutput struct {
+	io.Writer
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	closed bool
+}
+
+// openPipe starts the -exec command, if any, with its output going to
+// stdout and stderr. The command is not tied to a context: on Ctrl+C it
+// gets EOF and can finish what it has received.
+func openPipe(cfg *m3u8.DownloadConfig, stdout, stderr io.Writer) (*pipeOutput, error) {
+	if cfg.Exec == "" {
+		return &pipeOutput{Writer: stdout}, nil
+	}
+
+	cmd := shellCommand(cfg.Exec)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &pipeOutput{Writer: stdin, cmd: cmd, stdin: stdin}, nil
+}
+
+// Close ends the input of the -exec command and waits for it to exit.
+// Closing again does nothing.
+func (p *pipeOutput) Close() error {
+	if p.cmd == nil || p.closed {
+		return nil
+	}
+	p.closed = true
+	p.stdin.Close()
+	if err := p.cmd.Wait(); err != nil {
+		return fmt.Errorf("-exec command failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Package client downloads HLS playlists. It is the API the m3u8-download
+// command is built on, for programs that embed the downloader:
+//
+//	res, err := client.Download(ctx, "https://example.com/video.m3u8",
+//		client.WithOutput("video.mp4"),
+//		client.WithProgress(func(p m3u8.Progress) { fmt.Println(p.Done, "/", p.Total) }),
+//	)
+//
+// Segments are cached in a directory named after the job, under
+// os.UserCacheDir or WithCacheDir, while they are downloaded, so that an
+// interrupted download can be resumed with WithResume.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"m3u8-download/internal/downloader"
+	"m3u8-download/internal/muxer"
+	"m3u8-download/internal/parser"
+	"m3u8-download/internal/subtitle"
+	"m3u8-download/pkg/m3u8"
+)
+
+// Client downloads playlists over one HTTP client, whose connections, rate
+// limit and cookies every download shares. It is safe for concurrent use.
+type Client struct {
+	opts options
+	http *downloader.HTTPClient
+}
+
+// New returns a client configured by opts, which are also the defaults of
+// every download it runs.
+func New(opts ...Option) (*Client, error) {
+	o := defaultOptions().with(opts)
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+
+	httpClient := downloader.NewHTTPClient(&o.cfg)
+	if o.cfg.CookieFile != "" {
+		jar, err := downloader.LoadCookieFile(o.cfg.CookieFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load cookie file: %w", err)
+		}
+		httpClient.SetCookieJar(jar)
+	}
+
+	return &Client{opts: o, http: httpClient}, nil
+}
+
+// Download downloads url with a new client configured by opts.
+func Download(ctx context.Context, url string, opts ...Option) (*Result, error) {
+	c, err := New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return c.Download(ctx, url)
+}
+
+// RateLimit returns the current rate limit in bytes per second, zero when
+// downloads are not limited.
+func (c *Client) RateLimit() int64 {
+	return c.http.RateLimiter().Rate()
+}
+
+// SetRateLimit changes the rate limit of every download of c, including
+// those running; zero removes it.
+func (c *Client) SetRateLimit(bytesPerSec int64) {
+	c.http.RateLimiter().SetRate(bytesPerSec)
+}
+
+// Parse parses a media playlist fetched from url, against which its URIs
+// are resolved. It returns m3u8.ErrMasterPlaylist for a master playlist.
+func Parse(content, url string) (*m3u8.Playlist, error) {
+	return parser.ParsePlaylist(content, url)
+}
+
+// ParseMaster parses a master playlist fetched from url.
+func ParseMaster(content, url string) (*m3u8.MasterPlaylist, error) {
+	return parser.ParseMasterPlaylist(content, url)
+}
+
+// IsMaster reports whether content is a master playlist.
+func IsMaster(content string) bool {
+	return parser.IsMasterPlaylist(content)
+}
+
+// validate checks the options that would otherwise only fail once the
+// download runs.
+func (o *options) validate() error {
+	cfg := &o.cfg
+	if err := parser.ValidateVariantRule(cfg.Variant); err != nil {
+		return fmt.Errorf("invalid variant: %w", err)
+	}
+	if err := muxer.ValidateFormat(cfg.Format); err != nil {
+		return err
+	}
+	if cfg.SubsFormat != subtitle.FormatVTT && cfg.SubsFormat != subtitle.FormatSRT {
+		return fmt.Errorf("invalid subtitle format %q", cfg.SubsFormat)
+	}
+	if cfg.ProxyURL != "" {
+		if _, err := downloader.ParseProxyURL(cfg.ProxyURL); err != nil {
+			return fmt.Errorf("invalid proxy: %w", err)
+		}
+	}
+	if cfg.LimitRate != "" {
+		if _, err := downloader.ParseRate(cfg.LimitRate); err != nil {
+			return fmt.Errorf("invalid rate limit: %w", err)
+		}
+	}
+	switch {
+	case cfg.Workers <= 0:
+		return errors.New("workers must be positive")
+	case cfg.Retries <= 0:
+		return errors.New("retries must be positive")
+	case cfg.Timeout <= 0:
+		return errors.New("timeout must be positive")
+	case cfg.RetryPasses < 0, cfg.RetryBudget < 0, cfg.MaxFailed < 0:
+		return errors.New("retry passes, retry budget and max failed cannot be negative")
+	case cfg.LiveDuration < 0:
+		return errors.New("live duration cannot be negative")
+	case o.cacheDir == "":
+		return errors.New("cache directory cannot be empty")
+	}
+	return nil
+}
+
+// validateOutput checks the output of a single download.
+func (o *options) validateOutput() error {
+	if o.writer == nil && o.cfg.Output == "-" {
+		return errors.New("output \"-\" needs WithWriter")
+	}
+	if o.writer != nil && o.cfg.Format != "" {
+		return errors.New("a writer output cannot be remuxed into a format")
+	}
+	return nil
+}
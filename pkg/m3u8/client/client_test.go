@@ -0,0 +1,377 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"m3u8-download/internal/config"
+	"m3u8-download/internal/downloader"
+	"m3u8-download/pkg/m3u8"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newTestServer serves a playlist of three segments; segment2.ts fails
+// with 404 when missing2 is set.
+func newTestServer(t *testing.T, missing2 bool) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/video.m3u8"):
+			w.Write([]byte("#EXTM3U\n#EXTINF:10.0,\nsegment1.ts\n#EXTINF:10.0,\nsegment2.ts\n#EXTINF:10.0,\nsegment3.ts\n#EXT-X-ENDLIST\n"))
+		case strings.HasSuffix(r.URL.Path, "/segment1.ts"):
+			w.Write([]byte{0x47, 0x01})
+		case strings.HasSuffix(r.URL.Path, "/segment2.ts") && !missing2:
+			w.Write([]byte{0x47, 0x02})
+		case strings.HasSuffix(r.URL.Path, "/segment3.ts"):
+			w.Write([]byte{0x47, 0x03})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestDownload(t *testing.T) {
+	ts := newTestServer(t, false)
+	output := filepath.Join(t.TempDir(), "video.ts")
+
+	var progress []m3u8.Progress
+	res, err := Download(context.Background(), ts.URL+"/video.m3u8",
+		WithOutput(output),
+		WithJobName("test-client-download"),
+		WithCacheDir(t.TempDir()),
+		WithProgress(func(p m3u8.Progress) { progress = append(progress, p) }),
+	)
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	if res.Output != output {
+		t.Errorf("got output %q, want %q", res.Output, output)
+	}
+	if res.Stats.Completed != 3 || res.Incomplete() {
+		t.Errorf("got stats %+v, want 3 completed", res.Stats)
+	}
+	if len(progress) != 3 {
+		t.Fatalf("got %d progress calls, want 3", len(progress))
+	}
+	if got, want := progress[2], (m3u8.Progress{Total: 3, Done: 3, Bytes: 6}); got != want {
+		t.Errorf("got final progress %+v, want %+v", got, want)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if !bytes.Equal(data, []byte{0x47, 0x01, 0x47, 0x02, 0x47, 0x03}) {
+		t.Errorf("got output %x, want 470147024703", data)
+	}
+}
+
+func TestDownloadWriter(t *testing.T) {
+	ts := newTestServer(t, false)
+
+	c, err := New(WithJobName("test-client-writer"), WithCacheDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	res, err := c.Download(context.Background(), ts.URL+"/video.m3u8", WithWriter(&buf))
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	if res.Output != "" {
+		t.Errorf("got output %q, want none", res.Output)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{0x47, 0x01, 0x47, 0x02, 0x47, 0x03}) {
+		t.Errorf("got %x, want 470147024703", buf.Bytes())
+	}
+}
+
+func TestDownloadFailurePolicy(t *testing.T) {
+	ts := newTestServer(t, true)
+
+	tests := []struct {
+		name      string
+		maxFailed int
+		wantErr   bool
+	}{
+		{name: "within max failed", maxFailed: 1},
+		{name: "over max failed", maxFailed: 0, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir := t.TempDir()
+			res, err := Download(context.Background(), ts.URL+"/video.m3u8",
+				WithOutput(filepath.Join(t.TempDir(), "video.ts")),
+				WithJobName("test-client-failure"),
+				WithCacheDir(cacheDir),
+				WithRetries(1),
+				WithFailurePolicy(0, tt.maxFailed),
+			)
+
+			var incomplete *m3u8.IncompleteDownloadError
+			if got := errors.As(err, &incomplete); got != tt.wantErr {
+				t.Errorf("got error %v, want IncompleteDownloadError %v", err, tt.wantErr)
+			}
+			if !res.Incomplete() {
+				t.Error("Incomplete() = false with a segment missing")
+			}
+			// A failed job stays cached for WithResume.
+			_, err = os.Stat(filepath.Join(cacheDir, "test-client-failure"))
+			if cached := err == nil; cached != tt.wantErr {
+				t.Errorf("got job cached %v, want %v", cached, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewValidatesOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "variant", opts: []Option{WithVariant("best")}},
+		{name: "format", opts: []Option{WithFormat("avi")}},
+		{name: "subtitle format", opts: []Option{WithSubtitles("all", "ass")}},
+		{name: "proxy", opts: []Option{WithProxy("ftp://proxy")}},
+		{name: "workers", opts: []Option{WithWorkers(0, false)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.opts...); err == nil {
+				t.Error("got no error, want one")
+			}
+		})
+	}
+}
+
+func TestWithHeaderOverrides(t *testing.T) {
+	o := defaultOptions().with([]Option{
+		WithConfig(&m3u8.DownloadConfig{CustomHeader: map[string]string{"x-token": "cfg"}}),
+		WithHeader("user-agent", "a"),
+		WithHeaders(map[string]string{"User-Agent": "b", "X-TOKEN": "opt"}),
+	})
+
+	want := map[string]string{"User-Agent": "b", "X-Token": "opt"}
+	if fmt.Sprint(o.cfg.CustomHeader) != fmt.Sprint(want) {
+		t.Errorf("got headers %v, want %v", o.cfg.CustomHeader, want)
+	}
+}
+
+func TestDownloadValidatesOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "stdout without writer", opts: []Option{WithOutput("-")}},
+		{name: "writer with format", opts: []Option{WithWriter(io.Discard), WithFormat("mp4")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Download(context.Background(), "http://127.0.0.1:0/video.m3u8", tt.opts...); err == nil {
+				t.Error("got no error, want one")
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\nlow/index.m3u8\n"
+	if !IsMaster(master) {
+		t.Error("IsMaster() = false for a master playlist")
+	}
+	if _, err := Parse(master, "http://example.com/master.m3u8"); !errors.Is(err, m3u8.ErrMasterPlaylist) {
+		t.Errorf("got error %v, want %v", err, m3u8.ErrMasterPlaylist)
+	}
+
+	playlist, err := Parse("#EXTM3U\n#EXTINF:10.0,\nsegment1.ts\n#EXT-X-ENDLIST\n", "http://example.com/video/index.m3u8")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if got, want := playlist.Segments[0].Url, "http://example.com/video/segment1.ts"; got != want {
+		t.Errorf("got segment URL %q, want %q", got, want)
+	}
+}
+
+func TestFetchMediaPlaylistFollowsVariant(t *testing.T) {
+	var requested []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		switch r.URL.Path {
+		case "/master.m3u8":
+			w.Write([]byte(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360
+low/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2560000,RESOLUTION=1280x720
+high/index.m3u8`))
+		case "/low/index.m3u8", "/high/index.m3u8":
+			w.Write([]byte(`#EXTM3U
+#EXTINF:10.0,
+segment1.ts
+#EXT-X-ENDLIST`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	cfg := &m3u8.DownloadConfig{
+		URL:     ts.URL + "/master.m3u8",
+		Retries: 1,
+		Timeout: 10,
+		Variant: "lowest",
+	}
+
+	playlist, _, err := fetchMediaPlaylist(context.Background(), downloader.NewHTTPClient(cfg), cfg, discardLogger)
+	if err != nil {
+		t.Fatalf("fetchMediaPlaylist failed: %v", err)
+	}
+
+	if len(playlist.Segments) != 1 {
+		t.Fatalf("got %d segments, want 1", len(playlist.Segments))
+	}
+
+	if !strings.Contains(playlist.Segments[0].Url, "/low/") {
+		t.Errorf("segment URL %q not resolved against the selected variant", playlist.Segments[0].Url)
+	}
+
+	if len(requested) != 2 || requested[1] != "/low/index.m3u8" {
+		t.Errorf("got requests %v, want master then low variant", requested)
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	fmp4 := &m3u8.Playlist{Segments: []*m3u8.TSInfo{{Map: &m3u8.Map{URI: "init.mp4"}}}}
+	ts := &m3u8.Playlist{Segments: []*m3u8.TSInfo{{}}}
+
+	tests := []struct {
+		name       string
+		format     string
+		output     string
+		playlist   *m3u8.Playlist
+		wantFormat string
+		wantName   string
+	}{
+		{name: "MPEG-TS default", playlist: ts, wantFormat: "ts", wantName: "job.ts"},
+		{name: "fMP4 default", playlist: fmp4, wantFormat: "mp4", wantName: "job.mp4"},
+		{name: "format flag", format: "mkv", playlist: ts, wantFormat: "mkv", wantName: "job.mkv"},
+		{name: "output extension", output: "video.MP4", playlist: ts, wantFormat: "mp4", wantName: "video.MP4"},
+		{name: "unknown extension keeps segment container", output: "video.bin", playlist: fmp4, wantFormat: "mp4", wantName: "video.bin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &m3u8.DownloadConfig{Format: tt.format, Output: tt.output}
+
+			format := outputFormat(cfg, tt.playlist)
+			if format != tt.wantFormat {
+				t.Errorf("got format %q, want %q", format, tt.wantFormat)
+			}
+			if got := outputName(cfg, "job", format); got != tt.wantName {
+				t.Errorf("got name %q, want %q", got, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestRenditionExt(t *testing.T) {
+	id3 := "ID3\x04\x00\x00\x00\x00\x00\x3f" + strings.Repeat("\x00", 0x3f)
+	audio := &m3u8.Rendition{Type: m3u8.MediaTypeAudio}
+
+	tests := []struct {
+		name    string
+		url     string
+		data    string
+		missing bool
+		want    string
+	}{
+		{name: "packed aac without extension", url: "http://example.com/chunk/1", data: id3 + "\xff\xf1\x50\x80", want: ".aac"},
+		{name: "packed ac-3 behind a ts extension", url: "http://example.com/seg1.ts?x", data: id3 + "\x0b\x77\x00\x00\x00\x40", want: ".ac3"},
+		{name: "mpeg-ts named aac", url: "http://example.com/seg1.aac", data: "\x47\x40\x00\x10", want: ".ts"},
+		{name: "first segment missing", url: "http://example.com/chunk/1", data: "\xff\xfb\x90\x00", missing: true, want: ".mp3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir := t.TempDir()
+			playlist := &m3u8.Playlist{Segments: []*m3u8.TSInfo{
+				{Name: "000001.ts", Url: tt.url},
+				{Name: "000002.ts", Url: tt.url},
+			}}
+			for i, seg := range playlist.Segments {
+				if i == 0 && tt.missing {
+					continue
+				}
+				if err := os.WriteFile(filepath.Join(cacheDir, seg.Name), []byte(tt.data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := renditionExt(audio, playlist, cacheDir); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeManifest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\n#EXTINF:10.0,\nsegment1.ts\n#EXT-X-ENDLIST\n"))
+	}))
+
+	cfg := &m3u8.DownloadConfig{URL: ts.URL + "/video.m3u8", Timeout: 10, Retries: 1}
+	cacheDir := t.TempDir()
+	logger := discardLogger
+
+	mf, err := serveManifest(context.Background(), cfg, downloader.NewHTTPClient(cfg), cacheDir, logger)
+	if err != nil {
+		t.Fatalf("serveManifest failed: %v", err)
+	}
+	if len(mf.Playlist.Segments) != 1 {
+		t.Fatalf("got %d segments, want 1", len(mf.Playlist.Segments))
+	}
+
+	// A later serve plays from the cache without the origin.
+	ts.Close()
+	mf, err = serveManifest(context.Background(), cfg, downloader.NewHTTPClient(cfg), cacheDir, logger)
+	if err != nil {
+		t.Fatalf("serveManifest from cache failed: %v", err)
+	}
+	if len(mf.Playlist.Segments) != 1 {
+		t.Errorf("got %d cached segments, want 1", len(mf.Playlist.Segments))
+	}
+
+	if got := serveCacheID(&m3u8.DownloadConfig{URL: cfg.URL, Passthrough: true}); got != config.JobID(cfg.URL, "")+"-serve-raw" {
+		t.Errorf("got cache ID %q for passthrough", got)
+	}
+}
+
+func TestServeManifestLive(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\n#EXTINF:10.0,\nsegment1.ts\n"))
+	}))
+	defer ts.Close()
+
+	cfg := &m3u8.DownloadConfig{URL: ts.URL + "/live.m3u8", Timeout: 10, Retries: 1}
+	_, err := serveManifest(context.Background(), cfg, downloader.NewHTTPClient(cfg), t.TempDir(), discardLogger)
+	if !errors.Is(err, m3u8.ErrLivePlaylist) {
+		t.Errorf("got error %v, want %v", err, m3u8.ErrLivePlaylist)
+	}
+}
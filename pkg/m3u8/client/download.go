@@ -0,0 +1,401 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+
+	"m3u8-download/internal/config"
+	"m3u8-download/internal/downloader"
+	"m3u8-download/internal/manifest"
+	"m3u8-download/internal/muxer"
+	"m3u8-download/internal/parser"
+	"m3u8-download/pkg/m3u8"
+)
+
+// writerName stands for a WithWriter output in logs.
+const writerName = "writer"
+
+// job is one download of a Client.
+type job struct {
+	opts   options
+	cfg    *m3u8.DownloadConfig
+	http   *downloader.HTTPClient
+	logger *slog.Logger
+	id     string
+	res    *Result
+}
+
+// Download downloads url, or records it with WithLive, configured by the
+// client's options and opts. A download that could not be completed
+// returns an error: the context's error when it was canceled, or an
+// *m3u8.IncompleteDownloadError when more segments failed than the failure
+// policy allows. Segments missing within that limit are not an error; see
+// Result.Incomplete. A live recording stopped by canceling ctx is not an
+// error either, since that is how an open-ended recording ends.
+func (c *Client) Download(ctx context.Context, url string, opts ...Option) (*Result, error) {
+	o := c.opts.with(opts)
+	o.cfg.URL = url
+	if err := o.validate(); err != nil {
+		return &Result{}, err
+	}
+	if err := o.validateOutput(); err != nil {
+		return &Result{}, err
+	}
+
+	j := &job{
+		opts:   o,
+		cfg:    &o.cfg,
+		http:   c.http.WithHeaders(o.cfg.CustomHeader).WithRetryBudget(o.cfg.RetryBudget),
+		logger: o.logger,
+		id:     config.JobID(url, o.cfg.JobName),
+		res:    &Result{},
+	}
+
+	start := time.Now()
+	err := j.run(ctx)
+	j.res.Duration = time.Since(start)
+	return j.res, err
+}
+
+func (j *job) run(ctx context.Context) error {
+	cfg, logger := j.cfg, j.logger
+
+	cacheDir, err := config.EnsureCacheDirIn(j.opts.cacheDir, j.id)
+	if err != nil {
+		logger.Error("Failed to create cache directory", "error", err)
+		return err
+	}
+
+	dl := downloader.NewDownloader(j.http, logger)
+	if !j.opts.progressBar {
+		dl.HideProgress()
+	}
+	dl.SetProgressFunc(j.opts.progress)
+	pool := downloader.NewWorkerPool(cfg.Workers, cfg.Adaptive, logger)
+	dl.SetWorkerPool(pool)
+	dl.SetFailurePolicy(downloader.FailurePolicy{
+		RetryPasses: cfg.RetryPasses,
+		MaxFailed:   cfg.MaxFailed,
+	})
+
+	if cfg.Live {
+		return j.recordLive(ctx, dl, cacheDir)
+	}
+
+	mf := loadManifest(cfg, cacheDir, logger)
+	if mf == nil {
+		if err := config.ResetCacheDir(cacheDir); err != nil {
+			logger.Error("Failed to reset cache directory", "error", err)
+			return err
+		}
+
+		playlist, renditions, err := fetchMediaPlaylist(ctx, j.http, cfg, logger)
+		if err != nil {
+			return err
+		}
+		if !playlist.EndList {
+			logger.Warn("Playlist has no EXT-X-ENDLIST and may be live; use -live to keep recording it")
+		}
+
+		mf = manifest.New(cacheDir, cfg.URL, playlist)
+		mf.Renditions = renditions
+		if err := mf.Save(); err != nil {
+			logger.Error("Failed to write manifest", "error", err)
+			return err
+		}
+	}
+	dl.SetManifest(mf)
+	playlist := mf.Playlist
+
+	logger.Info("Playlist parsed", "segments", len(playlist.Segments), "encrypted", playlist.IsEncrypted, "fmp4", playlist.IsFragmentedMP4())
+
+	if j.opts.writer != nil {
+		return j.stream(ctx, dl, playlist, mf.Renditions, cacheDir)
+	}
+
+	format := outputFormat(cfg, playlist)
+	cfg.Output = outputName(cfg, j.id, format)
+	j.res.Output = cfg.Output
+	mux, err := muxer.Select(sourceFormat(playlist), format)
+	if err != nil {
+		logger.Error("Cannot write the requested output format", "format", format, "error", err)
+		return err
+	}
+
+	rds := newRenditionDownloads(j.http, pool, cfg, cacheDir, mf.Renditions, logger)
+	var trackMux muxer.TrackMuxer
+	if len(rds) > 0 {
+		trackMux, err = muxer.SelectTracks(format)
+		if err != nil {
+			logger.Warn("Cannot mux renditions into the output, writing them as separate files", "error", err)
+		}
+	}
+
+	merged := cfg.Output
+	if mux != nil || trackMux != nil {
+		merged = partName(cfg.Output, playlist)
+	}
+	dl.StreamTo(merged)
+
+	logger.Info("Starting download", "output", cfg.Output, "workers", cfg.Workers, "renditions", len(rds))
+	startTime := time.Now()
+
+	var stats *m3u8.DownloadStats
+	downloadRenditions(ctx, j.http, cfg, rds, func() {
+		stats, err = dl.DownloadSegments(ctx, playlist, cacheDir, cfg.Workers)
+	})
+	j.res.Stats = stats
+	if ctx.Err() != nil {
+		logger.Warn("Download interrupted, progress saved; rerun with -resume to continue", "cache", cacheDir)
+		return ctx.Err()
+	}
+	var incomplete *m3u8.IncompleteDownloadError
+	if errors.As(err, &incomplete) {
+		logger.Error("Too many segments failed, output is incomplete; rerun with -resume to retry them",
+			"file", merged,
+			"failed", len(incomplete.Missing),
+			"max_failed", cfg.MaxFailed,
+			"missing", incomplete.Missing,
+		)
+		return err
+	}
+	if err != nil {
+		logger.Error("Download failed", "error", err, "resume", "rerun with -resume to continue")
+		return err
+	}
+	if err := renditionsFailed(rds, cfg); err != nil {
+		return err
+	}
+
+	if err := mergeRenditions(ctx, rds, cfg.Output, cfg.SubsFormat); err != nil {
+		logger.Error("Failed to merge files", "error", err)
+		return err
+	}
+
+	if err := config.CleanupCacheDir(cacheDir); err != nil {
+		logger.Warn("Failed to cleanup cache directory", "error", err)
+	}
+
+	switch {
+	case trackMux != nil:
+		if err := muxRenditions(ctx, trackMux, merged, cfg.Output, rds, logger); err != nil {
+			logger.Error("Failed to mux renditions, merged files kept", "file", merged, "error", err)
+			return err
+		}
+		for _, rd := range rds {
+			rd.file = ""
+		}
+	case mux != nil:
+		if err := remux(ctx, mux, merged, cfg.Output, logger); err != nil {
+			logger.Error("Failed to remux output, merged file kept", "file", merged, "error", err)
+			return err
+		}
+	}
+	for _, rd := range rds {
+		j.res.Renditions = append(j.res.Renditions, RenditionResult{Rendition: rd.rendition, File: rd.file, Stats: rd.stats})
+		if rd.file != "" {
+			logger.Info("Rendition written", "type", rd.rendition.Type, "language", rd.rendition.Language, "file", rd.file)
+		}
+	}
+
+	elapsed := time.Since(startTime)
+	if stats.Failed > 0 {
+		logger.Error("Download incomplete, output has missing segments",
+			"file", cfg.Output,
+			"segments", stats.Total,
+			"failed", stats.Failed,
+			"missing", stats.FailedSegments,
+			"duration", elapsed,
+		)
+		return nil
+	}
+	if renditionsIncomplete(rds) {
+		return nil
+	}
+
+	logger.Info("Download completed",
+		"file", cfg.Output,
+		"segments", stats.Total,
+		"completed", stats.Completed,
+		"skipped", stats.Skipped,
+		"failed", stats.Failed,
+		"duration", elapsed,
+	)
+	return nil
+}
+
+// stream downloads playlist into the WithWriter writer in segment order.
+// Separate renditions cannot be muxed into it and are left out.
+func (j *job) stream(ctx context.Context, dl *downloader.Downloader, playlist *m3u8.Playlist, renditions []*m3u8.Rendition, cacheDir string) error {
+	cfg, logger := j.cfg, j.logger
+	if len(renditions) > 0 {
+		logger.Warn("Piped output does not include separate audio or subtitle renditions", "renditions", len(renditions))
+	}
+	dl.StreamToWriter(j.opts.writer)
+
+	logger.Info("Starting download", "output", writerName, "workers", cfg.Workers)
+	startTime := time.Now()
+
+	stats, err := dl.DownloadSegments(ctx, playlist, cacheDir, cfg.Workers)
+	j.res.Stats = stats
+	if ctx.Err() != nil {
+		logger.Warn("Download interrupted, progress saved; rerun with -resume to continue", "cache", cacheDir)
+		return ctx.Err()
+	}
+	var incomplete *m3u8.IncompleteDownloadError
+	if errors.As(err, &incomplete) {
+		logger.Error("Too many segments failed, output is incomplete; rerun with -resume to retry them",
+			"output", writerName,
+			"failed", len(incomplete.Missing),
+			"max_failed", cfg.MaxFailed,
+			"missing", incomplete.Missing,
+		)
+		return err
+	}
+	if err != nil {
+		logger.Error("Download failed", "error", err, "resume", "rerun with -resume to continue")
+		return err
+	}
+
+	if err := config.CleanupCacheDir(cacheDir); err != nil {
+		logger.Warn("Failed to cleanup cache directory", "error", err)
+	}
+
+	elapsed := time.Since(startTime)
+	if stats.Failed > 0 {
+		logger.Error("Download incomplete, output has missing segments",
+			"output", writerName,
+			"segments", stats.Total,
+			"failed", stats.Failed,
+			"missing", stats.FailedSegments,
+			"duration", elapsed,
+		)
+		return nil
+	}
+
+	logger.Info("Download completed",
+		"output", writerName,
+		"segments", stats.Total,
+		"completed", stats.Completed,
+		"skipped", stats.Skipped,
+		"duration", elapsed,
+	)
+	return nil
+}
+
+// recordLive records a live playlist until it ends, the live duration limit
+// is reached or ctx is canceled.
+func (j *job) recordLive(ctx context.Context, dl *downloader.Downloader, cacheDir string) error {
+	cfg, logger := j.cfg, j.logger
+
+	if err := config.ResetCacheDir(cacheDir); err != nil {
+		logger.Error("Failed to reset cache directory", "error", err)
+		return err
+	}
+	defer func() {
+		if err := config.CleanupCacheDir(cacheDir); err != nil {
+			logger.Warn("Failed to cleanup cache directory", "error", err)
+		}
+	}()
+
+	playlist, renditions, err := fetchMediaPlaylist(ctx, j.http, cfg, logger)
+	if err != nil {
+		return err
+	}
+	if len(renditions) > 0 {
+		logger.Warn("Live recording does not download separate audio or subtitle renditions", "renditions", len(renditions))
+	}
+	playlistURL := playlist.URL
+
+	refresh := func(ctx context.Context) (*m3u8.Playlist, error) {
+		body, err := j.http.Get(ctx, playlistURL)
+		if err != nil {
+			return nil, err
+		}
+		return parser.ParsePlaylist(string(body), playlistURL)
+	}
+
+	out := j.opts.writer
+	recording, output := writerName, writerName
+	var mux muxer.Muxer
+	var file *os.File
+	if out == nil {
+		format := outputFormat(cfg, playlist)
+		cfg.Output = outputName(cfg, j.id, format)
+		j.res.Output = cfg.Output
+		mux, err = muxer.Select(sourceFormat(playlist), format)
+		if err != nil {
+			logger.Error("Cannot write the requested output format", "format", format, "error", err)
+			return err
+		}
+
+		recording, output = cfg.Output, cfg.Output
+		if mux != nil {
+			recording = partName(cfg.Output, playlist)
+		}
+		file, err = os.Create(recording)
+		if err != nil {
+			logger.Error("Failed to create output file", "error", err)
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	logger.Info("Recording live stream", "output", recording, "limit", cfg.LiveDuration)
+	startTime := time.Now()
+
+	stats, err := dl.RecordLive(ctx, playlist, refresh, cacheDir, cfg.Workers, out, downloader.LiveOptions{
+		MaxDuration: cfg.LiveDuration,
+	})
+	j.res.Stats = stats
+
+	var incomplete *m3u8.IncompleteDownloadError
+	switch {
+	case ctx.Err() != nil:
+		logger.Info("Recording stopped")
+	case errors.As(err, &incomplete):
+		logger.Error("Too many live segments missing, recording stopped",
+			"file", recording,
+			"failed", len(incomplete.Missing),
+			"max_failed", cfg.MaxFailed,
+			"missing", incomplete.Missing,
+		)
+		return err
+	case err != nil:
+		logger.Error("Live recording failed", "file", recording, "error", err)
+		return err
+	}
+
+	if mux != nil {
+		file.Close()
+		// Canceling is how a recording normally ends, so the remux must
+		// not inherit the canceled context.
+		if err := remux(context.WithoutCancel(ctx), mux, recording, cfg.Output, logger); err != nil {
+			logger.Error("Failed to remux recording, recorded file kept", "file", recording, "error", err)
+			return err
+		}
+	}
+
+	elapsed := time.Since(startTime)
+	if stats.Failed > 0 {
+		logger.Error("Recording incomplete, output has missing segments",
+			"file", output,
+			"segments", stats.Total,
+			"failed", stats.Failed,
+			"missing", stats.FailedSegments,
+			"duration", elapsed,
+		)
+		return nil
+	}
+
+	logger.Info("Recording completed",
+		"file", output,
+		"segments", stats.Completed,
+		"duration", elapsed,
+	)
+	return nil
+}
@@ -0,0 +1,255 @@
+package client
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"m3u8-download/internal/config"
+	"m3u8-download/pkg/m3u8"
+)
+
+// Option configures a Client, or a single download when given to
+// Client.Download or Client.Serve.
+//
+// Options that configure connections — WithTimeout, WithRetries,
+// WithUserAgent, WithProxy, WithRateLimit, WithCookie and WithCookieFile —
+// only take effect in New, where the HTTP client shared by every download is
+// built. Headers and the retry budget may differ per download.
+type Option func(*options)
+
+type options struct {
+	cfg         m3u8.DownloadConfig
+	cacheDir    string
+	logger      *slog.Logger
+	writer      io.Writer
+	progress    func(m3u8.Progress)
+	progressBar bool
+}
+
+func defaultOptions() options {
+	return options{
+		cfg:      config.Default(),
+		cacheDir: defaultCacheDir(),
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+// defaultCacheDir is where jobs are cached without WithCacheDir.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "m3u8-download")
+}
+
+// with returns a copy of o with opts applied.
+func (o options) with(opts []Option) options {
+	headers := make(map[string]string, len(o.cfg.CustomHeader))
+	for key, value := range o.cfg.CustomHeader {
+		headers[key] = value
+	}
+	o.cfg.CustomHeader = headers
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithConfig starts from cfg, as parsed from the command line, instead of
+// the defaults. Options after it override its fields. URL, Input, Jobs,
+// Exec and Listen are ignored.
+func WithConfig(cfg *m3u8.DownloadConfig) Option {
+	return func(o *options) {
+		headers := o.cfg.CustomHeader
+		o.cfg = *cfg
+		o.cfg.CustomHeader = headers
+		for key, value := range cfg.CustomHeader {
+			o.setHeader(key, value)
+		}
+	}
+}
+
+// WithLogger logs progress and problems to logger. Nothing is logged by
+// default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithOutput writes the download to path. By default the name is derived
+// from the URL or WithJobName, with the extension of the output format.
+func WithOutput(path string) Option {
+	return func(o *options) { o.cfg.Output = path }
+}
+
+// WithWriter writes the segments to w in playlist order while they are
+// downloaded, instead of to a file. Separate renditions are left out and
+// the output cannot be remuxed.
+func WithWriter(w io.Writer) Option {
+	return func(o *options) { o.writer = w }
+}
+
+// WithFormat remuxes the output into format: "ts", "mp4" or "mkv".
+func WithFormat(format string) Option {
+	return func(o *options) { o.cfg.Format = format }
+}
+
+// WithWorkers sets how many segments are downloaded at once. With adaptive,
+// workers is the upper limit and the pool shrinks while the server throttles
+// or fails.
+func WithWorkers(workers int, adaptive bool) Option {
+	return func(o *options) {
+		o.cfg.Workers = workers
+		o.cfg.Adaptive = adaptive
+	}
+}
+
+// WithRetries sets how many times a failed request is retried.
+func WithRetries(retries int) Option {
+	return func(o *options) { o.cfg.Retries = retries }
+}
+
+// WithRetryBudget caps the retries of a whole download at n; zero means
+// unlimited.
+func WithRetryBudget(n int) Option {
+	return func(o *options) { o.cfg.RetryBudget = n }
+}
+
+// WithFailurePolicy retries failed segments in up to passes more passes and
+// then accepts up to maxFailed missing segments in the output.
+func WithFailurePolicy(passes, maxFailed int) Option {
+	return func(o *options) {
+		o.cfg.RetryPasses = passes
+		o.cfg.MaxFailed = maxFailed
+	}
+}
+
+// WithTimeout sets how long a request may take to connect and get its
+// response headers, and how long its body may stall, rounded up to a
+// second. A body read slowly under the rate limit does not time out.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) { o.cfg.Timeout = int((timeout + time.Second - 1) / time.Second) }
+}
+
+// WithUserAgent sets the User-Agent header.
+func WithUserAgent(userAgent string) Option {
+	return func(o *options) { o.cfg.UserAgent = userAgent }
+}
+
+// WithProxy sends requests through an http, https or socks5 proxy.
+func WithProxy(proxyURL string) Option {
+	return func(o *options) { o.cfg.ProxyURL = proxyURL }
+}
+
+// WithRateLimit limits the download rate to bytesPerSec; zero means no
+// limit. Client.SetRateLimit changes it later.
+func WithRateLimit(bytesPerSec int64) Option {
+	return func(o *options) {
+		o.cfg.LimitRate = ""
+		if bytesPerSec > 0 {
+			o.cfg.LimitRate = strconv.FormatInt(bytesPerSec, 10)
+		}
+	}
+}
+
+// WithHeader sends a header with every request, replacing a default one of
+// the same name. Names are case-insensitive: a later WithHeader or
+// WithHeaders for the same name replaces the value.
+func WithHeader(key, value string) Option {
+	return func(o *options) { o.setHeader(key, value) }
+}
+
+// WithHeaders sends every header in headers, as WithHeader does.
+func WithHeaders(headers map[string]string) Option {
+	return func(o *options) {
+		for key, value := range headers {
+			o.setHeader(key, value)
+		}
+	}
+}
+
+func (o *options) setHeader(key, value string) {
+	o.cfg.CustomHeader[http.CanonicalHeaderKey(key)] = value
+}
+
+// WithCookie sends cookie, a Cookie header value, with every request.
+func WithCookie(cookie string) Option {
+	return func(o *options) { o.cfg.Cookie = cookie }
+}
+
+// WithCookieFile sends the cookies of a Netscape cookies.txt file.
+func WithCookieFile(path string) Option {
+	return func(o *options) { o.cfg.CookieFile = path }
+}
+
+// WithVariant picks the variant of a master playlist: "highest", "lowest",
+// "max-resolution", a resolution such as "1280x720" or a bandwidth in bits
+// per second such as "2560000", as -variant does.
+func WithVariant(rule string) Option {
+	return func(o *options) { o.cfg.Variant = rule }
+}
+
+// WithAudio downloads the audio renditions matching rules, a comma
+// separated list of languages or names, instead of the default one.
+func WithAudio(rules string) Option {
+	return func(o *options) { o.cfg.AudioLang = rules }
+}
+
+// WithSubtitles downloads the subtitle renditions matching rules, "all" for
+// every one, and writes WebVTT subtitles in format, "vtt" or "srt".
+func WithSubtitles(rules, format string) Option {
+	return func(o *options) {
+		o.cfg.Subtitles = rules
+		o.cfg.SubsFormat = format
+	}
+}
+
+// WithJobName names the job's cache directory and default output instead
+// of a hash of the URL.
+func WithJobName(name string) Option {
+	return func(o *options) { o.cfg.JobName = name }
+}
+
+// WithCacheDir caches the segments of each job in a directory under dir
+// named after the job, instead of under m3u8-download in os.UserCacheDir.
+func WithCacheDir(dir string) Option {
+	return func(o *options) { o.cacheDir = dir }
+}
+
+// WithResume continues the download of an earlier run of the same job from
+// its cache directory.
+func WithResume(resume bool) Option {
+	return func(o *options) { o.cfg.Resume = resume }
+}
+
+// WithLive records a live playlist until it ends, the context is canceled
+// or, when maxDuration is not zero, that much media has been recorded.
+func WithLive(maxDuration time.Duration) Option {
+	return func(o *options) {
+		o.cfg.Live = true
+		o.cfg.LiveDuration = maxDuration
+	}
+}
+
+// WithPassthrough makes Serve hand out encrypted segments and their keys as
+// the origin sends them instead of decrypting them.
+func WithPassthrough(passthrough bool) Option {
+	return func(o *options) { o.cfg.Passthrough = passthrough }
+}
+
+// WithProgress calls fn whenever a segment of the main playlist is
+// downloaded, reused or given up on. Calls do not overlap.
+func WithProgress(fn func(m3u8.Progress)) Option {
+	return func(o *options) { o.progress = fn }
+}
+
+// WithProgressBar draws a progress bar on stderr.
+func WithProgressBar(show bool) Option {
+	return func(o *options) { o.progressBar = show }
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"m3u8-download/internal/downloader"
+	"m3u8-download/internal/manifest"
+	"m3u8-download/internal/muxer"
+	"m3u8-download/internal/parser"
+	"m3u8-download/pkg/m3u8"
+)
+
+// outputFormat returns the container the output is written in: the
+// configured format, else the one named by the output's extension, else the
+// container of the segments.
+func outputFormat(cfg *m3u8.DownloadConfig, playlist *m3u8.Playlist) string {
+	if cfg.Format != "" {
+		return cfg.Format
+	}
+	if format := muxer.FormatFromPath(cfg.Output); format != "" {
+		return format
+	}
+	return sourceFormat(playlist)
+}
+
+// sourceFormat returns the container of the merged segments: MP4 for fMP4
+// segments, MPEG-TS otherwise.
+func sourceFormat(playlist *m3u8.Playlist) string {
+	if playlist.IsFragmentedMP4() {
+		return muxer.FormatMP4
+	}
+	return muxer.FormatTS
+}
+
+// outputName returns cfg.Output, or when it is empty a name derived from the
+// job ID with the extension of format.
+func outputName(cfg *m3u8.DownloadConfig, id, format string) string {
+	if cfg.Output != "" {
+		return cfg.Output
+	}
+	return id + "." + format
+}
+
+// partName is where segments are merged before they are remuxed into
+// output.
+func partName(output string, playlist *m3u8.Playlist) string {
+	return output + ".part." + sourceFormat(playlist)
+}
+
+// remux converts merged into output with mux and removes merged.
+func remux(ctx context.Context, mux muxer.Muxer, merged, output string, logger *slog.Logger) error {
+	logger.Info("Remuxing output", "muxer", mux.Name(), "output", output)
+	if err := mux.Remux(ctx, merged, output); err != nil {
+		return err
+	}
+	if err := os.Remove(merged); err != nil {
+		logger.Warn("Failed to remove merged file", "path", merged, "error", err)
+	}
+	return nil
+}
+
+// loadManifest returns the manifest of a previous run when resuming and it
+// belongs to the same URL, or nil when the job should start over.
+func loadManifest(cfg *m3u8.DownloadConfig, cacheDir string, logger *slog.Logger) *manifest.Manifest {
+	if !cfg.Resume {
+		return nil
+	}
+
+	mf, err := manifest.Load(cacheDir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		logger.Info("No previous download to resume, starting fresh")
+		return nil
+	case err != nil:
+		logger.Warn("Failed to load manifest, starting fresh", "error", err)
+		return nil
+	case mf.URL != cfg.URL:
+		logger.Warn("Cached job belongs to a different URL, starting fresh", "cached", mf.URL)
+		return nil
+	}
+
+	logger.Info("Resuming download", "completed", mf.CompletedCount(), "segments", len(mf.Segments))
+	return mf
+}
+
+// fetchMediaPlaylist fetches cfg.URL and, when it is a master playlist,
+// follows the variant chosen by cfg.Variant to its media playlist and
+// returns the audio and subtitle renditions to download with it. In live
+// mode a media playlist without segments yet is returned empty.
+func fetchMediaPlaylist(ctx context.Context, httpClient *downloader.HTTPClient, cfg *m3u8.DownloadConfig, logger *slog.Logger) (*m3u8.Playlist, []*m3u8.Rendition, error) {
+	logger.Info("Fetching M3U8 playlist", "url", cfg.URL)
+	body, err := httpClient.Get(ctx, cfg.URL)
+	if err != nil {
+		logger.Error("Failed to fetch M3U8", "error", err)
+		return nil, nil, err
+	}
+
+	playlistURL := cfg.URL
+	var renditions []*m3u8.Rendition
+	if parser.IsMasterPlaylist(string(body)) {
+		master, err := parser.ParseMasterPlaylist(string(body), cfg.URL)
+		if err != nil {
+			logger.Error("Failed to parse master playlist", "error", err)
+			return nil, nil, err
+		}
+
+		variant, err := parser.SelectVariant(master, cfg.Variant)
+		if err != nil {
+			logger.Error("Failed to select variant", "rule", cfg.Variant, "error", err)
+			return nil, nil, err
+		}
+
+		logger.Info("Selected variant",
+			"variants", len(master.Variants),
+			"bandwidth", variant.Bandwidth,
+			"resolution", fmt.Sprintf("%dx%d", variant.Width, variant.Height),
+			"codecs", variant.Codecs,
+		)
+
+		renditions = selectRenditions(master, variant, cfg, logger)
+
+		playlistURL = variant.URL
+		body, err = httpClient.Get(ctx, playlistURL)
+		if err != nil {
+			logger.Error("Failed to fetch media playlist", "url", playlistURL, "error", err)
+			return nil, nil, err
+		}
+	}
+
+	logger.Info("Parsing playlist")
+	playlist, err := parser.ParsePlaylist(string(body), playlistURL)
+	if cfg.Live && errors.Is(err, m3u8.ErrNoTSFiles) {
+		// A live stream may not have published a segment yet.
+		return &m3u8.Playlist{URL: playlistURL}, renditions, nil
+	}
+	if err != nil {
+		logger.Error("Failed to parse playlist", "error", err)
+		return nil, nil, err
+	}
+
+	return playlist, renditions, nil
+}
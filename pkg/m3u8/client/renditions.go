@@ -0,0 +1,304 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"m3u8-download/internal/config"
+	"m3u8-download/internal/downloader"
+	"m3u8-download/internal/manifest"
+	"m3u8-download/internal/muxer"
+	"m3u8-download/internal/parser"
+	"m3u8-download/pkg/m3u8"
+)
+
+// renditionDownload is an alternate audio or subtitle rendition downloaded
+// next to the main playlist, into a subdirectory of the job's cache.
+type renditionDownload struct {
+	rendition *m3u8.Rendition
+	cacheDir  string
+	dl        *downloader.Downloader
+	logger    *slog.Logger
+	playlist  *m3u8.Playlist
+	file      string
+	stats     *m3u8.DownloadStats
+	err       error
+}
+
+// selectRenditions picks the renditions downloaded with variant: the audio
+// renditions matching -audio-lang, else the group's default one, and the
+// subtitles matching -subs.
+func selectRenditions(master *m3u8.MasterPlaylist, variant *m3u8.Variant, cfg *m3u8.DownloadConfig, logger *slog.Logger) []*m3u8.Rendition {
+	var selected []*m3u8.Rendition
+
+	if variant.Audio != "" {
+		var audio []*m3u8.Rendition
+		if cfg.AudioLang != "" {
+			audio = parser.SelectRenditions(master, m3u8.MediaTypeAudio, variant.Audio, cfg.AudioLang)
+			if len(audio) == 0 {
+				logger.Warn("No audio rendition matches, using the default one", "audio_lang", cfg.AudioLang, "group", variant.Audio)
+			}
+		}
+		if len(audio) == 0 {
+			if r := parser.DefaultRendition(master, m3u8.MediaTypeAudio, variant.Audio); r != nil {
+				audio = append(audio, r)
+			}
+		}
+		selected = append(selected, audio...)
+	}
+
+	if cfg.Subtitles != "" {
+		var subs []*m3u8.Rendition
+		if variant.Subtitles != "" {
+			subs = parser.SelectRenditions(master, m3u8.MediaTypeSubtitles, variant.Subtitles, cfg.Subtitles)
+		}
+		if len(subs) == 0 {
+			logger.Warn("No subtitle rendition matches", "subs", cfg.Subtitles)
+		}
+		selected = append(selected, subs...)
+	}
+
+	for _, r := range selected {
+		logger.Info("Selected rendition", "type", r.Type, "language", r.Language, "name", r.Name)
+	}
+	return selected
+}
+
+// newRenditionDownloads prepares a download for each rendition, sharing
+// httpClient, the worker pool and the failure policy of the main download.
+func newRenditionDownloads(httpClient *downloader.HTTPClient, pool *downloader.WorkerPool, cfg *m3u8.DownloadConfig, cacheDir string, renditions []*m3u8.Rendition, logger *slog.Logger) []*renditionDownload {
+	rds := make([]*renditionDownload, len(renditions))
+	for i, r := range renditions {
+		rlogger := logger.With("rendition", renditionLabel(r))
+		dl := downloader.NewDownloader(httpClient, rlogger)
+		dl.HideProgress()
+		dl.SetWorkerPool(pool)
+		dl.SetFailurePolicy(downloader.FailurePolicy{
+			RetryPasses: cfg.RetryPasses,
+			MaxFailed:   cfg.MaxFailed,
+		})
+
+		rds[i] = &renditionDownload{
+			rendition: r,
+			cacheDir:  filepath.Join(cacheDir, fmt.Sprintf("%s-%d", strings.ToLower(r.Type), i)),
+			dl:        dl,
+			logger:    rlogger,
+		}
+	}
+	return rds
+}
+
+// download fetches the rendition's media playlist, or reuses the one in its
+// manifest when resuming, and downloads its segments.
+func (rd *renditionDownload) download(ctx context.Context, httpClient *downloader.HTTPClient, cfg *m3u8.DownloadConfig) {
+	mf, err := rd.prepare(ctx, httpClient, cfg.Resume)
+	if err != nil {
+		rd.err = err
+		return
+	}
+	rd.playlist = mf.Playlist
+	rd.dl.SetManifest(mf)
+
+	rd.stats, rd.err = rd.dl.DownloadSegments(ctx, rd.playlist, rd.cacheDir, cfg.Workers)
+}
+
+func (rd *renditionDownload) prepare(ctx context.Context, httpClient *downloader.HTTPClient, resume bool) (*manifest.Manifest, error) {
+	uri := rd.rendition.URI
+	if resume {
+		if mf, err := manifest.Load(rd.cacheDir); err == nil && mf.URL == uri {
+			return mf, nil
+		}
+	}
+
+	if err := config.ResetCacheDir(rd.cacheDir); err != nil {
+		return nil, err
+	}
+
+	body, err := httpClient.Get(ctx, uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch rendition playlist: %w", err)
+	}
+	playlist, err := parser.ParsePlaylist(string(body), uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rendition playlist: %w", err)
+	}
+
+	mf := manifest.New(rd.cacheDir, uri, playlist)
+	if err := mf.Save(); err != nil {
+		return nil, err
+	}
+	return mf, nil
+}
+
+// downloadRenditions runs fn, the main download, while the renditions are
+// downloaded next to it, and returns when all of them are done.
+func downloadRenditions(ctx context.Context, httpClient *downloader.HTTPClient, cfg *m3u8.DownloadConfig, rds []*renditionDownload, fn func()) {
+	var wg sync.WaitGroup
+	for _, rd := range rds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rd.download(ctx, httpClient, cfg)
+		}()
+	}
+	fn()
+	wg.Wait()
+}
+
+// renditionsFailed logs the renditions that could not be downloaded and
+// returns the error of the first one.
+func renditionsFailed(rds []*renditionDownload, cfg *m3u8.DownloadConfig) error {
+	var failed error
+	for _, rd := range rds {
+		var incomplete *m3u8.IncompleteDownloadError
+		switch {
+		case errors.As(rd.err, &incomplete):
+			rd.logger.Error("Too many rendition segments failed, output not written; rerun with -resume to retry them",
+				"failed", len(incomplete.Missing),
+				"max_failed", cfg.MaxFailed,
+				"missing", incomplete.Missing,
+			)
+		case rd.err != nil:
+			rd.logger.Error("Rendition download failed", "error", rd.err, "resume", "rerun with -resume to continue")
+		}
+		if rd.err != nil && failed == nil {
+			failed = fmt.Errorf("rendition %s: %w", renditionLabel(rd.rendition), rd.err)
+		}
+	}
+	return failed
+}
+
+// renditionsIncomplete logs the renditions merged with missing segments and
+// reports whether there were any.
+func renditionsIncomplete(rds []*renditionDownload) bool {
+	incomplete := false
+	for _, rd := range rds {
+		if rd.stats.Failed > 0 {
+			rd.logger.Error("Rendition incomplete, output has missing segments",
+				"file", rd.file,
+				"segments", rd.stats.Total,
+				"failed", rd.stats.Failed,
+				"missing", rd.stats.FailedSegments,
+			)
+			incomplete = true
+		}
+	}
+	return incomplete
+}
+
+// mergeRenditions merges each rendition into a file named after output.
+// WebVTT subtitles are merged cue by cue into subsFormat.
+func mergeRenditions(ctx context.Context, rds []*renditionDownload, output, subsFormat string) error {
+	used := make(map[string]bool)
+	for _, rd := range rds {
+		var err error
+		if isWebVTT(rd.rendition, rd.playlist) {
+			rd.file = sidecarName(output, rd.rendition, "."+subsFormat, used)
+			err = rd.dl.MergeSubtitles(ctx, rd.playlist, rd.cacheDir, rd.file, subsFormat, rd.stats.FailedSegments)
+		} else {
+			rd.file = sidecarName(output, rd.rendition, renditionExt(rd.rendition, rd.playlist, rd.cacheDir), used)
+			err = rd.dl.MergeFiles(ctx, rd.playlist, rd.cacheDir, rd.file, rd.stats.FailedSegments)
+		}
+		if err != nil {
+			return fmt.Errorf("rendition %s: %w", renditionLabel(rd.rendition), err)
+		}
+	}
+	return nil
+}
+
+// isWebVTT reports whether a rendition is segmented WebVTT, the only
+// subtitle format HLS allows outside fMP4.
+func isWebVTT(r *m3u8.Rendition, playlist *m3u8.Playlist) bool {
+	return r.Type == m3u8.MediaTypeSubtitles && !playlist.IsFragmentedMP4()
+}
+
+// muxRenditions muxes merged and the rendition files into output with mux
+// and removes the inputs.
+func muxRenditions(ctx context.Context, mux muxer.TrackMuxer, merged, output string, rds []*renditionDownload, logger *slog.Logger) error {
+	tracks := make([]muxer.Track, len(rds))
+	for i, rd := range rds {
+		tracks[i] = muxer.Track{
+			Path:     rd.file,
+			Type:     muxer.TrackAudio,
+			Language: rd.rendition.Language,
+			Name:     rd.rendition.Name,
+		}
+		if rd.rendition.Type == m3u8.MediaTypeSubtitles {
+			tracks[i].Type = muxer.TrackSubtitles
+		}
+	}
+
+	logger.Info("Muxing renditions", "muxer", mux.Name(), "tracks", len(tracks), "output", output)
+	if err := mux.RemuxTracks(ctx, merged, tracks, output); err != nil {
+		return err
+	}
+
+	for _, name := range append([]string{merged}, trackPaths(tracks)...) {
+		if err := os.Remove(name); err != nil {
+			logger.Warn("Failed to remove merged file", "path", name, "error", err)
+		}
+	}
+	return nil
+}
+
+func trackPaths(tracks []muxer.Track) []string {
+	paths := make([]string, len(tracks))
+	for i, t := range tracks {
+		paths[i] = t.Path
+	}
+	return paths
+}
+
+// renditionExt returns the extension of a merged audio or fMP4 rendition:
+// .m4a or .mp4 for fMP4, that of the packed audio in its first cached
+// segment in cacheDir and .ts otherwise.
+func renditionExt(r *m3u8.Rendition, playlist *m3u8.Playlist, cacheDir string) string {
+	if playlist.IsFragmentedMP4() {
+		if r.Type == m3u8.MediaTypeAudio {
+			return ".m4a"
+		}
+		return ".mp4"
+	}
+
+	switch ext := downloader.CachedSegmentExt(playlist, cacheDir); ext {
+	case ".aac", ".mp3", ".ac3", ".ec3":
+		return ext
+	}
+	return ".ts"
+}
+
+// sidecarName returns the name of a rendition file written next to output,
+// such as "video.en.aac". used keeps names unique across renditions.
+func sidecarName(output string, r *m3u8.Rendition, ext string, used map[string]bool) string {
+	base := strings.TrimSuffix(output, filepath.Ext(output)) + "." + renditionLabel(r)
+
+	name := base + ext
+	for n := 2; used[name]; n++ {
+		name = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+	used[name] = true
+	return name
+}
+
+// renditionLabel names a rendition by language, else by name, in a form
+// safe for file names.
+func renditionLabel(r *m3u8.Rendition) string {
+	label := r.Language
+	if label == "" {
+		label = r.Name
+	}
+	label = strings.Trim(labelReplacer.ReplaceAllString(label, "_"), "_")
+	if label == "" {
+		return strings.ToLower(r.Type)
+	}
+	return label
+}
+
+var labelReplacer = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
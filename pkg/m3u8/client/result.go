@@ -0,0 +1,43 @@
+package client
+
+import (
+	"time"
+
+	"m3u8-download/pkg/m3u8"
+)
+
+// Result describes what a download wrote. Download returns one even when it
+// fails, with the fields known by then set.
+type Result struct {
+	// Output is the file written, empty when writing to WithWriter.
+	Output string
+	// Stats counts the segments of the main playlist, nil when it was
+	// never downloaded.
+	Stats      *m3u8.DownloadStats
+	Renditions []RenditionResult
+	Duration   time.Duration
+}
+
+// RenditionResult describes an audio or subtitle rendition downloaded with
+// the main playlist.
+type RenditionResult struct {
+	Rendition *m3u8.Rendition
+	// File is the separate file the rendition was written to, empty when
+	// it was muxed into the output.
+	File  string
+	Stats *m3u8.DownloadStats
+}
+
+// Incomplete reports whether the output or a rendition was written with
+// segments missing, as the failure policy allows.
+func (r *Result) Incomplete() bool {
+	if r.Stats != nil && r.Stats.Failed > 0 {
+		return true
+	}
+	for _, rr := range r.Renditions {
+		if rr.Stats != nil && rr.Stats.Failed > 0 {
+			return true
+		}
+	}
+	return false
+}
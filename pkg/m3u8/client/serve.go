@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"m3u8-download/internal/config"
+	"m3u8-download/internal/downloader"
+	"m3u8-download/internal/manifest"
+	"m3u8-download/internal/server"
+	"m3u8-download/pkg/m3u8"
+)
+
+// PlaylistPath is where Serve serves the rewritten playlist.
+const PlaylistPath = server.PlaylistPath
+
+// shutdownTimeout bounds how long Serve waits for open requests after ctx
+// is canceled.
+const shutdownTimeout = 5 * time.Second
+
+// Serve serves url on ln to local players until ctx is canceled, which is
+// the normal way to end it and returns nil. Players fetch the playlist at
+// PlaylistPath; segments are fetched on demand and cached, so that what
+// was played once plays again without the network. url must not be live:
+// Serve returns m3u8.ErrLivePlaylist for a playlist without #EXT-X-ENDLIST.
+func (c *Client) Serve(ctx context.Context, ln net.Listener, url string, opts ...Option) error {
+	o := c.opts.with(opts)
+	o.cfg.URL = url
+	if err := o.validate(); err != nil {
+		return err
+	}
+	cfg, logger := &o.cfg, o.logger
+	httpClient := c.http.WithHeaders(cfg.CustomHeader)
+
+	cacheDir, err := config.EnsureCacheDirIn(o.cacheDir, serveCacheID(cfg))
+	if err != nil {
+		logger.Error("Failed to create cache directory", "error", err)
+		return err
+	}
+
+	mf, err := serveManifest(ctx, cfg, httpClient, cacheDir, logger)
+	if err != nil {
+		return err
+	}
+
+	dl := downloader.NewDownloader(httpClient, logger)
+	dl.SetManifest(mf)
+	srv := server.New(mf.Playlist, dl.NewSegmentFetcher(mf.Playlist, cacheDir, cfg.Passthrough), cfg.Passthrough, logger)
+
+	hs := &http.Server{Handler: srv}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		hs.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("Serving playlist",
+		"url", "http://"+ln.Addr().String()+PlaylistPath,
+		"segments", len(mf.Playlist.Segments),
+		"cached", mf.CompletedCount(),
+		"decrypt", !cfg.Passthrough,
+		"cache", cacheDir,
+	)
+	err = hs.Serve(ln)
+	if saveErr := mf.Save(); saveErr != nil {
+		logger.Warn("Failed to write manifest", "error", saveErr)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Server failed", "error", err)
+		return err
+	}
+
+	logger.Info("Server stopped", "cached", mf.CompletedCount(), "segments", len(mf.Playlist.Segments))
+	return nil
+}
+
+// serveCacheID is the cache directory name of Serve. It differs from the
+// one of a download of the same URL, whose cached segments are not kept,
+// and between decrypted and passthrough caches.
+func serveCacheID(cfg *m3u8.DownloadConfig) string {
+	id := config.JobID(cfg.URL, cfg.JobName) + "-serve"
+	if cfg.Passthrough {
+		id += "-raw"
+	}
+	return id
+}
+
+// serveManifest returns the manifest cached by an earlier Serve of cfg.URL,
+// so that what it cached plays without the network, or fetches the playlist
+// and starts a new one.
+func serveManifest(ctx context.Context, cfg *m3u8.DownloadConfig, httpClient *downloader.HTTPClient, cacheDir string, logger *slog.Logger) (*manifest.Manifest, error) {
+	mf, err := manifest.Load(cacheDir)
+	switch {
+	case err == nil && mf.URL == cfg.URL:
+		logger.Info("Using cached playlist", "completed", mf.CompletedCount(), "segments", len(mf.Segments))
+		return mf, nil
+	case err == nil:
+		logger.Warn("Cached playlist belongs to a different URL, starting fresh", "cached", mf.URL)
+	case !errors.Is(err, os.ErrNotExist):
+		logger.Warn("Failed to load manifest, starting fresh", "error", err)
+	}
+
+	if err := config.ResetCacheDir(cacheDir); err != nil {
+		logger.Error("Failed to reset cache directory", "error", err)
+		return nil, err
+	}
+
+	playlist, renditions, err := fetchMediaPlaylist(ctx, httpClient, cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	if !playlist.EndList {
+		logger.Error("Playlist has no EXT-X-ENDLIST; serve only supports complete playlists")
+		return nil, m3u8.ErrLivePlaylist
+	}
+	if len(renditions) > 0 {
+		logger.Warn("Serving only the selected variant, separate audio and subtitle renditions are left out", "renditions", len(renditions))
+	}
+
+	mf = manifest.New(cacheDir, cfg.URL, playlist)
+	if err := mf.Save(); err != nil {
+		logger.Error("Failed to write manifest", "error", err)
+		return nil, err
+	}
+	return mf, nil
+}
@@ -2,6 +2,8 @@ package m3u8
 
 import (
 	"fmt"
+	"strings"
+	"time"
 )
 
 var (
@@ -9,14 +11,22 @@ var (
 	ErrNoTSFiles      = fmt.Errorf("no TS files found in playlist")
 	ErrDecryptFailed  = fmt.Errorf("AES decryption failed")
 	ErrDownloadFailed = fmt.Errorf("download failed after retries")
+	ErrRetryBudget    = fmt.Errorf("retry budget exhausted")
 	ErrMergeFailed    = fmt.Errorf("failed to merge files")
 	ErrInvalidKey     = fmt.Errorf("invalid decryption key")
 	ErrInvalidIV      = fmt.Errorf("invalid initialization vector")
+	ErrMasterPlaylist = fmt.Errorf("playlist is a master playlist")
+	ErrNoVariants     = fmt.Errorf("no variant streams found in master playlist")
+	ErrNoVariantMatch = fmt.Errorf("no variant stream matches selection")
+	ErrLivePlaylist   = fmt.Errorf("playlist is live")
 )
 
 type HTTPError struct {
 	StatusCode int
 	URL        string
+	// RetryAfter is the delay the server asked for with a Retry-After
+	// header, zero when it sent none.
+	RetryAfter time.Duration
 }
 
 func (e *HTTPError) Error() string {
@@ -36,6 +46,86 @@ func (e *RetryExhaustedError) Error() string {
 	return fmt.Errorf("failed after %d attempts: %w", e.Attempts, e.LastErr).Error()
 }
 
+func (e *RetryExhaustedError) Unwrap() error {
+	return e.LastErr
+}
+
 func NewRetryExhaustedError(attempts int, err error) *RetryExhaustedError {
 	return &RetryExhaustedError{Attempts: attempts, LastErr: err}
 }
+
+// UnsupportedMethodError reports an #EXT-X-KEY METHOD this tool cannot
+// decrypt, such as SAMPLE-AES-CTR.
+type UnsupportedMethodError struct {
+	Method string
+}
+
+func (e *UnsupportedMethodError) Error() string {
+	return fmt.Sprintf("unsupported encryption method %q", e.Method)
+}
+
+func NewUnsupportedMethodError(method string) *UnsupportedMethodError {
+	return &UnsupportedMethodError{Method: method}
+}
+
+// RangeError reports a server that did not honor a Range request for the
+// byte range Length@Offset of URL.
+type RangeError struct {
+	URL    string
+	Range  ByteRange
+	Reason string
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("byte range %d@%d of %s: %s", e.Range.Length, e.Range.Offset, e.URL, e.Reason)
+}
+
+func NewRangeError(url string, br ByteRange, reason string) *RangeError {
+	return &RangeError{URL: url, Range: br, Reason: reason}
+}
+
+// IncompleteDownloadError reports segments that are still missing after all
+// retries. Missing holds their playlist indices.
+type IncompleteDownloadError struct {
+	Total   int
+	Missing []int
+}
+
+func (e *IncompleteDownloadError) Error() string {
+	return fmt.Sprintf("%d of %d segments failed: %v", len(e.Missing), e.Total, e.Missing)
+}
+
+func NewIncompleteDownloadError(total int, missing []int) *IncompleteDownloadError {
+	return &IncompleteDownloadError{Total: total, Missing: missing}
+}
+
+// MergeError reports segment files that do not match the playlist being
+// merged: segments whose file is missing or empty, and files in the cache
+// directory that no segment names.
+type MergeError struct {
+	Missing []string
+	Empty   []string
+	Extra   []string
+}
+
+func (e *MergeError) Error() string {
+	var problems []string
+	for _, p := range []struct {
+		kind  string
+		names []string
+	}{{"missing", e.Missing}, {"empty", e.Empty}, {"extra", e.Extra}} {
+		if len(p.names) == 0 {
+			continue
+		}
+		names := p.names
+		if len(names) > 5 {
+			names = append(names[:5:5], "...")
+		}
+		problems = append(problems, fmt.Sprintf("%d %s (%s)", len(p.names), p.kind, strings.Join(names, ", ")))
+	}
+	return "segment files do not match the playlist: " + strings.Join(problems, ", ")
+}
+
+func (e *MergeError) Unwrap() error {
+	return ErrMergeFailed
+}
@@ -1,36 +1,235 @@
 package m3u8
 
+import "time"
+
+// Encryption methods of #EXT-X-KEY.
+const (
+	MethodNone      = "NONE"
+	MethodAES128    = "AES-128"
+	MethodSampleAES = "SAMPLE-AES"
+)
+
+// Playlist types of #EXT-X-PLAYLIST-TYPE.
+const (
+	PlaylistTypeEvent = "EVENT"
+	PlaylistTypeVOD   = "VOD"
+)
+
+// Rendition types of #EXT-X-MEDIA.
+const (
+	MediaTypeAudio          = "AUDIO"
+	MediaTypeVideo          = "VIDEO"
+	MediaTypeSubtitles      = "SUBTITLES"
+	MediaTypeClosedCaptions = "CLOSED-CAPTIONS"
+)
+
+// Key describes the #EXT-X-KEY in effect for a segment, or an
+// #EXT-X-SESSION-KEY of a master playlist.
+type Key struct {
+	Method            string
+	URI               string
+	IV                []byte
+	KeyFormat         string
+	KeyFormatVersions string
+}
+
+// ByteRange is the sub-range of a resource given by #EXT-X-BYTERANGE or a
+// BYTERANGE attribute. Offset is always resolved, even when the tag left it
+// implicit.
+type ByteRange struct {
+	Length int64
+	Offset int64
+}
+
+// Map is the media initialization section of #EXT-X-MAP. Key is the
+// AES-128 key in effect at the tag when the section itself is encrypted.
+type Map struct {
+	URI       string
+	ByteRange *ByteRange
+	Key       *Key
+}
+
+// TSInfo is one media segment. Key is nil when the segment is not
+// encrypted. Sequence is the segment's media sequence number and Duration
+// its #EXTINF duration in seconds. ProgramDateTime is zero unless the
+// segment has its own #EXT-X-PROGRAM-DATE-TIME; Map is the initialization
+// section in effect, if any.
 type TSInfo struct {
-	Name string
-	Url  string
+	Name            string
+	Url             string
+	Key             *Key
+	Sequence        int64
+	Duration        float64
+	Title           string
+	ByteRange       *ByteRange
+	Discontinuity   bool
+	ProgramDateTime time.Time
+	Map             *Map
+}
+
+// DateRange is an #EXT-X-DATERANGE. Zero EndDate, Duration and
+// PlannedDuration mean the attribute was absent. SCTE35 values are kept as
+// their hexadecimal text; X- client attributes are kept verbatim.
+type DateRange struct {
+	ID               string
+	Class            string
+	StartDate        time.Time
+	EndDate          time.Time
+	Duration         float64
+	PlannedDuration  float64
+	EndOnNext        bool
+	SCTE35Cmd        string
+	SCTE35Out        string
+	SCTE35In         string
+	ClientAttributes map[string]string
+}
+
+// Start is the preferred starting point of #EXT-X-START.
+type Start struct {
+	TimeOffset float64
+	Precise    bool
 }
 
+// Playlist is a parsed media playlist. Key and IV hold the first key in the
+// playlist; segments carry the key actually in effect for them. EndList is
+// false for live playlists that may still grow.
 type Playlist struct {
-	BaseURL     string
-	Key         string
-	IV          []byte
-	Segments    []*TSInfo
-	IsEncrypted bool
+	URL                   string
+	BaseURL               string
+	Key                   string
+	IV                    []byte
+	Version               int
+	PlaylistType          string
+	MediaSequence         int64
+	DiscontinuitySequence int64
+	TargetDuration        int
+	EndList               bool
+	IFramesOnly           bool
+	IndependentSegments   bool
+	Start                 *Start
+	DateRanges            []*DateRange
+	Segments              []*TSInfo
+	IsEncrypted           bool
+}
+
+// Variant is one #EXT-X-STREAM-INF or #EXT-X-I-FRAME-STREAM-INF entry of a
+// master playlist. Audio, Video, Subtitles and ClosedCaptions name the
+// rendition groups the variant uses.
+type Variant struct {
+	URL              string
+	Bandwidth        int
+	AverageBandwidth int
+	Width            int
+	Height           int
+	Codecs           string
+	FrameRate        float64
+	HDCPLevel        string
+	Audio            string
+	Video            string
+	Subtitles        string
+	ClosedCaptions   string
+}
+
+// Rendition is an #EXT-X-MEDIA entry: an alternative audio, video,
+// subtitle or closed-caption stream belonging to GroupID.
+type Rendition struct {
+	Type            string
+	URI             string
+	GroupID         string
+	Language        string
+	AssocLanguage   string
+	Name            string
+	Default         bool
+	AutoSelect      bool
+	Forced          bool
+	InstreamID      string
+	Characteristics string
+	Channels        string
+}
+
+// SessionData is an #EXT-X-SESSION-DATA entry.
+type SessionData struct {
+	DataID   string
+	Value    string
+	URI      string
+	Language string
+}
+
+// MasterPlaylist lists the variant streams a client can choose from.
+type MasterPlaylist struct {
+	BaseURL             string
+	Version             int
+	IndependentSegments bool
+	Start               *Start
+	Variants            []*Variant
+	IFrameVariants      []*Variant
+	Renditions          []*Rendition
+	SessionData         []*SessionData
+	SessionKeys         []*Key
+}
+
+// IsFragmentedMP4 reports whether the playlist's segments are fMP4/CMAF
+// fragments, i.e. have an #EXT-X-MAP initialization section.
+func (p *Playlist) IsFragmentedMP4() bool {
+	for _, seg := range p.Segments {
+		if seg.Map != nil {
+			return true
+		}
+	}
+	return false
 }
 
 type DownloadConfig struct {
 	URL          string
+	Input        string
+	Jobs         int
 	Output       string
+	Format       string
+	Exec         string
 	Workers      int
+	Adaptive     bool
 	Retries      int
+	RetryBudget  int
 	Timeout      int
 	UserAgent    string
 	Verbose      bool
 	ProxyURL     string
+	LimitRate    string
 	Origin       string
 	Referer      string
+	Variant      string
+	AudioLang    string
+	Subtitles    string
+	SubsFormat   string
+	JobName      string
+	Resume       bool
+	RetryPasses  int
+	MaxFailed    int
 	CustomHeader map[string]string
+	Cookie       string
+	CookieFile   string
+	Live         bool
+	LiveDuration time.Duration
+	Listen       string
+	Passthrough  bool
 }
 
 type DownloadStats struct {
-	Total     int
-	Completed int
-	Failed    int
-	StartTime int64
-	EndTime   int64
+	Total          int
+	Completed      int
+	Skipped        int
+	Failed         int
+	FailedSegments []int
+	StartTime      int64
+	EndTime        int64
+}
+
+// Progress is reported while a download runs. Done counts the segments
+// settled so far: downloaded, reused from the cache or failed in the first
+// pass. Bytes is what was downloaded. The Total of a live recording grows
+// as the playlist does.
+type Progress struct {
+	Total int
+	Done  int
+	Bytes int64
 }
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"m3u8-download/pkg/m3u8/client"
+)
+
+// watchRateSignals is a no-op where SIGUSR1 and SIGUSR2 do not exist.
+func watchRateSignals(ctx context.Context, c *client.Client, logger *slog.Logger) {}
@@ -0,0 +1,41 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"m3u8-download/internal/downloader"
+	"m3u8-download/pkg/m3u8/client"
+)
+
+// minRate keeps repeated SIGUSR1 from throttling downloads to nothing.
+const minRate = 1 << 10
+
+// watchRateSignals lets SIGUSR1 halve and SIGUSR2 double the rate limit
+// until ctx is done.
+func watchRateSignals(ctx context.Context, c *client.Client, logger *slog.Logger) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigs:
+				rate := c.RateLimit() * 2
+				if sig == syscall.SIGUSR1 {
+					rate = max(c.RateLimit()/2, minRate)
+				}
+				c.SetRateLimit(rate)
+				logger.Info("Rate limit changed", "rate", downloader.FormatRate(rate))
+			}
+		}
+	}()
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+
+	"m3u8-download/pkg/m3u8"
+	"m3u8-download/pkg/m3u8/client"
+)
+
+// runServe serves cfg.URL on cfg.Listen to local players until it is
+// stopped, which is the normal way to end it and exits 0.
+func runServe(ctx context.Context, c *client.Client, cfg *m3u8.DownloadConfig, logger *slog.Logger) int {
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		logger.Error("Failed to listen", "address", cfg.Listen, "error", err)
+		return 1
+	}
+
+	if err := c.Serve(ctx, ln, cfg.URL); err != nil {
+		return exitCode(ctx)
+	}
+	return 0
+}